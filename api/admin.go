@@ -0,0 +1,62 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// AddrResolver is a server whose advertised address can be resolved again,
+// such as the HTTP tracker.
+type AddrResolver interface {
+	Resolve() (string, error)
+}
+
+// authenticated wraps a ResponseHandler so that it is only run for requests
+// bearing the configured admin token, from clients with a certificate signed
+// by the client CA if one is configured.
+func (s *Server) authenticated(handler ResponseHandler) ResponseHandler {
+	needToken := s.config.APIConfig.AdminToken != ""
+	needCert := s.config.APIConfig.ClientCA != ""
+	token := []byte("Bearer " + s.config.APIConfig.AdminToken)
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
+		if needCert && !verifiedClient(r) {
+			return http.StatusForbidden, nil
+		}
+		auth := []byte(strings.TrimSpace(r.Header.Get("Authorization")))
+		if needToken && subtle.ConstantTimeCompare(auth, token) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="chihaya"`)
+			return http.StatusUnauthorized, nil
+		}
+		return handler(w, r, p)
+	}
+}
+
+func (s *Server) resolve(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
+	addr, err := s.resolver.Resolve()
+	if err != nil {
+		return http.StatusServiceUnavailable, err
+	}
+
+	return writeJSON(w, map[string]string{"addr": addr})
+}
+
+func (s *Server) backup(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
+	resp := make(map[string]interface{})
+	backup, err := s.tracker.Backend.Backup(s.config.APIConfig.BackupDir)
+	if err == nil {
+		resp["path"] = backup.Path
+		resp["rows"] = backup.Rows
+	}
+	return writeResult(w, resp, err)
+}
+
+func (s *Server) getConfig(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
+	return writeJSON(w, s.config.Sanitized())
+}
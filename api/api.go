@@ -7,6 +7,7 @@
 package api
 
 import (
+	"crypto/tls"
 	"net"
 	"net/http"
 	"time"
@@ -14,6 +15,7 @@ import (
 	"github.com/golang/glog"
 	"github.com/julienschmidt/httprouter"
 	"github.com/tylerb/graceful"
+	"golang.org/x/net/netutil"
 
 	"github.com/majestrate/chihaya/config"
 	"github.com/majestrate/chihaya/stats"
@@ -24,6 +26,7 @@ import (
 type Server struct {
 	config   *config.Config
 	tracker  *tracker.Tracker
+	resolver AddrResolver
 	grace    *graceful.Server
 	stopping bool
 }
@@ -33,11 +36,13 @@ func (s *Server) Setup() error {
 }
 
 // NewServer returns a new API server for a given configuration and tracker
-// instance.
-func NewServer(cfg *config.Config, tkr *tracker.Tracker) *Server {
+// instance. The resolver is the server whose address can be resolved again
+// through the API, and may be nil.
+func NewServer(cfg *config.Config, tkr *tracker.Tracker, resolver AddrResolver) *Server {
 	return &Server{
-		config:  cfg,
-		tracker: tkr,
+		config:   cfg,
+		tracker:  tkr,
+		resolver: resolver,
 	}
 }
 
@@ -48,8 +53,9 @@ func (s *Server) Stop() {
 	}
 }
 
-// Serve runs an API server, blocking until the server has shut down.
-func (s *Server) Serve() {
+// Serve runs an API server, blocking until the server has shut down. It
+// returns an error if the server failed rather than being stopped.
+func (s *Server) Serve() error {
 	glog.V(0).Info("Starting API on ", s.config.APIConfig.ListenAddr)
 
 	if s.config.APIConfig.ListenLimit != 0 {
@@ -57,9 +63,8 @@ func (s *Server) Serve() {
 	}
 
 	grace := &graceful.Server{
-		Timeout:     s.config.APIConfig.RequestTimeout.Duration,
-		ConnState:   s.connState,
-		ListenLimit: s.config.APIConfig.ListenLimit,
+		Timeout:   s.config.APIConfig.RequestTimeout.Duration,
+		ConnState: s.connState,
 
 		NoSignalHandling: true,
 		Server: &http.Server{
@@ -74,14 +79,53 @@ func (s *Server) Serve() {
 	grace.SetKeepAlivesEnabled(false)
 	grace.ShutdownInitiated = func() { s.stopping = true }
 
-	if err := grace.ListenAndServe(); err != nil {
+	l, err := s.listen()
+	if err != nil {
+		glog.Errorf("Failed to listen for the API server: %s", err)
+		return err
+	}
+
+	if err = grace.Serve(l); err != nil {
 		if opErr, ok := err.(*net.OpError); !ok || (ok && opErr.Op != "accept") {
 			glog.Errorf("Failed to gracefully run API server: %s", err.Error())
-			return
+			return err
 		}
 	}
 
 	glog.Info("API server shut down cleanly")
+	return nil
+}
+
+// listen opens the API server's listener, accepting at most ListenLimit
+// connections at once, and serving TLS if a certificate is configured.
+func (s *Server) listen() (net.Listener, error) {
+	var tlsConfig *tls.Config
+	if cert, key := s.config.APIConfig.TLSCert, s.config.APIConfig.TLSKey; cert != "" {
+		var err error
+		if tlsConfig, err = s.tlsConfig(); err != nil {
+			return nil, err
+		}
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+		tlsConfig.NextProtos = []string{"http/1.1"}
+	}
+
+	l, err := net.Listen("tcp", s.config.APIConfig.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	// Limit the TCP connections, so that TLS handshakes count against the
+	// limit too.
+	if limit := s.config.APIConfig.ListenLimit; limit > 0 {
+		l = netutil.LimitListener(l, limit)
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	return l, nil
 }
 
 // newRouter returns a router with all the routes.
@@ -93,10 +137,13 @@ func newRouter(s *Server) *httprouter.Router {
 		r.PUT("/users/:passkey", makeHandler(s.putUser))
 		// remove a user with a passkey from the database
 		r.DELETE("/users/:passkey", makeHandler(s.delUser))
+		// enable or disable a user with a passkey
+		r.POST("/users/:passkey/enabled", makeHandler(s.setUserEnabled))
+
+		// get category list
+		r.GET("/list/cats", makeHandler(s.listCategories))
 
 		/*
-		   // get category list
-		   r.GET("/list/cats", makeHandler(s.listCategories))
 		   // get page for category
 		   r.GET("/list/cat/:id", makeHandler(s.listCategory))
 		   // get search results for tag
@@ -110,6 +157,11 @@ func newRouter(s *Server) *httprouter.Router {
 		r.DELETE("/clients/:clientID", makeHandler(s.delClient))
 	}
 
+	// refuse to serve a torrent, evicting its peers
+	r.PUT("/blocklist/:infohash", makeHandler(s.blockInfohash))
+	// serve a blocked torrent again
+	r.DELETE("/blocklist/:infohash", makeHandler(s.unblockInfohash))
+
 	// get top torrent swarms
 	r.GET("/top/:num", makeHandler(s.getTopSwarms))
 	// get torrent info
@@ -118,12 +170,47 @@ func newRouter(s *Server) *httprouter.Router {
 	r.PUT("/torrents/:infohash", makeHandler(s.putTorrent))
 	// delete torrent from backend
 	r.DELETE("/torrents/:infohash", makeHandler(s.delTorrent))
+	// change a torrent's category, description, tags or freeleech flag
+	r.PATCH("/torrents/:infohash", makeHandler(s.patchTorrent))
+	// add torrent to backend from an uploaded .torrent file
+	r.POST("/torrents/:infohash", makeHandler(s.postTorrent))
+	// set a torrent's moderation flags
+	r.POST("/torrents/:infohash/status", makeHandler(s.setTorrentStatus))
+	// evict a peer from a torrent's swarm, or delete a torrent by its id
+	r.DELETE("/torrents/:infohash/*path", makeHandler(s.delTorrentPath))
 	// check if backend is alive
 	r.GET("/check", makeHandler(s.check))
 	// get stats
-	r.GET("/stats", makeHandler(s.stats))
+	r.GET("/stats", makeHandler(s.statsCORS(s.stats)))
 	// dump all info
 	r.GET("/dump", makeHandler(s.dumpAll))
+
+	adminAuth := s.config.APIConfig.AdminToken != "" || s.config.APIConfig.ClientCA != ""
+
+	if s.config.APIConfig.Expvar && !adminAuth {
+		glog.Warning("Not serving /debug/vars, as apiExpvar needs apiAdminToken or apiClientCA to be set")
+	}
+
+	if adminAuth {
+		// get the effective configuration, with secrets redacted
+		r.GET("/config", makeHandler(s.authenticated(s.getConfig)))
+
+		if s.config.APIConfig.Expvar {
+			// get the runtime's, the stats' and the configuration's expvars
+			publishExpvars(s.config)
+			r.GET("/debug/vars", makeHandler(s.authenticated(s.expvars)))
+		}
+
+		if s.resolver != nil {
+			// re-resolve and advertise the tracker's public address
+			r.POST("/admin/resolve", makeHandler(s.authenticated(s.resolve)))
+		}
+
+		if s.config.APIConfig.BackupDir != "" {
+			// snapshot the backend's database to a file
+			r.POST("/admin/backup", makeHandler(s.authenticated(s.backup)))
+		}
+	}
 	return r
 }
 
@@ -148,6 +235,23 @@ func (s *Server) connState(conn net.Conn, state http.ConnState) {
 	}
 }
 
+// responseWriter is an http.ResponseWriter that knows whether a response was
+// started.
+type responseWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	w.written = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	w.written = true
+	return w.ResponseWriter.Write(b)
+}
+
 // ResponseHandler is an HTTP handler that returns a status code.
 type ResponseHandler func(http.ResponseWriter, *http.Request, httprouter.Params) (int, error)
 
@@ -156,7 +260,8 @@ type ResponseHandler func(http.ResponseWriter, *http.Request, httprouter.Params)
 func makeHandler(handler ResponseHandler) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		start := time.Now()
-		httpCode, err := handler(w, r, p)
+		rw := &responseWriter{ResponseWriter: w}
+		httpCode, err := handler(rw, r, p)
 		duration := time.Since(start)
 
 		var msg string
@@ -167,7 +272,10 @@ func makeHandler(handler ResponseHandler) httprouter.Handle {
 		}
 
 		if len(msg) > 0 {
-			http.Error(w, msg, httpCode)
+			// handlers may have responded with the error themselves
+			if !rw.written {
+				http.Error(w, msg, httpCode)
+			}
 			stats.RecordEvent(stats.ErroredRequest)
 		}
 
@@ -0,0 +1,75 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/majestrate/chihaya/stats"
+	"github.com/majestrate/chihaya/tracker/models"
+)
+
+// The codes of the errors in JSON responses, which clients can rely on
+// unlike the messages.
+const (
+	codeBadRequest = "bad_request"
+	codeNotFound   = "not_found"
+	codeConflict   = "conflict"
+	codeInternal   = "internal"
+)
+
+// apiError is an error as it appears in JSON responses.
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// newAPIError classifies an error, returning it in the form of a JSON
+// response along with the HTTP status to respond with.
+func newAPIError(err error) (*apiError, int) {
+	code, status := codeInternal, http.StatusInternalServerError
+	switch err.(type) {
+	case models.NotFoundError:
+		code, status = codeNotFound, http.StatusNotFound
+	case models.ClientError:
+		code, status = codeBadRequest, http.StatusBadRequest
+		if err == models.ErrUserExists || err == models.ErrTorrentExists {
+			code, status = codeConflict, http.StatusConflict
+		}
+	}
+	if status != http.StatusInternalServerError {
+		stats.RecordEvent(stats.ClientError)
+	}
+	return &apiError{Code: code, Message: err.Error()}, status
+}
+
+// writeResult responds with resp as JSON, with the outcome of the request as
+// its "error" field, which is null on success. The status of the response
+// follows the error.
+func writeResult(w http.ResponseWriter, resp map[string]interface{}, err error) (int, error) {
+	status := http.StatusOK
+	resp["error"] = nil
+	if err != nil {
+		resp["error"], status = newAPIError(err)
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(status)
+	if encodeErr := json.NewEncoder(w).Encode(resp); encodeErr != nil && err == nil {
+		err = encodeErr
+	}
+	return status, err
+}
+
+// writeJSON responds with v as JSON, for the routes answering with a resource
+// rather than the outcome of a change.
+func writeJSON(w http.ResponseWriter, v interface{}) (int, error) {
+	w.Header().Set("Content-Type", jsonContentType)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
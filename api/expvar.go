@@ -0,0 +1,44 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package api
+
+import (
+	"expvar"
+	"net/http"
+	"runtime"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/majestrate/chihaya/config"
+	"github.com/majestrate/chihaya/stats"
+)
+
+var publishOnce sync.Once
+
+// publishExpvars publishes the stats and the sanitized configuration as
+// expvar variables. Variables are global and can only be published once, so
+// the configuration of the first API server is the one published.
+func publishExpvars(cfg *config.Config) {
+	publishOnce.Do(func() {
+		expvar.Publish("stats", expvar.Func(func() interface{} {
+			if stats.DefaultStats == nil {
+				return nil
+			}
+			stats.DefaultStats.GoRoutines = runtime.NumGoroutine()
+			return stats.DefaultStats
+		}))
+		expvar.Publish("config", expvar.Func(func() interface{} {
+			return cfg.Sanitized()
+		}))
+	})
+}
+
+// expvars serves the expvar variables, which hold the configuration, so it
+// is wrapped with authenticated when admin authentication is configured.
+func (s *Server) expvars(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
+	expvar.Handler().ServeHTTP(w, r)
+	return http.StatusOK, nil
+}
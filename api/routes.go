@@ -10,51 +10,58 @@ import (
 	"net/url"
 	"runtime"
 	"strconv"
+	"strings"
 
 	"github.com/julienschmidt/httprouter"
 
 	"github.com/majestrate/chihaya/stats"
+	"github.com/majestrate/chihaya/tracker"
 	"github.com/majestrate/chihaya/tracker/models"
 )
 
 const jsonContentType = "application/json; charset=UTF-8"
 
-func handleError(err error) (int, error) {
-	if err == nil {
-		return http.StatusOK, nil
-	} else if _, ok := err.(models.NotFoundError); ok {
-		stats.RecordEvent(stats.ClientError)
-		return http.StatusNotFound, nil
-	} else if _, ok := err.(models.ClientError); ok {
-		stats.RecordEvent(stats.ClientError)
-		return http.StatusBadRequest, nil
-	}
-	return http.StatusInternalServerError, err
-}
-
 func (s *Server) getTopSwarms(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
 	var err error
 	var num int
 	num, err = strconv.Atoi(p.ByName("num"))
-	if err == nil {
-		torrents := s.tracker.Cache.TopTorrents(num)
-		w.Header().Set("Content-Type", jsonContentType)
-		e := json.NewEncoder(w)
-		return handleError(e.Encode(torrents))
+	if err != nil {
+		return http.StatusInternalServerError, err
 	}
-	return handleError(err)
+	return writeJSON(w, s.tracker.Cache.TopTorrents(num))
 }
 
 func (s *Server) check(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
 	// Attempt to ping the backend if private tracker is enabled.
 	if s.config.PrivateEnabled {
 		if err := s.tracker.Backend.Ping(); err != nil {
-			return handleError(err)
+			return http.StatusInternalServerError, err
 		}
 	}
 
-	_, err := w.Write([]byte("STILL-ALIVE"))
-	return handleError(err)
+	if _, err := w.Write([]byte("STILL-ALIVE")); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// statsCORS wraps the stats handler so that browsers on the configured
+// origins may fetch it, for stats widgets embedded in other sites. No other
+// route is shared cross-origin.
+func (s *Server) statsCORS(handler ResponseHandler) ResponseHandler {
+	origins := make(map[string]bool, len(s.config.APIConfig.StatsOrigins))
+	for _, origin := range s.config.APIConfig.StatsOrigins {
+		origins[strings.TrimRight(origin, "/")] = true
+	}
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
+		if len(origins) > 0 {
+			w.Header().Add("Vary", "Origin")
+			if origin := r.Header.Get("Origin"); origin != "" && (origins[origin] || origins["*"]) {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+		}
+		return handler(w, r, p)
+	}
 }
 
 func (s *Server) stats(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
@@ -83,7 +90,10 @@ func (s *Server) stats(w http.ResponseWriter, r *http.Request, p httprouter.Para
 		err = json.NewEncoder(w).Encode(val)
 	}
 
-	return handleError(err)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
 }
 
 func (s *Server) getTorrent(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
@@ -94,12 +104,9 @@ func (s *Server) getTorrent(w http.ResponseWriter, r *http.Request, p httprouter
 
 	torrent, err := s.tracker.FindTorrent(infohash)
 	if err != nil {
-		return handleError(err)
+		return writeResult(w, make(map[string]interface{}), err)
 	}
-
-	w.Header().Set("Content-Type", jsonContentType)
-	e := json.NewEncoder(w)
-	return handleError(e.Encode(torrent))
+	return writeJSON(w, torrent)
 }
 
 func (s *Server) putTorrent(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
@@ -109,18 +116,44 @@ func (s *Server) putTorrent(w http.ResponseWriter, r *http.Request, p httprouter
 		return http.StatusBadRequest, err
 	}
 
-	resp := make(map[string]interface{})
-	err = s.tracker.PutTorrent(&torrent)
-	resp["error"] = err
+	return writeResult(w, make(map[string]interface{}), s.tracker.PutTorrent(&torrent))
+}
 
-	if err == nil {
-		// everything is gud
-		// TODO: put more info into response?
+func (s *Server) setTorrentStatus(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
+	infohash, err := url.QueryUnescape(p.ByName("infohash"))
+	if err != nil {
+		return http.StatusNotFound, err
 	}
 
-	w.Header().Set("Content-Type", jsonContentType)
-	e := json.NewEncoder(w)
-	return handleError(e.Encode(resp))
+	var status models.TorrentStatus
+	if err = json.NewDecoder(r.Body).Decode(&status); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	if err = s.tracker.SetTorrentStatus(infohash, status); err != nil {
+		return writeResult(w, make(map[string]interface{}), err)
+	}
+	return writeJSON(w, status)
+}
+
+// patchTorrent changes the metadata of a torrent in place, keeping its swarm
+// and snatches.
+func (s *Server) patchTorrent(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
+	infohash, err := url.QueryUnescape(p.ByName("infohash"))
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+
+	var update models.TorrentUpdate
+	if err = json.NewDecoder(r.Body).Decode(&update); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	torrent, err := s.tracker.UpdateTorrent(infohash, &update)
+	if err != nil {
+		return writeResult(w, make(map[string]interface{}), err)
+	}
+	return writeJSON(w, torrent)
 }
 
 func (s *Server) delTorrent(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
@@ -129,18 +162,49 @@ func (s *Server) delTorrent(w http.ResponseWriter, r *http.Request, p httprouter
 		return http.StatusNotFound, err
 	}
 
-	resp := make(map[string]interface{})
-	err = s.tracker.DeleteTorrent(infohash)
-	resp["error"] = err
+	return writeResult(w, make(map[string]interface{}), s.tracker.DeleteTorrent(infohash))
+}
 
-	if err == nil {
-		// everything is gud
-		// TODO: put more info into response?
+// delTorrentPath serves DELETE /torrents/:infohash/peers/*peerkey and
+// DELETE /torrents/id/:id. The router can't have the static "id" segment next
+// to the :infohash wildcard, so both are matched by a catch-all and told
+// apart here.
+func (s *Server) delTorrentPath(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
+	path := p.ByName("path")
+
+	if p.ByName("infohash") == "id" {
+		return s.delTorrentByID(w, strings.TrimPrefix(path, "/"))
 	}
 
-	w.Header().Set("Content-Type", jsonContentType)
-	e := json.NewEncoder(w)
-	return handleError(e.Encode(resp))
+	// Peer keys contain slashes, so they are matched by the catch-all too.
+	if peerkey := strings.TrimPrefix(path, "/peers/"); peerkey != path {
+		return s.delPeer(w, p.ByName("infohash"), peerkey)
+	}
+
+	return http.StatusNotFound, nil
+}
+
+func (s *Server) delTorrentByID(w http.ResponseWriter, idStr string) (int, error) {
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+
+	return writeResult(w, make(map[string]interface{}), s.tracker.DeleteTorrentByID(id))
+}
+
+func (s *Server) delPeer(w http.ResponseWriter, infohash, peerkey string) (int, error) {
+	infohash, err := url.QueryUnescape(infohash)
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+
+	peerkey, err = url.PathUnescape(peerkey)
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+
+	return writeResult(w, make(map[string]interface{}), s.tracker.EvictPeer(infohash, models.PeerKey(peerkey)))
 }
 
 func (s *Server) getUser(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
@@ -150,10 +214,7 @@ func (s *Server) getUser(w http.ResponseWriter, r *http.Request, p httprouter.Pa
 	} else if err != nil {
 		return http.StatusInternalServerError, err
 	}
-
-	w.Header().Set("Content-Type", jsonContentType)
-	e := json.NewEncoder(w)
-	return handleError(e.Encode(user))
+	return writeJSON(w, user)
 }
 
 func (s *Server) putUser(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
@@ -163,34 +224,33 @@ func (s *Server) putUser(w http.ResponseWriter, r *http.Request, p httprouter.Pa
 		return http.StatusBadRequest, err
 	}
 
-	var madeUser *models.User
 	resp := make(map[string]interface{})
-	madeUser, err = s.tracker.RegisterUser(&user)
-	resp["error"] = err
-
+	madeUser, err := s.tracker.RegisterUser(&user)
 	if err == nil {
-		// everything is gud
 		resp["user"] = *madeUser
 	}
-
-	w.Header().Set("Content-Type", jsonContentType)
-	e := json.NewEncoder(w)
-	return handleError(e.Encode(resp))
+	return writeResult(w, resp, err)
 }
 
 func (s *Server) delUser(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
-	resp := make(map[string]interface{})
-	err := s.tracker.DeleteUser(p.ByName("passkey"))
-	resp["error"] = err
+	return writeResult(w, make(map[string]interface{}), s.tracker.DeleteUser(p.ByName("passkey")))
+}
 
-	if err == nil {
-		// everything is gud
-		// TODO: put more info into response?
+func (s *Server) setUserEnabled(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
+	var body struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return http.StatusBadRequest, err
+	}
+	if body.Enabled == nil {
+		return http.StatusBadRequest, nil
 	}
 
-	w.Header().Set("Content-Type", jsonContentType)
-	e := json.NewEncoder(w)
-	return handleError(e.Encode(resp))
+	if err := s.tracker.SetUserEnabled(p.ByName("passkey"), *body.Enabled); err != nil {
+		return writeResult(w, make(map[string]interface{}), err)
+	}
+	return writeJSON(w, body)
 }
 
 func (s *Server) getClient(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
@@ -201,23 +261,67 @@ func (s *Server) getClient(w http.ResponseWriter, r *http.Request, p httprouter.
 }
 
 func (s *Server) putClient(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
-	s.tracker.Cache.PutClient(p.ByName("clientID"))
-	return http.StatusOK, nil
+	return writeResult(w, make(map[string]interface{}), s.tracker.PutClient(p.ByName("clientID")))
 }
 
 func (s *Server) delClient(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
-	s.tracker.Cache.DeleteClient(p.ByName("clientID"))
+	return writeResult(w, make(map[string]interface{}), s.tracker.DeleteClient(p.ByName("clientID")))
+}
+
+// blockedInfohash reads the infohash of a blocklist route, which is either hex
+// encoded, as in blocklist files, or url-escaped like in the torrent routes.
+func blockedInfohash(p httprouter.Params) (string, error) {
+	param := p.ByName("infohash")
+	if infohash, err := tracker.ParseHexInfohash(param); err == nil {
+		return infohash, nil
+	}
+	return url.QueryUnescape(param)
+}
+
+func (s *Server) blockInfohash(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
+	infohash, err := blockedInfohash(p)
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+	s.tracker.BlockInfohash(infohash)
+	return http.StatusOK, nil
+}
+
+func (s *Server) unblockInfohash(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
+	infohash, err := blockedInfohash(p)
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+	s.tracker.UnblockInfohash(infohash)
 	return http.StatusOK, nil
 }
 
 // list categories in json
+// torrents are only counted when the counts parameter is set
 func (s *Server) listCategories(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
-	return http.StatusOK, nil
+	var cats interface{}
+	if _, counts := r.URL.Query()["counts"]; counts {
+		counted, err := s.tracker.Backend.GetCategoryCounts()
+		if err != nil {
+			return writeResult(w, make(map[string]interface{}), err)
+		}
+		if counted == nil {
+			counted = []*models.CategoryCount{}
+		}
+		cats = counted
+	} else {
+		listed, err := s.tracker.Backend.GetCategories()
+		if err != nil {
+			return writeResult(w, make(map[string]interface{}), err)
+		}
+		if listed == nil {
+			listed = []*models.TorrentCategory{}
+		}
+		cats = listed
+	}
+	return writeJSON(w, cats)
 }
 
 func (s *Server) dumpAll(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
-	t := s.tracker.Cache.DumpTorrents()
-	w.Header().Set("Content-Type", jsonContentType)
-	e := json.NewEncoder(w)
-	return handleError(e.Encode(t))
+	return writeJSON(w, s.tracker.Cache.DumpTorrents())
 }
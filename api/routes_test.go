@@ -0,0 +1,520 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zeebo/bencode"
+
+	"github.com/majestrate/chihaya/backend/noop"
+	"github.com/majestrate/chihaya/config"
+	"github.com/majestrate/chihaya/stats"
+	"github.com/majestrate/chihaya/tracker"
+	"github.com/majestrate/chihaya/tracker/models"
+)
+
+// categoryBackend is a backend with a single category holding two torrents.
+type categoryBackend struct {
+	noop.NoOp
+}
+
+var testCategory = models.TorrentCategory{ID: 1, Name: "linux", Description: "distros"}
+
+func (*categoryBackend) GetCategories() ([]*models.TorrentCategory, error) {
+	return []*models.TorrentCategory{&testCategory}, nil
+}
+
+func (*categoryBackend) GetCategoryCounts() ([]*models.CategoryCount, error) {
+	return []*models.CategoryCount{{TorrentCategory: testCategory, Torrents: 2}}, nil
+}
+
+func TestListCategories(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.PrivateEnabled = true
+	tkr, err := tracker.New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tkr.Backend = &categoryBackend{}
+	router := newRouter(NewServer(&cfg, tkr, nil))
+
+	var tests = []struct {
+		path, expected string
+	}{
+		{"/list/cats", `[{"id":1,"name":"linux","desc":"distros"}]`},
+		{"/list/cats?counts", `[{"id":1,"name":"linux","desc":"distros","torrents":2}]`},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+		if body := strings.TrimSpace(rec.Body.String()); rec.Code != http.StatusOK || body != tt.expected {
+			t.Errorf("%s: expected %s, got %d %s", tt.path, tt.expected, rec.Code, body)
+		}
+	}
+}
+
+func TestStatsCORS(t *testing.T) {
+	stats.DefaultStats = stats.New(config.StatsConfig{})
+	defer func() { stats.DefaultStats = nil }()
+
+	cfg := config.DefaultConfig
+	cfg.APIConfig.StatsOrigins = []string{"https://widget.example"}
+	tkr, err := tracker.New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := newRouter(NewServer(&cfg, tkr, nil))
+
+	var tests = []struct {
+		path, origin, expected string
+	}{
+		{"/stats", "https://widget.example", "https://widget.example"},
+		{"/stats", "https://other.example", ""},
+		{"/check", "https://widget.example", ""},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.Header.Set("Origin", tt.origin)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); rec.Code != http.StatusOK || got != tt.expected {
+			t.Errorf("%s from %s: expected allowed origin %q, got %d %q", tt.path, tt.origin, tt.expected, rec.Code, got)
+		}
+	}
+}
+
+func TestGetConfig(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.APIConfig.AdminToken = "hunter2"
+	cfg.PeerKeySecret = "hunter3"
+	cfg.DriverConfig.Params = map[string]string{"url": "postgres://user:hunter4@db/chihaya"}
+	tkr, err := tracker.New(&config.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := newRouter(NewServer(&cfg, tkr, nil))
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/config", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected the config to require the admin token, got %d", rec.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/config", nil)
+	req.Header.Set("Authorization", "Bearer hunter2")
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK || !strings.Contains(body, `"apiListenAddr":"localhost:6880"`) {
+		t.Fatalf("expected the config, got %d %s", rec.Code, body)
+	}
+	if strings.Contains(body, "hunter") {
+		t.Errorf("expected secrets to be redacted, got %s", body)
+	}
+}
+
+func TestExpvarAuthenticated(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.APIConfig.Expvar = true
+	cfg.APIConfig.AdminToken = "hunter2"
+	tkr, err := tracker.New(&config.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := newRouter(NewServer(&cfg, tkr, nil))
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/vars", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected expvars to require the admin token, got %d", rec.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/debug/vars", nil)
+	req.Header.Set("Authorization", "Bearer hunter2")
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"memstats"`) {
+		t.Errorf("expected the expvars, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	cfg.APIConfig.AdminToken = ""
+	router = newRouter(NewServer(&cfg, tkr, nil))
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/vars", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected expvars not to be served without admin authentication, got %d", rec.Code)
+	}
+}
+
+func TestImportTorrentFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chihaya-torrents")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := config.DefaultConfig
+	cfg.APIConfig.TorrentFileDir = dir
+	tkr, err := tracker.New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := newRouter(NewServer(&cfg, tkr, nil))
+
+	info, _ := bencode.EncodeBytes(map[string]interface{}{
+		"name":         "distro",
+		"piece length": 16384,
+		"pieces":       strings.Repeat("x", 20),
+		"private":      1,
+		"files": []map[string]interface{}{
+			{"length": 10, "path": []string{"disc1", "image.iso"}},
+			{"length": 20, "path": []string{"README"}},
+		},
+	})
+	raw, _ := bencode.EncodeBytes(map[string]interface{}{
+		"announce": "http://tracker.example/announce",
+		"info":     bencode.RawMessage(info),
+		"url-list": "http://mirror.example/distro",
+	})
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("tags", "linux,iso")
+	part, _ := form.CreateFormFile("torrent", "distro.torrent")
+	part.Write(raw)
+	form.Close()
+
+	req := httptest.NewRequest("POST", "/torrents/file", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the torrent to be imported, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	hash := sha1.Sum(info)
+	torrent, err := tkr.FindTorrent(string(hash[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := torrent.Info
+	if got.TorrentName != "distro" || !got.Private || strings.Join(got.Files, ",") != "distro/disc1/image.iso,distro/README" ||
+		strings.Join(got.Tags, ",") != "linux,iso" || len(got.WebSeeds) != 1 {
+		t.Errorf("unexpected torrent info %+v", got)
+	}
+	if saved, err := ioutil.ReadFile(filepath.Join(dir, got.FilePath)); err != nil || !bytes.Equal(saved, raw) {
+		t.Errorf("expected the torrent file to be saved as %q, got %v", got.FilePath, err)
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("POST", "/torrents/file", strings.NewReader("not a torrent")))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected a malformed torrent file to be refused, got %d", rec.Code)
+	}
+}
+
+func TestPatchTorrent(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.MaxTorrentTags = 1
+	tkr, err := tracker.New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := newRouter(NewServer(&cfg, tkr, nil))
+
+	const infohash = "01234567890123456789"
+	err = tkr.PutTorrent(&models.Torrent{
+		Infohash: infohash,
+		Seeders:  models.NewPeerMap(true, &cfg),
+		Leechers: models.NewPeerMap(false, &cfg),
+		Info:     &models.TorrentInfo{TorrentName: "distro", Category: "misc", Description: "old"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"category": "linux", "tags": ["iso"], "freeleech": true}`
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("PATCH", "/torrents/"+infohash, strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the torrent to be updated, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	var torrent models.Torrent
+	if err = json.NewDecoder(rec.Body).Decode(&torrent); err != nil {
+		t.Fatal(err)
+	}
+	if torrent.Info.Category != "linux" || torrent.Info.Description != "old" || len(torrent.Info.Tags) != 1 || !torrent.Freeleech {
+		t.Errorf("expected the updated torrent to be returned, got %+v", torrent.Info)
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("PATCH", "/torrents/"+infohash, strings.NewReader("{")))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected a malformed update to be refused, got %d", rec.Code)
+	}
+
+	var tests = []struct {
+		infohash, body string
+		status         int
+		err            apiError
+	}{
+		{infohash, `{"tags": ["iso", "arm"]}`, http.StatusBadRequest, apiError{codeBadRequest, "torrent has 2 tags, at most 1 are allowed"}},
+		{"unknown-infohash-000", `{"tags": ["iso"]}`, http.StatusNotFound, apiError{codeNotFound, "torrent does not exist"}},
+	}
+
+	for _, tt := range tests {
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("PATCH", "/torrents/"+tt.infohash, strings.NewReader(tt.body)))
+
+		var resp struct {
+			Error *apiError `json:"error"`
+		}
+		if err = json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Errorf("%s: expected a JSON response, got %s", tt.body, err)
+		} else if rec.Code != tt.status || resp.Error == nil || *resp.Error != tt.err {
+			t.Errorf("%s: expected %d with %+v, got %d with %+v", tt.body, tt.status, tt.err, rec.Code, resp.Error)
+		}
+	}
+}
+
+// registrationBackend is a backend that records how users are added. Users
+// added by external id get the passkey of an existing user, as if the id had
+// been registered before.
+type registrationBackend struct {
+	noop.NoOp
+	calls []string
+}
+
+func (b *registrationBackend) AddUser(u *models.User) error {
+	b.calls = append(b.calls, "AddUser "+u.Username)
+	u.ID, u.Passkey = 2, "newpasskey"
+	return nil
+}
+
+func (b *registrationBackend) AddOrGetUser(u *models.User) error {
+	b.calls = append(b.calls, "AddOrGetUser "+u.ExternalID)
+	u.ID, u.Passkey = 1, "oldpasskey"
+	return nil
+}
+
+func (b *registrationBackend) LoadUsers(ids []uint64) ([]*models.User, error) {
+	passkey := "newpasskey"
+	if ids[0] == 1 {
+		passkey = "oldpasskey"
+	}
+	return []*models.User{{ID: ids[0], Passkey: passkey}}, nil
+}
+
+func TestPutUserExternalID(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.PrivateEnabled = true
+	tkr, err := tracker.New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc := &registrationBackend{}
+	tkr.Backend = bc
+	router := newRouter(NewServer(&cfg, tkr, nil))
+
+	var tests = []struct {
+		body, call, passkey string
+	}{
+		{`{"username": "alice", "externalId": "forum:1"}`, "AddOrGetUser forum:1", "oldpasskey"},
+		{`{"username": "bob"}`, "AddUser bob", "newpasskey"},
+	}
+
+	for _, tt := range tests {
+		bc.calls = nil
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("PUT", "/users/new", strings.NewReader(tt.body)))
+		var resp struct {
+			User models.User `json:"user"`
+		}
+		json.NewDecoder(rec.Body).Decode(&resp)
+		if rec.Code != http.StatusOK || len(bc.calls) != 1 || bc.calls[0] != tt.call {
+			t.Errorf("%s: expected %q, got %d and calls %v", tt.body, tt.call, rec.Code, bc.calls)
+		}
+		if resp.User.Passkey != tt.passkey {
+			t.Errorf("%s: expected passkey %q, got %q", tt.body, tt.passkey, resp.User.Passkey)
+		}
+	}
+}
+
+// errorBackend is a backend without users that refuses new ones and can't
+// delete torrents.
+type errorBackend struct {
+	noop.NoOp
+}
+
+func (*errorBackend) GetUserByPassKey(passkey string) (*models.User, error) {
+	return nil, models.ErrUserDNE
+}
+
+func (*errorBackend) AddUser(u *models.User) error {
+	return models.ErrUserExists
+}
+
+func (*errorBackend) DeleteTorrent(t *models.Torrent) error {
+	return errors.New("connection refused")
+}
+
+func TestErrorCodes(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.PrivateEnabled = true
+	cfg.MaxTorrentTags = 1
+	tkr, err := tracker.New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tkr.Backend = &errorBackend{}
+	router := newRouter(NewServer(&cfg, tkr, nil))
+
+	const infohash = "01234567890123456789"
+	tkr.Cache.PutTorrent(&models.Torrent{Infohash: infohash})
+
+	var tests = []struct {
+		method, path, body string
+		status             int
+		code               string
+	}{
+		{"PUT", "/torrents/" + infohash, `{"infohash": "` + infohash + `"}`, http.StatusOK, ""},
+		{"PUT", "/torrents/" + infohash, `{"infohash": "` + infohash + `", "info": {"tags": ["a", "b"]}}`, http.StatusBadRequest, codeBadRequest},
+		{"DELETE", "/torrents/" + infohash, "", http.StatusInternalServerError, codeInternal},
+		{"PUT", "/users/hunter2", `{"passkey": "hunter2"}`, http.StatusConflict, codeConflict},
+		{"DELETE", "/users/hunter2", "", http.StatusNotFound, codeNotFound},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+
+		var resp struct {
+			Error *apiError `json:"error"`
+		}
+		if err = json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Errorf("%s %s: expected a JSON response, got %s", tt.method, tt.path, err)
+			continue
+		}
+		code := ""
+		if resp.Error != nil {
+			code = resp.Error.Code
+		}
+		if rec.Code != tt.status || code != tt.code {
+			t.Errorf("%s %s: expected %d with code %q, got %d with %+v", tt.method, tt.path, tt.status, tt.code, rec.Code, resp.Error)
+		}
+	}
+}
+
+func TestErrorMessages(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.PrivateEnabled = true
+	tkr, err := tracker.New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tkr.Backend = &errorBackend{}
+	router := newRouter(NewServer(&cfg, tkr, nil))
+
+	const infohash = "01234567890123456789"
+	tkr.Cache.PutTorrent(&models.Torrent{Infohash: infohash})
+
+	var tests = []struct {
+		method, path string
+		message      string
+	}{
+		{"DELETE", "/users/hunter2", "user does not exist"},
+		{"DELETE", "/torrents/" + infohash, "connection refused"},
+		{"DELETE", "/torrents/id/7", "torrent does not exist"},
+		{"PUT", "/torrents/" + infohash, ""},
+	}
+
+	for _, tt := range tests {
+		body := `{"infohash": "` + infohash + `"}`
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, strings.NewReader(body)))
+
+		var resp map[string]json.RawMessage
+		if err = json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Errorf("%s %s: expected a JSON response, got %s", tt.method, tt.path, err)
+			continue
+		}
+		raw, present := resp["error"]
+		if !present {
+			t.Errorf("%s %s: expected an error field, got %v", tt.method, tt.path, resp)
+			continue
+		}
+
+		var e *apiError
+		if err = json.Unmarshal(raw, &e); err != nil {
+			t.Errorf("%s %s: expected a structured error, got %s", tt.method, tt.path, raw)
+		} else if tt.message == "" && e != nil {
+			t.Errorf("%s %s: expected a null error, got %s", tt.method, tt.path, raw)
+		} else if tt.message != "" && (e == nil || e.Message != tt.message) {
+			t.Errorf("%s %s: expected the error %q, got %s", tt.method, tt.path, tt.message, raw)
+		}
+	}
+}
+
+// backupBackend is a backend that pretends to write backups.
+type backupBackend struct {
+	noop.NoOp
+}
+
+func (*backupBackend) Backup(dir string) (*models.Backup, error) {
+	return &models.Backup{Path: dir + "/backup.json.gz", Rows: map[string]int64{"torrents": 2}}, nil
+}
+
+func TestBackup(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.APIConfig.AdminToken = "hunter2"
+	cfg.APIConfig.BackupDir = "/var/backups/chihaya"
+	tkr, err := tracker.New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := newRouter(NewServer(&cfg, tkr, nil))
+
+	backup := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/admin/backup", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := backup(""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected backups to require the admin token, got %d", rec.Code)
+	}
+
+	// the noop backend has nothing to back up
+	rec := backup("hunter2")
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), models.ErrBackupUnsupported.Error()) {
+		t.Errorf("expected the backup to be refused, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	tkr.Backend = &backupBackend{}
+	rec = backup("hunter2")
+	expected := `{"error":null,"path":"/var/backups/chihaya/backup.json.gz","rows":{"torrents":2}}`
+	if body := strings.TrimSpace(rec.Body.String()); rec.Code != http.StatusOK || body != expected {
+		t.Errorf("expected %s, got %d %s", expected, rec.Code, body)
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/majestrate/chihaya/config"
+	"github.com/majestrate/chihaya/tracker"
+)
+
+// testCert is a certificate along with its key, signed by parent or by itself
+// if parent is nil.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	tls  tls.Certificate
+}
+
+func newTestCert(t *testing.T, name string, ca bool, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  ca,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, tls: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}}
+}
+
+func TestClientCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chihaya-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "clients", true, nil)
+	caFile := filepath.Join(dir, "clients.crt")
+	if err = ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	serverCert := newTestCert(t, "api", false, nil)
+	valid := newTestCert(t, "admin", false, ca)
+	invalid := newTestCert(t, "intruder", false, nil)
+
+	var tests = []struct {
+		require bool
+		token   string
+		client  *testCert
+		path    string
+		status  int
+	}{
+		// Without requiring certificates, only the admin routes check them.
+		{false, "", nil, "/check", http.StatusOK},
+		{false, "", nil, "/config", http.StatusForbidden},
+		{false, "", valid, "/config", http.StatusOK},
+		// Clients don't offer certificates the server's CA didn't sign.
+		{false, "", invalid, "/config", http.StatusForbidden},
+
+		// Every request needs a valid certificate.
+		{true, "", nil, "/check", 0},
+		{true, "", invalid, "/check", 0},
+		{true, "", valid, "/check", http.StatusOK},
+
+		// Both the certificate and the token are needed when both are set.
+		{true, "secret", valid, "/config", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		cfg := config.DefaultConfig
+		cfg.APIConfig.AdminToken = tt.token
+		cfg.APIConfig.ClientCA = caFile
+		cfg.APIConfig.RequireClientCert = tt.require
+		tkr, err := tracker.New(&cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := NewServer(&cfg, tkr, nil)
+		tlsConfig, err := s.tlsConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{serverCert.tls}
+
+		ts := httptest.NewUnstartedServer(newRouter(s))
+		ts.TLS = tlsConfig
+		ts.StartTLS()
+
+		roots := x509.NewCertPool()
+		roots.AddCert(serverCert.cert)
+		clientConfig := &tls.Config{RootCAs: roots}
+		if tt.client != nil {
+			clientConfig.Certificates = []tls.Certificate{tt.client.tls}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+
+		status := 0
+		if res, err := client.Get(ts.URL + tt.path); err == nil {
+			status = res.StatusCode
+			res.Body.Close()
+		}
+		ts.Close()
+
+		if status != tt.status {
+			t.Errorf("%s with require=%t token=%q: expected status %d, got %d", tt.path, tt.require, tt.token, tt.status, status)
+		}
+	}
+}
+
+func TestListenLimitTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chihaya-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	serverCert := newTestCert(t, "api", false, nil)
+	keyDER, err := x509.MarshalECPrivateKey(serverCert.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "api.crt"), filepath.Join(dir, "api.key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: serverCert.cert.Raw}), 0644)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	cfg := config.DefaultConfig
+	cfg.APIConfig.ListenAddr = "127.0.0.1:0"
+	cfg.APIConfig.ListenLimit = 1
+	cfg.APIConfig.TLSCert, cfg.APIConfig.TLSKey = certFile, keyFile
+	l, err := NewServer(&cfg, nil, nil).listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+
+	first := <-accepted
+	if _, ok := first.(*tls.Conn); !ok {
+		t.Errorf("expected a TLS connection, got %T", first)
+	}
+	select {
+	case <-accepted:
+		t.Fatal("expected the second connection to wait for the first to close")
+	case <-time.After(50 * time.Millisecond):
+	}
+	first.Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(time.Second):
+		t.Error("expected the second connection to be accepted once the first closed")
+	}
+}
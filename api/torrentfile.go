@@ -0,0 +1,175 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package api
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/zeebo/bencode"
+
+	"github.com/majestrate/chihaya/tracker/models"
+)
+
+// maxTorrentFileSize is the largest .torrent file that can be uploaded.
+const maxTorrentFileSize = 10 << 20
+
+var errBadTorrentFile = models.ClientError("malformed torrent file")
+
+// metainfo is the part of a .torrent file the tracker keeps. The info dict is
+// kept raw, as the infohash is the hash of its exact bytes.
+type metainfo struct {
+	Info    bencode.RawMessage `bencode:"info"`
+	URLList interface{}        `bencode:"url-list"`
+}
+
+type metainfoInfo struct {
+	Name    string `bencode:"name"`
+	Private int    `bencode:"private"`
+	Files   []struct {
+		Path []string `bencode:"path"`
+	} `bencode:"files"`
+}
+
+// postTorrent serves POST /torrents/file. The router can't have the static
+// "file" segment next to the :infohash wildcard of the status route, so it is
+// matched by the wildcard and told apart here.
+func (s *Server) postTorrent(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
+	if p.ByName("infohash") != "file" {
+		return http.StatusNotFound, nil
+	}
+	return s.importTorrentFile(w, r)
+}
+
+// importTorrentFile adds the torrent of an uploaded .torrent file. The file is
+// either the "torrent" part of a multipart form or the whole request body.
+// The owner_user_id, category, desc and tags form values fill in the rest of
+// the torrent's info, as they can't be found in the file.
+func (s *Server) importTorrentFile(w http.ResponseWriter, r *http.Request) (int, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxTorrentFileSize)
+	raw, err := readTorrentFile(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	torrent, err := parseTorrentFile(raw)
+	if err != nil {
+		return writeResult(w, make(map[string]interface{}), err)
+	}
+	torrent.Seeders = models.NewPeerMap(true, s.config)
+	torrent.Leechers = models.NewPeerMap(false, s.config)
+
+	info := torrent.Info
+	info.Category = r.FormValue("category")
+	info.Description = r.FormValue("desc")
+	if tags := r.FormValue("tags"); tags != "" {
+		info.Tags = strings.Split(tags, ",")
+	}
+	if owner := r.FormValue("owner_user_id"); owner != "" {
+		if info.UserID, err = strconv.ParseUint(owner, 10, 64); err != nil {
+			return http.StatusBadRequest, err
+		}
+	}
+
+	if dir := s.config.APIConfig.TorrentFileDir; dir != "" {
+		// named like the files of torrents added by the backend, which
+		// records the name alone
+		info.FilePath = fmt.Sprintf("%d.torrent", time.Now().UTC().UnixNano())
+		if err = ioutil.WriteFile(filepath.Join(dir, info.FilePath), raw, 0644); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+
+	if err = s.tracker.PutTorrent(torrent); err != nil {
+		if info.FilePath != "" {
+			os.Remove(filepath.Join(s.config.APIConfig.TorrentFileDir, info.FilePath))
+		}
+		return writeResult(w, make(map[string]interface{}), err)
+	}
+	return writeJSON(w, torrent)
+}
+
+// readTorrentFile returns the uploaded file of a request to import a torrent.
+func readTorrentFile(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		return ioutil.ReadAll(r.Body)
+	}
+
+	if err := r.ParseMultipartForm(maxTorrentFileSize); err != nil {
+		return nil, err
+	}
+	file, _, err := r.FormFile("torrent")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
+
+// parseTorrentFile reads the infohash, name, files, web seeds and private flag
+// of a .torrent file into a torrent.
+func parseTorrentFile(raw []byte) (*models.Torrent, error) {
+	var meta metainfo
+	if err := bencode.DecodeBytes(raw, &meta); err != nil || len(meta.Info) == 0 {
+		return nil, errBadTorrentFile
+	}
+	var info metainfoInfo
+	if err := bencode.DecodeBytes(meta.Info, &info); err != nil || info.Name == "" {
+		return nil, errBadTorrentFile
+	}
+
+	files := []string{info.Name}
+	if len(info.Files) > 0 {
+		files = make([]string, 0, len(info.Files))
+		for _, file := range info.Files {
+			if len(file.Path) == 0 {
+				return nil, errBadTorrentFile
+			}
+			files = append(files, path.Join(append([]string{info.Name}, file.Path...)...))
+		}
+	}
+
+	hash := sha1.Sum(meta.Info)
+	return &models.Torrent{
+		Infohash:       string(hash[:]),
+		UpMultiplier:   1,
+		DownMultiplier: 1,
+		Info: &models.TorrentInfo{
+			TorrentName: info.Name,
+			Files:       files,
+			WebSeeds:    webSeeds(meta.URLList),
+			Private:     info.Private == 1,
+		},
+	}, nil
+}
+
+// webSeeds returns the web seeds of a url-list, which BEP 19 allows to be a
+// single URL or a list of them.
+func webSeeds(urlList interface{}) []string {
+	switch v := urlList.(type) {
+	case string:
+		if v != "" {
+			return []string{v}
+		}
+	case []interface{}:
+		var seeds []string
+		for _, url := range v {
+			if s, ok := url.(string); ok && s != "" {
+				seeds = append(seeds, s)
+			}
+		}
+		return seeds
+	}
+	return nil
+}
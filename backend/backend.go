@@ -9,6 +9,7 @@ package backend
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/majestrate/chihaya/config"
 	"github.com/majestrate/chihaya/tracker/models"
@@ -74,15 +75,56 @@ type Conn interface {
 	// doesn't load info or peer
 	GetTorrentByInfoHash(infohash string) (*models.Torrent, error)
 
+	// get all categories
+	GetCategories() ([]*models.TorrentCategory, error)
+
+	// get all categories with the number of torrents in each
+	GetCategoryCounts() ([]*models.CategoryCount, error)
+
+	// set the moderation flags of a torrent
+	SetTorrentStatus(torrent *models.Torrent) error
+
+	// set the category, description, tags and freeleech flag of a torrent,
+	// for those the update sets, failing with models.ErrUnknownCategory if
+	// its new category doesn't exist
+	UpdateTorrent(infohash string, update *models.TorrentUpdate) error
+
 	// delete a torrent from the database
 	DeleteTorrent(torrent *models.Torrent) error
 
+	// delete the torrents nobody announced since before from the database,
+	// returning their infohashes and the names their files were stored under
+	PurgeInactiveTorrents(before time.Time) ([]*models.Torrent, error)
+
 	// add a torrent to the database
 	AddTorrent(torrent *models.Torrent) error
 
 	// add a user to the database
 	AddUser(user *models.User) error
 
+	// add a user to the database unless a user with the same external id
+	// exists, and fill in the id and passkey of the user either way
+	AddOrGetUser(user *models.User) error
+
+	// check the credential of the user with a passkey
+	VerifyCredential(passkey, cred string) (bool, error)
+
+	// enable or disable a user without deleting them
+	SetUserEnabled(user *models.User, enabled bool) error
+
 	// delete a user from the database
 	DeleteUser(user *models.User) error
+
+	// get the ids of all approved clients
+	GetClients() ([]string, error)
+
+	// approve a client by the id of its software
+	AddClient(clientID string) error
+
+	// revoke the approval of a client
+	DeleteClient(clientID string) error
+
+	// write a consistent snapshot of the database to a new file in dir,
+	// failing with models.ErrBackupUnsupported if there is nothing to back up
+	Backup(dir string) (*models.Backup, error)
 }
@@ -7,6 +7,8 @@
 package noop
 
 import (
+	"time"
+
 	"github.com/majestrate/chihaya/backend"
 	"github.com/majestrate/chihaya/config"
 	"github.com/majestrate/chihaya/tracker/models"
@@ -38,10 +40,22 @@ func (n *NoOp) RecordAnnounce(delta *models.AnnounceDelta) error {
 	return nil
 }
 
+func (n *NoOp) SetTorrentStatus(t *models.Torrent) error {
+	return nil
+}
+
+func (n *NoOp) UpdateTorrent(infohash string, update *models.TorrentUpdate) error {
+	return nil
+}
+
 func (n *NoOp) DeleteTorrent(t *models.Torrent) error {
 	return nil
 }
 
+func (n *NoOp) PurgeInactiveTorrents(before time.Time) ([]*models.Torrent, error) {
+	return nil, nil
+}
+
 func (n *NoOp) AddTorrent(t *models.Torrent) error {
 	return nil
 }
@@ -50,10 +64,30 @@ func (n *NoOp) DeleteUser(u *models.User) error {
 	return nil
 }
 
+func (n *NoOp) SetUserEnabled(u *models.User, enabled bool) error {
+	return nil
+}
+
 func (n *NoOp) AddUser(u *models.User) error {
 	return nil
 }
 
+func (n *NoOp) AddOrGetUser(u *models.User) error {
+	return nil
+}
+
+func (n *NoOp) VerifyCredential(passkey, cred string) (bool, error) {
+	return false, nil
+}
+
+func (n *NoOp) GetCategories() ([]*models.TorrentCategory, error) {
+	return nil, nil
+}
+
+func (n *NoOp) GetCategoryCounts() ([]*models.CategoryCount, error) {
+	return nil, nil
+}
+
 func (n *NoOp) GetTorrentByInfoHash(infohash string) (*models.Torrent, error) {
 	return nil, nil
 }
@@ -72,6 +106,24 @@ func (n *NoOp) LoadUsers(ids []uint64) ([]*models.User, error) {
 	return nil, nil
 }
 
+// GetClients returns no clients.
+func (n *NoOp) GetClients() ([]string, error) {
+	return nil, nil
+}
+
+func (n *NoOp) AddClient(clientID string) error {
+	return nil
+}
+
+func (n *NoOp) DeleteClient(clientID string) error {
+	return nil
+}
+
+// Backup fails, as there is no database to back up.
+func (n *NoOp) Backup(dir string) (*models.Backup, error) {
+	return nil, models.ErrBackupUnsupported
+}
+
 // Init registers the noop driver as a backend for Chihaya.
 func init() {
 	backend.Register("noop", &driver{})
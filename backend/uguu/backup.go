@@ -0,0 +1,162 @@
+//
+// copywrong you're mom 2015
+//
+
+package uguu
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/lib/pq"
+
+	"github.com/majestrate/chihaya/tracker/models"
+)
+
+// tables written to backups, in an order they can be restored in
+var backupTables = []string{
+	"config",
+	"torrent_categories",
+	"torrent_users",
+	"torrents",
+	"torrent_tags",
+	"torrent_files",
+	"torrent_clients",
+}
+
+// the first line of a backup
+type backupHeader struct {
+	Version string    `json:"version"`
+	Time    time.Time `json:"time"`
+}
+
+// a line of a backup holding one row of a table
+type backupRow struct {
+	Table string                 `json:"table"`
+	Row   map[string]interface{} `json:"row"`
+}
+
+// name of the backup file taken at t
+func backupName(t time.Time) string {
+	return "chihaya-" + t.Format("20060102T150405.000000000Z") + ".json.gz"
+}
+
+// write every table to a new gzipped file of JSON lines in dir
+// the tables are read in one read only, repeatable read transaction, so the
+// backup is a consistent snapshot while announces and uploads go on
+func (u *UguuSQL) Backup(dir string) (backup *models.Backup, err error) {
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return
+	}
+
+	var tx *sql.Tx
+	tx, err = u.conn.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return
+	}
+	// nothing was written, so there is nothing to commit
+	defer tx.Rollback()
+
+	// write to a temporary file so a failed backup never looks complete
+	var f *os.File
+	f, err = ioutil.TempFile(dir, ".backup-")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			glog.Errorf("error while backing up database: %s", err.Error())
+			backup = nil
+		}
+	}()
+
+	now := time.Now().UTC()
+	zw := gzip.NewWriter(f)
+	enc := json.NewEncoder(zw)
+
+	var version string
+	err = tx.QueryRow("SELECT val FROM config WHERE key = $1", cfg_version).Scan(&version)
+	if err == nil {
+		err = enc.Encode(backupHeader{Version: version, Time: now})
+	}
+
+	backup = &models.Backup{
+		Path: filepath.Join(dir, backupName(now)),
+		Rows: make(map[string]int64),
+	}
+	for _, table := range backupTables {
+		if err != nil {
+			return
+		}
+		backup.Rows[table], err = backupTable(tx, enc, table)
+	}
+
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), backup.Path)
+	}
+	return
+}
+
+// write every row of a table, returning how many there were
+func backupTable(tx *sql.Tx, enc *json.Encoder, table string) (count int64, err error) {
+	var rows *sql.Rows
+	rows, err = tx.Query("SELECT * FROM " + pq.QuoteIdentifier(table))
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var columns []string
+	columns, err = rows.Columns()
+	if err != nil {
+		return
+	}
+	values := make([]interface{}, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+
+	for rows.Next() {
+		err = rows.Scan(dest...)
+		if err == nil {
+			err = enc.Encode(backupRow{Table: table, Row: rowValues(columns, values)})
+		}
+		if err != nil {
+			return
+		}
+		count++
+	}
+	err = rows.Err()
+	return
+}
+
+// pair up the columns of a row with their values, with text as strings
+// rather than the bytes the driver may scan it as
+func rowValues(columns []string, values []interface{}) map[string]interface{} {
+	row := make(map[string]interface{}, len(columns))
+	for i, column := range columns {
+		if b, ok := values[i].([]byte); ok {
+			row[column] = string(b)
+		} else {
+			row[column] = values[i]
+		}
+	}
+	return row
+}
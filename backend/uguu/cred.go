@@ -0,0 +1,76 @@
+//
+// copywrong you're mom 2015
+//
+
+package uguu
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// prefix of hashed credentials, old rows hold credentials verbatim
+const credHashPrefix = "pbkdf2-sha256$"
+
+// how many rounds of PBKDF2 new credentials are hashed with
+var credIterations = 600000
+
+const (
+	credSaltLength = 16
+	credKeyLength  = sha256.Size
+)
+
+var errMalformedCredHash = errors.New("malformed credential hash")
+
+// hash a credential for storing, as pbkdf2-sha256$iterations$salt$key
+func hashCred(cred string) (hashed string, err error) {
+	salt := make([]byte, credSaltLength)
+	_, err = rand.Read(salt)
+	if err == nil {
+		key := pbkdf2.Key([]byte(cred), salt, credIterations, credKeyLength, sha256.New)
+		hashed = fmt.Sprintf("%s%d$%s$%s", credHashPrefix, credIterations,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+	}
+	return
+}
+
+// check a credential against a stored one
+// stored credentials that aren't hashed yet are compared as is, and flagged
+// so they can be replaced with a hash
+func checkCred(stored, cred string) (ok, plaintext bool, err error) {
+	if !strings.HasPrefix(stored, credHashPrefix) {
+		ok = subtle.ConstantTimeCompare([]byte(stored), []byte(cred)) == 1
+		plaintext = true
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(stored, credHashPrefix), "$")
+	if len(parts) != 3 {
+		err = errMalformedCredHash
+		return
+	}
+	var iterations int
+	var salt, key []byte
+	iterations, err = strconv.Atoi(parts[0])
+	if err == nil {
+		salt, err = base64.RawStdEncoding.DecodeString(parts[1])
+	}
+	if err == nil {
+		key, err = base64.RawStdEncoding.DecodeString(parts[2])
+	}
+	if err != nil || iterations <= 0 || len(key) == 0 {
+		err = errMalformedCredHash
+		return
+	}
+	ok = hmac.Equal(key, pbkdf2.Key([]byte(cred), salt, iterations, len(key), sha256.New))
+	return
+}
@@ -0,0 +1,49 @@
+//
+// copywrong you're mom 2015
+//
+
+package uguu
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+)
+
+func TestCheckCred(t *testing.T) {
+	defer func(n int) { credIterations = n }(credIterations)
+	credIterations = 10
+
+	hashed, err := hashCred("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a credential stored as it would have been hashed, from the PBKDF2 test
+	// vectors of RFC 7914 section 11
+	key, _ := hex.DecodeString("4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d")
+	vector := credHashPrefix + "80000$" + base64.RawStdEncoding.EncodeToString([]byte("NaCl")) + "$" + base64.RawStdEncoding.EncodeToString(key)
+
+	var tests = []struct {
+		stored, cred  string
+		ok, plaintext bool
+	}{
+		{hashed, "hunter2", true, false},
+		{hashed, "hunter3", false, false},
+		{vector, "Password", true, false},
+		{vector, "password", false, false},
+		{"hunter2", "hunter2", true, true},
+		{"hunter2", "hunter3", false, true},
+	}
+
+	for _, tt := range tests {
+		ok, plaintext, err := checkCred(tt.stored, tt.cred)
+		if err != nil || ok != tt.ok || plaintext != tt.plaintext {
+			t.Errorf("%q against %q: expected ok=%t plaintext=%t, got %t %t %v", tt.cred, tt.stored, tt.ok, tt.plaintext, ok, plaintext, err)
+		}
+	}
+
+	if _, _, err := checkCred(credHashPrefix+"10$nope", "hunter2"); err != errMalformedCredHash {
+		t.Errorf("expected a malformed hash to be reported, got %v", err)
+	}
+}
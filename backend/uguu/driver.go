@@ -9,12 +9,13 @@ import (
 	"crypto/rand"
 
 	"database/sql"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 
 	"encoding/base32"
 	"errors"
 	"fmt"
 	"io"
+	"strconv"
 	"strings"
 	"time"
 
@@ -31,10 +32,65 @@ type uguuDriver struct{}
 type UguuSQL struct {
 	// database connection
 	conn *sql.DB
+
+	// most torrents a user may upload in a day, 0 for no limit
+	maxUploadsPerDay int
+	// users the upload limit does not apply to
+	quotaExempt map[uint64]bool
+	// create the categories torrents are added under if they don't exist
+	autoCreateCategories bool
+	// how stale a torrent's last activity may get before an announce
+	// updates it
+	activityResolution time.Duration
 }
 
+// ErrUploadQuotaExceeded is returned when a user has already uploaded as many
+// torrents as they may in a day.
+var ErrUploadQuotaExceeded = models.ClientError("daily upload limit reached")
+
+// most rows put in a single INSERT when storing a torrent's files or tags
+// the tracker caps how many a torrent may have, with maxTorrentFiles and
+// maxTorrentTags, before they get here
+const insertBatchSize = 1000
+
 var cfg_version = "uguu.version"
 
+// the database version that migrations end at
+var latest_version = "9"
+
+// postgres error code for a violated unique constraint
+const uniqueViolation = "23505"
+
+// bits of the torrent_status column
+const (
+	statusApproved = 1 << iota
+	statusDead
+	statusTrumped
+)
+
+// pack moderation flags into a torrent_status value
+func encodeStatus(s models.TorrentStatus) (status int) {
+	if s.Approved {
+		status |= statusApproved
+	}
+	if s.Dead {
+		status |= statusDead
+	}
+	if s.Trumped {
+		status |= statusTrumped
+	}
+	return
+}
+
+// unpack a torrent_status value into moderation flags
+func decodeStatus(status int) models.TorrentStatus {
+	return models.TorrentStatus{
+		Approved: status&statusApproved != 0,
+		Dead:     status&statusDead != 0,
+		Trumped:  status&statusTrumped != 0,
+	}
+}
+
 // what database version are we at
 func (u *UguuSQL) Version() (version string, err error) {
 	err = u.conn.QueryRow("SELECT val FROM config WHERE key = $1", cfg_version).Scan(&version)
@@ -64,7 +120,7 @@ func (u *UguuSQL) InitTables() (err error) {
 
 // return true if the version string is the latest version
 func (u *UguuSQL) LatestVersion(version string) (latest bool) {
-	latest = version == "1"
+	latest = version == latest_version
 	return
 }
 
@@ -129,6 +185,55 @@ func (u *UguuSQL) UpgradeToNext(version string) (err error) {
 		table_order = append(table_order, "torrents")
 		table_order = append(table_order, "torrent_tags")
 		table_order = append(table_order, "torrent_files")
+	} else if version == "1" {
+		// migrate to version 2
+		next_version = "2"
+		// keep only the first torrent added for each infohash, which is the
+		// one lookups by infohash should have found all along
+		pre_queries = append(pre_queries, `DELETE FROM torrents a USING torrents b
+                                     WHERE a.torrent_infohash = b.torrent_infohash AND a.torrent_id > b.torrent_id`)
+		post_queries = append(post_queries, `CREATE UNIQUE INDEX IF NOT EXISTS torrents_infohash_key ON torrents(torrent_infohash)`)
+	} else if version == "2" {
+		// migrate to version 3
+		next_version = "3"
+		// users registered by passkey alone have no external id
+		post_queries = append(post_queries, `ALTER TABLE torrent_users ADD COLUMN IF NOT EXISTS user_external_id VARCHAR(255)`)
+		post_queries = append(post_queries, `CREATE UNIQUE INDEX IF NOT EXISTS torrent_users_external_id_key ON torrent_users(user_external_id)`)
+	} else if version == "3" {
+		// migrate to version 4
+		next_version = "4"
+		// torrents tracked before moderation existed count as approved
+		post_queries = append(post_queries, `ALTER TABLE torrents ADD COLUMN IF NOT EXISTS torrent_status INTEGER NOT NULL DEFAULT 0`)
+		post_queries = append(post_queries, fmt.Sprintf(`UPDATE torrents SET torrent_status = %d`, statusApproved))
+	} else if version == "4" {
+		// migrate to version 5
+		next_version = "5"
+		post_queries = append(post_queries, `ALTER TABLE torrent_users ADD COLUMN IF NOT EXISTS user_enabled BOOLEAN NOT NULL DEFAULT TRUE`)
+	} else if version == "5" {
+		// migrate to version 6
+		next_version = "6"
+		// whether the torrent file had the private flag set, which was never
+		// recorded before
+		post_queries = append(post_queries, `ALTER TABLE torrents ADD COLUMN IF NOT EXISTS torrent_private BOOLEAN NOT NULL DEFAULT FALSE`)
+	} else if version == "6" {
+		// migrate to version 7
+		next_version = "7"
+		// activity was never recorded before, so count existing torrents as
+		// active now rather than purging them all
+		post_queries = append(post_queries, fmt.Sprintf(`UPDATE torrents SET torrent_last_active = %d WHERE torrent_last_active = 0`, time.Now().UTC().UnixNano()))
+		post_queries = append(post_queries, `CREATE INDEX IF NOT EXISTS torrents_last_active_idx ON torrents(torrent_last_active)`)
+	} else if version == "7" {
+		// migrate to version 8
+		next_version = "8"
+		// the client whitelist, which was only kept in memory before
+		table_defs["torrent_clients"] = `(
+                                       client_id VARCHAR(255) PRIMARY KEY
+                                     )`
+		table_order = append(table_order, "torrent_clients")
+	} else if version == "8" {
+		// migrate to version 9
+		next_version = "9"
+		post_queries = append(post_queries, `ALTER TABLE torrents ADD COLUMN IF NOT EXISTS torrent_freeleech BOOLEAN NOT NULL DEFAULT FALSE`)
 	} else {
 		// invalid version
 		return errors.New("invalid version")
@@ -158,7 +263,7 @@ func (u *UguuSQL) UpgradeToNext(version string) (err error) {
 
 	// run post-conditions
 	glog.Infof("run %d postconditions", len(post_queries))
-	for _, q := range pre_queries {
+	for _, q := range post_queries {
 		glog.V(1).Infof(">> %s", q)
 		_, err = u.conn.Exec(q)
 		if err != nil {
@@ -200,6 +305,16 @@ func (u *UguuSQL) Ping() (err error) {
 // record that a bittorrent announce happened
 func (u *UguuSQL) RecordAnnounce(delta *models.AnnounceDelta) (err error) {
 	// TODO: record ratio
+	// the first announce also sets the first activity, in the same statement
+	// so that concurrent first announces can't both set it
+	// the last activity is only written once it is older than
+	// activityResolution, so hot torrents don't cost a write per announce
+	now := time.Now().UTC()
+	_, err = u.conn.Exec(`UPDATE torrents SET
+                          torrent_last_active = $1,
+                          torrent_first_active = CASE WHEN torrent_first_active = 0 THEN $1 ELSE torrent_first_active END
+                        WHERE torrent_infohash = $2 AND (torrent_last_active < $3 OR torrent_first_active = 0)`,
+		now.UnixNano(), delta.Torrent.Infohash, now.Add(-u.activityResolution).UnixNano())
 	return
 }
 
@@ -215,7 +330,8 @@ func (u *UguuSQL) AddTorrent(torrent *models.Torrent) (err error) {
 	var hasUser, canUpload bool
 	if info.UserID == 0 {
 		// no user specified
-		// this is an anonymously added torrent
+		// this is an anonymously added torrent and no anonymousUserID
+		// is configured to attribute it to
 		// TODO: check if we allow it explicitly
 		hasUser = true
 	} else {
@@ -244,17 +360,19 @@ func (u *UguuSQL) AddTorrent(torrent *models.Torrent) (err error) {
 		return
 	}
 
-	var cat_id int64
-	err = u.conn.QueryRow(`SELECT cat_id FROM torrent_categories WHERE cat_name = $1 LIMIT 1`, info.Category).Scan(&cat_id)
-
+	// are they over their quota?
+	err = u.checkUploadQuota(info.UserID)
 	if err != nil {
-		// no category?
-		glog.Errorf("failed to get cat_id: %s", err.Error())
 		return
 	}
 
 	now := time.Now().UTC().UnixNano()
 
+	file_path := info.FilePath
+	if file_path == "" {
+		file_path = fmt.Sprintf("%d.torrent", now)
+	}
+
 	var torrent_id int64
 
 	var tx *sql.Tx
@@ -263,6 +381,15 @@ func (u *UguuSQL) AddTorrent(torrent *models.Torrent) (err error) {
 	if err != nil {
 		return
 	}
+	var cat_id int64
+	cat_id, err = u.torrentCategory(txCategories{tx}, info.Category)
+	if err != nil {
+		tx.Rollback()
+		if err != models.ErrUnknownCategory {
+			glog.Errorf("failed to get category %q: %s", info.Category, err.Error())
+		}
+		return
+	}
 	// insert into torrents table
 	err = tx.QueryRow(`INSERT INTO torrents
                      (
@@ -272,7 +399,11 @@ func (u *UguuSQL) AddTorrent(torrent *models.Torrent) (err error) {
                        torrent_cat_id, 
                        torrent_description, 
                        torrent_file_filepath,
-                       torrent_uploaded_time
+                       torrent_uploaded_time,
+                       torrent_status,
+                       torrent_private,
+                       torrent_last_active,
+                       torrent_freeleech
                      )
                      VALUES
                      ( 
@@ -282,7 +413,11 @@ func (u *UguuSQL) AddTorrent(torrent *models.Torrent) (err error) {
                        $4,
                        $5,
                        $6,
-                       $7
+                       $7,
+                       $8,
+                       $9,
+                       $10,
+                       $11
                      )
                      RETURNING torrent_id`,
 		info.UserID,
@@ -290,36 +425,41 @@ func (u *UguuSQL) AddTorrent(torrent *models.Torrent) (err error) {
 		info.TorrentName,
 		cat_id,
 		info.Description,
-		fmt.Sprintf("%d.torrent", now),
-		now).Scan(&torrent_id)
+		file_path,
+		now,
+		encodeStatus(torrent.Status),
+		info.Private,
+		now,
+		torrent.Freeleech).Scan(&torrent_id)
+
+	if isUniqueViolation(err) {
+		tx.Rollback()
+		return models.ErrTorrentExists
+	}
 
 	if err == nil {
 		// we inserted it
 		if torrent_id > 0 {
 			// it's inserted for sure, probably
 			// insert tags
-			for _, tag := range info.Tags {
-				_, err = tx.Exec(`INSERT INTO torrent_tags(tag_name, tag_torrent_id) VALUES($1, $2)`, tag, torrent_id)
-				if err != nil {
-					glog.Error("failed to insert torrent tag", err.Error())
-					err2 := tx.Rollback()
-					if err2 != nil {
-						glog.Error("failed to rollback transaction", err2.Error())
-					}
-					return errors.New("database error")
+			err = insertBatched(tx, `INSERT INTO torrent_tags(tag_name, tag_torrent_id) VALUES`, torrent_id, info.Tags)
+			if err != nil {
+				glog.Error("failed to insert torrent tag", err.Error())
+				err2 := tx.Rollback()
+				if err2 != nil {
+					glog.Error("failed to rollback transaction", err2.Error())
 				}
+				return errors.New("database error")
 			}
 			// insert file records
-			for _, file := range info.Files {
-				_, err = tx.Exec(`INSERT INTO torrent_files(file_name, file_torrent_id) VALUES($1, $2)`, file, torrent_id)
-				if err != nil {
-					glog.Error("failed to insert torrent file records", err.Error())
-					err2 := tx.Rollback()
-					if err2 != nil {
-						glog.Error("failed to rollback transaction", err2.Error())
-					}
-					return errors.New("database error")
+			err = insertBatched(tx, `INSERT INTO torrent_files(file_name, file_torrent_id) VALUES`, torrent_id, info.Files)
+			if err != nil {
+				glog.Error("failed to insert torrent file records", err.Error())
+				err2 := tx.Rollback()
+				if err2 != nil {
+					glog.Error("failed to rollback transaction", err2.Error())
 				}
+				return errors.New("database error")
 			}
 			// it gud, let's commit
 			err = tx.Commit()
@@ -328,11 +468,123 @@ func (u *UguuSQL) AddTorrent(torrent *models.Torrent) (err error) {
 		}
 	}
 	if err != nil {
+		tx.Rollback()
 		glog.Errorf("error while addding torrent: %s", err.Error())
 	}
 	return
 }
 
+// the categories a torrent may be added under
+type categoryStore interface {
+	// get the id of a category, sql.ErrNoRows if it doesn't exist
+	find(name string) (int64, error)
+	// get the id of a category, creating it with no description if it
+	// doesn't exist
+	create(name string) (int64, error)
+}
+
+// the categories as seen by the transaction adding a torrent
+type txCategories struct {
+	tx *sql.Tx
+}
+
+func (c txCategories) find(name string) (cat_id int64, err error) {
+	err = c.tx.QueryRow(`SELECT cat_id FROM torrent_categories WHERE cat_name = $1 LIMIT 1`, name).Scan(&cat_id)
+	return
+}
+
+// the table is locked for the rest of the transaction first, so that torrents
+// added at once in the same new category don't each create it
+func (c txCategories) create(name string) (cat_id int64, err error) {
+	_, err = c.tx.Exec(`LOCK TABLE torrent_categories IN SHARE ROW EXCLUSIVE MODE`)
+	if err != nil {
+		return
+	}
+	cat_id, err = c.find(name)
+	if err == sql.ErrNoRows {
+		glog.Infof("creating category %q", name)
+		err = c.tx.QueryRow(`INSERT INTO torrent_categories(cat_name, cat_desc) VALUES($1, '') RETURNING cat_id`, name).Scan(&cat_id)
+	}
+	return
+}
+
+// get the id of the category a torrent is added under
+// a new category is created along with the torrent, if we may
+func (u *UguuSQL) torrentCategory(cats categoryStore, name string) (cat_id int64, err error) {
+	cat_id, err = cats.find(name)
+	if err == sql.ErrNoRows {
+		if !u.autoCreateCategories || name == "" {
+			return 0, models.ErrUnknownCategory
+		}
+		cat_id, err = cats.create(name)
+	}
+	return
+}
+
+// insert a torrent's files or tags, many rows per statement
+// prefix is the INSERT up to VALUES, with the value column before the torrent
+// id column
+func insertBatched(tx *sql.Tx, prefix string, torrent_id int64, values []string) (err error) {
+	for _, batch := range splitBatches(values, insertBatchSize) {
+		args := make([]interface{}, 0, len(batch)+1)
+		args = append(args, torrent_id)
+		for _, value := range batch {
+			args = append(args, value)
+		}
+		_, err = tx.Exec(batchInsertQuery(prefix, len(batch)), args...)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// split values into batches of at most size
+func splitBatches(values []string, size int) (batches [][]string) {
+	for len(values) > size {
+		batches = append(batches, values[:size])
+		values = values[size:]
+	}
+	if len(values) > 0 {
+		batches = append(batches, values)
+	}
+	return
+}
+
+// build an INSERT of n rows, which all share the torrent id in $1
+func batchInsertQuery(prefix string, n int) string {
+	var query strings.Builder
+	query.WriteString(prefix)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			query.WriteString(",")
+		}
+		fmt.Fprintf(&query, " ($%d, $1)", i+2)
+	}
+	return query.String()
+}
+
+// check if an error is postgres refusing to break a unique constraint
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == uniqueViolation
+}
+
+// check that a user has not uploaded their daily quota of torrents already
+func (u *UguuSQL) checkUploadQuota(userID uint64) (err error) {
+	if u.maxUploadsPerDay <= 0 || u.quotaExempt[userID] {
+		return
+	}
+	// upload times are stored in nanoseconds
+	since := time.Now().UTC().Add(-24 * time.Hour).UnixNano()
+	var count int64
+	err = u.conn.QueryRow(`SELECT COUNT(*) FROM torrents WHERE torrent_upload_user_id = $1 AND torrent_uploaded_time > $2`, userID, since).Scan(&count)
+	if err == nil && count >= int64(u.maxUploadsPerDay) {
+		err = ErrUploadQuotaExceeded
+	}
+	return
+}
+
 // generate a passkey
 func genPassKey() string {
 	var buff [30]byte
@@ -361,19 +613,269 @@ func (u *UguuSQL) GeneratePasskey() (key string) {
 }
 
 // add a user to the database
+// the user's credential is stored hashed
 func (u *UguuSQL) AddUser(user *models.User) (err error) {
+	var inserted bool
+	inserted, err = u.insertUser(user)
+	if err == nil && !inserted {
+		err = models.ErrUserExists
+	}
+	return
+}
+
+// add a user to the database unless one with the same external id exists
+func (u *UguuSQL) AddOrGetUser(user *models.User) (err error) {
+	if user.ExternalID == "" {
+		return u.AddUser(user)
+	}
+	var inserted bool
+	inserted, err = u.insertUser(user)
+	if err == nil && !inserted {
+		// the user was registered already
+		err = u.conn.QueryRow(`SELECT user_id, user_passkey FROM torrent_users WHERE user_external_id = $1`, user.ExternalID).Scan(&user.ID, &user.Passkey)
+	}
+	return
+}
+
+// insert a user with a new passkey unless its external id is taken
+func (u *UguuSQL) insertUser(user *models.User) (inserted bool, err error) {
 	passkey := u.GeneratePasskey()
-	if len(passkey) > 0 {
-		_, err = u.conn.Exec(`INSERT INTO torrent_users(user_passkey, user_login_name, user_login_cred) VALUES($1, $2, $3)`, passkey, user.Username, user.Cred)
-	} else {
+	if len(passkey) == 0 {
 		err = errors.New("cannot generate passkey")
+		return
+	}
+	var cred string
+	cred, err = hashCred(user.Cred)
+	if err != nil {
+		return
+	}
+	var externalID sql.NullString
+	if user.ExternalID != "" {
+		externalID = sql.NullString{String: user.ExternalID, Valid: true}
+	}
+	err = u.conn.QueryRow(`INSERT INTO torrent_users(user_passkey, user_login_name, user_login_cred, user_external_id) VALUES($1, $2, $3, $4)
+                         ON CONFLICT (user_external_id) DO NOTHING RETURNING user_id`, passkey, user.Username, cred, externalID).Scan(&user.ID)
+	if err == sql.ErrNoRows {
+		// the external id is taken
+		err = nil
+	} else if err == nil {
+		user.Passkey = passkey
+		inserted = true
+	}
+	return
+}
+
+// check a user's credential
+// credentials stored before they were hashed are hashed once they check out
+func (u *UguuSQL) VerifyCredential(passkey, cred string) (ok bool, err error) {
+	var stored string
+	err = u.conn.QueryRow(`SELECT user_login_cred FROM torrent_users WHERE user_passkey = $1 LIMIT 1`, passkey).Scan(&stored)
+	if err == sql.ErrNoRows {
+		err = models.ErrUserDNE
+	}
+	if err != nil {
+		return
+	}
+
+	var plaintext bool
+	ok, plaintext, err = checkCred(stored, cred)
+	if err == nil && ok && plaintext {
+		var hashed string
+		hashed, err = hashCred(cred)
+		if err == nil {
+			// only replace the credential that was checked
+			_, err = u.conn.Exec(`UPDATE torrent_users SET user_login_cred = $1 WHERE user_passkey = $2 AND user_login_cred = $3`, hashed, passkey, stored)
+		}
+		if err != nil {
+			glog.Errorf("failed to hash stored credential: %s", err)
+			// the credential checked out all the same
+			err = nil
+		}
+	}
+	return
+}
+
+// set the moderation flags of an already existing torrent
+func (u *UguuSQL) SetTorrentStatus(torrent *models.Torrent) (err error) {
+	var res sql.Result
+	res, err = u.conn.Exec(`UPDATE torrents SET torrent_status = $1 WHERE torrent_infohash = $2`, encodeStatus(torrent.Status), torrent.Infohash)
+	if err == nil {
+		var affected int64
+		affected, err = res.RowsAffected()
+		if err == nil && affected == 0 {
+			err = models.ErrTorrentDNE
+		}
+	}
+	return
+}
+
+// set the category, description, tags and freeleech flag of a torrent, for
+// those of them the update sets, leaving the others as they are stored
+// tags are diffed against the stored ones, so unchanged tags are left alone
+func (u *UguuSQL) UpdateTorrent(infohash string, update *models.TorrentUpdate) (err error) {
+	var cat_id int64
+	if update.Category != nil {
+		err = u.conn.QueryRow(`SELECT cat_id FROM torrent_categories WHERE cat_name = $1 LIMIT 1`, *update.Category).Scan(&cat_id)
+		if err == sql.ErrNoRows {
+			return models.ErrUnknownCategory
+		} else if err != nil {
+			return
+		}
+	}
+
+	var tx *sql.Tx
+	tx, err = u.conn.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var torrent_id int64
+	sets, args := updateColumns(update, cat_id)
+	args = append(args, infohash)
+	if len(sets) > 0 {
+		err = tx.QueryRow(fmt.Sprintf(`UPDATE torrents SET %s WHERE torrent_infohash = $%d RETURNING torrent_id`, strings.Join(sets, ", "), len(args)),
+			args...).Scan(&torrent_id)
+	} else {
+		err = tx.QueryRow(`SELECT torrent_id FROM torrents WHERE torrent_infohash = $1`, infohash).Scan(&torrent_id)
+	}
+	if err == sql.ErrNoRows {
+		err = models.ErrTorrentDNE
+		return
+	} else if err != nil {
+		return
+	}
+
+	if update.Tags != nil {
+		var stored []string
+		stored, err = torrentTags(tx, torrent_id)
+		if err != nil {
+			return
+		}
+		added, removed := diffTags(stored, *update.Tags)
+		if len(removed) > 0 {
+			_, err = tx.Exec(`DELETE FROM torrent_tags WHERE tag_torrent_id = $1 AND tag_name = ANY($2)`, torrent_id, pq.Array(removed))
+			if err != nil {
+				return
+			}
+		}
+		err = insertBatched(tx, `INSERT INTO torrent_tags(tag_name, tag_torrent_id) VALUES`, torrent_id, added)
+		if err != nil {
+			return
+		}
+	}
+	err = tx.Commit()
+	return
+}
+
+// the assignments of the torrents columns an update changes, with their
+// arguments numbered from $1
+func updateColumns(update *models.TorrentUpdate, cat_id int64) (sets []string, args []interface{}) {
+	set := func(column string, value interface{}) {
+		args = append(args, value)
+		sets = append(sets, fmt.Sprintf("%s = $%d", column, len(args)))
+	}
+	if update.Category != nil {
+		set("torrent_cat_id", cat_id)
+	}
+	if update.Description != nil {
+		set("torrent_description", *update.Description)
+	}
+	if update.Freeleech != nil {
+		set("torrent_freeleech", *update.Freeleech)
+	}
+	return
+}
+
+// get the tags of a torrent
+func torrentTags(tx *sql.Tx, torrent_id int64) (tags []string, err error) {
+	var rows *sql.Rows
+	rows, err = tx.Query(`SELECT tag_name FROM torrent_tags WHERE tag_torrent_id = $1`, torrent_id)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tag string
+		if err = rows.Scan(&tag); err != nil {
+			return
+		}
+		tags = append(tags, tag)
+	}
+	err = rows.Err()
+	return
+}
+
+// find the tags to add and remove to turn the stored tags into the wanted ones
+func diffTags(stored, wanted []string) (added, removed []string) {
+	have := make(map[string]bool, len(stored))
+	for _, tag := range stored {
+		have[tag] = true
+	}
+	want := make(map[string]bool, len(wanted))
+	for _, tag := range wanted {
+		if !want[tag] && !have[tag] {
+			added = append(added, tag)
+		}
+		want[tag] = true
+	}
+	for _, tag := range stored {
+		if !want[tag] {
+			removed = append(removed, tag)
+		}
 	}
 	return
 }
 
 // delete an already existing torrent
 func (u *UguuSQL) DeleteTorrent(torrent *models.Torrent) (err error) {
-	_, err = u.conn.Exec(`DELETE FROM torrents WHERE torrent_infohash = $1`, torrent.Infohash)
+	var res sql.Result
+	res, err = u.conn.Exec(`DELETE FROM torrents WHERE torrent_infohash = $1`, torrent.Infohash)
+	if err == nil {
+		var affected int64
+		affected, err = res.RowsAffected()
+		if err == nil && affected == 0 {
+			err = models.ErrTorrentDNE
+		}
+	}
+	return
+}
+
+// delete all torrents that were not announced since before
+func (u *UguuSQL) PurgeInactiveTorrents(before time.Time) (torrents []*models.Torrent, err error) {
+	var rows *sql.Rows
+	rows, err = u.conn.Query(`DELETE FROM torrents WHERE torrent_last_active < $1
+                            RETURNING torrent_infohash, torrent_file_filepath`, before.UTC().UnixNano())
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		t := &models.Torrent{Info: new(models.TorrentInfo)}
+		if err = rows.Scan(&t.Infohash, &t.Info.FilePath); err != nil {
+			return
+		}
+		torrents = append(torrents, t)
+	}
+	err = rows.Err()
+	return
+}
+
+// enable or disable a user, keeping their history
+func (u *UguuSQL) SetUserEnabled(user *models.User, enabled bool) (err error) {
+	var res sql.Result
+	res, err = u.conn.Exec(`UPDATE torrent_users SET user_enabled = $1 WHERE user_passkey = $2`, enabled, user.Passkey)
+	if err == nil {
+		var affected int64
+		affected, err = res.RowsAffected()
+		if err == nil && affected == 0 {
+			err = models.ErrUserDNE
+		}
+	}
 	return
 }
 
@@ -382,43 +884,130 @@ func (u *UguuSQL) DeleteUser(user *models.User) (err error) {
 	return
 }
 
-func (u *UguuSQL) GetTorrentByInfoHash(infohash string) (t *models.Torrent, err error) {
-	var count int64
-	err = u.conn.QueryRow(`SELECT COUNT(*) FROM torrents WHERE torrent_infohash = $1`, infohash).Scan(&count)
-	if err == nil {
-		if count > 0 {
-			t = new(models.Torrent)
-			t.Infohash = infohash
-		} else {
-			err = models.ErrTorrentDNE
+// get the ids of all whitelisted clients
+func (u *UguuSQL) GetClients() (clients []string, err error) {
+	var rows *sql.Rows
+	rows, err = u.conn.Query(`SELECT client_id FROM torrent_clients`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var client string
+		if err = rows.Scan(&client); err != nil {
+			return
 		}
+		clients = append(clients, client)
+	}
+	err = rows.Err()
+	return
+}
+
+// whitelist a client, if it isn't already
+func (u *UguuSQL) AddClient(clientID string) (err error) {
+	_, err = u.conn.Exec(`INSERT INTO torrent_clients(client_id) VALUES($1) ON CONFLICT DO NOTHING`, clientID)
+	return
+}
+
+// remove a client from the whitelist
+func (u *UguuSQL) DeleteClient(clientID string) (err error) {
+	_, err = u.conn.Exec(`DELETE FROM torrent_clients WHERE client_id = $1`, clientID)
+	return
+}
+
+// get a torrent by its infohash, which is unique
+// doesn't load info or peers
+func (u *UguuSQL) GetTorrentByInfoHash(infohash string) (t *models.Torrent, err error) {
+	torrent := new(models.Torrent)
+	var status int
+	err = u.conn.QueryRow(`SELECT torrent_id, torrent_infohash, torrent_status, torrent_freeleech FROM torrents WHERE torrent_infohash = $1`, infohash).Scan(&torrent.ID, &torrent.Infohash, &status, &torrent.Freeleech)
+	if err == sql.ErrNoRows {
+		err = models.ErrTorrentDNE
+	} else if err == nil {
+		torrent.Status = decodeStatus(status)
+		t = torrent
 	}
 	return
 }
 
 func (u *UguuSQL) GetUserByPassKey(passkey string) (user *models.User, err error) {
 	obtained := new(models.User)
-	err = u.conn.QueryRow(`SELECT user_id, user_passkey, user_login_name, user_login_cred FROM torrent_users WHERE user_passkey = $1 LIMIT 1`, passkey).Scan(&obtained.ID, &obtained.Passkey, &obtained.Username, &obtained.Cred)
-	if err == nil {
+	err = u.conn.QueryRow(`SELECT user_id, user_passkey, user_login_name, COALESCE(user_external_id, ''), NOT user_enabled FROM torrent_users WHERE user_passkey = $1 LIMIT 1`, passkey).Scan(&obtained.ID, &obtained.Passkey, &obtained.Username, &obtained.ExternalID, &obtained.Disabled)
+	if err == sql.ErrNoRows {
+		err = models.ErrUserDNE
+	} else if err == nil {
 		user = obtained
 	}
 	return
 }
 
+// get all categories
 func (u *UguuSQL) GetCategories() (cats []*models.TorrentCategory, err error) {
+	var rows *sql.Rows
+	rows, err = u.conn.Query(`SELECT cat_id, cat_name, cat_desc FROM torrent_categories ORDER BY cat_id`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		cat := new(models.TorrentCategory)
+		if err = rows.Scan(&cat.ID, &cat.Name, &cat.Description); err != nil {
+			return
+		}
+		cats = append(cats, cat)
+	}
+	err = rows.Err()
+	return
+}
+
+// get all categories with how many torrents each has, empty ones included
+func (u *UguuSQL) GetCategoryCounts() (cats []*models.CategoryCount, err error) {
+	var rows *sql.Rows
+	rows, err = u.conn.Query(`SELECT c.cat_id, c.cat_name, c.cat_desc, COUNT(t.torrent_id)
+                            FROM torrent_categories c LEFT JOIN torrents t ON t.torrent_cat_id = c.cat_id
+                            GROUP BY c.cat_id ORDER BY c.cat_id`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		cat := new(models.CategoryCount)
+		if err = rows.Scan(&cat.ID, &cat.Name, &cat.Description, &cat.Torrents); err != nil {
+			return
+		}
+		cats = append(cats, cat)
+	}
+	err = rows.Err()
 	return
 }
 
+// load torrents given an array of ids
+// ids that don't exist are skipped
+// doesn't load info or peers
 func (u *UguuSQL) LoadTorrents(ids []uint64) (torrents []*models.Torrent, err error) {
-	err = errors.New("uguu load torrents not implemented")
+	for _, id := range ids {
+		torrent := new(models.Torrent)
+		var status int
+		err = u.conn.QueryRow(`SELECT torrent_id, torrent_infohash, torrent_status, torrent_freeleech FROM torrents WHERE torrent_id = $1 LIMIT 1`, id).Scan(&torrent.ID, &torrent.Infohash, &status, &torrent.Freeleech)
+		if err == sql.ErrNoRows {
+			err = nil
+			continue
+		}
+		if err != nil {
+			return
+		}
+		torrent.Status = decodeStatus(status)
+		torrents = append(torrents, torrent)
+	}
 	return
 }
 
 // load users given an array of ids
+// credentials are not loaded, use VerifyCredential to check them
 func (u *UguuSQL) LoadUsers(ids []uint64) (users []*models.User, err error) {
 	for _, id := range ids {
 		user := new(models.User)
-		err = u.conn.QueryRow(`SELECT user_id, user_passkey, user_login_name, user_login_cred FROM torrent_users WHERE user_id = $1 LIMIT 1`, id).Scan(&user.ID, &user.Passkey, &user.Username, &user.Cred)
+		err = u.conn.QueryRow(`SELECT user_id, user_passkey, user_login_name, COALESCE(user_external_id, ''), NOT user_enabled FROM torrent_users WHERE user_id = $1 LIMIT 1`, id).Scan(&user.ID, &user.Passkey, &user.Username, &user.ExternalID, &user.Disabled)
 		if err != nil {
 			return
 		}
@@ -437,14 +1026,82 @@ func extractDBCreds(param map[string]string) (str string, err error) {
 	return
 }
 
+// extract the upload quota settings from map
+func extractUploadQuota(param map[string]string) (max int, exempt map[uint64]bool, err error) {
+	if str, ok := param["maxUploadsPerDay"]; ok {
+		max, err = strconv.Atoi(str)
+		if err != nil {
+			err = fmt.Errorf("invalid maxUploadsPerDay parameter: %s", err)
+			return
+		}
+	}
+	exempt = make(map[uint64]bool)
+	if str, ok := param["quotaExemptUsers"]; ok {
+		for _, field := range strings.Split(str, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			var id uint64
+			id, err = strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				err = fmt.Errorf("invalid quotaExemptUsers parameter: %s", err)
+				return
+			}
+			exempt[id] = true
+		}
+	}
+	return
+}
+
+// extract whether categories are created on first use from map
+func extractAutoCreateCategories(param map[string]string) (auto bool, err error) {
+	if str, ok := param["autoCreateCategories"]; ok {
+		auto, err = strconv.ParseBool(str)
+		if err != nil {
+			err = fmt.Errorf("invalid autoCreateCategories parameter: %s", err)
+		}
+	}
+	return
+}
+
+// default for how stale a torrent's last activity may get before an announce
+// updates it
+const defaultActivityResolution = 5 * time.Minute
+
+// get how stale a torrent's last activity may get from the driver params
+func extractActivityResolution(param map[string]string) (resolution time.Duration, err error) {
+	resolution = defaultActivityResolution
+	if str, ok := param["activityResolution"]; ok {
+		resolution, err = time.ParseDuration(str)
+		if err == nil && resolution < 0 {
+			err = errors.New("must not be negative")
+		}
+		if err != nil {
+			err = fmt.Errorf("invalid activityResolution parameter: %s", err)
+		}
+	}
+	return
+}
+
 // create a new uguu driver
 func (d *uguuDriver) New(cfg *config.DriverConfig) (c backend.Conn, err error) {
 	var url string
 	// get db creds
 	url, err = extractDBCreds(cfg.Params)
+	if err != nil {
+		return
+	}
+	uguu := new(UguuSQL)
+	uguu.maxUploadsPerDay, uguu.quotaExempt, err = extractUploadQuota(cfg.Params)
+	if err == nil {
+		uguu.autoCreateCategories, err = extractAutoCreateCategories(cfg.Params)
+	}
+	if err == nil {
+		uguu.activityResolution, err = extractActivityResolution(cfg.Params)
+	}
 	if err == nil {
 		// we got them db creds now create a connection
-		uguu := new(UguuSQL)
 		uguu.conn, err = sql.Open("postgres", url)
 		if err == nil {
 			// do all migrations
@@ -0,0 +1,224 @@
+//
+// copywrong you're mom 2015
+//
+
+package uguu
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/majestrate/chihaya/tracker/models"
+)
+
+func TestIsUniqueViolation(t *testing.T) {
+	var tests = []struct {
+		err       error
+		duplicate bool
+	}{
+		{&pq.Error{Code: "23505", Constraint: "torrents_infohash_key"}, true},
+		{&pq.Error{Code: "23503"}, false},
+		{errors.New("connection refused"), false},
+		{nil, false},
+	}
+
+	for _, tt := range tests {
+		if isUniqueViolation(tt.err) != tt.duplicate {
+			t.Errorf("%v: expected duplicate=%t", tt.err, tt.duplicate)
+		}
+	}
+}
+
+func TestTorrentStatus(t *testing.T) {
+	for _, status := range []models.TorrentStatus{
+		{},
+		{Approved: true},
+		{Approved: true, Trumped: true},
+		{Dead: true},
+		{Approved: true, Dead: true, Trumped: true},
+	} {
+		if decoded := decodeStatus(encodeStatus(status)); decoded != status {
+			t.Errorf("expected %+v to round trip, got %+v", status, decoded)
+		}
+	}
+}
+
+func TestBatchInsertQuery(t *testing.T) {
+	query := batchInsertQuery("INSERT INTO torrent_tags(tag_name, tag_torrent_id) VALUES", 3)
+	expected := "INSERT INTO torrent_tags(tag_name, tag_torrent_id) VALUES ($2, $1), ($3, $1), ($4, $1)"
+	if query != expected {
+		t.Errorf("expected %q, got %q", expected, query)
+	}
+}
+
+func TestSplitBatches(t *testing.T) {
+	files := make([]string, 25500)
+	for i := range files {
+		files[i] = "file" + strconv.Itoa(i)
+	}
+
+	batches := splitBatches(files, insertBatchSize)
+	if len(batches) != 26 || len(batches[25]) != 500 {
+		t.Fatalf("expected 25 full batches and one of 500, got %d batches", len(batches))
+	}
+	var n int
+	for _, batch := range batches {
+		if len(batch) > insertBatchSize || batch[0] != files[n] {
+			t.Fatalf("expected batch at %d to hold the next %d files", n, insertBatchSize)
+		}
+		n += len(batch)
+	}
+	if n != len(files) {
+		t.Errorf("expected every file to be batched, got %d", n)
+	}
+
+	if batches = splitBatches(nil, insertBatchSize); len(batches) != 0 {
+		t.Errorf("expected no batches for no files, got %d", len(batches))
+	}
+}
+
+func TestDiffTags(t *testing.T) {
+	added, removed := diffTags([]string{"iso", "linux", "old"}, []string{"linux", "iso", "amd64", "amd64"})
+	if strings.Join(added, ",") != "amd64" || strings.Join(removed, ",") != "old" {
+		t.Errorf("expected amd64 to be added and old removed, got %v and %v", added, removed)
+	}
+
+	if added, removed = diffTags(nil, nil); len(added) != 0 || len(removed) != 0 {
+		t.Errorf("expected no changes, got %v and %v", added, removed)
+	}
+}
+
+func TestUpdateColumns(t *testing.T) {
+	freeleech := true
+	sets, args := updateColumns(&models.TorrentUpdate{Freeleech: &freeleech}, 0)
+	if strings.Join(sets, ", ") != "torrent_freeleech = $1" || len(args) != 1 || args[0] != true {
+		t.Errorf("expected only the freeleech flag to be set, got %v with %v", sets, args)
+	}
+
+	category, desc := "linux", "new"
+	sets, args = updateColumns(&models.TorrentUpdate{Category: &category, Description: &desc}, 7)
+	if strings.Join(sets, ", ") != "torrent_cat_id = $1, torrent_description = $2" || len(args) != 2 || args[0] != int64(7) || args[1] != "new" {
+		t.Errorf("expected the category and description to be set, got %v with %v", sets, args)
+	}
+
+	if sets, args = updateColumns(&models.TorrentUpdate{}, 0); len(sets) != 0 || len(args) != 0 {
+		t.Errorf("expected nothing to be set, got %v with %v", sets, args)
+	}
+}
+
+func TestRowValues(t *testing.T) {
+	row := rowValues([]string{"torrent_id", "torrent_name", "torrent_private"}, []interface{}{int64(7), []byte("debian.iso"), true})
+	if row["torrent_id"] != int64(7) || row["torrent_name"] != "debian.iso" || row["torrent_private"] != true {
+		t.Errorf("expected the columns to be paired up with text as strings, got %v", row)
+	}
+}
+
+func TestExtractActivityResolution(t *testing.T) {
+	var tests = []struct {
+		params     map[string]string
+		resolution time.Duration
+		valid      bool
+	}{
+		{map[string]string{}, defaultActivityResolution, true},
+		{map[string]string{"activityResolution": "1h"}, time.Hour, true},
+		{map[string]string{"activityResolution": "0s"}, 0, true},
+		{map[string]string{"activityResolution": "-1m"}, 0, false},
+		{map[string]string{"activityResolution": "often"}, 0, false},
+	}
+
+	for _, tt := range tests {
+		resolution, err := extractActivityResolution(tt.params)
+		if (err == nil) != tt.valid || (tt.valid && resolution != tt.resolution) {
+			t.Errorf("%v: expected %s and valid=%t, got %s and %v", tt.params, tt.resolution, tt.valid, resolution, err)
+		}
+	}
+}
+
+func TestExtractAutoCreateCategories(t *testing.T) {
+	var tests = []struct {
+		params map[string]string
+		auto   bool
+		valid  bool
+	}{
+		{map[string]string{}, false, true},
+		{map[string]string{"autoCreateCategories": "true"}, true, true},
+		{map[string]string{"autoCreateCategories": "false"}, false, true},
+		{map[string]string{"autoCreateCategories": "yes please"}, false, false},
+	}
+
+	for _, tt := range tests {
+		auto, err := extractAutoCreateCategories(tt.params)
+		if (err == nil) != tt.valid || auto != tt.auto {
+			t.Errorf("%v: expected %t and valid=%t, got %t and %v", tt.params, tt.auto, tt.valid, auto, err)
+		}
+	}
+}
+
+// categories kept in memory, counting how many were created
+type memCategories struct {
+	ids     map[string]int64
+	created int
+}
+
+func (c *memCategories) find(name string) (int64, error) {
+	if id, ok := c.ids[name]; ok {
+		return id, nil
+	}
+	return 0, sql.ErrNoRows
+}
+
+func (c *memCategories) create(name string) (int64, error) {
+	if id, ok := c.ids[name]; ok {
+		return id, nil
+	}
+	c.created++
+	c.ids[name] = int64(len(c.ids) + 1)
+	return c.ids[name], nil
+}
+
+func TestTorrentCategory(t *testing.T) {
+	var tests = []struct {
+		auto    bool
+		names   []string
+		ids     []int64
+		created int
+		err     error
+	}{
+		{false, []string{"linux"}, []int64{1}, 0, nil},
+		{false, []string{"music"}, nil, 0, models.ErrUnknownCategory},
+		{true, []string{"music"}, []int64{2}, 1, nil},
+		{true, []string{"music", "music"}, []int64{2, 2}, 1, nil},
+		{true, []string{"music", "linux", "films"}, []int64{2, 1, 3}, 2, nil},
+		{true, []string{""}, nil, 0, models.ErrUnknownCategory},
+	}
+
+	for _, tt := range tests {
+		u := &UguuSQL{autoCreateCategories: tt.auto}
+		cats := &memCategories{ids: map[string]int64{"linux": 1}}
+		var ids []int64
+		var err error
+		for _, name := range tt.names {
+			var id int64
+			if id, err = u.torrentCategory(cats, name); err != nil {
+				break
+			}
+			ids = append(ids, id)
+		}
+		if err != tt.err || cats.created != tt.created || len(ids) != len(tt.ids) {
+			t.Errorf("%t %v: expected %v, %d created and %v, got %v, %d created and %v", tt.auto, tt.names, tt.ids, tt.created, tt.err, ids, cats.created, err)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != tt.ids[i] {
+				t.Errorf("%t %v: expected ids %v, got %v", tt.auto, tt.names, tt.ids, ids)
+				break
+			}
+		}
+	}
+}
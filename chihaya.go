@@ -9,6 +9,7 @@ package chihaya
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	"runtime"
@@ -25,6 +26,7 @@ import (
 
 	"github.com/majestrate/chihaya/stats"
 	"github.com/majestrate/chihaya/tracker"
+	"github.com/majestrate/chihaya/udp"
 
 	// uguu tracker backend
 	_ "github.com/majestrate/chihaya/backend/uguu"
@@ -42,9 +44,22 @@ func init() {
 	flag.StringVar(&configPath, "config", "", "path to the configuration file")
 }
 
+// maxServeAttempts is how many times in a row a server may fail to set up or
+// serve before the tracker gives up.
+const maxServeAttempts = 10
+
+var (
+	// serveRetryDelay is how long a server that failed is left down before
+	// it is set up again.
+	serveRetryDelay = time.Second
+	// serveResetAfter is how long a server has to serve for before its failed
+	// attempts stop counting.
+	serveResetAfter = time.Minute
+)
+
 type server interface {
 	Setup() error
-	Serve()
+	Serve() error
 	Stop()
 }
 
@@ -72,6 +87,10 @@ func Boot() {
 		glog.V(1).Infof("Loaded config file: %s", configPath)
 	}
 
+	if err = cfg.Validate(); err != nil {
+		glog.Fatalf("Invalid configuration: %s\n", err)
+	}
+
 	stats.DefaultStats = stats.New(cfg.StatsConfig)
 
 	tkr, err := tracker.New(cfg)
@@ -81,30 +100,28 @@ func Boot() {
 
 	var servers []server
 
+	httpServer := http.NewServer(lokinet.NewLokiNetwork(cfg.Lokinet.ResolverAddr), cfg, tkr)
 	if cfg.APIConfig.ListenAddr != "" {
-		servers = append(servers, api.NewServer(cfg, tkr))
+		servers = append(servers, api.NewServer(cfg, tkr, httpServer))
+	}
+	servers = append(servers, httpServer)
+	if cfg.UDPConfig.ListenAddr != "" || cfg.UDPConfig.ListenAddr6 != "" {
+		servers = append(servers, udp.NewServer(cfg, tkr))
 	}
-	servers = append(servers, http.NewServer(lokinet.NewLokiNetwork(cfg.Lokinet.ResolverAddr), cfg, tkr))
 	var wg sync.WaitGroup
 	for _, srv := range servers {
 		wg.Add(1)
 		// If you don't explicitly pass the server, every goroutine captures the
 		// last server in the list.
 		go func(srv server) {
-			for {
-				err := srv.Setup()
-				if err == nil {
-					defer wg.Done()
-					srv.Serve()
-				} else {
-					glog.Error("Setup: ", err)
-				}
-				time.Sleep(time.Second)
+			defer wg.Done()
+			if err := serve(srv); err != nil {
+				glog.Fatalf("Failed to serve: %s", err)
 			}
 		}(srv)
 	}
 
-	shutdown := make(chan os.Signal)
+	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
@@ -126,3 +143,32 @@ func Boot() {
 		glog.Errorf("Failed to shut down tracker cleanly: %s", err.Error())
 	}
 }
+
+// serve sets up and serves srv until it stops cleanly, retrying when either
+// fails. It gives up after maxServeAttempts failures in a row, counting
+// afresh once the server has served for serveResetAfter.
+func serve(srv server) error {
+	for attempt := 1; ; attempt++ {
+		err := srv.Setup()
+		if err == nil {
+			started := time.Now()
+			if err = srv.Serve(); err == nil {
+				return nil
+			}
+			if time.Since(started) > serveResetAfter {
+				// The server was up for a while, so this is a new
+				// failure rather than a failure to start, and the next
+				// attempt is the first.
+				glog.Errorf("Failed to serve after %s, restarting: %s", time.Since(started), err)
+				attempt = 0
+				time.Sleep(serveRetryDelay)
+				continue
+			}
+		}
+		if attempt >= maxServeAttempts {
+			return fmt.Errorf("gave up after %d failed attempts: %s", attempt, err)
+		}
+		glog.Errorf("Failed to serve (attempt %d of %d): %s", attempt, maxServeAttempts, err)
+		time.Sleep(serveRetryDelay)
+	}
+}
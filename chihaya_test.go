@@ -0,0 +1,64 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package chihaya
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// flakyServer is a server that fails to serve once for each of its runs,
+// after serving for as long as the run, and then serves cleanly.
+type flakyServer struct {
+	runs  []time.Duration
+	calls int
+}
+
+func (s *flakyServer) Setup() error { return nil }
+
+func (s *flakyServer) Serve() error {
+	s.calls++
+	if len(s.runs) == 0 {
+		return nil
+	}
+	time.Sleep(s.runs[0])
+	s.runs = s.runs[1:]
+	return errors.New("listener closed")
+}
+
+func (s *flakyServer) Stop() {}
+
+func TestServeRetries(t *testing.T) {
+	defer func(delay, reset time.Duration) {
+		serveRetryDelay, serveResetAfter = delay, reset
+	}(serveRetryDelay, serveResetAfter)
+	serveRetryDelay, serveResetAfter = 0, 20*time.Millisecond
+
+	// failures that come quickly, and ones after serving long enough to
+	// start counting afresh
+	quick := func(n int) []time.Duration { return make([]time.Duration, n) }
+	long := []time.Duration{30 * time.Millisecond}
+
+	var tests = []struct {
+		runs  []time.Duration
+		calls int
+		ok    bool
+	}{
+		{nil, 1, true},
+		{quick(maxServeAttempts - 1), maxServeAttempts, true},
+		{quick(maxServeAttempts), maxServeAttempts, false},
+		{append(append(quick(maxServeAttempts-1), long...), quick(maxServeAttempts-1)...), 2 * maxServeAttempts, true},
+		{append(long, quick(maxServeAttempts)...), maxServeAttempts + 1, false},
+	}
+
+	for i, tt := range tests {
+		srv := &flakyServer{runs: tt.runs}
+		err := serve(srv)
+		if (err == nil) != tt.ok || srv.calls != tt.calls {
+			t.Errorf("%d: expected %d attempts and ok=%t, got %d and %v", i, tt.calls, tt.ok, srv.calls, err)
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"time"
 )
@@ -51,11 +52,12 @@ type SubnetConfig struct {
 
 // NetConfig is the configuration used to tune networking behaviour.
 type NetConfig struct {
-	AllowIPSpoofing  bool   `json:"allowIPSpoofing"`
-	DualStackedPeers bool   `json:"dualStackedPeers"`
-	RealIPHeader     string `json:"realIPHeader"`
-	RespectAF        bool   `json:"respectAF"`
-	NumListeners     int    `json:"listeners"`
+	AllowIPSpoofing  bool     `json:"allowIPSpoofing"`
+	DualStackedPeers bool     `json:"dualStackedPeers"`
+	RealIPHeader     string   `json:"realIPHeader"`
+	TrustedProxies   []string `json:"trustedProxies"`
+	RespectAF        bool     `json:"respectAF"`
+	NumListeners     int      `json:"listeners"`
 	SubnetConfig
 }
 
@@ -65,6 +67,7 @@ type StatsConfig struct {
 	IncludeMem        bool     `json:"includeMemStats"`
 	VerboseMem        bool     `json:"verboseMemStats"`
 	MemUpdateInterval Duration `json:"memStatsInterval"`
+	ConnectionStates  bool     `json:"connectionStateStats"`
 }
 
 // WhitelistConfig is the configuration used enable and store a whitelist of
@@ -79,13 +82,67 @@ type TrackerConfig struct {
 	CreateOnAnnounce      bool     `json:"createOnAnnounce"`
 	PrivateEnabled        bool     `json:"privateEnabled"`
 	FreeleechEnabled      bool     `json:"freeleechEnabled"`
+	AnonymousUserID       uint64   `json:"anonymousUserID"`
+	DisabledUserMessage   string   `json:"disabledUserMessage"`
 	PurgeInactiveTorrents bool     `json:"purgeInactiveTorrents"`
+	InactiveTorrentAge    Duration `json:"inactiveTorrentAge"`
+	StrictEvents          bool     `json:"strictEvents"`
+	DryRunEnabled         bool     `json:"dryRunEnabled"`
 	Announce              Duration `json:"announce"`
 	MinAnnounce           Duration `json:"minAnnounce"`
+	MaxAnnounce           Duration `json:"maxAnnounce"`
+	MinInterval           Duration `json:"minInterval"`
+	MaxInterval           Duration `json:"maxInterval"`
+	LoadConnections       int64    `json:"loadConnections"`
+	LoadRequestRate       float64  `json:"loadRequestRate"`
 	ReapInterval          Duration `json:"reapInterval"`
 	ReapRatio             float64  `json:"reapRatio"`
+	PeerTTL               Duration `json:"peerTTL"`
+	ReapBatchSize         int      `json:"reapBatchSize"`
 	NumWantFallback       int      `json:"defaultNumWant"`
+	MaxResponseSize       int      `json:"maxResponseSize"`
+	MinSeedersToLeech     int      `json:"minSeedersToLeech"`
+	MaxActiveLeech        int      `json:"maxActiveLeech"`
+	RequireApproval       bool     `json:"requireApproval"`
+	RequirePrivateFlag    bool     `json:"requirePrivateFlag"`
+	WebSeeds              []string `json:"webSeeds"`
+	DHTNodes              []string `json:"dhtNodes"`
+	PreferredSources      []string `json:"preferredSources"`
+	MaxPreferredSources   int      `json:"maxPreferredSources"`
+	BlockedPorts          []string `json:"blockedPorts"`
+	HideBlockedPorts      bool     `json:"hideBlockedPorts"`
+	InfohashBlocklist     string   `json:"infohashBlocklist"`
+	PeerIDReuseWindow     Duration `json:"peerIDReuseWindow"`
+	RejectPeerIDReuse     bool     `json:"rejectPeerIDReuse"`
 	TorrentMapShards      int      `json:"torrentMapShards"`
+	MaxTorrentAnnounces   int      `json:"maxTorrentAnnounces"`
+	TorrentAnnounceWait   Duration `json:"torrentAnnounceWait"`
+	LookupCacheSize       int      `json:"lookupCacheSize"`
+	LookupCacheTTL        Duration `json:"lookupCacheTTL"`
+	PeerListCacheTTL      Duration `json:"peerListCacheTTL"`
+	PeerListCacheChanges  int      `json:"peerListCacheChanges"`
+	HashPeerKeys          bool     `json:"hashPeerKeys"`
+	PeerKeySecret         string   `json:"peerKeySecret"`
+	AuditLog              string   `json:"auditLog"`
+	AuditLogMaxSize       int64    `json:"auditLogMaxSize"`
+	AuditLogMaxAge        Duration `json:"auditLogMaxAge"`
+	MaxTorrentFiles       int      `json:"maxTorrentFiles"`
+	MaxTorrentTags        int      `json:"maxTorrentTags"`
+	MaxTorrentNameLength  int      `json:"maxTorrentNameLength"`
+	MaxTorrentDescLength  int      `json:"maxTorrentDescLength"`
+	ScrapeRateLimit       float64  `json:"scrapeRateLimit"`
+	ScrapeRateBurst       int      `json:"scrapeRateBurst"`
+	BackendRetryIn        Duration `json:"backendRetryIn"`
+	BackendConnectRetries int      `json:"backendConnectRetries"`
+	BackendConnectWait    Duration `json:"backendConnectWait"`
+	SlowRequestThreshold  Duration `json:"slowRequestThreshold"`
+	AnnounceAuthURL       string   `json:"announceAuthURL"`
+	AnnounceAuthTimeout   Duration `json:"announceAuthTimeout"`
+	AnnounceAuthCacheSize int      `json:"announceAuthCacheSize"`
+	AnnounceAuthCacheTTL  Duration `json:"announceAuthCacheTTL"`
+
+	// the number of addresses a user may be in a torrent's swarm from
+	MaxPeersPerUserPerTorrent int `json:"maxPeersPerUserPerTorrent"`
 
 	NetConfig
 	WhitelistConfig
@@ -98,21 +155,41 @@ type APIConfig struct {
 	ReadTimeout    Duration `json:"apiReadTimeout"`
 	WriteTimeout   Duration `json:"apiWriteTimeout"`
 	ListenLimit    int      `json:"apiListenLimit"`
+	Expvar         bool     `json:"apiExpvar"`
+	AdminToken     string   `json:"apiAdminToken"`
+	StatsOrigins   []string `json:"apiStatsOrigins"`
+	TorrentFileDir string   `json:"apiTorrentFileDir"`
+	BackupDir      string   `json:"apiBackupDir"`
+
+	TLSCert           string `json:"apiTLSCert"`
+	TLSKey            string `json:"apiTLSKey"`
+	ClientCA          string `json:"apiClientCA"`
+	RequireClientCert bool   `json:"apiRequireClientCert"`
 }
 
 // HTTPConfig is the configuration for the HTTP protocol.
 type HTTPConfig struct {
-	ListenAddr     string   `json:"httpListenAddr"`
-	RequestTimeout Duration `json:"httpRequestTimeout"`
-	ReadTimeout    Duration `json:"httpReadTimeout"`
-	WriteTimeout   Duration `json:"httpWriteTimeout"`
-	ListenLimit    int      `json:"httpListenLimit"`
+	ListenAddr        string   `json:"httpListenAddr"`
+	RequestTimeout    Duration `json:"httpRequestTimeout"`
+	ReadTimeout       Duration `json:"httpReadTimeout"`
+	WriteTimeout      Duration `json:"httpWriteTimeout"`
+	ListenLimit       int      `json:"httpListenLimit"`
+	PerIPLimit        int      `json:"httpPerIPLimit"`
+	PathPrefix        string   `json:"httpPathPrefix"`
+	HTMLIndex         bool     `json:"httpHTMLIndex"`
+	DisableIndex      bool     `json:"httpDisableIndex"`
+	AnonymizeLogs     bool     `json:"httpAnonymizeLogs"`
+	AnnounceBatchSize int      `json:"httpAnnounceBatchSize"`
 }
 
 // UDPConfig is the configuration for the UDP protocol.
 type UDPConfig struct {
-	ListenAddr     string `json:"udpListenAddr"`
-	ReadBufferSize int    `json:"udpReadBufferSize"`
+	ListenAddr       string   `json:"udpListenAddr"`
+	ListenAddr6      string   `json:"udpListenAddr6"`
+	ReadBufferSize   int      `json:"udpReadBufferSize"`
+	ConnectionMaxAge Duration `json:"udpConnectionMaxAge"`
+	ReplayWindow     Duration `json:"udpReplayWindow"`
+	ReplayCacheSize  int      `json:"udpReplayCacheSize"`
 }
 
 // i2cp options for sam connections
@@ -132,6 +209,16 @@ type SamConfig struct {
 	Opts    samOpts
 	Session string
 	Keyfile string
+	// number of timestamped copies of the keyfile to keep next to it
+	KeyfileBackups int
+	// number of accepted connections buffered until the tracker takes them
+	// a larger backlog rides out bursts of connections instead of stalling
+	// the accept loops, at the cost of memory and of connections waiting
+	// longer to be served
+	AcceptBacklog int
+	// number of bridge connections kept ready for accepting, so accepts
+	// don't wait on a new connection to the bridge first
+	AcceptPoolSize int
 }
 
 // I2PConfig is the configuration for i2p tracker mode options
@@ -139,6 +226,12 @@ type I2PConfig struct {
 	SAM       SamConfig
 	Listeners int
 	Enabled   bool
+	// number of name lookups to remember, 0 disables caching them
+	LookupCacheSize int
+	// how long resolved names are remembered
+	LookupCacheTTL Duration
+	// how long names the bridge couldn't resolve are remembered
+	LookupNegativeTTL Duration
 }
 
 type LokinetConfig struct {
@@ -168,20 +261,61 @@ var DefaultConfig = Config{
 			Session: "chihaya-i2p",
 			Opts:    make(map[string]string),
 			Keyfile: "chihaya-i2p-privkey.dat",
+
+			KeyfileBackups: 3,
+			AcceptBacklog:  128,
+			AcceptPoolSize: 4,
 		},
-		Enabled: false,
+		Enabled:           false,
+		LookupCacheSize:   1024,
+		LookupCacheTTL:    Duration{10 * time.Minute},
+		LookupNegativeTTL: Duration{30 * time.Second},
 	},
 	TrackerConfig: TrackerConfig{
 		CreateOnAnnounce:      true,
 		PrivateEnabled:        false,
 		FreeleechEnabled:      false,
+		AnonymousUserID:       0,
 		PurgeInactiveTorrents: true,
+		StrictEvents:          false,
+		DryRunEnabled:         false,
 		Announce:              Duration{30 * time.Minute},
 		MinAnnounce:           Duration{15 * time.Minute},
+		MaxAnnounce:           Duration{2 * time.Hour},
+		MinInterval:           Duration{0},
+		MaxInterval:           Duration{0},
+		LoadConnections:       0,
+		LoadRequestRate:       0,
 		ReapInterval:          Duration{60 * time.Second},
 		ReapRatio:             1.25,
+		PeerTTL:               Duration{0},
+		ReapBatchSize:         100,
 		NumWantFallback:       50,
+		MinSeedersToLeech:     0,
+		RequireApproval:       false,
+		RequirePrivateFlag:    false,
+		MaxPreferredSources:   5,
 		TorrentMapShards:      1,
+		MaxTorrentAnnounces:   0,
+		TorrentAnnounceWait:   Duration{100 * time.Millisecond},
+		LookupCacheSize:       0,
+		LookupCacheTTL:        Duration{10 * time.Second},
+		PeerListCacheTTL:      Duration{0},
+		PeerListCacheChanges:  0,
+		HashPeerKeys:          false,
+		MaxTorrentFiles:       10000,
+		MaxTorrentTags:        64,
+		MaxTorrentNameLength:  1024,
+		MaxTorrentDescLength:  65536,
+		ScrapeRateLimit:       0,
+		ScrapeRateBurst:       10,
+		BackendRetryIn:        Duration{10 * time.Minute},
+		BackendConnectRetries: 0,
+		BackendConnectWait:    Duration{time.Second},
+		SlowRequestThreshold:  Duration{0},
+		AnnounceAuthTimeout:   Duration{5 * time.Second},
+		AnnounceAuthCacheSize: 10000,
+		AnnounceAuthCacheTTL:  Duration{time.Minute},
 
 		NetConfig: NetConfig{
 			AllowIPSpoofing:  true,
@@ -210,7 +344,10 @@ var DefaultConfig = Config{
 	},
 
 	UDPConfig: UDPConfig{
-		ListenAddr: "localhost:6882",
+		ListenAddr:       "localhost:6882",
+		ConnectionMaxAge: Duration{2 * time.Minute},
+		ReplayWindow:     Duration{0},
+		ReplayCacheSize:  65536,
 	},
 
 	DriverConfig: DriverConfig{
@@ -252,3 +389,107 @@ func Decode(r io.Reader) (*Config, error) {
 	err := json.NewDecoder(r).Decode(&conf)
 	return &conf, err
 }
+
+// redacted replaces secret values in a sanitized configuration.
+const redacted = "<redacted>"
+
+// Sanitized returns a copy of the configuration that is safe to show to
+// operators, with secrets such as the peer key secret, the API admin token,
+// the path of the I2P private key, and the announce authorization URL and
+// driver parameters, which may hold credentials, redacted.
+func (c *Config) Sanitized() Config {
+	sanitized := *c
+	if sanitized.PeerKeySecret != "" {
+		sanitized.PeerKeySecret = redacted
+	}
+	if sanitized.APIConfig.AdminToken != "" {
+		sanitized.APIConfig.AdminToken = redacted
+	}
+	if sanitized.APIConfig.TLSKey != "" {
+		sanitized.APIConfig.TLSKey = redacted
+	}
+	if sanitized.AnnounceAuthURL != "" {
+		sanitized.AnnounceAuthURL = redacted
+	}
+	if sanitized.I2P.SAM.Keyfile != "" {
+		sanitized.I2P.SAM.Keyfile = redacted
+	}
+	if c.DriverConfig.Params != nil {
+		sanitized.DriverConfig.Params = make(map[string]string, len(c.DriverConfig.Params))
+		for k := range c.DriverConfig.Params {
+			sanitized.DriverConfig.Params[k] = redacted
+		}
+	}
+	return sanitized
+}
+
+// Validate checks a Config for settings that can't work together, so that
+// the tracker can refuse to start instead of failing in the background.
+func (c *Config) Validate() error {
+	if c.APIConfig.ListenAddr != "" && listenAddrsOverlap(c.APIConfig.ListenAddr, c.HTTPConfig.ListenAddr) {
+		return fmt.Errorf("apiListenAddr %q and httpListenAddr %q use the same address",
+			c.APIConfig.ListenAddr, c.HTTPConfig.ListenAddr)
+	}
+	if (c.APIConfig.TLSCert == "") != (c.APIConfig.TLSKey == "") {
+		return errors.New("apiTLSCert and apiTLSKey must be set together")
+	}
+	if c.APIConfig.ClientCA != "" && c.APIConfig.TLSCert == "" {
+		return errors.New("apiClientCA needs the API served over TLS with apiTLSCert and apiTLSKey")
+	}
+	if c.APIConfig.RequireClientCert && c.APIConfig.ClientCA == "" {
+		return errors.New("apiRequireClientCert needs an apiClientCA to check certificates against")
+	}
+	if c.MinInterval.Duration > 0 && c.MaxInterval.Duration > 0 && c.MinInterval.Duration > c.MaxInterval.Duration {
+		return fmt.Errorf("minInterval %s is longer than maxInterval %s", c.MinInterval.Duration, c.MaxInterval.Duration)
+	}
+	if c.BackendConnectWait.Duration <= 0 {
+		return fmt.Errorf("backendConnectWait %s must be positive", c.BackendConnectWait.Duration)
+	}
+	if c.MaxInterval.Duration > 0 && c.MaxInterval.Duration < c.MinAnnounce.Duration {
+		return fmt.Errorf("maxInterval %s is shorter than minAnnounce %s", c.MaxInterval.Duration, c.MinAnnounce.Duration)
+	}
+	// Peers told to wait longer than they are kept would be dropped before
+	// their next announce.
+	ttl := c.PeerTTL.Duration
+	if ttl <= 0 {
+		ttl = time.Duration(float64(c.MinAnnounce.Duration) * c.ReapRatio)
+	}
+	if c.MinInterval.Duration > ttl {
+		return fmt.Errorf("minInterval %s is longer than the %s peers are kept after their last announce",
+			c.MinInterval.Duration, ttl)
+	}
+	if c.UDPConfig.ListenAddr != "" && c.UDPConfig.ListenAddr6 != "" &&
+		isDualStackAddr(c.UDPConfig.ListenAddr) && listenAddrsOverlap(c.UDPConfig.ListenAddr, c.UDPConfig.ListenAddr6) {
+		return fmt.Errorf("udpListenAddr %q already accepts IPv6 on the port of udpListenAddr6 %q",
+			c.UDPConfig.ListenAddr, c.UDPConfig.ListenAddr6)
+	}
+	return nil
+}
+
+// listenAddrsOverlap is true if listening on both addresses would try to bind
+// the same port twice.
+func listenAddrsOverlap(a, b string) bool {
+	hostA, portA, errA := net.SplitHostPort(a)
+	hostB, portB, errB := net.SplitHostPort(b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+
+	// Port 0 picks a free port.
+	if portA != portB || portA == "0" {
+		return false
+	}
+	return hostA == hostB || isWildcardHost(hostA) || isWildcardHost(hostB)
+}
+
+// isDualStackAddr is true if listening on addr accepts both IPv4 and IPv6.
+func isDualStackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	return err == nil && (host == "" || host == "::")
+}
+
+// isWildcardHost is true if host listens on all addresses.
+func isWildcardHost(host string) bool {
+	ip := net.ParseIP(host)
+	return host == "" || (ip != nil && ip.IsUnspecified())
+}
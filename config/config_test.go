@@ -0,0 +1,224 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package config
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestValidateListenAddrs(t *testing.T) {
+	var tests = []struct {
+		api, http string
+		valid     bool
+	}{
+		{"localhost:6880", "localhost:6881", true},
+		{"", "localhost:6881", true},
+		{"localhost:0", "localhost:0", true},
+		{"localhost:6881", "localhost:6881", false},
+		{":6881", "127.0.0.1:6881", false},
+		{"127.0.0.1:6881", "[::]:6881", false},
+		{"127.0.0.1:6881", "10.0.0.1:6881", true},
+	}
+
+	for _, tt := range tests {
+		cfg := DefaultConfig
+		cfg.APIConfig.ListenAddr = tt.api
+		cfg.HTTPConfig.ListenAddr = tt.http
+		if err := cfg.Validate(); (err == nil) != tt.valid {
+			t.Errorf("api %q and http %q: expected valid=%t, got %v", tt.api, tt.http, tt.valid, err)
+		}
+	}
+}
+
+func TestValidateAPITLS(t *testing.T) {
+	var tests = []struct {
+		cert, key, ca string
+		require       bool
+		valid         bool
+	}{
+		{"", "", "", false, true},
+		{"api.crt", "api.key", "", false, true},
+		{"api.crt", "api.key", "clients.crt", true, true},
+		{"api.crt", "", "", false, false},
+		{"", "", "clients.crt", false, false},
+		{"api.crt", "api.key", "", true, false},
+	}
+
+	for _, tt := range tests {
+		cfg := DefaultConfig
+		cfg.APIConfig.TLSCert = tt.cert
+		cfg.APIConfig.TLSKey = tt.key
+		cfg.APIConfig.ClientCA = tt.ca
+		cfg.APIConfig.RequireClientCert = tt.require
+		if err := cfg.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%+v: expected valid=%t, got %v", tt, tt.valid, err)
+		}
+	}
+}
+
+func TestValidateUDPListenAddrs(t *testing.T) {
+	var tests = []struct {
+		udp, udp6 string
+		valid     bool
+	}{
+		{"0.0.0.0:6882", "[::]:6882", true},
+		{"[::]:6882", "", true},
+		{"[::]:6882", "[::]:6882", false},
+		{":6882", "[::1]:6882", false},
+		{"[::]:6882", "[::]:6883", true},
+	}
+
+	for _, tt := range tests {
+		cfg := DefaultConfig
+		cfg.UDPConfig.ListenAddr = tt.udp
+		cfg.UDPConfig.ListenAddr6 = tt.udp6
+		if err := cfg.Validate(); (err == nil) != tt.valid {
+			t.Errorf("udp %q and udp6 %q: expected valid=%t, got %v", tt.udp, tt.udp6, tt.valid, err)
+		}
+	}
+}
+
+func TestValidateIntervalBounds(t *testing.T) {
+	var tests = []struct {
+		min, max time.Duration
+		valid    bool
+	}{
+		{0, 0, true},
+		{time.Hour, 0, true},
+		{0, time.Minute, true},
+		{time.Minute, time.Hour, true},
+		{time.Hour, time.Hour, true},
+		{time.Hour, time.Minute, false},
+	}
+
+	for _, tt := range tests {
+		cfg := DefaultConfig
+		cfg.MinAnnounce = Duration{time.Minute}
+		cfg.PeerTTL = Duration{2 * time.Hour}
+		cfg.MinInterval = Duration{tt.min}
+		cfg.MaxInterval = Duration{tt.max}
+		if err := cfg.Validate(); (err == nil) != tt.valid {
+			t.Errorf("minInterval %s and maxInterval %s: expected valid=%t, got %v", tt.min, tt.max, tt.valid, err)
+		}
+	}
+}
+
+func TestValidateIntervalsAgainstReaping(t *testing.T) {
+	var tests = []struct {
+		min, max, peerTTL time.Duration
+		valid             bool
+	}{
+		{0, 0, 0, true},
+		{15 * time.Minute, 0, 0, true},
+		{20 * time.Minute, 0, 0, false},
+		{20 * time.Minute, 0, 30 * time.Minute, true},
+		{20 * time.Minute, 0, 10 * time.Minute, false},
+		{0, 15 * time.Minute, 0, true},
+		{0, 10 * time.Minute, 0, false},
+	}
+
+	// Peers are kept for 1.25 times minAnnounce, 18m45s, without peerTTL.
+	for _, tt := range tests {
+		cfg := DefaultConfig
+		cfg.MinAnnounce = Duration{15 * time.Minute}
+		cfg.ReapRatio = 1.25
+		cfg.PeerTTL = Duration{tt.peerTTL}
+		cfg.MinInterval = Duration{tt.min}
+		cfg.MaxInterval = Duration{tt.max}
+		if err := cfg.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%+v: expected valid=%t, got %v", tt, tt.valid, err)
+		}
+	}
+}
+
+func TestValidateBackendConnectWait(t *testing.T) {
+	for _, wait := range []time.Duration{0, -time.Second} {
+		cfg := DefaultConfig
+		cfg.BackendConnectWait = Duration{wait}
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("expected backendConnectWait %s to be rejected", wait)
+		}
+	}
+}
+
+func TestSanitized(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.PeerKeySecret = "hunter2"
+	cfg.APIConfig.AdminToken = "hunter3"
+	cfg.DriverConfig.Params = map[string]string{"dsn": "postgres://user:hunter2@db/chihaya"}
+
+	sanitized := cfg.Sanitized()
+	if sanitized.PeerKeySecret != redacted || sanitized.APIConfig.AdminToken != redacted ||
+		sanitized.DriverConfig.Params["dsn"] != redacted {
+		t.Errorf("expected secrets to be redacted, got %q, %q and %v",
+			sanitized.PeerKeySecret, sanitized.APIConfig.AdminToken, sanitized.DriverConfig.Params)
+	}
+	if cfg.PeerKeySecret != "hunter2" || cfg.APIConfig.AdminToken != "hunter3" || cfg.DriverConfig.Params["dsn"] == redacted {
+		t.Error("expected the original configuration to be left alone")
+	}
+}
+
+// secretField matches the names of fields that may hold a secret.
+var secretField = regexp.MustCompile(`(?i)secret|token|password|key(file)?$|authurl|dsn|params`)
+
+// TestSanitizedRedactsAllSecrets fills in every string field of a Config and
+// checks that any field named like a secret is redacted, so that a new secret
+// can't be exposed by forgetting to add it to Sanitized.
+func TestSanitizedRedactsAllSecrets(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.DriverConfig.Params = map[string]string{"url": "hunter2"}
+	fillStrings(reflect.ValueOf(&cfg).Elem())
+
+	sanitized := cfg.Sanitized()
+	checkRedacted(t, reflect.ValueOf(sanitized), "Config")
+}
+
+func fillStrings(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" {
+				fillStrings(v.Field(i))
+			}
+		}
+	case reflect.String:
+		v.SetString("hunter2")
+	}
+}
+
+func checkRedacted(t *testing.T, v reflect.Value, path string) {
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			name := path + "." + field.Name
+			if secretField.MatchString(field.Name) {
+				checkSecret(t, v.Field(i), name)
+			}
+			checkRedacted(t, v.Field(i), name)
+		}
+	}
+}
+
+func checkSecret(t *testing.T, v reflect.Value, name string) {
+	switch v.Kind() {
+	case reflect.String:
+		if v.String() != redacted {
+			t.Errorf("expected %s to be redacted, got %q", name, v.String())
+		}
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			if value := v.MapIndex(k); value.Kind() == reflect.String && value.String() != redacted {
+				t.Errorf("expected %s[%v] to be redacted, got %q", name, k, value.String())
+			}
+		}
+	}
+}
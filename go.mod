@@ -12,5 +12,6 @@ require (
 	github.com/pushrax/flatjson v0.0.0-20150101170617-86044f1c998d
 	github.com/tylerb/graceful v0.0.0-20150422221042-0c011221e91b
 	github.com/zeebo/bencode v1.0.0
-	golang.org/x/net v0.0.0-20150423015207-d175081df37e
+	golang.org/x/crypto v0.21.0
+	golang.org/x/net v0.21.0
 )
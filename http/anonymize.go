@@ -0,0 +1,79 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// An Anonymizer replaces identifying values, such as peer IDs, infohashes and
+// passkeys, before requests are logged.
+type Anonymizer interface {
+	Anonymize(value string) string
+}
+
+// anonymizedParams are the query parameters that identify a peer or torrent.
+var anonymizedParams = []string{"info_hash", "peer_id"}
+
+// hmacAnonymizer replaces values by a keyed hash. The key is random for each
+// run, so the same value is logged the same way for as long as the tracker
+// runs, but can't be recovered from the logs.
+type hmacAnonymizer struct {
+	key []byte
+}
+
+func newHMACAnonymizer() (*hmacAnonymizer, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return &hmacAnonymizer{key}, nil
+}
+
+func (a *hmacAnonymizer) Anonymize(value string) string {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// SetAnonymizer replaces the anonymizer used for logging requests. A nil
+// anonymizer logs requests as they are.
+func (s *Server) SetAnonymizer(a Anonymizer) {
+	s.anonymizer = a
+}
+
+// requestString describes a request for the logs, with the full query string
+// at verbosity 3 and above.
+func (s *Server) requestString(r *http.Request, p httprouter.Params, full bool) string {
+	path := r.URL.Path
+	if s.anonymizer == nil {
+		if full {
+			path = r.URL.RequestURI()
+		}
+		return path + " " + r.RemoteAddr
+	}
+
+	if passkey := p.ByName("passkey"); passkey != "" {
+		path = strings.Replace(path, passkey, s.anonymizer.Anonymize(passkey), 1)
+	}
+	if full && r.URL.RawQuery != "" {
+		query := r.URL.Query()
+		for _, param := range anonymizedParams {
+			values := query[param]
+			for i := range values {
+				values[i] = s.anonymizer.Anonymize(values[i])
+			}
+		}
+		path += "?" + query.Encode()
+	}
+	return path + " " + r.RemoteAddr
+}
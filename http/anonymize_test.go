@@ -0,0 +1,42 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package http
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestRequestStringAnonymized(t *testing.T) {
+	a, err := newHMACAnonymizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{anonymizer: a}
+
+	r := httptest.NewRequest("GET", "/users/secretpasskey/announce?info_hash=abcdefghij0123456789&peer_id=-TR2820-identifying&port=6881", nil)
+	p := httprouter.Params{{Key: "passkey", Value: "secretpasskey"}}
+
+	full := s.requestString(r, p, true)
+	for _, sensitive := range []string{"secretpasskey", "abcdefghij0123456789", "identifying"} {
+		if strings.Contains(full, sensitive) {
+			t.Errorf("expected %q to be anonymized, got %q", sensitive, full)
+		}
+	}
+	if !strings.Contains(full, "port=6881") {
+		t.Errorf("expected other parameters to be logged as is, got %q", full)
+	}
+	if again := s.requestString(r, p, true); again != full {
+		t.Errorf("expected the same request to be logged the same way, got %q and %q", full, again)
+	}
+
+	s.anonymizer = nil
+	if plain := s.requestString(r, p, true); !strings.Contains(plain, "peer_id=-TR2820-identifying") {
+		t.Errorf("expected requests to be logged as is without an anonymizer, got %q", plain)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package http
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/majestrate/chihaya/tracker"
+	"github.com/majestrate/chihaya/tracker/models"
+)
+
+// errBatchTooLarge is returned for batch announces of more torrents than
+// httpAnnounceBatchSize.
+var errBatchTooLarge = models.ClientError("too many torrents in batch announce")
+
+// A batch announce has the parameters of a regular announce, except that
+// info_hash, left, uploaded, downloaded and the optional corrupt are
+// repeated once per torrent, in the same order. event may be given once for
+// all torrents or once per torrent. The response holds the announce
+// response, or failure, of each torrent under its infohash in a files dict,
+// like a scrape response.
+
+func (s *Server) serveAnnounceBatch(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
+	writer := newWriter(w, r, s.config.MaxResponseSize)
+	anns, err := s.newAnnounceBatch(r, p)
+	if err != nil {
+		return handleTorrentError(err, writer)
+	}
+
+	entries := make([]*batchEntry, len(anns))
+	writers := make([]tracker.Writer, len(anns))
+	for i := range entries {
+		entries[i] = &batchEntry{json: writer.JSON, maxSize: writer.MaxResponseSize}
+		writers[i] = entries[i]
+	}
+	if err = s.tracker.HandleAnnounceBatch(anns, writers); err != nil {
+		return handleTorrentError(err, writer)
+	}
+	return handleTorrentError(writeBatch(writer, anns, entries), writer)
+}
+
+// newAnnounceBatch parses a batch announce into an announce per torrent.
+func (s *Server) newAnnounceBatch(r *http.Request, p httprouter.Params) ([]*models.Announce, error) {
+	// The parameters shared by all torrents are parsed as for a regular
+	// announce, which also checks the last torrent's parameters.
+	shared, err := s.newAnnounce(r, p)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return nil, models.ErrMalformedRequest
+	}
+	infohashes := values["info_hash"]
+	if len(infohashes) > s.config.HTTPConfig.AnnounceBatchSize {
+		return nil, errBatchTooLarge
+	}
+	events := values["event"]
+	if len(events) > 1 && len(events) != len(infohashes) {
+		return nil, models.ErrMalformedRequest
+	}
+
+	seen := make(map[string]bool, len(infohashes))
+	anns := make([]*models.Announce, len(infohashes))
+	for i, infohash := range infohashes {
+		if (len(infohash) != infohashLength && len(infohash) != infohashV2Length) || seen[infohash] {
+			return nil, models.ErrMalformedRequest
+		}
+		seen[infohash] = true
+
+		ann := *shared
+		ann.Infohash = infohash
+		if len(events) > 1 {
+			ann.Event = events[i]
+		}
+		if ann.Left, err = batchUint64(values, "left", i, len(infohashes)); err != nil {
+			return nil, err
+		}
+		if ann.Uploaded, err = batchUint64(values, "uploaded", i, len(infohashes)); err != nil {
+			return nil, err
+		}
+		if ann.Downloaded, err = batchUint64(values, "downloaded", i, len(infohashes)); err != nil {
+			return nil, err
+		}
+		ann.Corrupt = 0
+		if _, ok := values["corrupt"]; ok {
+			if ann.Corrupt, err = batchUint64(values, "corrupt", i, len(infohashes)); err != nil {
+				return nil, err
+			}
+			if ann.Corrupt > ann.Downloaded {
+				ann.Corrupt = ann.Downloaded
+			}
+		}
+		anns[i] = &ann
+	}
+	return anns, nil
+}
+
+// batchUint64 parses the i-th of the n values of a parameter repeated for each
+// torrent.
+func batchUint64(values url.Values, key string, i, n int) (uint64, error) {
+	if len(values[key]) != n {
+		return 0, models.ErrMalformedRequest
+	}
+	v, err := strconv.ParseUint(values[key][i], 10, 64)
+	if err != nil {
+		return 0, models.ErrMalformedRequest
+	}
+	return v, nil
+}
+
+// batchEntry is the tracker.Writer for one torrent of a batch announce. It
+// keeps the torrent's response until the whole batch is written.
+type batchEntry struct {
+	json    bool
+	maxSize int
+	body    []byte      // bencoded response
+	value   interface{} // JSON response
+}
+
+func (e *batchEntry) WriteAnnounce(res *models.AnnounceResponse) error {
+	if e.json {
+		e.value = newJSONAnnounce(truncateJSONAnnounce(res, e.maxSize))
+	} else {
+		e.body = appendAnnounce(nil, truncateAnnounce(res, e.maxSize))
+	}
+	return nil
+}
+
+func (e *batchEntry) WriteError(err error) error {
+	var retryIn int64
+	if retryable, ok := err.(*models.RetryableError); ok {
+		retryIn = retryMinutes(retryable.RetryIn)
+	}
+
+	if e.json {
+		res := map[string]interface{}{"failure reason": err.Error()}
+		if retryIn > 0 {
+			res["retry in"] = retryIn
+		}
+		e.value = res
+		return nil
+	}
+
+	b := append(e.body[:0], 'd')
+	b = appendString(b, "failure reason")
+	b = appendString(b, err.Error())
+	if retryIn > 0 {
+		b = appendString(b, "retry in")
+		b = appendInt(b, retryIn)
+	}
+	e.body = append(b, 'e')
+	return nil
+}
+
+func (e *batchEntry) WriteScrape(*models.ScrapeResponse) error {
+	return errors.New("http: scrape written to a batch announce")
+}
+
+// writeBatch writes the responses of a batch announce under the infohash of
+// each torrent.
+func writeBatch(w *Writer, anns []*models.Announce, entries []*batchEntry) error {
+	if w.JSON {
+		files := make(map[string]interface{}, len(anns))
+		for i, ann := range anns {
+			files[hex.EncodeToString([]byte(ann.Infohash))] = entries[i].value
+		}
+		return writeJSON(w, map[string]interface{}{"files": files})
+	}
+
+	order := make([]int, len(anns))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return anns[order[i]].Infohash < anns[order[j]].Infohash })
+
+	buf := responsePool.Get().(*[]byte)
+	defer responsePool.Put(buf)
+
+	b := append((*buf)[:0], 'd')
+	b = appendString(b, "files")
+	b = append(b, 'd')
+	for _, i := range order {
+		b = appendString(b, anns[i].Infohash)
+		b = append(b, entries[i].body...)
+	}
+	b = append(b, 'e', 'e')
+	*buf = b
+
+	return writeBody(w, "text/plain", b)
+}
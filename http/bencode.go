@@ -0,0 +1,181 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package http
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/majestrate/chihaya/tracker/models"
+)
+
+// The functions in this file append bencoded responses directly to a byte
+// slice, writing dict keys in their required sorted order, so that the hot
+// announce and scrape paths don't need to build and box an intermediate map
+// for every request.
+
+// responsePool holds the buffers responses are serialized into.
+var responsePool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 512)
+		return &buf
+	},
+}
+
+func appendString(b []byte, s string) []byte {
+	b = strconv.AppendInt(b, int64(len(s)), 10)
+	b = append(b, ':')
+	return append(b, s...)
+}
+
+func appendInt(b []byte, i int64) []byte {
+	b = append(b, 'i')
+	b = strconv.AppendInt(b, i, 10)
+	return append(b, 'e')
+}
+
+func appendUint(b []byte, u uint64) []byte {
+	b = append(b, 'i')
+	b = strconv.AppendUint(b, u, 10)
+	return append(b, 'e')
+}
+
+// appendAnnounce appends the bencoded dict for an AnnounceResponse.
+func appendAnnounce(b []byte, res *models.AnnounceResponse) []byte {
+	compact := int64(0)
+	if res.Compact {
+		compact = 1
+	}
+
+	b = append(b, 'd')
+	b = appendString(b, "compact")
+	b = appendInt(b, compact)
+	b = appendString(b, "complete")
+	b = appendInt(b, int64(res.Complete))
+	b = appendString(b, "incomplete")
+	b = appendInt(b, int64(res.Incomplete))
+	b = appendString(b, "interval")
+	b = appendInt(b, res.Interval)
+	b = appendString(b, "min interval")
+	b = appendInt(b, res.MinInterval)
+	if len(res.DHTNodes) > 0 {
+		// Not part of any BEP, but shaped like the metainfo key of BEP 5.
+		b = appendString(b, "nodes")
+		b = append(b, 'l')
+		for _, node := range res.DHTNodes {
+			b = append(b, 'l')
+			b = appendString(b, node.Host)
+			b = appendInt(b, int64(node.Port))
+			b = append(b, 'e')
+		}
+		b = append(b, 'e')
+	}
+	b = appendString(b, "peers")
+	if res.CachedPeers != nil {
+		b = append(b, res.CachedPeers.Encoded(encodePeers)...)
+	} else {
+		b = appendPeers(b, res.Peers)
+	}
+	if len(res.WebSeeds) > 0 {
+		// Not part of any BEP, but named after the metainfo key of BEP 19.
+		b = appendString(b, "url-list")
+		b = append(b, 'l')
+		for _, url := range res.WebSeeds {
+			b = appendString(b, url)
+		}
+		b = append(b, 'e')
+	}
+	if res.Warning != "" {
+		b = appendString(b, "warning message")
+		b = appendString(b, res.Warning)
+	}
+	return append(b, 'e')
+}
+
+// encodePeers bencodes a peer list shared between several responses.
+func encodePeers(peers models.PeerList) []byte {
+	return appendPeers(nil, peers)
+}
+
+// appendPeers appends a bencoded list of peer dicts.
+func appendPeers(b []byte, peers models.PeerList) []byte {
+	b = append(b, 'l')
+	for i := range peers {
+		b = append(b, 'd')
+		b = appendString(b, "ip")
+		b = appendString(b, peers[i].IP)
+		b = appendString(b, "peer id")
+		b = appendString(b, peers[i].ID)
+		b = appendString(b, "port")
+		b = appendInt(b, int64(peers[i].Port))
+		b = append(b, 'e')
+	}
+	return append(b, 'e')
+}
+
+// truncateAnnounce cuts the peer list of res short if its bencoding would be
+// larger than maxSize bytes.
+func truncateAnnounce(res *models.AnnounceResponse, maxSize int) *models.AnnounceResponse {
+	return truncatePeers(res, maxSize, func(res *models.AnnounceResponse) int {
+		return len(appendAnnounce(nil, res))
+	}, bencodedPeerSize)
+}
+
+// bencodedPeerSize is the number of bytes appendPeers appends for p.
+func bencodedPeerSize(p *models.Peer) int {
+	return len("d2:ip7:peer id4:portiee") +
+		bencodedStringSize(p.IP) + bencodedStringSize(p.ID) + digits(uint64(p.Port))
+}
+
+func bencodedStringSize(s string) int {
+	return digits(uint64(len(s))) + 1 + len(s)
+}
+
+// digits is the number of decimal digits of u.
+func digits(u uint64) int {
+	n := 1
+	for ; u >= 10; u /= 10 {
+		n++
+	}
+	return n
+}
+
+// appendScrape appends the bencoded dict for a ScrapeResponse.
+func appendScrape(b []byte, res *models.ScrapeResponse) []byte {
+	files := servedTorrents(res)
+	sort.Sort(byInfohash(files))
+
+	b = append(b, 'd')
+	b = appendString(b, "files")
+	b = append(b, 'd')
+	for i, torrent := range files {
+		if i > 0 && files[i-1].Infohash == torrent.Infohash {
+			continue
+		}
+		b = appendString(b, torrent.Infohash)
+		b = appendTorrent(b, torrent)
+	}
+	b = append(b, 'e')
+	return append(b, 'e')
+}
+
+// appendTorrent appends the bencoded scrape dict for a single torrent.
+func appendTorrent(b []byte, torrent *models.Torrent) []byte {
+	b = append(b, 'd')
+	b = appendString(b, "complete")
+	b = appendInt(b, int64(torrent.Seeders.Len()))
+	b = appendString(b, "downloaded")
+	b = appendUint(b, torrent.Snatches)
+	b = appendString(b, "incomplete")
+	b = appendInt(b, int64(torrent.Leechers.Len()))
+	return append(b, 'e')
+}
+
+type byInfohash []*models.Torrent
+
+func (t byInfohash) Len() int           { return len(t) }
+func (t byInfohash) Less(i, j int) bool { return t[i].Infohash < t[j].Infohash }
+func (t byInfohash) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
@@ -8,8 +8,11 @@ package http
 
 import (
 	"context"
+	"errors"
 	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
@@ -28,17 +31,51 @@ type ResponseHandler func(http.ResponseWriter, *http.Request, httprouter.Params)
 // Server represents an HTTP serving torrent tracker.
 type Server struct {
 	network  network.Network
-	addr     string
 	config   *config.Config
 	tracker  *tracker.Tracker
 	grace    *graceful.Server
 	stopping bool
+
+	// proxies allowed to set the client address via the real IP header
+	trustedProxies []*net.IPNet
+
+	// the address advertised on the index page and the listener it was
+	// resolved for
+	addrMu   sync.RWMutex
+	addr     string
+	listener net.Listener
+
+	// replaces identifying values in logged requests, nil to log them as is
+	anonymizer Anonymizer
+
+	// the last state of each open connection, nil unless the active and idle
+	// connections are counted
+	connStates *sync.Map
+
+	// requests in flight per client address, nil when unlimited
+	perIP *ipLimiter
 }
 
+// errNotServing is returned when resolving the address of a server that isn't
+// listening.
+var errNotServing = errors.New("http server is not serving")
+
 // makeHandler wraps our ResponseHandlers while timing requests, collecting,
 // stats, logging, and handling errors.
-func makeHandler(handler ResponseHandler) httprouter.Handle {
+func (s *Server) makeHandler(handler ResponseHandler) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if s.perIP != nil {
+			host := s.remoteHost(r)
+			if !s.perIP.Acquire(host) {
+				// refused without logging, as it happens in floods
+				stats.RecordEvent(stats.ThrottledRequest)
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+			defer s.perIP.Release(host)
+		}
+
 		start := time.Now()
 		httpCode, err := handler(w, r, p)
 		duration := time.Since(start)
@@ -55,11 +92,14 @@ func makeHandler(handler ResponseHandler) httprouter.Handle {
 			stats.RecordEvent(stats.ErroredRequest)
 		}
 
+		if threshold := s.config.SlowRequestThreshold.Duration; threshold > 0 && duration > threshold {
+			// slow requests are logged in full whatever the verbosity
+			glog.Warningf("[HTTP - %9s] slow request %s (%d)", duration, s.requestString(r, p, true), httpCode)
+			stats.RecordEvent(stats.SlowRequest)
+		}
+
 		if len(msg) > 0 || glog.V(2) {
-			reqString := r.URL.Path + " " + r.RemoteAddr
-			if glog.V(3) {
-				reqString = r.URL.RequestURI() + " " + r.RemoteAddr
-			}
+			reqString := s.requestString(r, p, bool(glog.V(3)))
 
 			if len(msg) > 0 {
 				glog.Errorf("[HTTP - %9s] %s (%d - %s)", duration, reqString, httpCode, msg)
@@ -74,27 +114,51 @@ func makeHandler(handler ResponseHandler) httprouter.Handle {
 }
 
 func (s *Server) ServerAddr() string {
+	s.addrMu.RLock()
+	defer s.addrMu.RUnlock()
 	return s.addr
 }
 
 // newRouter returns a router with all the routes.
 func newRouter(s *Server) *httprouter.Router {
 	r := httprouter.New()
+	prefix := s.pathPrefix()
 
+	// private trackers identify users by the passkey in their announce URL
+	trackerPrefix := prefix
 	if s.config.PrivateEnabled {
-		r.GET("/users/:passkey/announce", makeHandler(s.serveAnnounce))
-		r.GET("/users/:passkey/scrape", makeHandler(s.serveScrape))
-	} else {
-		r.GET("/announce", makeHandler(s.serveAnnounce))
-		r.GET("/scrape", makeHandler(s.serveScrape))
+		trackerPrefix += "/users/:passkey"
+	}
+	r.GET(trackerPrefix+"/announce", s.makeHandler(s.serveAnnounce))
+	r.GET(trackerPrefix+"/scrape", s.makeHandler(s.serveScrape))
+	if s.config.HTTPConfig.AnnounceBatchSize > 0 {
+		r.GET(trackerPrefix+"/announce-batch", s.makeHandler(s.serveAnnounceBatch))
 	}
-	r.GET("/", makeHandler(s.serveIndex))
+	if !s.config.HTTPConfig.DisableIndex {
+		r.GET(prefix+"/", s.makeHandler(s.serveIndex))
+	}
+	// health checks bypass makeHandler so they don't count as requests
+	r.GET(prefix+"/healthz", s.serveHealth)
 	return r
 }
 
+// pathPrefix returns the configured path prefix with a leading slash and
+// without a trailing one, so that it can be prepended to any route.
+func (s *Server) pathPrefix() string {
+	prefix := strings.Trim(s.config.HTTPConfig.PathPrefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
+
 // connState is used by graceful in order to gracefully shutdown. It also
 // keeps track of connection stats.
 func (s *Server) connState(conn net.Conn, state http.ConnState) {
+	if s.connStates != nil {
+		s.recordConnState(conn, state)
+	}
+
 	switch state {
 	case http.StateNew:
 		stats.RecordEvent(stats.AcceptedConnection)
@@ -113,19 +177,87 @@ func (s *Server) connState(conn net.Conn, state http.ConnState) {
 	}
 }
 
+// recordConnState updates the counts of active and idle connections as conn
+// moves from its previous state to state.
+func (s *Server) recordConnState(conn net.Conn, state http.ConnState) {
+	var active, idle int64
+	if prev, ok := s.connStates.Load(conn); ok {
+		switch prev.(http.ConnState) {
+		case http.StateActive:
+			active--
+		case http.StateIdle:
+			idle--
+		}
+	}
+
+	switch state {
+	case http.StateActive:
+		active++
+	case http.StateIdle:
+		idle++
+	}
+
+	if state == http.StateClosed || state == http.StateHijacked {
+		s.connStates.Delete(conn)
+	} else {
+		s.connStates.Store(conn, state)
+	}
+	stats.RecordConnectionStates(active, idle)
+}
+
 func (s *Server) Setup() (err error) {
 	return s.network.Setup()
 }
 
-func (s *Server) resolveName(l net.Listener) (err error) {
+// resolveName sets the address the server advertises on its index page. If
+// the public address cannot be resolved, the listening address is advertised
+// instead rather than keeping the server from serving.
+func (s *Server) resolveName(l net.Listener) {
+	addr, err := s.publicAddr(l)
+	if err != nil {
+		addr = l.Addr().String()
+		glog.Warningf("Failed to resolve the public address of %s, advertising it as is: %s", addr, err)
+	}
+	s.addrMu.Lock()
+	s.addr, s.listener = addr, l
+	s.addrMu.Unlock()
+}
+
+func (s *Server) publicAddr(l net.Listener) (string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 	defer cancel()
-	s.addr, err = s.network.PublicAddr(ctx, l)
-	return
+	return s.network.PublicAddr(ctx, l)
+}
+
+// Resolve resolves the public address of the server again, for when its DNS
+// records have changed, and advertises it from then on. The old address is
+// kept if resolving fails.
+func (s *Server) Resolve() (string, error) {
+	s.addrMu.RLock()
+	l := s.listener
+	s.addrMu.RUnlock()
+	if l == nil {
+		return "", errNotServing
+	}
+
+	addr, err := s.publicAddr(l)
+	if err != nil {
+		return "", err
+	}
+	s.addrMu.Lock()
+	defer s.addrMu.Unlock()
+	if s.listener != l {
+		// the server stopped or restarted while resolving
+		return "", errNotServing
+	}
+	s.addr = addr
+	glog.Infof("Now advertising %s bound at %s", addr, l.Addr())
+	return addr, nil
 }
 
-// Serve runs an HTTP server, blocking until the server has shut down.
-func (s *Server) Serve() {
+// Serve runs an HTTP server, blocking until the server has shut down. It
+// returns an error if the server failed rather than being stopped.
+func (s *Server) Serve() error {
 	router := newRouter(s)
 	serv := &http.Server{
 		Handler:      router,
@@ -135,18 +267,25 @@ func (s *Server) Serve() {
 	laddr := s.config.HTTPConfig.ListenAddr
 	l, err := s.network.Listen("tcp", laddr)
 	if err == nil {
+		if limit := s.config.HTTPConfig.ListenLimit; limit > 0 {
+			glog.V(0).Info("Limiting connections to ", limit)
+			l = newLimitListener(l, limit)
+		}
 		// disable keepalive
 		serv.SetKeepAlivesEnabled(true)
-		err = s.resolveName(l)
-		if err == nil {
-			glog.Infof("Serving on %s bound at %s", s.addr, l.Addr())
-			err = serv.Serve(l)
-		} else {
-			l.Close()
-		}
+		s.resolveName(l)
+		glog.Infof("Serving on %s bound at %s", s.ServerAddr(), l.Addr())
+		err = serv.Serve(l)
+		s.addrMu.Lock()
+		s.listener = nil
+		s.addrMu.Unlock()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		glog.Errorf("Failed to run HTTP server: %s", err)
+		return err
 	}
-	glog.Error(err)
 	glog.Info("HTTP server shut down cleanly")
+	return nil
 }
 
 // Stop cleanly shuts down the server.
@@ -158,9 +297,23 @@ func (s *Server) Stop() {
 
 // NewServer returns a new HTTP server for a given configuration and tracker.
 func NewServer(n network.Network, cfg *config.Config, tkr *tracker.Tracker) *Server {
-	return &Server{
+	s := &Server{
 		network: n,
 		config:  cfg,
 		tracker: tkr,
+
+		trustedProxies: parseTrustedProxies(cfg.TrustedProxies),
+		perIP:          newIPLimiter(cfg.HTTPConfig.PerIPLimit),
+	}
+	if cfg.HTTPConfig.AnonymizeLogs {
+		a, err := newHMACAnonymizer()
+		if err != nil {
+			glog.Fatalf("Failed to create the log anonymizer: %s", err)
+		}
+		s.anonymizer = a
+	}
+	if cfg.StatsConfig.ConnectionStates {
+		s.connStates = &sync.Map{}
 	}
+	return s
 }
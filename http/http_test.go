@@ -5,7 +5,9 @@
 package http
 
 import (
+	"context"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -42,21 +44,62 @@ func setupTracker(cfg *config.Config, tkr *tracker.Tracker) (*httptest.Server, e
 	return createServer(tkr, cfg)
 }
 
+// testNetwork is a network.Network over plain TCP that uses the host part of
+// an address as its name.
+type testNetwork struct{}
+
+func (testNetwork) Setup() error { return nil }
+
+func (testNetwork) Listen(network, addr string) (net.Listener, error) {
+	return net.Listen(network, addr)
+}
+
+func (testNetwork) ReverseDNS(c context.Context, addr string) ([]string, error) {
+	h, _, err := net.SplitHostPort(addr)
+	return []string{h}, err
+}
+
+func (testNetwork) ForwardDNS(c context.Context, h string) ([]net.Addr, error) {
+	return nil, nil
+}
+
+func (testNetwork) GetPublicPrivateAddrs(reverse, forward string) (string, string) {
+	return forward, reverse
+}
+
+func (testNetwork) PublicAddr(c context.Context, l net.Listener) (string, error) {
+	return l.Addr().String(), nil
+}
+
 func createServer(tkr *tracker.Tracker, cfg *config.Config) (*httptest.Server, error) {
 	srv := &Server{
+		network: testNetwork{},
 		config:  cfg,
 		tracker: tkr,
+
+		trustedProxies: parseTrustedProxies(cfg.TrustedProxies),
 	}
 	return httptest.NewServer(newRouter(srv)), nil
 }
 
+// announce sends an announce with the parameters p from the address in
+// p["ip"], which must be a loopback address. The tracker takes peers'
+// addresses from their connections rather than from the ip parameter.
 func announce(p params, srv *httptest.Server) ([]byte, error) {
 	values := &url.Values{}
 	for k, v := range p {
 		values.Add(k, v)
 	}
 
-	body, _, err := fetchPath(srv.URL + "/announce?" + values.Encode())
+	dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(p["ip"])}}
+	client := &http.Client{Transport: &http.Transport{DialContext: dialer.DialContext, DisableKeepAlives: true}}
+	response, err := client.Get(srv.URL + "/announce?" + values.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
 	return body, err
 }
 
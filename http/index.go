@@ -0,0 +1,65 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package http
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/majestrate/chihaya/stats"
+)
+
+// indexTemplate is the index page served to browsers. It only shows what the
+// plaintext index and the public stats already tell anyone who asks.
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>bittorrent tracker</title>
+</head>
+<body>
+<h1>bittorrent {{if .Private}}private{{else}}open{{end}} tracker</h1>
+{{if .Private}}<p>announce url: <code>{{.AnnounceURL}}</code>, where <code>&lt;passkey&gt;</code> is your own passkey</p>
+{{else}}<p>announce url: <code>{{.AnnounceURL}}</code></p>
+<p>to use:</p>
+<pre>mktorrent -a {{.AnnounceURL}} somedirectory</pre>
+{{end}}{{if .Stats}}<p>{{.Torrents}} torrents, {{.Peers}} peers</p>
+{{end}}</body>
+</html>
+`))
+
+type indexPage struct {
+	Private     bool
+	AnnounceURL string
+	Stats       bool
+	Torrents    uint64
+	Peers       int64
+}
+
+// wantsHTML is true if the client asked for HTML, as browsers do. Clients
+// like curl accept anything and are given plaintext.
+func wantsHTML(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType := strings.TrimSpace(strings.SplitN(accept, ";", 2)[0]); mediaType == "text/html" {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) serveHTMLIndex(w http.ResponseWriter, announceURL string) (int, error) {
+	page := indexPage{
+		Private:     s.config.PrivateEnabled,
+		AnnounceURL: announceURL,
+	}
+	if stats.DefaultStats != nil {
+		page.Stats = true
+		page.Torrents = stats.DefaultStats.TorrentsSize
+		page.Peers = stats.DefaultStats.Peers.Current
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	return http.StatusOK, indexTemplate.Execute(w, page)
+}
@@ -0,0 +1,64 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package http
+
+import "sync"
+
+// ipLimiter bounds the requests each client address may have in flight at
+// once, so that one source opening many slow requests can't hold up the
+// server for everyone else the way it could with only a global limit. A nil
+// *ipLimiter is valid and allows everything.
+type ipLimiter struct {
+	limit int
+
+	inFlight map[string]int
+	sync.Mutex
+}
+
+// newIPLimiter creates a limiter allowing limit requests per address. It
+// returns nil when limit is not positive.
+func newIPLimiter(limit int) *ipLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &ipLimiter{
+		limit:    limit,
+		inFlight: make(map[string]int),
+	}
+}
+
+// Acquire starts a request from addr, returning false if the address already
+// has as many requests in flight as allowed. Each successful Acquire must be
+// followed by a Release once the request is done.
+func (l *ipLimiter) Acquire(addr string) bool {
+	if l == nil {
+		return true
+	}
+	l.Lock()
+	defer l.Unlock()
+
+	if l.inFlight[addr] >= l.limit {
+		return false
+	}
+	l.inFlight[addr]++
+	return true
+}
+
+// Release ends a request from addr.
+func (l *ipLimiter) Release(addr string) {
+	if l == nil {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+
+	// addresses without requests in flight are forgotten, so the map only
+	// grows with the number of concurrent clients
+	if l.inFlight[addr] <= 1 {
+		delete(l.inFlight, addr)
+	} else {
+		l.inFlight[addr]--
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/majestrate/chihaya/config"
+)
+
+func TestPerIPLimit(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.HTTPConfig.PerIPLimit = 2
+	s := NewServer(testNetwork{}, &cfg, nil)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := s.makeHandler(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
+		select {
+		case started <- struct{}{}:
+			<-release
+		case <-release:
+		}
+		return http.StatusOK, nil
+	})
+
+	serve := func(addr string) int {
+		r := httptest.NewRequest("GET", "/announce", nil)
+		r.RemoteAddr = addr
+		rec := httptest.NewRecorder()
+		handler(rec, r, nil)
+		return rec.Code
+	}
+
+	// Hold the two requests the address is allowed.
+	var wg sync.WaitGroup
+	codes := make(chan int, 3)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- serve("10.0.0.1:6881")
+		}()
+		<-started
+	}
+
+	// Many more from the same address, from other ports, are all refused.
+	var refused sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		refused.Add(1)
+		go func() {
+			defer refused.Done()
+			if code := serve("10.0.0.1:6882"); code != http.StatusTooManyRequests {
+				t.Errorf("expected a request over the limit to be refused, got %d", code)
+			}
+		}()
+	}
+	refused.Wait()
+
+	// Another address has its own limit.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		codes <- serve("10.0.0.2:6881")
+	}()
+	<-started
+
+	close(release)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("expected the requests within the limit to be served, got %d", code)
+		}
+	}
+
+	if code := serve("10.0.0.1:6881"); code != http.StatusOK {
+		t.Errorf("expected the address to be allowed again once its requests finished, got %d", code)
+	}
+	if len(s.perIP.inFlight) != 0 {
+		t.Errorf("expected no requests to be left in flight, got %v", s.perIP.inFlight)
+	}
+}
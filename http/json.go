@@ -0,0 +1,119 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package http
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/majestrate/chihaya/tracker/models"
+)
+
+// The types in this file are the JSON representations of announce and scrape
+// responses. They mirror the keys of the bencoded responses, except that
+// binary infohashes and peer IDs are hex encoded so they survive as JSON
+// strings.
+
+type jsonAnnounce struct {
+	Complete    int             `json:"complete"`
+	Incomplete  int             `json:"incomplete"`
+	Interval    int64           `json:"interval"`
+	MinInterval int64           `json:"min interval"`
+	DHTNodes    [][]interface{} `json:"nodes,omitempty"`
+	Peers       []jsonPeer      `json:"peers"`
+	WebSeeds    []string        `json:"url-list,omitempty"`
+	Warning     string          `json:"warning message,omitempty"`
+}
+
+type jsonPeer struct {
+	IP   string `json:"ip"`
+	ID   string `json:"peer id"`
+	Port uint16 `json:"port"`
+}
+
+type jsonScrape struct {
+	Files map[string]jsonTorrent `json:"files"`
+}
+
+type jsonTorrent struct {
+	Complete   int    `json:"complete"`
+	Downloaded uint64 `json:"downloaded"`
+	Incomplete int    `json:"incomplete"`
+}
+
+func newJSONAnnounce(res *models.AnnounceResponse) *jsonAnnounce {
+	peers := make([]jsonPeer, len(res.Peers))
+	for i, peer := range res.Peers {
+		peers[i] = jsonPeer{
+			IP:   peer.IP,
+			ID:   hex.EncodeToString([]byte(peer.ID)),
+			Port: peer.Port,
+		}
+	}
+
+	var nodes [][]interface{}
+	for _, node := range res.DHTNodes {
+		nodes = append(nodes, []interface{}{node.Host, node.Port})
+	}
+
+	return &jsonAnnounce{
+		Complete:    res.Complete,
+		Incomplete:  res.Incomplete,
+		Interval:    res.Interval,
+		MinInterval: res.MinInterval,
+		DHTNodes:    nodes,
+		Peers:       peers,
+		WebSeeds:    res.WebSeeds,
+		Warning:     res.Warning,
+	}
+}
+
+// truncateJSONAnnounce cuts the peer list of res short if its JSON encoding
+// would be larger than maxSize bytes.
+func truncateJSONAnnounce(res *models.AnnounceResponse, maxSize int) *models.AnnounceResponse {
+	return truncatePeers(res, maxSize, func(res *models.AnnounceResponse) int {
+		b, _ := json.Marshal(newJSONAnnounce(res))
+		return len(b) + 1 // the encoder's trailing newline
+	}, func(p *models.Peer) int {
+		b, _ := json.Marshal(jsonPeer{IP: p.IP, ID: hex.EncodeToString([]byte(p.ID)), Port: p.Port})
+		return len(b) + 1 // the separating comma
+	})
+}
+
+func newJSONScrape(res *models.ScrapeResponse) *jsonScrape {
+	files := make(map[string]jsonTorrent, len(res.Files))
+	for _, torrent := range servedTorrents(res) {
+		files[hex.EncodeToString([]byte(torrent.Infohash))] = jsonTorrent{
+			Complete:   torrent.Seeders.Len(),
+			Downloaded: torrent.Snatches,
+			Incomplete: torrent.Leechers.Len(),
+		}
+	}
+	return &jsonScrape{Files: files}
+}
+
+// acceptsJSON is true if a request lists application/json in its Accept
+// header.
+func acceptsJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediatype, _, err := mime.ParseMediaType(accept)
+		if err == nil && mediatype == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	// end with a newline like json.Encoder does
+	return writeBody(w, "application/json", append(b, '\n'))
+}
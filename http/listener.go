@@ -0,0 +1,65 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package http
+
+import (
+	"net"
+	"sync"
+
+	"github.com/majestrate/chihaya/stats"
+)
+
+// limitListener is a net.Listener that serves at most a fixed number of
+// connections at once. Connections beyond the limit are closed as soon as
+// they are accepted, rather than queueing up while each holds a file
+// descriptor.
+type limitListener struct {
+	net.Listener
+	sem chan struct{}
+}
+
+// newLimitListener limits l to limit concurrent connections. It returns l
+// itself when limit is not positive.
+func newLimitListener(l net.Listener, limit int) net.Listener {
+	if limit <= 0 {
+		return l
+	}
+	return &limitListener{
+		Listener: l,
+		sem:      make(chan struct{}, limit),
+	}
+}
+
+// Accept waits for and returns the next connection that fits within the
+// limit, rejecting any others that arrive in the meantime.
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		select {
+		case l.sem <- struct{}{}:
+			return &limitConn{Conn: conn, sem: l.sem}, nil
+		default:
+			conn.Close()
+			stats.RecordEvent(stats.RejectedConnection)
+		}
+	}
+}
+
+// limitConn frees its slot in a limitListener when it is closed.
+type limitConn struct {
+	net.Conn
+	sem  chan struct{}
+	once sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { <-c.sem })
+	return err
+}
@@ -0,0 +1,101 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package http
+
+import (
+	"net"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// parseTrustedProxies parses a list of CIDRs or single IPs. Invalid entries
+// are logged and skipped, which only ever makes fewer proxies trusted.
+func parseTrustedProxies(proxies []string) (nets []*net.IPNet) {
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil {
+				bits := 128
+				if v4 := ip.To4(); v4 != nil {
+					ip, bits = v4, 32
+				}
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		}
+
+		_, ipnet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			glog.Errorf("Ignoring invalid trusted proxy %q: %s", proxy, err)
+			continue
+		}
+		nets = append(nets, ipnet)
+	}
+	return
+}
+
+// isTrustedProxy is true if addr, a host and port, is within one of the
+// trusted proxy ranges.
+func (s *Server) isTrustedProxy(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range s.trustedProxies {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr finds the client in a chain of forwarded addresses, such as the
+// comma separated list in X-Forwarded-For, that reached the tracker through
+// the trusted proxy at remoteAddr. Each proxy appends the address it received
+// the request from, so the chain is walked from the right, skipping trusted
+// proxies, until an address that isn't one is found. Anything left of a
+// malformed entry can't be trusted, so the walk stops there.
+func (s *Server) clientAddr(chain []string, remoteAddr string) string {
+	addr := remoteAddr
+	for i := len(chain) - 1; i >= 0; i-- {
+		if strings.TrimSpace(chain[i]) == "" {
+			continue
+		}
+
+		hop, ok := forwardedAddr(chain[i], remoteAddr)
+		if !ok {
+			break
+		}
+		addr = hop
+
+		if !s.isTrustedProxy(hop) {
+			break
+		}
+	}
+	return addr
+}
+
+// forwardedAddr turns the client address a proxy forwarded into a host and
+// port, borrowing the port of the proxy's connection if none was given.
+func forwardedAddr(forwarded, remoteAddr string) (string, bool) {
+	forwarded = strings.TrimSpace(forwarded)
+	if ip := net.ParseIP(strings.Trim(forwarded, "[]")); ip != nil {
+		_, port, err := net.SplitHostPort(remoteAddr)
+		if err != nil {
+			return "", false
+		}
+		return net.JoinHostPort(ip.String(), port), true
+	}
+
+	host, _, err := net.SplitHostPort(forwarded)
+	if err != nil || net.ParseIP(host) == nil {
+		return "", false
+	}
+	return forwarded, true
+}
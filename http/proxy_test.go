@@ -0,0 +1,86 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package http
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/majestrate/chihaya/config"
+)
+
+func newProxiedServer(header string, proxies ...string) *Server {
+	cfg := config.DefaultConfig
+	cfg.RealIPHeader = header
+	cfg.TrustedProxies = proxies
+	return &Server{
+		network:        testNetwork{},
+		config:         &cfg,
+		trustedProxies: parseTrustedProxies(proxies),
+	}
+}
+
+func realHost(t *testing.T, s *Server, remoteAddr string, header ...string) string {
+	r := httptest.NewRequest("GET", "/announce", nil)
+	r.RemoteAddr = remoteAddr
+	for _, value := range header {
+		r.Header.Add(s.config.RealIPHeader, value)
+	}
+
+	host, err := s.getRealAddress(nil, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host
+}
+
+func TestTrustedProxies(t *testing.T) {
+	s := newProxiedServer("X-Real-IP", "10.0.0.0/8", "2001:db8::1", "not a cidr")
+
+	var tests = []struct {
+		remoteAddr, header, expected string
+	}{
+		{"10.1.2.3:4000", "203.0.113.7", "203.0.113.7"},
+		{"[2001:db8::1]:4000", "203.0.113.7:6881", "203.0.113.7"},
+		{"10.1.2.3:4000", "garbage", "10.1.2.3"},
+		{"192.0.2.1:4000", "203.0.113.7", "192.0.2.1"},
+		{"[2001:db8::2]:4000", "203.0.113.7", "2001:db8::2"},
+	}
+
+	for _, tt := range tests {
+		if host := realHost(t, s, tt.remoteAddr, tt.header); host != tt.expected {
+			t.Errorf("%s spoofing %s: expected %s, got %s", tt.remoteAddr, tt.header, tt.expected, host)
+		}
+	}
+
+	if host := realHost(t, newProxiedServer("X-Real-IP"), "10.1.2.3:4000", "203.0.113.7"); host != "10.1.2.3" {
+		t.Errorf("expected the header to be ignored without trusted proxies, got %s", host)
+	}
+}
+
+func TestForwardedForChains(t *testing.T) {
+	s := newProxiedServer("X-Forwarded-For", "10.0.0.0/8")
+
+	var tests = []struct {
+		header   []string
+		expected string
+	}{
+		{[]string{"203.0.113.7"}, "203.0.113.7"},
+		{[]string{"203.0.113.7, 10.0.0.5"}, "203.0.113.7"},
+		{[]string{"198.51.100.1, 203.0.113.7, 10.0.0.5"}, "203.0.113.7"},
+		{[]string{"198.51.100.1, 203.0.113.7", "10.0.0.5"}, "203.0.113.7"},
+		{[]string{"10.0.0.9, 10.0.0.5"}, "10.0.0.9"},
+		{[]string{"203.0.113.7, , [2001:db8::7]:6881,"}, "2001:db8::7"},
+		{[]string{"203.0.113.7, bogus, 10.0.0.5"}, "10.0.0.5"},
+		{[]string{"bogus"}, "10.1.2.3"},
+		{nil, "10.1.2.3"},
+	}
+
+	for _, tt := range tests {
+		if host := realHost(t, s, "10.1.2.3:4000", tt.header...); host != tt.expected {
+			t.Errorf("%q: expected %s, got %s", tt.header, tt.expected, host)
+		}
+	}
+}
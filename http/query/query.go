@@ -10,15 +10,26 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 // Query represents a parsed URL.Query.
 type Query struct {
+	// Infohashes holds every info_hash when more than one was provided and is
+	// empty otherwise.
 	Infohashes []string
 	Params     map[string]string
 }
 
-// New parses a raw url query.
+// queryPool holds released Queries so their maps and slices can be reused.
+var queryPool = sync.Pool{
+	New: func() interface{} {
+		return &Query{Params: make(map[string]string)}
+	},
+}
+
+// New parses a raw url query. The returned Query may be handed back with
+// Release once the caller no longer references it or anything it contains.
 func New(query string) (*Query, error) {
 	var (
 		keyStart, keyEnd int
@@ -28,10 +39,7 @@ func New(query string) (*Query, error) {
 		onKey       = true
 		hasInfohash = false
 
-		q = &Query{
-			Infohashes: nil,
-			Params:     make(map[string]string),
-		}
+		q = queryPool.Get().(*Query)
 	)
 
 	for i, length := 0, len(query); i < length; i++ {
@@ -50,6 +58,7 @@ func New(query string) (*Query, error) {
 
 			keyStr, err := url.QueryUnescape(query[keyStart : keyEnd+1])
 			if err != nil {
+				q.Release()
 				return nil, err
 			}
 
@@ -58,6 +67,7 @@ func New(query string) (*Query, error) {
 			if valEnd > 0 {
 				valStr, err = url.QueryUnescape(query[valStart : valEnd+1])
 				if err != nil {
+					q.Release()
 					return nil, err
 				}
 			}
@@ -67,8 +77,8 @@ func New(query string) (*Query, error) {
 			if keyStr == "info_hash" {
 				if hasInfohash {
 					// Multiple infohashes
-					if q.Infohashes == nil {
-						q.Infohashes = []string{firstInfohash}
+					if len(q.Infohashes) == 0 {
+						q.Infohashes = append(q.Infohashes, firstInfohash)
 					}
 					q.Infohashes = append(q.Infohashes, valStr)
 				} else {
@@ -95,6 +105,20 @@ func New(query string) (*Query, error) {
 	return q, nil
 }
 
+// Release resets a Query and returns it to the pool used by New. Neither the
+// Query nor its Infohashes slice may be used after calling Release; strings
+// read from it remain valid.
+func (q *Query) Release() {
+	for key := range q.Params {
+		delete(q.Params, key)
+	}
+	for i := range q.Infohashes {
+		q.Infohashes[i] = ""
+	}
+	q.Infohashes = q.Infohashes[:0]
+	queryPool.Put(q)
+}
+
 // Uint64 is a helper to obtain a uint of any length from a Query. After being
 // called, you can safely cast the uint64 to your desired length.
 func (q *Query) Uint64(key string) (uint64, error) {
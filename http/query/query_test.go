@@ -98,3 +98,50 @@ func BenchmarkURLParseQuery(b *testing.B) {
 		}
 	}
 }
+
+func TestReleasedQueryIsReset(t *testing.T) {
+	q, err := New("info_hash=a&info_hash=b&port=6881")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(q.Infohashes) != 2 {
+		t.Fatalf("expected 2 infohashes, got %v", q.Infohashes)
+	}
+	q.Release()
+
+	for i := 0; i < 10; i++ {
+		q, err = New("info_hash=c&left=1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(q.Infohashes) != 0 {
+			t.Errorf("expected no leftover infohashes, got %v", q.Infohashes)
+		}
+		if _, exists := q.Params["port"]; exists || len(q.Params) != 2 {
+			t.Errorf("expected no leftover params, got %v", q.Params)
+		}
+		q.Release()
+	}
+}
+
+func BenchmarkParseQueryAllocs(b *testing.B) {
+	raw := ValidAnnounceArguments[4].Encode()
+	b.ReportAllocs()
+	for bCount := 0; bCount < b.N; bCount++ {
+		if _, err := New(raw); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseQueryAllocsReleased(b *testing.B) {
+	raw := ValidAnnounceArguments[4].Encode()
+	b.ReportAllocs()
+	for bCount := 0; bCount < b.N; bCount++ {
+		q, err := New(raw)
+		if err != nil {
+			b.Fatal(err)
+		}
+		q.Release()
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"io"
 	"net/http"
 
+	"github.com/golang/glog"
 	"github.com/julienschmidt/httprouter"
 
 	"github.com/majestrate/chihaya/stats"
@@ -20,7 +21,10 @@ func handleTorrentError(err error, w *Writer) (int, error) {
 		return http.StatusOK, nil
 	} else if models.IsPublicError(err) {
 		w.WriteError(err)
-		stats.RecordEvent(stats.ClientError)
+		if _, retryable := err.(*models.RetryableError); !retryable {
+			// Retryable errors were recorded as the tracker's own failures.
+			stats.RecordEvent(stats.ClientError)
+		}
 		return http.StatusOK, nil
 	}
 
@@ -28,7 +32,7 @@ func handleTorrentError(err error, w *Writer) (int, error) {
 }
 
 func (s *Server) serveAnnounce(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
-	writer := &Writer{w}
+	writer := newWriter(w, r, s.config.MaxResponseSize)
 	ann, err := s.newAnnounce(r, p)
 	if err != nil {
 		return handleTorrentError(err, writer)
@@ -38,7 +42,7 @@ func (s *Server) serveAnnounce(w http.ResponseWriter, r *http.Request, p httprou
 }
 
 func (s *Server) serveScrape(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
-	writer := &Writer{w}
+	writer := newWriter(w, r, s.config.MaxResponseSize)
 	scrape, err := s.newScrape(r, p)
 	if err != nil {
 		return handleTorrentError(err, writer)
@@ -48,10 +52,29 @@ func (s *Server) serveScrape(w http.ResponseWriter, r *http.Request, p httproute
 }
 
 func (s *Server) serveIndex(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
-	addr := s.ServerAddr()
-	txt := fmt.Sprintf("bittorrent open tracker announce url http://%s/announce\n", addr)
+	announceURL := fmt.Sprintf("http://%s%s/announce", s.ServerAddr(), s.pathPrefix())
+	if s.config.HTTPConfig.HTMLIndex && wantsHTML(r) {
+		if s.config.PrivateEnabled {
+			announceURL = fmt.Sprintf("http://%s%s/users/<passkey>/announce", s.ServerAddr(), s.pathPrefix())
+		}
+		return s.serveHTMLIndex(w, announceURL)
+	}
+	txt := fmt.Sprintf("bittorrent open tracker announce url %s\n", announceURL)
 	_, err := io.WriteString(w, txt)
-	txt = fmt.Sprintf("to use:\n\nmktorrent -a http://%s/announce somedirectory\n", addr)
+	txt = fmt.Sprintf("to use:\n\nmktorrent -a %s somedirectory\n", announceURL)
 	_, err = io.WriteString(w, txt)
 	return http.StatusOK, err
 }
+
+// serveHealth responds with 200 while the tracker is serving, for load
+// balancers. The backend is only checked if the backend parameter is set.
+func (s *Server) serveHealth(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if r.URL.Query().Get("backend") != "" {
+		if err := s.tracker.Backend.Ping(); err != nil {
+			glog.Errorf("Health check failed to ping backend: %s", err)
+			http.Error(w, "backend unavailable", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	io.WriteString(w, "ok\n")
+}
@@ -0,0 +1,233 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package http
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/majestrate/chihaya/config"
+	"github.com/majestrate/chihaya/stats"
+)
+
+func TestPathPrefix(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.HTTPConfig.PathPrefix = "t1/"
+
+	srv, err := setupTracker(&cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	body, status, err := fetchPath(srv.URL + "/t1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || !strings.Contains(string(body), "/t1/announce") {
+		t.Errorf("expected the index to show the prefixed announce URL, got %d %q", status, body)
+	}
+
+	if _, status, _ = fetchPath(srv.URL + "/t1/scrape?info_hash=" + url.QueryEscape(infoHash)); status != http.StatusOK {
+		t.Errorf("expected scrapes under the prefix, got %d", status)
+	}
+	if _, status, _ = fetchPath(srv.URL + "/announce"); status != http.StatusNotFound {
+		t.Errorf("expected no announce route outside the prefix, got %d", status)
+	}
+}
+
+func TestDisableIndex(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		cfg := config.DefaultConfig
+		cfg.HTTPConfig.DisableIndex = disabled
+		srv, err := setupTracker(&cfg, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := http.StatusOK
+		if disabled {
+			expected = http.StatusNotFound
+		}
+		if _, status, _ := fetchPath(srv.URL + "/"); status != expected {
+			t.Errorf("disabled=%t: expected the index to respond with %d, got %d", disabled, expected, status)
+		}
+		if _, status, _ := fetchPath(srv.URL + "/scrape?info_hash=" + url.QueryEscape(infoHash)); status != http.StatusOK {
+			t.Errorf("disabled=%t: expected scrapes to be served, got %d", disabled, status)
+		}
+		srv.Close()
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	srv, err := setupTracker(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	for _, path := range []string{"/healthz", "/healthz?backend=1"} {
+		body, status, err := fetchPath(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != http.StatusOK || string(body) != "ok\n" {
+			t.Errorf("%s: expected a healthy response, got %d %q", path, status, body)
+		}
+	}
+}
+
+// unresolvableNetwork is a testNetwork whose public address can't be resolved.
+type unresolvableNetwork struct{ testNetwork }
+
+func (unresolvableNetwork) PublicAddr(c context.Context, l net.Listener) (string, error) {
+	return "", errors.New("no reverse dns")
+}
+
+func TestResolveNameFallback(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	s := &Server{network: unresolvableNetwork{}}
+	s.resolveName(l)
+	if s.ServerAddr() != l.Addr().String() {
+		t.Errorf("expected the listening address %s to be advertised, got %q", l.Addr(), s.ServerAddr())
+	}
+}
+
+func TestResolve(t *testing.T) {
+	s := &Server{network: unresolvableNetwork{}}
+	if _, err := s.Resolve(); err != errNotServing {
+		t.Errorf("expected resolving before serving to fail with %q, got %v", errNotServing, err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	s.resolveName(l)
+	if _, err = s.Resolve(); err == nil {
+		t.Error("expected an unresolvable address to fail")
+	}
+	if s.ServerAddr() != l.Addr().String() {
+		t.Errorf("expected a failed resolve to keep advertising %s, got %q", l.Addr(), s.ServerAddr())
+	}
+
+	s.network = testNetwork{}
+	if addr, err := s.Resolve(); err != nil || addr != l.Addr().String() || s.ServerAddr() != addr {
+		t.Errorf("expected %s to be resolved and advertised, got %q (%v) and %q", l.Addr(), addr, err, s.ServerAddr())
+	}
+}
+
+func TestHTMLIndex(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.HTTPConfig.HTMLIndex = true
+
+	srv, err := setupTracker(&cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml;q=0.9,*/*;q=0.8")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("expected an HTML index for browsers, got %q", ct)
+	}
+	if !strings.Contains(string(body), "/announce</code>") {
+		t.Errorf("expected the announce URL on the HTML index, got %q", body)
+	}
+
+	body, _, err = fetchPath(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(body), "bittorrent open tracker announce url") {
+		t.Errorf("expected the plaintext index for other clients, got %q", body)
+	}
+}
+
+func TestSlowRequests(t *testing.T) {
+	defaultStats := stats.DefaultStats
+	stats.DefaultStats = stats.New(config.StatsConfig{})
+	defer func() { stats.DefaultStats = defaultStats }()
+
+	cfg := config.DefaultConfig
+	cfg.SlowRequestThreshold = config.Duration{Duration: time.Nanosecond}
+	srv, err := setupTracker(&cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	if _, _, err = fetchPath(srv.URL + "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stats are handled in order by a single goroutine, so once this event is
+	// received the slow request has been counted.
+	stats.RecordEvent(stats.Announce)
+	if n := stats.DefaultStats.RequestsSlow; n != 1 {
+		t.Errorf("expected the request to be counted as slow, got %d", n)
+	}
+}
+
+func TestConnectionStateStats(t *testing.T) {
+	defaultStats := stats.DefaultStats
+	stats.DefaultStats = stats.New(config.StatsConfig{})
+	defer func() { stats.DefaultStats = defaultStats }()
+
+	cfg := config.DefaultConfig
+	cfg.StatsConfig.ConnectionStates = true
+	s := NewServer(testNetwork{}, &cfg, nil)
+
+	conn1, conn2 := net.Pipe()
+	defer conn1.Close()
+	defer conn2.Close()
+
+	var tests = []struct {
+		conn         net.Conn
+		state        http.ConnState
+		active, idle int64
+	}{
+		{conn1, http.StateNew, 0, 0},
+		{conn1, http.StateActive, 1, 0},
+		{conn2, http.StateNew, 1, 0},
+		{conn2, http.StateActive, 2, 0},
+		{conn1, http.StateIdle, 1, 1},
+		{conn1, http.StateActive, 2, 0},
+		{conn2, http.StateIdle, 1, 1},
+		{conn2, http.StateClosed, 1, 0},
+		{conn1, http.StateClosed, 0, 0},
+	}
+
+	for i, tt := range tests {
+		s.connState(tt.conn, tt.state)
+		active := atomic.LoadInt64(&stats.DefaultStats.ActiveConnections)
+		idle := atomic.LoadInt64(&stats.DefaultStats.IdleConnections)
+		if active != tt.active || idle != tt.idle {
+			t.Errorf("%d: expected %d active and %d idle connections, got %d and %d", i, tt.active, tt.idle, active, idle)
+		}
+	}
+}
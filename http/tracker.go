@@ -7,33 +7,46 @@ package http
 import (
 	"context"
 	"errors"
+	"net"
 	"net/http"
+	"net/textproto"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
 
 	"github.com/majestrate/chihaya/http/query"
+	"github.com/majestrate/chihaya/stats"
 	"github.com/majestrate/chihaya/tracker/models"
 )
 
+// Lengths of the binary identifiers in an announce. Infohashes are SHA-1
+// hashes, or SHA-256 hashes for BitTorrent v2.
+const (
+	infohashLength   = 20
+	infohashV2Length = 32
+	peerIDLength     = 20
+)
+
 // newAnnounce parses an HTTP request and generates a models.Announce.
 func (s *Server) newAnnounce(r *http.Request, p httprouter.Params) (*models.Announce, error) {
 	q, err := query.New(r.URL.RawQuery)
 	if err != nil {
 		return nil, err
 	}
+	defer q.Release()
 
 	event, _ := q.Params["event"]
 	numWant := requestedPeerCount(q, s.config.NumWantFallback)
 
 	infohash, exists := q.Params["info_hash"]
-	if !exists {
+	if !exists || (len(infohash) != infohashLength && len(infohash) != infohashV2Length) {
 		return nil, models.ErrMalformedRequest
 	}
 
 	peerID, exists := q.Params["peer_id"]
-	if !exists {
+	if !exists || len(peerID) != peerIDLength {
 		return nil, models.ErrMalformedRequest
 	}
 
@@ -62,6 +75,19 @@ func (s *Server) newAnnounce(r *http.Request, p httprouter.Params) (*models.Anno
 		return nil, models.ErrMalformedRequest
 	}
 
+	// Corrupt bytes are a part of those downloaded, so a client can't claim
+	// more of them than that.
+	corrupt := uint64(0)
+	if _, ok := q.Params["corrupt"]; ok {
+		corrupt, err = q.Uint64("corrupt")
+		if err != nil {
+			return nil, models.ErrMalformedRequest
+		}
+		if corrupt > downloaded {
+			corrupt = downloaded
+		}
+	}
+
 	compact := uint64(0)
 	_, ok := q.Params["compact"]
 	if ok {
@@ -82,32 +108,71 @@ func (s *Server) newAnnounce(r *http.Request, p httprouter.Params) (*models.Anno
 		Passkey:    p.ByName("passkey"),
 		PeerID:     peerID,
 		Uploaded:   uploaded,
+		Corrupt:    corrupt,
 	}
 	a.IP = addr
 	a.Port = uint16(port)
+	a.DryRun = q.Params["dryrun"] == "1"
+	if s.config.AllowIPSpoofing && s.config.DualStackedPeers {
+		a.AltIP = dualStackAddress(q, addr)
+	}
 	return a, nil
 }
 
+// dualStackAddress returns the address a dual-stacked peer announced via the
+// ipv4 or ipv6 parameter of BEP 7 for the address family other than addr's.
+// Peers on overlay networks, whose addresses aren't IPs, never get one.
+func dualStackAddress(q *query.Query, addr string) string {
+	primary := net.ParseIP(addr)
+	if primary == nil {
+		return ""
+	}
+
+	param := "ipv6"
+	if primary.To4() == nil {
+		param = "ipv4"
+	}
+	value, exists := q.Params[param]
+	if !exists {
+		return ""
+	}
+
+	// The address may be given with a port, which is ignored.
+	ip := net.ParseIP(strings.Trim(value, "[]"))
+	if host, _, err := net.SplitHostPort(value); ip == nil && err == nil {
+		ip = net.ParseIP(host)
+	}
+	if ip == nil || (ip.To4() != nil) != (param == "ipv4") {
+		return ""
+	}
+	return ip.String()
+}
+
 // newScrape parses an HTTP request and generates a models.Scrape.
 func (s *Server) newScrape(r *http.Request, p httprouter.Params) (*models.Scrape, error) {
 	q, err := query.New(r.URL.RawQuery)
 	if err != nil {
 		return nil, err
 	}
+	defer q.Release()
 
-	if q.Infohashes == nil {
-		if _, exists := q.Params["info_hash"]; !exists {
-			// There aren't any infohashes.
-			return nil, models.ErrMalformedRequest
-		}
-		q.Infohashes = []string{q.Params["info_hash"]}
+	var infohashes []string
+	if len(q.Infohashes) > 0 {
+		// The query's slice is reused once it is released.
+		infohashes = append(infohashes, q.Infohashes...)
+	} else if infohash, exists := q.Params["info_hash"]; exists {
+		infohashes = []string{infohash}
+	} else {
+		// There aren't any infohashes.
+		return nil, models.ErrMalformedRequest
 	}
 
 	return &models.Scrape{
 		Config: s.config,
 
+		IP:         s.remoteHost(r),
 		Passkey:    p.ByName("passkey"),
-		Infohashes: q.Infohashes,
+		Infohashes: infohashes,
 	}, nil
 }
 
@@ -124,28 +189,49 @@ func requestedPeerCount(q *query.Query, fallback int) int {
 	return fallback
 }
 
-// obtain the "real" address from a remote connection
+// obtain the "real" address from a remote connection. The real IP header is
+// only honored on connections from a trusted proxy, so that clients can't spoof
+// their address by sending it themselves.
 func (s *Server) getRealAddress(q *query.Query, r *http.Request) (string, error) {
-	var addr string
-	if s.config != nil && s.config.RealIPHeader != "" {
-		addr = r.Header.Get(s.config.RealIPHeader)
+	return s.lookupRealAddress(s.remoteAddr(r))
+}
+
+// remoteAddr returns the address of the client that made a request, which is
+// taken from the real IP header on connections from a trusted proxy.
+func (s *Server) remoteAddr(r *http.Request) string {
+	addr := r.RemoteAddr
+	if s.config != nil && s.config.RealIPHeader != "" && s.isTrustedProxy(r.RemoteAddr) {
+		var chain []string
+		for _, value := range r.Header[textproto.CanonicalMIMEHeaderKey(s.config.RealIPHeader)] {
+			chain = append(chain, strings.Split(value, ",")...)
+		}
+		addr = s.clientAddr(chain, r.RemoteAddr)
 	}
-	if addr == "" {
-		addr = r.RemoteAddr
+	return addr
+}
+
+// remoteHost returns the host part of the address of the client that made a
+// request, without resolving it.
+func (s *Server) remoteHost(r *http.Request) string {
+	addr := s.remoteAddr(r)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
 	}
-	return s.lookupRealAddress(addr)
+	return addr
 }
 
 func (s *Server) lookupRealAddress(addr string) (string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
+	start := time.Now()
 	addrs, err := s.network.ReverseDNS(ctx, addr)
+	if err == nil && len(addrs) == 0 {
+		err = errors.New("no reverse dns provided")
+	}
+	stats.RecordDNSLookup(true, start, err)
 	if err != nil {
 		return "", err
 	}
-	if len(addrs) == 0 {
-		return "", errors.New("no reverse dns provided")
-	}
 	_, pub := s.network.GetPublicPrivateAddrs(addrs[0], addr)
 	return pub, nil
 }
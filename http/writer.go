@@ -5,7 +5,10 @@
 package http
 
 import (
+	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/majestrate/chihaya/tracker/models"
 	"github.com/zeebo/bencode"
@@ -14,60 +17,133 @@ import (
 // Writer implements the tracker.Writer interface for the HTTP protocol.
 type Writer struct {
 	http.ResponseWriter
+
+	// JSON is set when responses are written as JSON rather than bencode.
+	JSON bool
+
+	// MaxResponseSize is the largest announce response written, in bytes,
+	// or 0 for no limit. Peer lists that don't fit are cut short.
+	MaxResponseSize int
+}
+
+// newWriter returns a Writer for a request, writing JSON if the request
+// accepts it.
+func newWriter(w http.ResponseWriter, r *http.Request, maxResponseSize int) *Writer {
+	return &Writer{ResponseWriter: w, JSON: acceptsJSON(r), MaxResponseSize: maxResponseSize}
 }
 
-// WriteError writes a bencode dict with a failure reason.
+// WriteError writes a bencode dict with a failure reason, and for retryable
+// errors the number of minutes after which to retry as per BEP 31.
 func (w *Writer) WriteError(err error) error {
-	bencoder := bencode.NewEncoder(w)
-	w.Header().Set("Content-Type", "text/plain")
-	return bencoder.Encode(map[string]interface{}{
-		"failure reason": err.Error(),
-	})
+	res := map[string]interface{}{"failure reason": err.Error()}
+	if retryable, ok := err.(*models.RetryableError); ok {
+		res["retry in"] = retryMinutes(retryable.RetryIn)
+	}
+
+	if w.JSON {
+		return writeJSON(w, res)
+	}
+
+	b, err := bencode.EncodeBytes(res)
+	if err != nil {
+		return err
+	}
+	return writeBody(w, "text/plain", b)
+}
+
+// writeBody writes a complete response body along with its length, so that
+// it isn't sent with chunked encoding.
+func writeBody(w http.ResponseWriter, contentType string, b []byte) error {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	_, err := w.Write(b)
+	return err
+}
+
+// retryMinutes rounds a duration up to whole minutes, and is at least one.
+func retryMinutes(d time.Duration) int64 {
+	minutes := int64((d + time.Minute - 1) / time.Minute)
+	if minutes < 1 {
+		minutes = 1
+	}
+	return minutes
 }
 
 // WriteAnnounce writes a bencode dict representation of an AnnounceResponse.
 func (w *Writer) WriteAnnounce(res *models.AnnounceResponse) error {
-	compact := 0
-	if res.Compact {
-		compact = 1
-	}
-	dict := map[string]interface{}{
-		"complete":     res.Complete,
-		"incomplete":   res.Incomplete,
-		"interval":     res.Interval,
-		"min interval": res.MinInterval,
-		"compact":      compact,
-		"peers":        res.Peers,
+	if w.JSON {
+		return writeJSON(w, newJSONAnnounce(truncateJSONAnnounce(res, w.MaxResponseSize)))
 	}
 
-	w.Header().Set("Content-Type", "text/plain")
-	bencoder := bencode.NewEncoder(w)
-	return bencoder.Encode(dict)
+	buf := responsePool.Get().(*[]byte)
+	defer responsePool.Put(buf)
+
+	*buf = appendAnnounce((*buf)[:0], truncateAnnounce(res, w.MaxResponseSize))
+	return writeBody(w, "text/plain", *buf)
 }
 
 // WriteScrape writes a bencode dict representation of a ScrapeResponse.
 func (w *Writer) WriteScrape(res *models.ScrapeResponse) error {
-	dict := map[string]interface{}{
-		"files": filesDict(res.Files),
+	if w.JSON {
+		return writeJSON(w, newJSONScrape(res))
 	}
 
-	w.Header().Set("Content-Type", "text/plain")
-	bencoder := bencode.NewEncoder(w)
-	return bencoder.Encode(dict)
+	buf := responsePool.Get().(*[]byte)
+	defer responsePool.Put(buf)
+
+	*buf = appendScrape((*buf)[:0], res)
+	return writeBody(w, "text/plain", *buf)
 }
 
-func filesDict(torrents []*models.Torrent) map[string]interface{} {
-	d := make(map[string]interface{})
-	for _, torrent := range torrents {
-		d[torrent.Infohash] = torrentDict(torrent)
+// servedTorrents returns the torrents of a scrape response, leaving out the
+// infohashes that aren't served. HTTP scrapes are keyed by infohash, so
+// these are simply left out of the files dict, as per BEP 48.
+func servedTorrents(res *models.ScrapeResponse) []*models.Torrent {
+	files := make([]*models.Torrent, 0, len(res.Files))
+	for _, torrent := range res.Files {
+		if torrent != nil {
+			files = append(files, torrent)
+		}
 	}
-	return d
+	return files
 }
 
-func torrentDict(torrent *models.Torrent) map[string]interface{} {
-	return map[string]interface{}{
-		"complete":   torrent.Seeders.Len(),
-		"incomplete": torrent.Leechers.Len(),
-		"downloaded": torrent.Snatches,
+// truncatePeers returns res if it fits in maxSize bytes, or a copy of it with
+// as many of its peers as fit and a warning that the peer list is incomplete.
+// size is the encoded size of a response without peers, and peerSize the
+// number of bytes each peer adds to it.
+func truncatePeers(res *models.AnnounceResponse, maxSize int, size func(*models.AnnounceResponse) int, peerSize func(*models.Peer) int) *models.AnnounceResponse {
+	if maxSize <= 0 || len(res.Peers) == 0 {
+		return res
+	}
+
+	truncated := *res
+	truncated.Peers = nil
+	truncated.CachedPeers = nil
+
+	used := size(&truncated)
+	for i := range res.Peers {
+		used += peerSize(&res.Peers[i])
+	}
+	if used <= maxSize {
+		return res
+	}
+
+	// The warning holds the number of peers kept, which is at most as long as
+	// the total.
+	truncated.Warning = truncationWarning(len(res.Peers), len(res.Peers))
+	used = size(&truncated)
+	n := 0
+	for ; n < len(res.Peers); n++ {
+		if used += peerSize(&res.Peers[n]); used > maxSize {
+			break
+		}
 	}
+	truncated.Peers = res.Peers[:n]
+	truncated.Warning = truncationWarning(n, len(res.Peers))
+	return &truncated
+}
+
+func truncationWarning(kept, total int) string {
+	return fmt.Sprintf("response too large, only sending %d of %d peers", kept, total)
 }
@@ -0,0 +1,410 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package http
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zeebo/bencode"
+
+	"github.com/majestrate/chihaya/config"
+	"github.com/majestrate/chihaya/tracker"
+	"github.com/majestrate/chihaya/tracker/models"
+)
+
+func makeTestAnnounceResponse(numPeers int) *models.AnnounceResponse {
+	res := &models.AnnounceResponse{
+		Complete:    numPeers / 2,
+		Incomplete:  numPeers - numPeers/2,
+		Interval:    1800,
+		MinInterval: 900,
+		Compact:     true,
+	}
+	for i := 0; i < numPeers; i++ {
+		res.Peers = append(res.Peers, models.Peer{
+			ID:   "-TR2820-peer" + strconv.Itoa(i),
+			IP:   "10.0.0." + strconv.Itoa(i%256),
+			Port: uint16(1024 + i),
+		})
+	}
+	return res
+}
+
+func makeTestScrapeResponse() *models.ScrapeResponse {
+	var files []*models.Torrent
+	for _, infohash := range []string{infoHash, "bbbbbbbbbbbbbbbbbbbb", "aaaaaaaaaaaaaaaaaaaa", infoHash} {
+		torrent := &models.Torrent{
+			Infohash: infohash,
+			Snatches: 3,
+			Seeders:  models.NewPeerMap(true, &config.DefaultConfig),
+			Leechers: models.NewPeerMap(false, &config.DefaultConfig),
+		}
+		torrent.Seeders.Put(models.Peer{ID: "peer1", IP: "10.0.0.1"})
+		files = append(files, torrent)
+	}
+	return &models.ScrapeResponse{Files: files}
+}
+
+// encodeAnnounceMap encodes an AnnounceResponse the way the writer did before
+// it streamed responses, as a reference for the streaming encoder.
+func encodeAnnounceMap(res *models.AnnounceResponse) ([]byte, error) {
+	compact := 0
+	if res.Compact {
+		compact = 1
+	}
+	return bencode.EncodeBytes(map[string]interface{}{
+		"complete":     res.Complete,
+		"incomplete":   res.Incomplete,
+		"interval":     res.Interval,
+		"min interval": res.MinInterval,
+		"compact":      compact,
+		"peers":        res.Peers,
+	})
+}
+
+func encodeScrapeMap(res *models.ScrapeResponse) ([]byte, error) {
+	files := make(map[string]interface{})
+	for _, torrent := range res.Files {
+		files[torrent.Infohash] = map[string]interface{}{
+			"complete":   torrent.Seeders.Len(),
+			"incomplete": torrent.Leechers.Len(),
+			"downloaded": torrent.Snatches,
+		}
+	}
+	return bencode.EncodeBytes(map[string]interface{}{"files": files})
+}
+
+func TestWriteAnnounceMatchesMapEncoding(t *testing.T) {
+	for _, numPeers := range []int{0, 1, 50} {
+		res := makeTestAnnounceResponse(numPeers)
+
+		expected, err := encodeAnnounceMap(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rec := httptest.NewRecorder()
+		if err := (&Writer{ResponseWriter: rec}).WriteAnnounce(res); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(rec.Body.Bytes(), expected) {
+			t.Errorf("%d peers:\ngot:    %q\nwanted: %q", numPeers, rec.Body.Bytes(), expected)
+		}
+	}
+}
+
+func TestWriteScrapeMatchesMapEncoding(t *testing.T) {
+	res := makeTestScrapeResponse()
+
+	expected, err := encodeScrapeMap(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	if err := (&Writer{ResponseWriter: rec}).WriteScrape(res); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(rec.Body.Bytes(), expected) {
+		t.Errorf("\ngot:    %q\nwanted: %q", rec.Body.Bytes(), expected)
+	}
+}
+
+func TestWriteAnnounceWebSeeds(t *testing.T) {
+	res := makeTestAnnounceResponse(1)
+	res.WebSeeds = []string{"http://mirror.example/a", "http://mirror.example/b"}
+	res.Warning = "no peers"
+
+	rec := httptest.NewRecorder()
+	if err := (&Writer{ResponseWriter: rec}).WriteAnnounce(res); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded struct {
+		WebSeeds []string `bencode:"url-list"`
+		Warning  string   `bencode:"warning message"`
+	}
+	if err := bencode.DecodeBytes(rec.Body.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.WebSeeds) != 2 || decoded.WebSeeds[1] != res.WebSeeds[1] || decoded.Warning != res.Warning {
+		t.Errorf("unexpected announce %q", rec.Body.Bytes())
+	}
+}
+
+func TestWriteContentLength(t *testing.T) {
+	for name, write := range map[string]func(*Writer) error{
+		"announce": func(w *Writer) error { return w.WriteAnnounce(makeTestAnnounceResponse(5)) },
+		"scrape":   func(w *Writer) error { return w.WriteScrape(makeTestScrapeResponse()) },
+		"error":    func(w *Writer) error { return w.WriteError(models.ErrMalformedRequest) },
+	} {
+		for _, asJSON := range []bool{false, true} {
+			rec := httptest.NewRecorder()
+			if err := write(&Writer{ResponseWriter: rec, JSON: asJSON}); err != nil {
+				t.Fatal(err)
+			}
+			if length := rec.Header().Get("Content-Length"); length != strconv.Itoa(rec.Body.Len()) {
+				t.Errorf("%s (json %t): expected a Content-Length of %d, got %q", name, asJSON, rec.Body.Len(), length)
+			}
+		}
+	}
+}
+
+func TestWriteAnnounceDHTNodes(t *testing.T) {
+	res := makeTestAnnounceResponse(1)
+	res.DHTNodes = []models.DHTNode{{Host: "router.example", Port: 6881}, {Host: "::1", Port: 6882}}
+
+	rec := httptest.NewRecorder()
+	if err := (&Writer{ResponseWriter: rec}).WriteAnnounce(res); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded struct {
+		Nodes [][]interface{} `bencode:"nodes"`
+		Peers []interface{}   `bencode:"peers"`
+	}
+	if err := bencode.DecodeBytes(rec.Body.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Nodes) != 2 || decoded.Nodes[1][0] != "::1" || decoded.Nodes[1][1] != int64(6882) || len(decoded.Peers) != 1 {
+		t.Errorf("unexpected announce %q", rec.Body.Bytes())
+	}
+}
+
+func TestWriteAnnounceGiantSwarm(t *testing.T) {
+	const maxSize = 64 << 10
+	res := makeTestAnnounceResponse(200000)
+
+	for _, accept := range []string{"", "application/json"} {
+		req := httptest.NewRequest("GET", "/announce", nil)
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		if err := newWriter(rec, req, maxSize).WriteAnnounce(res); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Body.Len() > maxSize {
+			t.Errorf("expected a response of at most %d bytes, got %d", maxSize, rec.Body.Len())
+		}
+
+		var decoded struct {
+			Peers   []interface{} `bencode:"peers" json:"peers"`
+			Warning string        `bencode:"warning message" json:"warning message"`
+		}
+		var err error
+		if accept == "" {
+			err = bencode.DecodeBytes(rec.Body.Bytes(), &decoded)
+		} else {
+			err = json.Unmarshal(rec.Body.Bytes(), &decoded)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A much smaller response would mean the limit is misjudged.
+		if len(decoded.Peers) == 0 || rec.Body.Len() < maxSize-100 {
+			t.Errorf("expected the response to be filled with peers, got %d peers in %d bytes", len(decoded.Peers), rec.Body.Len())
+		}
+		if decoded.Warning != truncationWarning(len(decoded.Peers), len(res.Peers)) {
+			t.Errorf("expected a truncation warning, got %q", decoded.Warning)
+		}
+	}
+
+	// Responses that fit are left alone.
+	full := appendAnnounce(nil, makeTestAnnounceResponse(50))
+	rec := httptest.NewRecorder()
+	if err := (&Writer{ResponseWriter: rec, MaxResponseSize: len(full)}).WriteAnnounce(makeTestAnnounceResponse(50)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), full) {
+		t.Errorf("expected a response that fits to be written whole, got %q", rec.Body.Bytes())
+	}
+}
+
+func TestWriteRetryableError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	err := &models.RetryableError{Reason: "tracker backend unavailable", RetryIn: 90 * time.Second}
+	if err := (&Writer{ResponseWriter: rec}).WriteError(err); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded struct {
+		Reason  string `bencode:"failure reason"`
+		RetryIn int64  `bencode:"retry in"`
+	}
+	if err := bencode.DecodeBytes(rec.Body.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Reason != err.Reason || decoded.RetryIn != 2 {
+		t.Errorf("expected a retry in 2 minutes, got %q", rec.Body.Bytes())
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	req := httptest.NewRequest("GET", "/announce", nil)
+	req.Header.Set("Accept", "text/html, application/json;q=0.9")
+
+	rec := httptest.NewRecorder()
+	if err := newWriter(rec, req, 0).WriteAnnounce(makeTestAnnounceResponse(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	var announce jsonAnnounce
+	if err := json.Unmarshal(rec.Body.Bytes(), &announce); err != nil {
+		t.Fatalf("expected a JSON announce, got %q: %s", rec.Body.Bytes(), err)
+	}
+	if rec.Header().Get("Content-Type") != "application/json" || announce.Interval != 1800 ||
+		len(announce.Peers) != 2 || announce.Peers[1].ID != hex.EncodeToString([]byte("-TR2820-peer1")) {
+		t.Errorf("unexpected JSON announce %q", rec.Body.Bytes())
+	}
+
+	rec = httptest.NewRecorder()
+	if err := newWriter(rec, req, 0).WriteScrape(makeTestScrapeResponse()); err != nil {
+		t.Fatal(err)
+	}
+
+	var scrape jsonScrape
+	if err := json.Unmarshal(rec.Body.Bytes(), &scrape); err != nil {
+		t.Fatalf("expected a JSON scrape, got %q: %s", rec.Body.Bytes(), err)
+	}
+	if len(scrape.Files) != 3 || scrape.Files[hex.EncodeToString([]byte(infoHash))].Complete != 1 {
+		t.Errorf("unexpected JSON scrape %q", rec.Body.Bytes())
+	}
+
+	req.Header.Set("Accept", "*/*")
+	if newWriter(rec, req, 0).JSON {
+		t.Error("expected clients not asking for JSON to get bencode")
+	}
+}
+
+func BenchmarkWriteAnnounceMap(b *testing.B) {
+	res := makeTestAnnounceResponse(50)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		bencode.NewEncoder(ioutil.Discard).Encode(map[string]interface{}{
+			"complete":     res.Complete,
+			"incomplete":   res.Incomplete,
+			"interval":     res.Interval,
+			"min interval": res.MinInterval,
+			"compact":      1,
+			"peers":        res.Peers,
+		})
+	}
+}
+
+func BenchmarkWriteAnnounce(b *testing.B) {
+	res := makeTestAnnounceResponse(50)
+	w := &Writer{ResponseWriter: discardResponseWriter{httptest.NewRecorder()}}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w.WriteAnnounce(res)
+	}
+}
+
+func BenchmarkWriteScrapeMap(b *testing.B) {
+	res := makeTestScrapeResponse()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		encodeScrapeMap(res)
+	}
+}
+
+func BenchmarkWriteScrape(b *testing.B) {
+	res := makeTestScrapeResponse()
+	w := &Writer{ResponseWriter: discardResponseWriter{httptest.NewRecorder()}}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w.WriteScrape(res)
+	}
+}
+
+func benchmarkHotSwarm(b *testing.B, cacheTTL time.Duration) {
+	cfg := config.DefaultConfig
+	cfg.PeerListCacheTTL = config.Duration{Duration: cacheTTL}
+	tkr, err := tracker.New(&cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	w := &Writer{ResponseWriter: discardResponseWriter{httptest.NewRecorder()}}
+	newAnnounce := func(peerID string, left uint64) *models.Announce {
+		return &models.Announce{
+			Config:   &cfg,
+			Infohash: infoHash,
+			PeerID:   peerID,
+			IP:       "10.0.0.1",
+			Port:     1234,
+			Left:     left,
+			NumWant:  50,
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		if err := tkr.HandleAnnounce(newAnnounce("peer"+strconv.Itoa(i), uint64(i%2)), w); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tkr.HandleAnnounce(newAnnounce("peer1", 1), w)
+	}
+}
+
+func BenchmarkAnnounceHotSwarm(b *testing.B)       { benchmarkHotSwarm(b, 0) }
+func BenchmarkAnnounceHotSwarmCached(b *testing.B) { benchmarkHotSwarm(b, time.Second) }
+
+// discardResponseWriter is a ResponseRecorder that throws away its body so
+// benchmarks don't measure buffer growth.
+type discardResponseWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+
+// benchmarkScrapeI2PSwarm scrapes a torrent whose swarm is made of peers with
+// I2P destinations, which are 516 base64 characters long, as their address.
+func benchmarkScrapeI2PSwarm(b *testing.B, swarmSize int) {
+	cfg := config.DefaultConfig
+	tkr, err := tracker.New(&cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	torrent := &models.Torrent{
+		Infohash: infoHash,
+		Seeders:  models.NewPeerMap(true, &cfg),
+		Leechers: models.NewPeerMap(false, &cfg),
+	}
+	tkr.PutTorrent(torrent)
+	dest := strings.Repeat("AAAA", 129)
+	for i := 0; i < swarmSize; i++ {
+		peer := &models.Peer{ID: paddedPeerID(strconv.Itoa(i)), IP: dest + strconv.Itoa(i)}
+		if i%2 == 0 {
+			tkr.PutSeeder(infoHash, peer)
+		} else {
+			tkr.PutLeecher(infoHash, peer)
+		}
+	}
+
+	scrape := &models.Scrape{Config: &cfg, Infohashes: []string{infoHash}}
+	w := &Writer{ResponseWriter: discardResponseWriter{httptest.NewRecorder()}}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tkr.HandleScrape(scrape, w)
+	}
+}
+
+func BenchmarkScrapeI2PSwarm100(b *testing.B)    { benchmarkScrapeI2PSwarm(b, 100) }
+func BenchmarkScrapeI2PSwarm100000(b *testing.B) { benchmarkScrapeI2PSwarm(b, 100000) }
@@ -4,7 +4,11 @@ import (
 	"context"
 	"errors"
 	"net"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/majestrate/chihaya/stats"
 )
 
 type Network struct {
@@ -47,7 +51,9 @@ func (n *Network) ReverseDNS(ctx context.Context, a string) ([]string, error) {
 }
 
 func (n *Network) ForwardDNS(ctx context.Context, h string) (found []net.Addr, e error) {
+	start := time.Now()
 	addrs, err := n.resolver.LookupIPAddr(ctx, h)
+	stats.RecordDNSLookup(false, start, err)
 	if err != nil {
 		e = err
 		return
@@ -63,6 +69,21 @@ func (n *Network) GetPublicPrivateAddrs(reverse, forward string) (string, string
 	return h, reverse
 }
 
+// service and protocol of the SRV records that advertise the announce port
+const (
+	srvService = "bittorrent"
+	srvProto   = "tcp"
+)
+
+// LookupSRV looks up the SRV records of a service on a host
+func (n *Network) LookupSRV(ctx context.Context, service, proto, name string) ([]*net.SRV, error) {
+	_, addrs, err := n.resolver.LookupSRV(ctx, service, proto, name)
+	return addrs, err
+}
+
+// PublicAddr returns the address the tracker is reachable at, which comes from
+// the _bittorrent._tcp SRV record of the listener's reverse dns name if there
+// is one, and is the reverse dns name and the listening port otherwise
 func (n *Network) PublicAddr(ctx context.Context, l net.Listener) (string, error) {
 	addr := l.Addr().String()
 	_, port, err := net.SplitHostPort(addr)
@@ -76,5 +97,14 @@ func (n *Network) PublicAddr(ctx context.Context, l net.Listener) (string, error
 	if len(addrs) == 0 {
 		return "", errors.New("no reverse dns")
 	}
+	if srvs, err := n.LookupSRV(ctx, srvService, srvProto, addrs[0]); err == nil {
+		for _, srv := range srvs {
+			target := strings.TrimSuffix(srv.Target, ".")
+			// a target of "." means the service is not available on the host
+			if target != "" {
+				return net.JoinHostPort(target, strconv.Itoa(int(srv.Port))), nil
+			}
+		}
+	}
 	return net.JoinHostPort(addrs[0], port), nil
 }
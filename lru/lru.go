@@ -0,0 +1,129 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package lru implements a thread-safe, size-bounded cache whose entries
+// expire after a TTL.
+package lru
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Cache is a thread-safe, size-bounded cache whose entries expire after a
+// TTL. A nil *Cache is valid and never holds anything, so callers don't need
+// to check whether caching is enabled.
+type Cache struct {
+	size int
+	ttl  time.Duration
+
+	ll    *list.List
+	items map[string]*list.Element
+	sync.Mutex
+}
+
+type entry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// New creates a cache holding at most size entries, for ttl each unless they
+// are stored with PutTTL. It returns nil when size is not positive.
+func New(size int, ttl time.Duration) *Cache {
+	if size <= 0 {
+		return nil
+	}
+	return &Cache{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// Get returns the value stored for key if it exists and has not expired.
+func (c *Cache) Get(key string) (value interface{}, ok bool) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	el, exists := c.items[key]
+	if !exists {
+		return
+	}
+
+	e := el.Value.(*entry)
+	if time.Now().After(e.expires) {
+		c.removeElement(el)
+		return
+	}
+
+	c.ll.MoveToFront(el)
+	return e.value, true
+}
+
+// Put stores value for key for the cache's TTL, evicting the least recently
+// used entry if the cache is full.
+func (c *Cache) Put(key string, value interface{}) {
+	if c == nil {
+		return
+	}
+	c.PutTTL(key, value, c.ttl)
+}
+
+// PutTTL stores value for key for ttl instead of the cache's TTL.
+func (c *Cache) PutTTL(key string, value interface{}, ttl time.Duration) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	expires := time.Now().Add(ttl)
+	if el, exists := c.items[key]; exists {
+		e := el.Value.(*entry)
+		e.value = value
+		e.expires = expires
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&entry{key, value, expires})
+	if c.ll.Len() > c.size {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+// Remove invalidates any value stored for key.
+func (c *Cache) Remove(key string) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	if el, exists := c.items[key]; exists {
+		c.removeElement(el)
+	}
+}
+
+// Len returns the number of entries currently held, including expired entries
+// that have not been evicted yet.
+func (c *Cache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.Lock()
+	defer c.Unlock()
+	return c.ll.Len()
+}
+
+func (c *Cache) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*entry).key)
+}
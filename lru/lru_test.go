@@ -0,0 +1,75 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package lru
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCacheEviction(t *testing.T) {
+	c := New(2, time.Minute)
+
+	c.Put("a", 1)
+	c.Put("b", 2)
+	c.Get("a")
+	c.Put("c", 3)
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("expected least recently used entry to be evicted")
+	}
+	if v, ok := c.Get("a"); !ok || v.(int) != 1 {
+		t.Errorf("expected a=1, got %v (%t)", v, ok)
+	}
+	if v, ok := c.Get("c"); !ok || v.(int) != 3 {
+		t.Errorf("expected c=3, got %v (%t)", v, ok)
+	}
+
+	c.Remove("a")
+	if _, ok := c.Get("a"); ok {
+		t.Error("expected removed entry to be gone")
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	c := New(2, 10*time.Millisecond)
+
+	c.Put("a", 1)
+	time.Sleep(20 * time.Millisecond)
+
+	if _, ok := c.Get("a"); ok {
+		t.Error("expected entry to have expired")
+	}
+	if c.Len() != 0 {
+		t.Errorf("expected expired entry to be evicted, have %d entries", c.Len())
+	}
+}
+
+func TestCacheDisabled(t *testing.T) {
+	c := New(0, time.Minute)
+	if c != nil {
+		t.Fatal("expected a zero sized cache to be nil")
+	}
+
+	c.Put("a", 1)
+	if _, ok := c.Get("a"); ok {
+		t.Error("expected a disabled cache to never hit")
+	}
+}
+
+func TestCachePutTTL(t *testing.T) {
+	c := New(2, time.Minute)
+
+	c.PutTTL("a", 1, 10*time.Millisecond)
+	c.Put("b", 2)
+	time.Sleep(20 * time.Millisecond)
+
+	if _, ok := c.Get("a"); ok {
+		t.Error("expected entry stored with a short TTL to have expired")
+	}
+	if v, ok := c.Get("b"); !ok || v.(int) != 2 {
+		t.Errorf("expected b=2, got %v (%t)", v, ok)
+	}
+}
@@ -37,7 +37,11 @@ func LoadKeysIncompat(r io.Reader) (k I2PKeys, err error) {
 	_, err = io.Copy(&buff, r)
 	if err == nil {
 		parts := strings.Split(buff.String(), "\n")
-		k = I2PKeys{I2PAddr(parts[0]), parts[1]}
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			err = errors.New("malformed keyfile")
+		} else {
+			k = I2PKeys{I2PAddr(parts[0]), parts[1]}
+		}
 	}
 	return
 }
@@ -25,6 +25,8 @@ type Config struct {
 	Opts    Options
 	Session string
 	Keyfile string
+	// number of timestamped copies of the keyfile to keep next to it
+	KeyfileBackups int
 }
 
 // create new sam connector from config with a stream session
@@ -35,7 +37,7 @@ func (cfg *Config) StreamSession() (session *StreamSession, err error) {
 	if err == nil {
 		// ensure keys exist
 		var keys I2PKeys
-		keys, err = s.EnsureKeyfile(cfg.Keyfile)
+		keys, err = s.EnsureKeyfile(cfg.Keyfile, cfg.KeyfileBackups)
 		if err == nil {
 			// create session
 			session, err = s.NewStreamSession(cfg.Session, keys, cfg.Opts.AsList())
@@ -52,7 +54,7 @@ func (cfg *Config) DatagramSession() (session *DatagramSession, err error) {
 	if err == nil {
 		// ensure keys exist
 		var keys I2PKeys
-		keys, err = s.EnsureKeyfile(cfg.Keyfile)
+		keys, err = s.EnsureKeyfile(cfg.Keyfile, cfg.KeyfileBackups)
 		if err == nil {
 			// determine udp port
 			var portstr string
@@ -69,7 +69,6 @@ func Test_DatagramServerClient(t *testing.T) {
 				return
 			}
 		}
-		c <- true
 	}(c, w)
 	buf := make([]byte, 512)
 	fmt.Println("\tServer: ReadFrom() waiting...")
@@ -0,0 +1,73 @@
+package sam3
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeSAM serves one SAM connection that expects a STREAM CONNECT, replies
+// with result, and then echoes what it reads.
+func fakeSAM(t *testing.T, result string) (addr string, connect chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	connect = make(chan string, 1)
+	go func() {
+		defer l.Close()
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		r := bufio.NewReader(c)
+		if _, err = r.ReadString('\n'); err != nil {
+			return
+		}
+		io.WriteString(c, "HELLO REPLY RESULT=OK VERSION=3.0\n")
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		connect <- strings.TrimSpace(line)
+		fmt.Fprintf(c, "STREAM STATUS RESULT=%s\n", result)
+		io.Copy(c, r)
+	}()
+	return l.Addr().String(), connect
+}
+
+func TestDial(t *testing.T) {
+	dest := I2PAddr("remote-dest")
+	addr, connect := fakeSAM(t, "OK")
+	ss := &StreamSession{samAddr: addr, id: "tracker", keys: NewKeys(I2PAddr("local-dest"), "")}
+
+	c, err := ss.Dial(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if line := <-connect; line != "STREAM CONNECT ID=tracker DESTINATION=remote-dest SILENT=false" {
+		t.Errorf("unexpected connect request %q", line)
+	}
+	if c.RemoteAddr() != dest || c.LocalAddr() != I2PAddr("local-dest") {
+		t.Errorf("unexpected addresses %s and %s", c.LocalAddr(), c.RemoteAddr())
+	}
+
+	io.WriteString(c, "ping\n")
+	if line, err := readLine(c); err != nil || line != "ping" {
+		t.Errorf("expected the stream to be connected, got %q (%v)", line, err)
+	}
+}
+
+func TestDialUnreachable(t *testing.T) {
+	addr, _ := fakeSAM(t, "CANT_REACH_PEER")
+	ss := &StreamSession{samAddr: addr, id: "tracker"}
+
+	if _, err := ss.Dial(I2PAddr("remote-dest")); err == nil || err.Error() != "Can not reach peer" {
+		t.Errorf("expected an unreachable peer to fail, got %v", err)
+	}
+}
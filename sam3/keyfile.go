@@ -0,0 +1,128 @@
+package sam3
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// format of the timestamp in the names of keyfile backups, which sorts in
+// the order the backups were made
+const keyfileBackupTime = "20060102T150405.000000000Z"
+
+// write keys to a keyfile atomically
+// the keys go to a temporary file that is synced and renamed over the
+// keyfile, so a failed write never leaves a truncated keyfile behind, and
+// are then read back to make sure they load as the same keys
+func writeKeyfile(fname string, keys I2PKeys) (err error) {
+	var buf bytes.Buffer
+	err = StoreKeysIncompat(keys, &buf)
+	if err == nil {
+		err = writeFileAtomic(fname, buf.Bytes())
+	}
+	if err != nil {
+		return
+	}
+
+	var f *os.File
+	f, err = os.Open(fname)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	var stored I2PKeys
+	stored, err = LoadKeysIncompat(f)
+	if err == nil && (stored.String() != keys.String() || stored.Addr().Base64() != keys.Addr().Base64()) {
+		err = errors.New("keys read back from keyfile do not match the keys written")
+	}
+	if err != nil {
+		err = fmt.Errorf("keyfile %s failed validation after writing: %s", fname, err)
+	}
+	return
+}
+
+// write data to fname through a temporary file in the same directory
+func writeFileAtomic(fname string, data []byte) (err error) {
+	var f *os.File
+	f, err = ioutil.TempFile(filepath.Dir(fname), filepath.Base(fname)+".tmp")
+	if err != nil {
+		return
+	}
+	tmp := f.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		// TempFile already creates the file readable only by us
+		err = os.Rename(tmp, fname)
+	}
+	return
+}
+
+// list the backups of a keyfile, oldest first
+func keyfileBackups(fname string) (backups []string, err error) {
+	backups, err = filepath.Glob(fname + ".*.bak")
+	sort.Strings(backups)
+	return
+}
+
+// keep a timestamped copy of a keyfile, and at most max copies in total
+// nothing is copied if the newest backup already holds the same keys
+func backupKeyfile(fname string, max int) (err error) {
+	if max <= 0 {
+		return
+	}
+	var data []byte
+	data, err = ioutil.ReadFile(fname)
+	if err != nil {
+		return
+	}
+	var backups []string
+	backups, err = keyfileBackups(fname)
+	if err != nil {
+		return
+	}
+
+	newest := len(backups) - 1
+	if newest < 0 || !fileHolds(backups[newest], data) {
+		backup := fname + "." + time.Now().UTC().Format(keyfileBackupTime) + ".bak"
+		err = writeFileAtomic(backup, data)
+		if err != nil {
+			return
+		}
+		glog.V(0).Infof("Backed up keyfile %s to %s", fname, backup)
+		backups = append(backups, backup)
+	}
+
+	// remove the oldest backups
+	for len(backups) > max {
+		if rerr := os.Remove(backups[0]); rerr != nil {
+			glog.Errorf("Could not remove old keyfile backup %s: %s", backups[0], rerr)
+		}
+		backups = backups[1:]
+	}
+	return
+}
+
+// check if a file holds exactly data
+func fileHolds(fname string, data []byte) bool {
+	existing, err := ioutil.ReadFile(fname)
+	return err == nil && bytes.Equal(existing, data)
+}
@@ -0,0 +1,96 @@
+package sam3
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKeyfileRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sam3-keyfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tests = []I2PKeys{
+		NewKeys(I2PAddr("pub~key"), "pub~keypriv~key"),
+		NewKeys(I2PAddr(strings.Repeat("A", 516)), strings.Repeat("B", 884)),
+	}
+
+	fname := filepath.Join(dir, "keys.dat")
+	for _, keys := range tests {
+		// the second write replaces the first keyfile
+		if err := writeKeyfile(fname, keys); err != nil {
+			t.Fatalf("%.10s: writing keyfile failed: %s", keys.Addr(), err)
+		}
+		f, err := os.Open(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := LoadKeysIncompat(f)
+		f.Close()
+		if err != nil || loaded.Addr() != keys.Addr() || loaded.String() != keys.String() {
+			t.Errorf("%.10s: expected the keys written to load back, got %.10s (%v)", keys.Addr(), loaded.Addr(), err)
+		}
+	}
+
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 1 {
+		t.Errorf("expected only the keyfile to be left behind, got %v", files)
+	}
+}
+
+func TestLoadMalformedKeyfile(t *testing.T) {
+	var tests = []string{
+		"",
+		"pub~key",
+		"pub~key\n",
+		"\npub~keypriv~key",
+	}
+
+	for _, contents := range tests {
+		if _, err := LoadKeysIncompat(strings.NewReader(contents)); err == nil {
+			t.Errorf("%q: expected a malformed keyfile to fail loading", contents)
+		}
+	}
+}
+
+func TestBackupKeyfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sam3-keyfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fname := filepath.Join(dir, "keys.dat")
+	backup := func(contents string, max, expected int) {
+		t.Helper()
+		if err := ioutil.WriteFile(fname, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := backupKeyfile(fname, max); err != nil {
+			t.Fatalf("backing up keyfile failed: %s", err)
+		}
+		backups, err := keyfileBackups(fname)
+		if err != nil || len(backups) != expected {
+			t.Fatalf("expected %d backups, got %v (%v)", expected, backups, err)
+		}
+		if expected > 0 && !fileHolds(backups[len(backups)-1], []byte(contents)) {
+			t.Errorf("expected the newest backup to hold %q", contents)
+		}
+	}
+
+	backup("a", 0, 0)
+	backup("a", 2, 1)
+	// unchanged keys aren't copied again
+	backup("a", 2, 1)
+	backup("b", 2, 2)
+	backup("c", 2, 2)
+
+	backups, _ := keyfileBackups(fname)
+	if fileHolds(backups[0], []byte("a")) {
+		t.Error("expected the oldest backup to be removed")
+	}
+}
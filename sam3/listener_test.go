@@ -0,0 +1,78 @@
+package sam3
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStreamListenerConcurrentClose(t *testing.T) {
+	l := newStreamListener(nil, I2PAddr("listener.b32.i2p"), 4)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		// accepting, like the tracker does
+		go func() {
+			defer wg.Done()
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				c.Close()
+			}
+		}()
+		// accepting from the bridge, like acceptLoop does
+		go func() {
+			defer wg.Done()
+			for {
+				c, remote := net.Pipe()
+				remote.Close()
+				if !l.deliver(c) {
+					return
+				}
+			}
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.Close()
+		}()
+	}
+	wg.Wait()
+
+	if _, err := l.Accept(); err != errListenerClosed {
+		t.Errorf("expected accepting on a closed listener to fail, got %v", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Errorf("expected closing again to be harmless, got %s", err)
+	}
+}
+
+func TestStreamListenerDeliverAfterClose(t *testing.T) {
+	l := newStreamListener(nil, I2PAddr("listener.b32.i2p"), 4)
+	l.Close()
+
+	// with room in the backlog, the send and done are both ready, so try
+	// enough times for either to be picked
+	for i := 0; i < 100; i++ {
+		c, remote := net.Pipe()
+		if l.deliver(c) {
+			t.Fatal("expected delivering to a closed listener to fail")
+		}
+		if _, err := c.Write([]byte{0}); err != io.ErrClosedPipe {
+			t.Fatalf("expected the connection to be closed, got %v", err)
+		}
+		remote.Close()
+	}
+	if len(l.accepted) != 0 {
+		t.Errorf("expected no connections left in the backlog, got %d", len(l.accepted))
+	}
+}
@@ -0,0 +1,61 @@
+package sam3
+
+import (
+	"time"
+
+	"github.com/majestrate/chihaya/lru"
+)
+
+// lookupCache remembers name lookups, names the bridge resolved for ttl and
+// names it couldn't resolve for negativeTTL, so repeated lookups of dead
+// destinations don't each cost a round trip to the bridge
+// lookups that failed to reach the bridge are never remembered
+// a nil *lookupCache is valid and never holds anything
+type lookupCache struct {
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	entries *lru.Cache
+}
+
+// create a cache of up to size lookups, or nil if size is not positive
+func newLookupCache(size int, ttl, negativeTTL time.Duration) *lookupCache {
+	if size <= 0 {
+		return nil
+	}
+	return &lookupCache{
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		entries:     lru.New(size, ttl),
+	}
+}
+
+// get the remembered lookup of name, if it hasn't expired
+func (c *lookupCache) Get(name string) (res lookupResult, ok bool) {
+	if c == nil {
+		return
+	}
+	v, ok := c.entries.Get(name)
+	if ok {
+		res = v.(lookupResult)
+	}
+	return
+}
+
+// remember the lookup of name
+func (c *lookupCache) Put(name string, addr I2PAddr, err error) {
+	if c == nil {
+		return
+	}
+	ttl := c.ttl
+	if err != nil {
+		if _, unresolvable := err.(namingError); !unresolvable {
+			return
+		}
+		ttl = c.negativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	c.entries.PutTTL(name, lookupResult{addr, err}, ttl)
+}
@@ -4,10 +4,12 @@ import (
 	"context"
 	"errors"
 	"net"
+	"time"
 
 	"github.com/golang/glog"
 
 	"github.com/majestrate/chihaya/config"
+	"github.com/majestrate/chihaya/stats"
 )
 
 // implements network.Network
@@ -17,6 +19,8 @@ type Network struct {
 	keys    *I2PKeys
 	session *StreamSession
 	conf    config.I2PConfig
+	// recent name lookups, nil when disabled
+	lookups *lookupCache
 }
 
 func (n *Network) Setup() (err error) {
@@ -32,7 +36,7 @@ func (n *Network) Setup() (err error) {
 	fname := n.conf.SAM.Keyfile
 	var keys I2PKeys
 	glog.V(0).Info("Ensuring keyfile ", fname)
-	keys, err = n.sam.EnsureKeyfile(fname)
+	keys, err = n.sam.EnsureKeyfile(fname, n.conf.SAM.KeyfileBackups)
 	if err != nil {
 		glog.Errorf("Could not persist/load keyfile %s: %s", fname, err)
 		return
@@ -45,7 +49,16 @@ func (n *Network) Setup() (err error) {
 	glog.V(0).Info("Creating new Session with I2P")
 	n.session, err = n.sam.NewStreamSession(sess, keys, opts.AsList())
 	if err != nil {
-		glog.Errorf("Could not create session with I2P: %s", err)
+		switch {
+		case errors.Is(err, ErrDuplicatedID):
+			glog.Errorf("Could not create session with I2P, session name %q is taken, is another tracker running? %s", sess, err)
+		case errors.Is(err, ErrDuplicatedDest):
+			glog.Errorf("Could not create session with I2P, the destination in keyfile %s is already in use: %s", fname, err)
+		case errors.Is(err, ErrInvalidKey):
+			glog.Errorf("Could not create session with I2P, keyfile %s holds invalid keys: %s", fname, err)
+		default:
+			glog.Errorf("Could not create session with I2P: %s", err)
+		}
 		return
 	}
 	return
@@ -53,7 +66,8 @@ func (n *Network) Setup() (err error) {
 
 func NewI2PNetwork(conf config.I2PConfig) *Network {
 	return &Network{
-		conf: conf,
+		conf:    conf,
+		lookups: newLookupCache(conf.LookupCacheSize, conf.LookupCacheTTL.Duration, conf.LookupNegativeTTL.Duration),
 	}
 }
 
@@ -61,7 +75,7 @@ func (n *Network) Listen(network, addr string) (l net.Listener, err error) {
 	if network != "i2p" {
 		return nil, errors.New("invalid network, is not i2p")
 	}
-	return n.session.Listen(n.conf.Listeners)
+	return n.session.ListenPool(n.conf.Listeners, n.conf.SAM.AcceptBacklog, n.conf.SAM.AcceptPoolSize)
 }
 
 func (n *Network) GetPublicPrivateAddrs(reverse, forward string) (string, string) {
@@ -74,11 +88,17 @@ func (n *Network) ReverseDNS(c context.Context, a string) ([]string, error) {
 }
 
 func (n *Network) ForwardDNS(c context.Context, h string) ([]net.Addr, error) {
-	addr, err := n.session.Lookup(h)
-	if err != nil {
-		return nil, err
+	res, cached := n.lookups.Get(h)
+	if !cached {
+		start := time.Now()
+		res.addr, res.err = n.session.Lookup(h)
+		stats.RecordDNSLookup(false, start, res.err)
+		n.lookups.Put(h, res.addr, res.err)
+	}
+	if res.err != nil {
+		return nil, res.err
 	}
-	return []net.Addr{addr}, nil
+	return []net.Addr{res.addr}, nil
 }
 
 func (n *Network) PublicAddr(c context.Context, l net.Listener) (string, error) {
@@ -0,0 +1,87 @@
+package sam3
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/majestrate/chihaya/config"
+)
+
+// fakeLookups answers the name lookups of a session from answers, counting
+// how many reach the bridge.
+func fakeLookups(answers map[string]lookupResult) (*StreamSession, *int) {
+	s := &StreamSession{lookups: make(chan *lookupRequest)}
+	count := new(int)
+	go func() {
+		for req := range s.lookups {
+			*count++
+			req.resp <- answers[req.name]
+		}
+	}()
+	return s, count
+}
+
+func TestForwardDNSCache(t *testing.T) {
+	conf := config.DefaultConfig.I2P
+	conf.LookupNegativeTTL = config.Duration{Duration: 50 * time.Millisecond}
+	n := NewI2PNetwork(conf)
+
+	var count *int
+	n.session, count = fakeLookups(map[string]lookupResult{
+		"tracker.i2p": {I2PAddr("tracker-dest"), nil},
+		"dead.i2p":    {"", namingError("Unable to resolve dead.i2p")},
+		"flaky.i2p":   {"", errors.New("connection reset")},
+	})
+
+	var tests = []struct {
+		name    string
+		lookups int
+		ok      bool
+	}{
+		{"tracker.i2p", 1, true},
+		{"tracker.i2p", 1, true},
+		{"dead.i2p", 2, false},
+		{"dead.i2p", 2, false},
+		{"flaky.i2p", 3, false},
+		{"flaky.i2p", 4, false},
+	}
+
+	for _, tt := range tests {
+		addrs, err := n.ForwardDNS(context.Background(), tt.name)
+		if (err == nil) != tt.ok || (tt.ok && addrs[0] != I2PAddr("tracker-dest")) {
+			t.Errorf("%s: unexpected result %v (%v)", tt.name, addrs, err)
+		}
+		if *count != tt.lookups {
+			t.Errorf("%s: expected %d lookups to reach the bridge, got %d", tt.name, tt.lookups, *count)
+		}
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, err := n.ForwardDNS(context.Background(), "dead.i2p"); err == nil || *count != 5 {
+		t.Errorf("expected an unresolvable name to be looked up again once forgotten, got %d lookups (%v)", *count, err)
+	}
+	if _, err := n.ForwardDNS(context.Background(), "tracker.i2p"); err != nil || *count != 5 {
+		t.Errorf("expected a resolved name to still be remembered, got %d lookups (%v)", *count, err)
+	}
+}
+
+func TestLookupCacheSize(t *testing.T) {
+	c := newLookupCache(2, time.Minute, time.Minute)
+	for _, name := range []string{"a.i2p", "b.i2p", "c.i2p"} {
+		c.Put(name, I2PAddr(name), nil)
+	}
+	if c.entries.Len() != 2 {
+		t.Errorf("expected the cache to hold 2 lookups, got %d", c.entries.Len())
+	}
+	if _, ok := c.Get("c.i2p"); !ok {
+		t.Error("expected the latest lookup to be remembered")
+	}
+
+	var disabled *lookupCache
+	disabled.Put("a.i2p", I2PAddr("a.i2p"), nil)
+	if _, ok := disabled.Get("a.i2p"); ok {
+		t.Error("expected a disabled cache to hold nothing")
+	}
+}
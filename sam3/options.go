@@ -0,0 +1,141 @@
+package sam3
+
+import (
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// option keys that SAM, I2CP and the streaming library understand
+var knownOptions = map[string]bool{
+	// SAM
+	"SIGNATURE_TYPE":  true,
+	"FROM_PORT":       true,
+	"TO_PORT":         true,
+	"PROTOCOL":        true,
+	"HEADER":          true,
+	"LISTEN_PORT":     true,
+	"LISTEN_PROTOCOL": true,
+
+	// I2CP
+	"inbound.length":                  true,
+	"inbound.lengthVariance":          true,
+	"inbound.quantity":                true,
+	"inbound.backupQuantity":          true,
+	"inbound.allowZeroHop":            true,
+	"inbound.IPRestriction":           true,
+	"inbound.nickname":                true,
+	"inbound.randomKey":               true,
+	"outbound.length":                 true,
+	"outbound.lengthVariance":         true,
+	"outbound.quantity":               true,
+	"outbound.backupQuantity":         true,
+	"outbound.allowZeroHop":           true,
+	"outbound.IPRestriction":          true,
+	"outbound.nickname":               true,
+	"outbound.priority":               true,
+	"outbound.randomKey":              true,
+	"shouldBundleReplyInfo":           true,
+	"explicitPeers":                   true,
+	"crypto.lowTagThreshold":          true,
+	"crypto.tagsToSend":               true,
+	"crypto.ratchet.inboundTags":      true,
+	"crypto.ratchet.outboundTags":     true,
+	"clientMessageTimeout":            true,
+	"i2cp.closeIdleTime":              true,
+	"i2cp.closeOnIdle":                true,
+	"i2cp.dontPublishLeaseSet":        true,
+	"i2cp.encryptLeaseSet":            true,
+	"i2cp.fastReceive":                true,
+	"i2cp.gzip":                       true,
+	"i2cp.leaseSetAuthType":           true,
+	"i2cp.leaseSetBlindedType":        true,
+	"i2cp.leaseSetEncType":            true,
+	"i2cp.leaseSetKey":                true,
+	"i2cp.leaseSetOfflineExpiration":  true,
+	"i2cp.leaseSetOfflineSignature":   true,
+	"i2cp.leaseSetPrivateKey":         true,
+	"i2cp.leaseSetSecret":             true,
+	"i2cp.leaseSetSigningPrivateKey":  true,
+	"i2cp.leaseSetTransientPublicKey": true,
+	"i2cp.leaseSetType":               true,
+	"i2cp.messageReliability":         true,
+	"i2cp.password":                   true,
+	"i2cp.reduceIdleTime":             true,
+	"i2cp.reduceOnIdle":               true,
+	"i2cp.reduceQuantity":             true,
+	"i2cp.SSL":                        true,
+	"i2cp.tcp.host":                   true,
+	"i2cp.tcp.port":                   true,
+	"i2cp.username":                   true,
+
+	// streaming library
+	"i2p.streaming.answerPings":                         true,
+	"i2p.streaming.blacklist":                           true,
+	"i2p.streaming.bufferSize":                          true,
+	"i2p.streaming.congestionAvoidanceGrowthRateFactor": true,
+	"i2p.streaming.connectDelay":                        true,
+	"i2p.streaming.connectTimeout":                      true,
+	"i2p.streaming.disableRejectLogging":                true,
+	"i2p.streaming.dsalist":                             true,
+	"i2p.streaming.enforceProtocol":                     true,
+	"i2p.streaming.inactivityAction":                    true,
+	"i2p.streaming.inactivityTimeout":                   true,
+	"i2p.streaming.initialAckDelay":                     true,
+	"i2p.streaming.initialResendDelay":                  true,
+	"i2p.streaming.initialRTO":                          true,
+	"i2p.streaming.initialRTT":                          true,
+	"i2p.streaming.initialWindowSize":                   true,
+	"i2p.streaming.limitAction":                         true,
+	"i2p.streaming.maxConcurrentStreams":                true,
+	"i2p.streaming.maxConnsPerDay":                      true,
+	"i2p.streaming.maxConnsPerHour":                     true,
+	"i2p.streaming.maxConnsPerMinute":                   true,
+	"i2p.streaming.maxMessageSize":                      true,
+	"i2p.streaming.maxResends":                          true,
+	"i2p.streaming.maxTotalConnsPerDay":                 true,
+	"i2p.streaming.maxTotalConnsPerHour":                true,
+	"i2p.streaming.maxTotalConnsPerMinute":              true,
+	"i2p.streaming.maxWindowSize":                       true,
+	"i2p.streaming.profile":                             true,
+	"i2p.streaming.readTimeout":                         true,
+	"i2p.streaming.slowStartGrowthRateFactor":           true,
+	"i2p.streaming.tcbcache.rttDampening":               true,
+	"i2p.streaming.tcbcache.rttdevDampening":            true,
+	"i2p.streaming.tcbcache.wdwDampening":               true,
+	"i2p.streaming.whitelist":                           true,
+	"i2p.streaming.writeTimeout":                        true,
+}
+
+// return the options whose keys are not known options
+func unknownOptions(options []string) (unknown []string) {
+	for _, opt := range options {
+		key := opt
+		if idx := strings.Index(opt, "="); idx >= 0 {
+			key = opt[:idx]
+		}
+		if !knownOptions[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	return
+}
+
+// log a warning for each option the SAM bridge is not known to accept
+// the bridge refuses to create sessions with options it doesn't know, and
+// doesn't always say which one it didn't like
+func warnUnknownOptions(options []string) {
+	for _, key := range unknownOptions(options) {
+		glog.Warningf("Unknown SAM session option %q, the SAM bridge may refuse to create the session", key)
+	}
+}
+
+// extract the MESSAGE= part of a SAM reply, which may be quoted
+func replyMessage(reply string) string {
+	idx := strings.Index(reply, "MESSAGE=")
+	if idx < 0 {
+		return ""
+	}
+	msg := strings.TrimSpace(reply[idx+len("MESSAGE="):])
+	return strings.Trim(msg, `"`)
+}
@@ -0,0 +1,45 @@
+package sam3
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUnknownOptions(t *testing.T) {
+	var tests = []struct {
+		options []string
+		unknown []string
+	}{
+		{nil, nil},
+		{[]string{"inbound.length=1", "outbound.quantity=3"}, nil},
+		{[]string{"i2cp.leaseSetEncType=4,0", "i2p.streaming.profile=1"}, nil},
+		{[]string{"inbound.lenght=1"}, []string{"inbound.lenght"}},
+		{[]string{"inbound.length=1", "bogus", "other=x=y"}, []string{"bogus", "other"}},
+		// keys are case sensitive, like the bridge's
+		{[]string{"Inbound.length=1"}, []string{"Inbound.length"}},
+	}
+
+	for _, tt := range tests {
+		if unknown := unknownOptions(tt.options); !reflect.DeepEqual(unknown, tt.unknown) {
+			t.Errorf("%q: expected unknown options %q, got %q", tt.options, tt.unknown, unknown)
+		}
+	}
+}
+
+func TestReplyMessage(t *testing.T) {
+	var tests = []struct {
+		reply, message string
+	}{
+		{"SESSION STATUS RESULT=OK DESTINATION=abc\n", ""},
+		{"SESSION STATUS RESULT=I2P_ERROR MESSAGE=oops\n", "oops"},
+		{`SESSION STATUS RESULT=I2P_ERROR MESSAGE="bad option inbound.lenght"` + "\n", "bad option inbound.lenght"},
+		{"SESSION STATUS RESULT=I2P_ERROR MESSAGE=\n", ""},
+		{`NAMING REPLY RESULT=KEY_NOT_FOUND NAME=x.i2p MESSAGE="not found"`, "not found"},
+	}
+
+	for _, tt := range tests {
+		if message := replyMessage(tt.reply); message != tt.message {
+			t.Errorf("%q: expected message %q, got %q", tt.reply, tt.message, message)
+		}
+	}
+}
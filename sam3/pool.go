@@ -0,0 +1,93 @@
+package sam3
+
+import (
+	"sync"
+	"time"
+)
+
+// how long the pool waits before dialing the bridge again after a failure
+var samPoolRetry = time.Second
+
+// samPool keeps up to a fixed number of bridge connections that have already
+// said HELLO, so an accept loop can issue STREAM ACCEPT right away instead of
+// dialing and handshaking with the bridge first
+// a connection that accepted a stream belongs to that stream, so connections
+// are replaced rather than returned to the pool
+// a nil *samPool is valid and dials a new connection every time
+type samPool struct {
+	addr      string
+	idle      chan *SAM
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// create a pool of size connections to the bridge at addr, or nil if size is
+// not positive
+func newSAMPool(addr string, size int) *samPool {
+	if size <= 0 {
+		return nil
+	}
+	p := &samPool{
+		addr: addr,
+		// fill holds one more while waiting to hand it over
+		idle: make(chan *SAM, size-1),
+		done: make(chan struct{}),
+	}
+	go p.fill()
+	return p
+}
+
+// keep the pool full until it is closed, then close the idle connections
+// this is the only goroutine adding connections, so none are left behind
+func (p *samPool) fill() {
+	defer func() {
+		for {
+			select {
+			case s := <-p.idle:
+				s.Close()
+			default:
+				return
+			}
+		}
+	}()
+	for {
+		s, err := NewSAM(p.addr)
+		if err != nil {
+			select {
+			case <-time.After(samPoolRetry):
+				continue
+			case <-p.done:
+				return
+			}
+		}
+		select {
+		case p.idle <- s:
+		case <-p.done:
+			s.Close()
+			return
+		}
+	}
+}
+
+// get a connection that said HELLO to the bridge at addr, dialing one if the
+// pool is empty
+func (p *samPool) get(addr string) (*SAM, error) {
+	if p != nil {
+		select {
+		case s := <-p.idle:
+			return s, nil
+		default:
+		}
+	}
+	return NewSAM(addr)
+}
+
+// close the pool and its idle connections
+func (p *samPool) Close() {
+	if p == nil {
+		return
+	}
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
+}
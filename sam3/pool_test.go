@@ -0,0 +1,116 @@
+package sam3
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// bridgeCounts are the connections made to a fake bridge, and how many of
+// them are still open.
+type bridgeCounts struct {
+	total, open int32
+}
+
+// fakeAcceptBridge is a SAM bridge that takes helloDelay to handshake and has
+// a peer waiting for every STREAM ACCEPT.
+func fakeAcceptBridge(tb testing.TB, helloDelay time.Duration) (addr string, counts *bridgeCounts, stop func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	counts = new(bridgeCounts)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&counts.total, 1)
+			atomic.AddInt32(&counts.open, 1)
+			go func() {
+				defer atomic.AddInt32(&counts.open, -1)
+				defer c.Close()
+				r := bufio.NewReader(c)
+				if _, err := r.ReadString('\n'); err != nil {
+					return
+				}
+				time.Sleep(helloDelay)
+				io.WriteString(c, "HELLO REPLY RESULT=OK VERSION=3.0\n")
+				line, err := r.ReadString('\n')
+				if err != nil || !strings.HasPrefix(line, "STREAM ACCEPT ") {
+					return
+				}
+				io.WriteString(c, "STREAM STATUS RESULT=OK\npeer-dest\n")
+				io.Copy(ioutil.Discard, r)
+			}()
+		}
+	}()
+	return l.Addr().String(), counts, func() { l.Close() }
+}
+
+func TestAcceptWithPool(t *testing.T) {
+	addr, counts, stop := fakeAcceptBridge(t, 0)
+	defer stop()
+
+	ss := &StreamSession{samAddr: addr, id: "tracker"}
+	l := newStreamListener(ss, I2PAddr("local-dest"), 1)
+	l.pool = newSAMPool(addr, 2)
+
+	for i := 0; i < 3; i++ {
+		c, err := l.AcceptI2P()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.RemoteAddr() != I2PAddr("peer-dest") {
+			t.Errorf("expected a stream from peer-dest, got %s", c.RemoteAddr())
+		}
+		c.Close()
+	}
+
+	// the pool refills in the background, but never beyond its size
+	time.Sleep(20 * time.Millisecond)
+	if n := atomic.LoadInt32(&counts.total); n != 3+2 {
+		t.Errorf("expected 3 accepted and 2 idle bridge connections, got %d", n)
+	}
+
+	l.Close()
+	time.Sleep(20 * time.Millisecond)
+	if n := atomic.LoadInt32(&counts.open); n != 0 {
+		t.Errorf("expected idle connections to be closed with the listener, %d are open", n)
+	}
+}
+
+// BenchmarkAcceptI2P measures accepts by a single accept loop from a bridge
+// that takes a millisecond to say HELLO.
+func BenchmarkAcceptI2P(b *testing.B) {
+	for _, size := range []int{0, 4} {
+		b.Run("pool="+strconv.Itoa(size), func(b *testing.B) {
+			addr, _, stop := fakeAcceptBridge(b, time.Millisecond)
+			defer stop()
+
+			ss := &StreamSession{samAddr: addr, id: "tracker"}
+			l := newStreamListener(ss, I2PAddr("local-dest"), 1)
+			l.pool = newSAMPool(addr, size)
+			defer l.Close()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c, err := l.AcceptI2P()
+				if err != nil {
+					b.Fatal(err)
+				}
+				c.Close()
+				// a stream takes a while to be served, which is the
+				// time the pool has to refill
+				time.Sleep(time.Millisecond)
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"bufio"
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"os"
@@ -18,12 +19,16 @@ type SAM struct {
 	keys    *I2PKeys
 }
 
-const (
-	session_OK             = "SESSION STATUS RESULT=OK DESTINATION="
-	session_DUPLICATE_ID   = "SESSION STATUS RESULT=DUPLICATED_ID\n"
-	session_DUPLICATE_DEST = "SESSION STATUS RESULT=DUPLICATED_DEST\n"
-	session_INVALID_KEY    = "SESSION STATUS RESULT=INVALID_KEY\n"
-	session_I2P_ERROR      = "SESSION STATUS RESULT=I2P_ERROR MESSAGE="
+const session_STATUS = "SESSION STATUS "
+
+// Errors for the RESULT of a failed SESSION CREATE. The SAM bridge's message,
+// if it sent one, is appended to them.
+var (
+	ErrDuplicatedID   = errors.New("tunnel name is already in use by another session")
+	ErrDuplicatedDest = errors.New("destination is already in use by another session")
+	ErrInvalidID      = errors.New("invalid tunnel name")
+	ErrInvalidKey     = errors.New("invalid key")
+	ErrI2PError       = errors.New("I2P router error")
 )
 
 // Creates a new controller for the I2P routers SAM bridge.
@@ -70,8 +75,9 @@ func (sam *SAM) ReadKeys(r io.Reader) (err error) {
 	return
 }
 
-// if keyfile fname does not exist
-func (sam *SAM) EnsureKeyfile(fname string) (keys I2PKeys, err error) {
+// load keys from keyfile fname, creating it with new keys if it does not exist
+// up to backups timestamped copies of the keyfile are kept next to it
+func (sam *SAM) EnsureKeyfile(fname string, backups int) (keys I2PKeys, err error) {
 	if fname == "" {
 		// transient
 		keys, err = sam.NewKeys()
@@ -85,14 +91,8 @@ func (sam *SAM) EnsureKeyfile(fname string) (keys I2PKeys, err error) {
 			// make the keys
 			keys, err = sam.NewKeys()
 			if err == nil {
-				sam.keys = &keys
 				// save keys
-				var f io.WriteCloser
-				f, err = os.OpenFile(fname, os.O_WRONLY|os.O_CREATE, 0600)
-				if err == nil {
-					err = StoreKeysIncompat(keys, f)
-					f.Close()
-				}
+				err = writeKeyfile(fname, keys)
 			}
 		} else if err == nil {
 			// we haz key file
@@ -100,11 +100,16 @@ func (sam *SAM) EnsureKeyfile(fname string) (keys I2PKeys, err error) {
 			f, err = os.Open(fname)
 			if err == nil {
 				keys, err = LoadKeysIncompat(f)
-				if err == nil {
-					sam.keys = &keys
+				f.Close()
+				if err != nil {
+					err = fmt.Errorf("%s, backups may be found in %s.*.bak", err, fname)
 				}
 			}
 		}
+		if err == nil {
+			sam.keys = &keys
+			err = backupKeyfile(fname, backups)
+		}
 	}
 	return
 }
@@ -189,6 +194,7 @@ func (sam *SAM) Lookup(name string) (I2PAddr, error) {
 // setting extra to something else than []string{}.
 // This sam3 instance is now a session
 func (sam *SAM) newGenericSession(style, id string, keys I2PKeys, options []string, extras []string) (net.Conn, error) {
+	warnUnknownOptions(options)
 
 	optStr := ""
 	for _, opt := range options {
@@ -215,29 +221,61 @@ func (sam *SAM) newGenericSession(style, id string, keys I2PKeys, options []stri
 		conn.Close()
 		return nil, err
 	}
-	text := string(buf[:n])
-	if strings.HasPrefix(text, session_OK) {
-		if keys.String() != text[len(session_OK):len(text)-1] {
+	text := strings.TrimSpace(string(buf[:n]))
+	if !strings.HasPrefix(text, session_STATUS) {
+		conn.Close()
+		return nil, errors.New("Unable to parse SAMv3 reply: " + text)
+	}
+	result, dest, message := parseSessionStatus(text)
+	if result == "OK" {
+		if keys.String() != dest {
 			conn.Close()
 			return nil, errors.New("SAMv3 created a tunnel with keys other than the ones we asked it for")
 		}
 		return conn, nil //&StreamSession{id, conn, keys, nil, sync.RWMutex{}, nil}, nil
-	} else if text == session_DUPLICATE_ID {
-		conn.Close()
-		return nil, errors.New("Duplicate tunnel name")
-	} else if text == session_DUPLICATE_DEST {
-		conn.Close()
-		return nil, errors.New("Duplicate destination")
-	} else if text == session_INVALID_KEY {
-		conn.Close()
-		return nil, errors.New("Invalid key")
-	} else if strings.HasPrefix(text, session_I2P_ERROR) {
-		conn.Close()
-		return nil, errors.New("I2P error " + text[len(session_I2P_ERROR):])
-	} else {
-		conn.Close()
-		return nil, errors.New("Unable to parse SAMv3 reply: " + text)
 	}
+	conn.Close()
+	return nil, sessionError(result, message)
+}
+
+// split a SESSION STATUS reply into its RESULT, DESTINATION and MESSAGE
+func parseSessionStatus(reply string) (result, dest, message string) {
+	message = replyMessage(reply)
+	// the message may contain spaces, so only look for fields before it
+	if idx := strings.Index(reply, "MESSAGE="); idx >= 0 {
+		reply = reply[:idx]
+	}
+	for _, field := range strings.Fields(reply) {
+		if strings.HasPrefix(field, "RESULT=") {
+			result = field[len("RESULT="):]
+		} else if strings.HasPrefix(field, "DESTINATION=") {
+			dest = field[len("DESTINATION="):]
+		}
+	}
+	return
+}
+
+// map the RESULT of a failed session creation to an error
+func sessionError(result, message string) error {
+	var err error
+	switch result {
+	case "DUPLICATED_ID":
+		err = ErrDuplicatedID
+	case "DUPLICATED_DEST":
+		err = ErrDuplicatedDest
+	case "INVALID_ID":
+		err = ErrInvalidID
+	case "INVALID_KEY":
+		err = ErrInvalidKey
+	case "I2P_ERROR":
+		err = ErrI2PError
+	default:
+		err = errors.New("unknown SAMv3 session result " + result)
+	}
+	if message != "" {
+		return fmt.Errorf("%w: %s", err, message)
+	}
+	return err
 }
 
 // close this sam session
@@ -1,6 +1,7 @@
 package sam3
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 	"time"
@@ -13,7 +14,7 @@ func Test_Basic(t *testing.T) {
 	fmt.Println("\tAttaching to SAM at " + yoursam)
 	sam, err := NewSAM(yoursam)
 	if err != nil {
-		fmt.Println(err.Error)
+		fmt.Println(err.Error())
 		t.Fail()
 		return
 	}
@@ -50,7 +51,7 @@ func Test_GenericSession(t *testing.T) {
 	fmt.Println("Test_GenericSession")
 	sam, err := NewSAM(yoursam)
 	if err != nil {
-		fmt.Println(err.Error)
+		fmt.Println(err.Error())
 		t.Fail()
 		return
 	}
@@ -148,7 +149,6 @@ func Test_RawServerClient(t *testing.T) {
 				return
 			}
 		}
-		c <- true
 	}(c, w)
 	buf := make([]byte, 512)
 	fmt.Println("\tServer: Read() waiting...")
@@ -162,3 +162,50 @@ func Test_RawServerClient(t *testing.T) {
 	fmt.Println("\tServer: Received datagram: " + string(buf[:n]))
 	//	fmt.Println("\tServer: Senders address was: " + saddr.Base32())
 }
+
+func TestParseSessionStatus(t *testing.T) {
+	var tests = []struct {
+		reply                 string
+		result, dest, message string
+	}{
+		{"SESSION STATUS RESULT=OK DESTINATION=abc~\n", "OK", "abc~", ""},
+		{"SESSION STATUS DESTINATION=abc~ RESULT=OK\n", "OK", "abc~", ""},
+		{"SESSION STATUS RESULT=DUPLICATED_ID\n", "DUPLICATED_ID", "", ""},
+		{`SESSION STATUS RESULT=I2P_ERROR MESSAGE="RESULT=OK isn't a valid option"` + "\n",
+			"I2P_ERROR", "", "RESULT=OK isn't a valid option"},
+		{"SESSION STATUS\n", "", "", ""},
+	}
+
+	for _, tt := range tests {
+		result, dest, message := parseSessionStatus(tt.reply)
+		if result != tt.result || dest != tt.dest || message != tt.message {
+			t.Errorf("%q: expected %q, %q and %q, got %q, %q and %q",
+				tt.reply, tt.result, tt.dest, tt.message, result, dest, message)
+		}
+	}
+}
+
+func TestSessionError(t *testing.T) {
+	var tests = []struct {
+		result, message string
+		err             error
+		text            string
+	}{
+		{"DUPLICATED_ID", "", ErrDuplicatedID, ErrDuplicatedID.Error()},
+		{"DUPLICATED_DEST", "", ErrDuplicatedDest, ErrDuplicatedDest.Error()},
+		{"INVALID_ID", "", ErrInvalidID, ErrInvalidID.Error()},
+		{"INVALID_KEY", "bad key", ErrInvalidKey, ErrInvalidKey.Error() + ": bad key"},
+		{"I2P_ERROR", "oops", ErrI2PError, ErrI2PError.Error() + ": oops"},
+		{"SOMETHING_NEW", "", nil, "unknown SAMv3 session result SOMETHING_NEW"},
+	}
+
+	for _, tt := range tests {
+		err := sessionError(tt.result, tt.message)
+		if tt.err != nil && !errors.Is(err, tt.err) {
+			t.Errorf("%s: expected %v, got %v", tt.result, tt.err, err)
+		}
+		if err.Error() != tt.text {
+			t.Errorf("%s: expected %q, got %q", tt.result, tt.text, err)
+		}
+	}
+}
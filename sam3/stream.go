@@ -8,6 +8,7 @@ import (
 	"io"
 	"net"
 	"strings"
+	"sync"
 )
 
 // Represents a streaming session.
@@ -91,6 +92,12 @@ type lookupResult struct {
 	err  error
 }
 
+// the bridge's answer to a lookup of a name it couldn't resolve, as opposed
+// to failing to talk to the bridge at all
+type namingError string
+
+func (e namingError) Error() string { return string(e) }
+
 func (ss *StreamSession) doNameLookup(req *lookupRequest) {
 	if _, err := ss.conn.Write([]byte("NAMING LOOKUP NAME=" + req.name + "\n")); err != nil {
 		ss.Close()
@@ -131,18 +138,36 @@ func (ss *StreamSession) doNameLookup(req *lookupRequest) {
 			continue
 		}
 	}
-	req.resp <- lookupResult{I2PAddr(""), errors.New(errStr)}
+	req.resp <- lookupResult{I2PAddr(""), namingError(errStr)}
 }
 
+// default number of accepted connections a listener buffers
+const DefaultAcceptBacklog = 128
+
 // create a new stream listener to accept inbound connections
 func (s *StreamSession) Listen(n int) (*StreamListener, error) {
-	l := &StreamListener{
-		session:  s,
-		id:       s.id,
-		laddr:    s.keys.Addr(),
-		accepted: make(chan acceptedConn, 128),
-		run:      true,
+	return s.ListenBacklog(n, DefaultAcceptBacklog)
+}
+
+// create a new stream listener to accept inbound connections with n accept
+// loops, buffering up to backlog accepted connections
+// while the backlog is full the accept loops stop accepting, so under a burst
+// a small backlog leaves connections waiting in the router and a large one
+// holds them open in memory until they are served
+func (s *StreamSession) ListenBacklog(n, backlog int) (*StreamListener, error) {
+	return s.ListenPool(n, backlog, 0)
+}
+
+// create a new stream listener like ListenBacklog that keeps up to pool bridge
+// connections ready for its accept loops
+// without a pool every accept first dials the bridge and waits for its HELLO
+// reply, which holds up accepting during a burst
+func (s *StreamSession) ListenPool(n, backlog, pool int) (*StreamListener, error) {
+	if backlog <= 0 {
+		backlog = DefaultAcceptBacklog
 	}
+	l := newStreamListener(s, s.keys.Addr(), backlog)
+	l.pool = newSAMPool(s.samAddr, pool)
 	s.listeners = append(s.listeners, l)
 	if n <= 0 {
 		n = 1
@@ -167,20 +192,71 @@ type StreamListener struct {
 	// our local address for this sam socket
 	laddr I2PAddr
 	// channel for accepted connection backlog
+	// never closed, so accept loops can't send on a closed channel
 	accepted chan acceptedConn
-	// run flag
-	run bool
+	// closed once the listener is closed
+	done      chan struct{}
+	closeOnce sync.Once
+	// bridge connections ready to accept on, nil without a pool
+	pool *samPool
+}
+
+func newStreamListener(s *StreamSession, laddr I2PAddr, backlog int) *StreamListener {
+	l := &StreamListener{
+		session:  s,
+		laddr:    laddr,
+		accepted: make(chan acceptedConn, backlog),
+		done:     make(chan struct{}),
+	}
+	if s != nil {
+		l.id = s.id
+	}
+	return l
+}
+
+// closed is true once the listener is closed
+func (l *StreamListener) closed() bool {
+	select {
+	case <-l.done:
+		return true
+	default:
+		return false
+	}
 }
 
 func (l *StreamListener) acceptLoop() {
-	for l.run && l.session.IsOpen() {
+	for !l.closed() && l.session.IsOpen() {
 		n, err := l.AcceptI2P()
-		if l.accepted != nil {
-			if err == nil {
-				l.accepted <- acceptedConn{n, nil}
-				continue
-			}
-		} else {
+		if err == nil && !l.deliver(n) {
+			return
+		}
+	}
+}
+
+// hand an accepted connection to Accept, closing it instead if the listener
+// is closed first
+func (l *StreamListener) deliver(n net.Conn) bool {
+	select {
+	case l.accepted <- acceptedConn{n, nil}:
+		// Close may have emptied the backlog just before we sent
+		if l.closed() {
+			l.closeBacklog()
+			return false
+		}
+		return true
+	case <-l.done:
+		n.Close()
+		return false
+	}
+}
+
+// close the connections in the backlog nobody will accept now
+func (l *StreamListener) closeBacklog() {
+	for {
+		select {
+		case a := <-l.accepted:
+			a.c.Close()
+		default:
 			return
 		}
 	}
@@ -193,23 +269,29 @@ func (l *StreamListener) Addr() net.Addr {
 }
 
 // implements net.Listener
+// closing more than once is harmless
 func (l *StreamListener) Close() error {
-	l.run = false
-	chnl := l.accepted
-	l.accepted = nil
-	close(chnl)
-	l.session = nil
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.pool.Close()
+		l.closeBacklog()
+	})
 	return nil
 }
 
+var errListenerClosed = errors.New("i2p acceptor closed")
+
 // implements net.Listener
 func (l *StreamListener) Accept() (n net.Conn, err error) {
-	a, ok := <-l.accepted
-	if !ok {
-		err = errors.New("i2p acceptor closed")
-		return
+	if l.closed() {
+		return nil, errListenerClosed
+	}
+	select {
+	case a := <-l.accepted:
+		n, err = a.c, a.err
+	case <-l.done:
+		err = errListenerClosed
 	}
-	n, err = a.c, a.err
 	return
 }
 
@@ -217,18 +299,63 @@ func (l *StreamListener) AcceptI2P() (*SAMConn, error) {
 	if l.session == nil {
 		return nil, errors.New("no i2p session for this listener")
 	}
-	s, err := NewSAM(l.session.samAddr)
+	s, err := l.pool.get(l.session.samAddr)
 	if err != nil {
 		return nil, err
 	}
 	nc := s.conn
 	fmt.Fprintf(nc, "STREAM ACCEPT ID=%s SILENT=false\n", l.id)
+	if err = readStreamStatus(nc); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	// the bridge sends the destination of the peer once it connects
 	var line string
 	line, err = readLine(nc)
 	if err != nil {
 		nc.Close()
 		return nil, err
 	}
+	nc.(*net.TCPConn).SetLinger(0)
+	return &SAMConn{
+		laddr: l.laddr,
+		raddr: I2PAddr(line),
+		conn:  nc,
+	}, nil
+}
+
+// dial a destination through the sam bridge as a net.Conn
+func (s *StreamSession) Dial(dest I2PAddr) (net.Conn, error) {
+	return s.DialI2P(dest)
+}
+
+// dial a destination through the sam bridge
+func (s *StreamSession) DialI2P(dest I2PAddr) (*SAMConn, error) {
+	sam, err := NewSAM(s.samAddr)
+	if err != nil {
+		return nil, err
+	}
+	nc := sam.conn
+	fmt.Fprintf(nc, "STREAM CONNECT ID=%s DESTINATION=%s SILENT=false\n", s.id, dest.Base64())
+	if err = readStreamStatus(nc); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	nc.(*net.TCPConn).SetLinger(0)
+	return &SAMConn{
+		laddr: s.keys.Addr(),
+		raddr: dest,
+		conn:  nc,
+	}, nil
+}
+
+// read the STREAM STATUS reply to a STREAM ACCEPT or STREAM CONNECT, which is
+// nil if the bridge replied RESULT=OK
+func readStreamStatus(nc net.Conn) error {
+	line, err := readLine(nc)
+	if err != nil {
+		return err
+	}
 	scanner := bufio.NewScanner(strings.NewReader(line))
 	scanner.Split(bufio.ScanWords)
 	for scanner.Scan() {
@@ -237,36 +364,20 @@ func (l *StreamListener) AcceptI2P() (*SAMConn, error) {
 		case "STATUS":
 			continue
 		case "RESULT=OK":
-			line, err = readLine(nc)
-			if err != nil {
-				nc.Close()
-				return nil, err
-			}
-			nc.(*net.TCPConn).SetLinger(0)
-			return &SAMConn{
-				laddr: l.laddr,
-				raddr: I2PAddr(line),
-				conn:  nc,
-			}, nil
+			return nil
 		case "RESULT=CANT_REACH_PEER":
-			nc.Close()
-			return nil, errors.New("Can not reach peer")
+			return errors.New("Can not reach peer")
 		case "RESULT=I2P_ERROR":
-			nc.Close()
-			return nil, errors.New("I2P internal error")
+			return errors.New("I2P internal error")
 		case "RESULT=INVALID_KEY":
-			nc.Close()
-			return nil, errors.New("Invalid key")
+			return errors.New("Invalid key")
 		case "RESULT=INVALID_ID":
-			nc.Close()
-			return nil, errors.New("Invalid tunnel ID")
+			return errors.New("Invalid tunnel ID")
 		case "RESULT=TIMEOUT":
-			nc.Close()
-			return nil, errors.New("Timeout")
+			return errors.New("Timeout")
 		default:
-			nc.Close()
-			return nil, errors.New("Unknown error: " + line)
+			return errors.New("Unknown error: " + line)
 		}
 	}
-	return nil, err
+	return errors.New("Unknown error: " + line)
 }
@@ -13,7 +13,7 @@ func Test_StreamingDial(t *testing.T) {
 	fmt.Println("Test_StreamingDial")
 	sam, err := NewSAM(yoursam)
 	if err != nil {
-		fmt.Println(err.Error)
+		fmt.Println(err.Error())
 		t.Fail()
 		return
 	}
@@ -121,9 +121,9 @@ func Test_StreamingServerClient(t *testing.T) {
 		}
 		c <- true
 	}(c, w)
-	l, err := ss.Listen()
+	l, err := ss.Listen(1)
 	if err != nil {
-		fmt.Println("ss.Listen(): " + err.Error())
+		fmt.Println("ss.Listen(1): " + err.Error())
 		t.Fail()
 		w <- false
 		return
@@ -260,7 +260,7 @@ func ExampleStreamListener() {
 		fmt.Println(err.Error())
 		return
 	}
-	l, err := ss.Listen()
+	l, err := ss.Listen(1)
 	if err != nil {
 		fmt.Println(err.Error())
 		return
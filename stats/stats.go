@@ -7,6 +7,7 @@
 package stats
 
 import (
+	"sync/atomic"
 	"time"
 
 	"github.com/pushrax/faststats"
@@ -18,6 +19,9 @@ import (
 const (
 	Announce = iota
 	Scrape
+	ThrottledScrape
+	UnknownScrapeTorrent
+	SuspiciousPeerID
 
 	Completed
 	NewLeech
@@ -33,12 +37,23 @@ const (
 
 	AcceptedConnection
 	ClosedConnection
+	RejectedConnection
 
 	HandledRequest
+	SlowRequest
 	ErroredRequest
+	ThrottledRequest
 	ClientError
+	BackendUnavailable
+
+	ReverseDNSLookup
+	ReverseDNSFailure
+	ForwardDNSLookup
+	ForwardDNSFailure
 
 	ResponseTime
+	ReverseDNSTime
+	ForwardDNSTime
 )
 
 // DefaultStats is a default instance of stats tracking that uses an unbuffered
@@ -66,36 +81,73 @@ type PercentileTimes struct {
 	P95 *faststats.Percentile
 }
 
+// DNSLookupStats counts the lookups of one kind of DNS query and how long
+// they took, in milliseconds.
+type DNSLookupStats struct {
+	Lookups  uint64 // Lookups made, including failed ones.
+	Failures uint64 // Lookups that failed or found nothing.
+	Time     PercentileTimes
+}
+
+type DNSStats struct {
+	Reverse DNSLookupStats
+	Forward DNSLookupStats
+}
+
+type timing struct {
+	event    int
+	duration time.Duration
+}
+
 type Stats struct {
 	Started time.Time // Time at which Chihaya was booted.
 
 	OpenConnections     int64  `json:"connectionsOpen"`
+	ActiveConnections   int64  `json:"connectionsActive"`
+	IdleConnections     int64  `json:"connectionsIdle"`
 	ConnectionsAccepted uint64 `json:"connectionsAccepted"`
+	ConnectionsRejected uint64 `json:"connectionsRejected"`
 	BytesTransmitted    uint64 `json:"bytesTransmitted"`
 
 	GoRoutines int `json:"runtimeGoRoutines"`
 
 	RequestsHandled uint64 `json:"requestsHandled"`
 	RequestsErrored uint64 `json:"requestsErrored"`
+	RequestsSlow    uint64 `json:"requestsSlow"`
 	ClientErrors    uint64 `json:"requestsBad"`
+	BackendErrors   uint64 `json:"requestsBackendUnavailable"`
 	ResponseTime    PercentileTimes
 
+	// Requests refused because their address had too many in flight.
+	RequestsThrottled uint64 `json:"requestsThrottled"`
+
 	Announces uint64 `json:"trackerAnnounces"`
 	Scrapes   uint64 `json:"trackerScrapes"`
 
+	ScrapesThrottled uint64 `json:"trackerScrapesThrottled"`
+	ScrapesUnknown   uint64 `json:"trackerScrapesUnknownTorrents"`
+
+	// Announces by a peer ID just seen at a distant address.
+	SuspiciousPeerIDs uint64 `json:"trackerAnnouncesSuspiciousPeerID"`
+
+	// The announce interval in seconds currently advertised to clients.
+	AnnounceInterval int64 `json:"trackerAnnounceInterval"`
+
 	TorrentsSize    uint64 `json:"torrentsSize"`
 	TorrentsAdded   uint64 `json:"torrentsAdded"`
 	TorrentsRemoved uint64 `json:"torrentsRemoved"`
 	TorrentsReaped  uint64 `json:"torrentsReaped"`
 
-	Peers PeerStats `json:"peers`
+	Peers PeerStats `json:"peers"`
+
+	DNS DNSStats `json:"dns"`
 
 	*MemStatsWrapper `json:",omitempty"`
 
-	events             chan int
-	peerEvents         chan int
-	responseTimeEvents chan time.Duration
-	recordMemStats     <-chan time.Time
+	events         chan int
+	peerEvents     chan int
+	timingEvents   chan timing
+	recordMemStats <-chan time.Time
 
 	flattened flatjson.Map
 }
@@ -107,13 +159,13 @@ func New(cfg config.StatsConfig) *Stats {
 
 		GoRoutines: 0,
 
-		peerEvents:         make(chan int, cfg.BufferSize),
-		responseTimeEvents: make(chan time.Duration, cfg.BufferSize),
+		peerEvents:   make(chan int, cfg.BufferSize),
+		timingEvents: make(chan timing, cfg.BufferSize),
 
-		ResponseTime: PercentileTimes{
-			P50: faststats.NewPercentile(0.5),
-			P90: faststats.NewPercentile(0.9),
-			P95: faststats.NewPercentile(0.95),
+		ResponseTime: newPercentileTimes(),
+		DNS: DNSStats{
+			Reverse: DNSLookupStats{Time: newPercentileTimes()},
+			Forward: DNSLookupStats{Time: newPercentileTimes()},
 		},
 	}
 
@@ -127,6 +179,21 @@ func New(cfg config.StatsConfig) *Stats {
 	return s
 }
 
+func newPercentileTimes() PercentileTimes {
+	return PercentileTimes{
+		P50: faststats.NewPercentile(0.5),
+		P90: faststats.NewPercentile(0.9),
+		P95: faststats.NewPercentile(0.95),
+	}
+}
+
+func (pt *PercentileTimes) addSample(duration time.Duration) {
+	f := float64(duration) / float64(time.Millisecond)
+	pt.P50.AddSample(f)
+	pt.P90.AddSample(f)
+	pt.P95.AddSample(f)
+}
+
 func (s *Stats) Flattened() flatjson.Map {
 	return s.flattened
 }
@@ -149,13 +216,30 @@ func (s *Stats) RecordPeerEvent(event int) {
 
 func (s *Stats) RecordTiming(event int, duration time.Duration) {
 	switch event {
-	case ResponseTime:
-		s.responseTimeEvents <- duration
+	case ResponseTime, ReverseDNSTime, ForwardDNSTime:
+		s.timingEvents <- timing{event, duration}
 	default:
 		panic("stats: RecordTiming called with an unknown event")
 	}
 }
 
+// RecordAnnounceInterval sets the announce interval currently advertised to
+// clients.
+func (s *Stats) RecordAnnounceInterval(interval time.Duration) {
+	atomic.StoreInt64(&s.AnnounceInterval, int64(interval/time.Second))
+}
+
+// RecordConnectionStates adds to the numbers of connections serving a request
+// and of connections kept alive between requests.
+func (s *Stats) RecordConnectionStates(active, idle int64) {
+	if active != 0 {
+		atomic.AddInt64(&s.ActiveConnections, active)
+	}
+	if idle != 0 {
+		atomic.AddInt64(&s.IdleConnections, idle)
+	}
+}
+
 func (s *Stats) handleEvents() {
 	for {
 		select {
@@ -165,11 +249,8 @@ func (s *Stats) handleEvents() {
 		case event := <-s.peerEvents:
 			s.handlePeerEvent(&s.Peers, event)
 
-		case duration := <-s.responseTimeEvents:
-			f := float64(duration) / float64(time.Millisecond)
-			s.ResponseTime.P50.AddSample(f)
-			s.ResponseTime.P90.AddSample(f)
-			s.ResponseTime.P95.AddSample(f)
+		case t := <-s.timingEvents:
+			s.handleTiming(t)
 
 		case <-s.recordMemStats:
 			s.MemStatsWrapper.Update()
@@ -185,6 +266,15 @@ func (s *Stats) handleEvent(event int) {
 	case Scrape:
 		s.Scrapes++
 
+	case ThrottledScrape:
+		s.ScrapesThrottled++
+
+	case UnknownScrapeTorrent:
+		s.ScrapesUnknown++
+
+	case SuspiciousPeerID:
+		s.SuspiciousPeerIDs++
+
 	case NewTorrent:
 		s.TorrentsAdded++
 		s.TorrentsSize++
@@ -199,13 +289,19 @@ func (s *Stats) handleEvent(event int) {
 
 	case AcceptedConnection:
 		s.ConnectionsAccepted++
-		s.OpenConnections++
+		atomic.AddInt64(&s.OpenConnections, 1)
 
 	case ClosedConnection:
-		s.OpenConnections--
+		atomic.AddInt64(&s.OpenConnections, -1)
+
+	case RejectedConnection:
+		s.ConnectionsRejected++
 
 	case HandledRequest:
-		s.RequestsHandled++
+		atomic.AddUint64(&s.RequestsHandled, 1)
+
+	case SlowRequest:
+		s.RequestsSlow++
 
 	case ClientError:
 		s.ClientErrors++
@@ -213,11 +309,42 @@ func (s *Stats) handleEvent(event int) {
 	case ErroredRequest:
 		s.RequestsErrored++
 
+	case ThrottledRequest:
+		s.RequestsThrottled++
+
+	case BackendUnavailable:
+		s.BackendErrors++
+
+	case ReverseDNSLookup:
+		s.DNS.Reverse.Lookups++
+
+	case ReverseDNSFailure:
+		s.DNS.Reverse.Failures++
+
+	case ForwardDNSLookup:
+		s.DNS.Forward.Lookups++
+
+	case ForwardDNSFailure:
+		s.DNS.Forward.Failures++
+
 	default:
 		panic("stats: RecordEvent called with an unknown event")
 	}
 }
 
+func (s *Stats) handleTiming(t timing) {
+	switch t.event {
+	case ResponseTime:
+		s.ResponseTime.addSample(t.duration)
+
+	case ReverseDNSTime:
+		s.DNS.Reverse.Time.addSample(t.duration)
+
+	case ForwardDNSTime:
+		s.DNS.Forward.Time.addSample(t.duration)
+	}
+}
+
 func (s *Stats) handlePeerEvent(ps *PeerStats, event int) {
 	switch event {
 	case Completed:
@@ -279,3 +406,36 @@ func RecordTiming(event int, duration time.Duration) {
 		DefaultStats.RecordTiming(event, duration)
 	}
 }
+
+// RecordAnnounceInterval sets the announce interval advertised to clients in
+// the default stats.
+func RecordAnnounceInterval(interval time.Duration) {
+	if DefaultStats != nil {
+		DefaultStats.RecordAnnounceInterval(interval)
+	}
+}
+
+// RecordConnectionStates adds to the numbers of active and idle connections in
+// the default stats.
+func RecordConnectionStates(active, idle int64) {
+	if DefaultStats != nil {
+		DefaultStats.RecordConnectionStates(active, idle)
+	}
+}
+
+// RecordDNSLookup broadcasts the outcome of a DNS lookup made at start, either
+// a reverse or a forward one, to the default stats queue.
+func RecordDNSLookup(reverse bool, start time.Time, err error) {
+	if DefaultStats == nil {
+		return
+	}
+	lookup, failure, took := ForwardDNSLookup, ForwardDNSFailure, ForwardDNSTime
+	if reverse {
+		lookup, failure, took = ReverseDNSLookup, ReverseDNSFailure, ReverseDNSTime
+	}
+	DefaultStats.RecordEvent(lookup)
+	if err != nil {
+		DefaultStats.RecordEvent(failure)
+	}
+	DefaultStats.RecordTiming(took, time.Since(start))
+}
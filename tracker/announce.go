@@ -5,25 +5,117 @@
 package tracker
 
 import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/majestrate/chihaya/config"
 	"github.com/majestrate/chihaya/stats"
 	"github.com/majestrate/chihaya/tracker/models"
 )
 
+// how long clients shed for announcing to a busy torrent are asked to wait
+const busyTorrentRetryIn = time.Minute
+
 // HandleAnnounce encapsulates all of the logic of handling a BitTorrent
 // client's Announce without being coupled to any transport protocol.
-func (tkr *Tracker) HandleAnnounce(ann *models.Announce, w Writer) (err error) {
-	if tkr.Config.ClientWhitelistEnabled {
-		if err = tkr.ClientApproved(ann.ClientID()); err != nil {
+func (tkr *Tracker) HandleAnnounce(ann *models.Announce, w Writer) error {
+	user, err := tkr.announceUser(ann)
+	if err != nil {
+		return err
+	}
+	return tkr.handleAnnounce(ann, user, w)
+}
+
+// HandleAnnounceBatch handles the announces of one client for several
+// torrents, checking the client and looking up its user only once. Each
+// announce is still authorized on its own, as the Authorizer may refuse some
+// torrents and not others. The response to each announce, or its public
+// error, is written to the Writer at the same index. An error is only
+// returned if the client is refused or an announce fails on the tracker's
+// side.
+func (tkr *Tracker) HandleAnnounceBatch(anns []*models.Announce, writers []Writer) error {
+	if len(anns) == 0 || len(anns) != len(writers) {
+		return models.ErrMalformedRequest
+	}
+
+	user, err := tkr.announceUser(anns[0])
+	if err != nil {
+		return err
+	}
+
+	for i, ann := range anns {
+		err = nil
+		if i > 0 {
+			_, err = tkr.Authorizer.AuthorizeAnnounce(ann)
+		}
+		if err == nil {
+			err = tkr.handleAnnounce(ann, user, writers[i])
+		}
+		if err == nil {
+			continue
+		}
+		if !models.IsPublicError(err) {
+			return err
+		}
+		if _, retryable := err.(*models.RetryableError); !retryable {
+			stats.RecordEvent(stats.ClientError)
+		}
+		if err = writers[i].WriteError(err); err != nil {
 			return err
 		}
 	}
+	return nil
+}
 
-	var user *models.User
-	if tkr.Config.PrivateEnabled {
-		if user, err = tkr.FindUser(ann.Passkey); err != nil {
-			return err
+// announceUser checks that the client announcing is allowed to and that the
+// announce is authorized, and finds its user on a private tracker.
+func (tkr *Tracker) announceUser(ann *models.Announce) (*models.User, error) {
+	if tkr.Config.ClientWhitelistEnabled {
+		if err := tkr.ClientApproved(ann.ClientID()); err != nil {
+			return nil, err
+		}
+	}
+
+	return tkr.Authorizer.AuthorizeAnnounce(ann)
+}
+
+// handleAnnounce handles an announce by a client already checked by
+// announceUser.
+func (tkr *Tracker) handleAnnounce(ann *models.Announce, user *models.User, w Writer) (err error) {
+	if ann.DryRun && !tkr.Config.DryRunEnabled {
+		return models.ErrDryRunDisabled
+	}
+
+	if tkr.blocklist.Contains(ann.Infohash) {
+		return models.ErrTorrentBlocked
+	}
+
+	// Peers can't be reached on blocked ports. Some clients send port 0 when
+	// they stop, so stopping peers are let through to leave the swarm.
+	blockedPort := tkr.blockedPorts.Contains(ann.Port) && ann.Event != "stopped"
+	if blockedPort && !tkr.Config.HideBlockedPorts {
+		return models.ErrMalformedRequest
+	}
+
+	if seen := tkr.peerIDs.Check(ann.PeerID, ann.IP, ann.AltIP); seen != nil {
+		glog.Warningf("Peer ID %q announced from %s, but was just seen at %s", ann.PeerID, ann.IP, seen)
+		stats.RecordEvent(stats.SuspiciousPeerID)
+		if tkr.Config.RejectPeerIDReuse {
+			return models.ErrPeerIDReused
+		}
+	}
+
+	// Limit the announces for a torrent processed at once, so that a flash
+	// crowd on one torrent doesn't hold up everything else.
+	if !tkr.Cache.AcquireAnnounce(ann.Infohash, tkr.Config.TorrentAnnounceWait.Duration) {
+		return &models.RetryableError{
+			Reason:  "too many announces for this torrent",
+			RetryIn: busyTorrentRetryIn,
 		}
 	}
+	defer tkr.Cache.ReleaseAnnounce(ann.Infohash)
 
 	torrent, err := tkr.FindTorrent(ann.Infohash)
 
@@ -34,25 +126,69 @@ func (tkr *Tracker) HandleAnnounce(ann *models.Announce, w Writer) (err error) {
 			Leechers: models.NewPeerMap(false, tkr.Config),
 		}
 
-		tkr.PutTorrent(torrent)
-		stats.RecordEvent(stats.NewTorrent)
+		if !ann.DryRun {
+			tkr.PutTorrent(torrent)
+			stats.RecordEvent(stats.NewTorrent)
+		}
 	} else if err != nil {
 		return err
 	}
 
 	ann.BuildPeer(user, torrent)
+	if blockedPort {
+		ann.Peer.Unreachable = true
+		if ann.AltPeer != nil {
+			ann.AltPeer.Unreachable = true
+		}
+	}
+
+	if tkr.Config.RequireApproval && !torrent.Status.Leechable() && ann.Left > 0 &&
+		!torrent.Leechers.Contains(ann.Peer.Key()) && !torrent.Seeders.Contains(ann.Peer.Key()) {
+		return models.ErrTorrentUnapproved
+	}
+
+	if ann.Event == "completed" && !torrent.Leechers.Contains(ann.Peer.Key()) {
+		// Only a leecher can complete a torrent. Cross-seeding clients start
+		// out as seeders and may still send the event, so it is ignored
+		// unless events are strictly checked.
+		if tkr.Config.StrictEvents {
+			return models.ErrBadRequest
+		}
+		ann.Event = ""
+	}
+
+	if ann.DryRun {
+		// Respond as if the announce had been handled, but leave the swarm,
+		// the stats and the backend untouched.
+		return w.WriteAnnounce(tkr.newAnnounceResponse(ann))
+	}
+
+	// Peers already in the swarm keep their place, whatever the limit.
+	if user != nil && !leaving(ann) && !torrent.Leechers.Contains(ann.Peer.Key()) && !torrent.Seeders.Contains(ann.Peer.Key()) &&
+		!tkr.userPeers.Acquire(user.ID, torrent.Infohash, ann.Peer.Key(), ann.Peer.IP, tkr.userPeer) {
+		return models.ErrTooManyUserPeers
+	}
+
+	// Seeding is unlimited, and leechers already in the swarm keep their slot.
+	if user != nil && ann.Left > 0 && !leaving(ann) && !torrent.Leechers.Contains(ann.Peer.Key()) &&
+		!tkr.leechSlots.Acquire(user.ID, torrent.Infohash, ann.Peer.Key(), tkr.userLeeching) {
+		return models.ErrTooManyLeeches
+	}
+
 	var delta *models.AnnounceDelta
 
 	if tkr.Config.PrivateEnabled {
 		delta = newAnnounceDelta(ann, torrent)
 	}
 
-	created, err := tkr.updateSwarm(ann)
-	if err != nil {
-		return err
+	var created, snatched bool
+	if leaving(ann) {
+		// A leaving peer is only removed, there is no point in updating it
+		// first or picking peers for it.
+		_, err = tkr.handleEvent(ann)
+	} else if created, err = tkr.updateSwarm(ann); err == nil {
+		snatched, err = tkr.handleEvent(ann)
 	}
-
-	snatched, err := tkr.handleEvent(ann)
 	if err != nil {
 		return err
 	}
@@ -61,7 +197,7 @@ func (tkr *Tracker) HandleAnnounce(ann *models.Announce, w Writer) (err error) {
 		delta.Created = created
 		delta.Snatched = snatched
 		if err = tkr.Backend.RecordAnnounce(delta); err != nil {
-			return err
+			return tkr.backendError(err)
 		}
 	} else if tkr.Config.PurgeInactiveTorrents && torrent.PeerCount() == 0 {
 		// Rather than deleting the torrent explicitly, let the tracker driver delete torrents
@@ -70,24 +206,41 @@ func (tkr *Tracker) HandleAnnounce(ann *models.Announce, w Writer) (err error) {
 		stats.RecordEvent(stats.DeletedTorrent)
 	}
 
+	tkr.audit.Record(ann)
 	stats.RecordEvent(stats.Announce)
-	return w.WriteAnnounce(newAnnounceResponse(ann))
+	return w.WriteAnnounce(tkr.newAnnounceResponse(ann))
+}
+
+// leaving is true for announces of peers leaving the swarm, which only have to
+// be removed and get an empty peer list.
+func leaving(ann *models.Announce) bool {
+	return ann.Event == "stopped" || ann.Event == "paused"
+}
+
+// subtractClamped returns a-b, or 0 if b is larger than a.
+func subtractClamped(a, b uint64) uint64 {
+	if b > a {
+		return 0
+	}
+	return a - b
 }
 
 // Builds a partially populated AnnounceDelta, without the Snatched and Created
 // fields set.
 func newAnnounceDelta(ann *models.Announce, t *models.Torrent) *models.AnnounceDelta {
-	var oldUp, oldDown, rawDeltaUp, rawDeltaDown uint64
+	var oldUp, oldDown, oldCorrupt, rawDeltaUp, rawDeltaDown, deltaCorrupt uint64
 
 	switch {
 	case t.Seeders.Contains(ann.Peer.Key()):
 		oldPeer, _ := t.Seeders.LookUp(ann.Peer.Key())
 		oldUp = oldPeer.Uploaded
 		oldDown = oldPeer.Downloaded
+		oldCorrupt = oldPeer.Corrupt
 	case t.Leechers.Contains(ann.Peer.Key()):
 		oldPeer, _ := t.Leechers.LookUp(ann.Peer.Key())
 		oldUp = oldPeer.Uploaded
 		oldDown = oldPeer.Downloaded
+		oldCorrupt = oldPeer.Corrupt
 	}
 
 	// Restarting a torrent may cause a delta to be negative.
@@ -97,11 +250,16 @@ func newAnnounceDelta(ann *models.Announce, t *models.Torrent) *models.AnnounceD
 	if ann.Peer.Downloaded > oldDown {
 		rawDeltaDown = ann.Peer.Downloaded - oldDown
 	}
+	if ann.Peer.Corrupt > oldCorrupt {
+		deltaCorrupt = ann.Peer.Corrupt - oldCorrupt
+	}
 
-	uploaded := uint64(float64(rawDeltaUp) * ann.User.UpMultiplier * ann.Torrent.UpMultiplier)
-	downloaded := uint64(float64(rawDeltaDown) * ann.User.DownMultiplier * ann.Torrent.DownMultiplier)
+	// Bytes that failed a hash check are credited to neither side. They are
+	// taken off before the multipliers, which apply to the bytes that count.
+	uploaded := uint64(float64(subtractClamped(rawDeltaUp, deltaCorrupt)) * ann.User.UpMultiplier * ann.Torrent.UpMultiplier)
+	downloaded := uint64(float64(subtractClamped(rawDeltaDown, deltaCorrupt)) * ann.User.DownMultiplier * ann.Torrent.DownMultiplier)
 
-	if ann.Config.FreeleechEnabled {
+	if ann.Config.FreeleechEnabled || ann.Torrent.Freeleech {
 		downloaded = 0
 	}
 
@@ -121,11 +279,22 @@ func newAnnounceDelta(ann *models.Announce, t *models.Torrent) *models.AnnounceD
 func (tkr *Tracker) updateSwarm(ann *models.Announce) (created bool, err error) {
 	tkr.TouchTorrent(ann.Torrent.Infohash)
 	created, err = tkr.updatePeer(ann, ann.Peer)
+	if err == nil && ann.AltPeer != nil {
+		_, err = tkr.updatePeer(ann, ann.AltPeer)
+	}
 	return
 }
 
-func (tkr *Tracker) updatePeer(ann *models.Announce, peer *models.Peer) (created bool, err error) {
-	p, t := ann.Peer, ann.Torrent
+func (tkr *Tracker) updatePeer(ann *models.Announce, p *models.Peer) (created bool, err error) {
+	t := ann.Torrent
+
+	// Count this announce along with the peer's earlier ones.
+	p.Announces = 1
+	if old, ok := t.Seeders.LookUp(p.Key()); ok {
+		p.Announces += old.Announces
+	} else if old, ok := t.Leechers.LookUp(p.Key()); ok {
+		p.Announces += old.Announces
+	}
 
 	switch {
 	case t.Seeders.Contains(p.Key()):
@@ -164,23 +333,27 @@ func (tkr *Tracker) updatePeer(ann *models.Announce, peer *models.Peer) (created
 // properly handles that event.
 func (tkr *Tracker) handleEvent(ann *models.Announce) (snatched bool, err error) {
 	snatched, err = tkr.handlePeerEvent(ann, ann.Peer)
-	if err == nil {
+	if err == nil && ann.AltPeer != nil {
+		// A dual-stacked peer is a single download, so it is only counted
+		// as one snatch.
+		var altSnatched bool
+		altSnatched, err = tkr.handlePeerEvent(ann, ann.AltPeer)
+		snatched = snatched || altSnatched
+	}
+	if err == nil && snatched {
+		// ann.Torrent is the stored torrent, so this is reflected there too.
 		err = tkr.IncrementTorrentSnatches(ann.Torrent.Infohash)
-		if err == nil {
-			ann.Torrent.Snatches++
-			snatched = true
-		}
 	}
 	return
 }
 
 func (tkr *Tracker) handlePeerEvent(ann *models.Announce, p *models.Peer) (snatched bool, err error) {
-	p, t := ann.Peer, ann.Torrent
+	t := ann.Torrent
 
 	switch {
-	case ann.Event == "stopped" || ann.Event == "paused":
-		// updateSwarm checks if the peer is active on the torrent,
-		// so one of these branches must be followed.
+	case leaving(ann):
+		// Peers that stop are removed right away rather than being left for
+		// the reaper, which only catches peers that vanish without stopping.
 		if t.Seeders.Contains(p.Key()) {
 			err = tkr.DeleteSeeder(t.Infohash, p)
 			if err != nil {
@@ -227,7 +400,17 @@ func (tkr *Tracker) leecherFinished(t *models.Torrent, p *models.Peer) error {
 	return nil
 }
 
-func newAnnounceResponse(ann *models.Announce) *models.AnnounceResponse {
+// announceInterval returns the interval to advertise to clients: announce, or
+// the interval raised under load, kept within minInterval and maxInterval.
+func (tkr *Tracker) announceInterval(cfg *config.Config) time.Duration {
+	interval := tkr.loadInterval.Interval(cfg.Announce.Duration)
+	return clampInterval(interval, cfg.MinInterval.Duration, cfg.MaxInterval.Duration)
+}
+
+// newAnnounceResponse builds the response to an announce. The seeder and
+// leecher counts are those of the live swarm whether or not any peers are
+// handed out, as clients show them as the health of the torrent.
+func (tkr *Tracker) newAnnounceResponse(ann *models.Announce) *models.AnnounceResponse {
 	seedCount := ann.Torrent.Seeders.Len()
 	leechCount := ann.Torrent.Leechers.Len()
 
@@ -235,15 +418,23 @@ func newAnnounceResponse(ann *models.Announce) *models.AnnounceResponse {
 		Announce:    ann,
 		Complete:    seedCount,
 		Incomplete:  leechCount,
-		Interval:    int64(ann.Config.Announce.Duration.Seconds()),
+		Interval:    int64(tkr.announceInterval(ann.Config).Seconds()),
 		MinInterval: int64(ann.Config.MinAnnounce.Duration.Seconds()),
 		Compact:     true,
 	}
 
-	if ann.NumWant > 0 && ann.Event != "stopped" && ann.Event != "paused" {
-		res.Peers = getPeers(ann)
+	if ann.NumWant > 0 && !leaving(ann) {
+		res.DHTNodes = tkr.dhtNodes
+
+		if ann.Left > 0 && seedCount < ann.Config.MinSeedersToLeech {
+			res.Warning = fmt.Sprintf("torrent has fewer than %d seeders, not handing out peers", ann.Config.MinSeedersToLeech)
+			return res
+		}
+
+		res.Peers, res.CachedPeers = tkr.getPeers(ann)
 
 		if len(res.Peers) == 0 {
+			res.WebSeeds = webSeeds(ann)
 			res.Peers = append(res.Peers, *ann.Peer)
 		}
 	}
@@ -251,15 +442,77 @@ func newAnnounceResponse(ann *models.Announce) *models.AnnounceResponse {
 	return res
 }
 
-// getPeers returns lists IPv4 and IPv6 peers on a given torrent sized according
-// to the wanted parameter.
-func getPeers(ann *models.Announce) (peers models.PeerList) {
+// webSeeds returns the web seeds of an announce's torrent, falling back to
+// the globally configured ones.
+func webSeeds(ann *models.Announce) []string {
+	if info := ann.Torrent.Info; info != nil && len(info.WebSeeds) > 0 {
+		return info.WebSeeds
+	}
+	return ann.Config.WebSeeds
+}
+
+// getPeers returns the peers for an announce, reusing a list recently picked
+// for another announce when the peer list cache is enabled. Empty lists are
+// never cached. Started announces always get a freshly picked list, as a
+// client that just started has to find peers to begin downloading. A cached
+// list holding the announcing peer itself is handed out without it, and then
+// isn't shared.
+func (tkr *Tracker) getPeers(ann *models.Announce) (models.PeerList, *models.CachedPeerList) {
+	if tkr.peerLists == nil {
+		return pickPeers(ann), nil
+	}
+
+	key := peerListKey{
+		infohash: ann.Infohash,
+		numWant:  ann.NumWant,
+		seeding:  ann.Left == 0,
+		family:   familyOf(ann.IP),
+
+		sameFamily: ann.SameFamily,
+	}
+	changes := ann.Torrent.Seeders.Changes() + ann.Torrent.Leechers.Changes()
+
+	if ann.Event != "started" {
+		if cached := tkr.peerLists.Get(key, changes); cached != nil {
+			if peers := cached.Peers.Without(ann.Peer); len(peers) != len(cached.Peers) {
+				return peers, nil
+			}
+			return cached.Peers, cached
+		}
+	}
+
+	peers := pickPeers(ann)
+	if len(peers) == 0 {
+		return peers, nil
+	}
+	cached := &models.CachedPeerList{Peers: peers}
+	tkr.peerLists.Put(key, changes, cached)
+	return peers, cached
+}
+
+// pickPeers returns lists IPv4 and IPv6 peers on a given torrent sized according
+// to the wanted parameter, or only peers of the announce's own address family
+// if it can't take others. Peers from the preferred source networks come
+// first, up to the configured cap.
+func pickPeers(ann *models.Announce) (peers models.PeerList) {
+	preferred := ann.Config.MaxPreferredSources
+	if preferred > ann.NumWant {
+		preferred = ann.NumWant
+	}
+
 	if ann.Left == 0 {
 		// If they're seeding, give them only leechers.
-		return ann.Torrent.Leechers.AppendPeers(peers, ann, ann.NumWant)
+		if preferred > 0 {
+			peers = ann.Torrent.Leechers.AppendPreferredPeers(peers, ann, preferred)
+		}
+		return ann.Torrent.Leechers.AppendPeers(peers, ann, ann.NumWant-len(peers))
 	}
 
 	// If they're leeching, prioritize giving them seeders.
-	peers = ann.Torrent.Seeders.AppendPeers(peers, ann, ann.NumWant)
+	if preferred > 0 {
+		peers = ann.Torrent.Seeders.AppendPreferredPeers(peers, ann, preferred)
+		peers = ann.Torrent.Leechers.AppendPreferredPeers(peers, ann, preferred-len(peers))
+	}
+	peers = ann.Torrent.Seeders.AppendPeers(peers, ann, ann.NumWant-len(peers))
 	return ann.Torrent.Leechers.AppendPeers(peers, ann, ann.NumWant-len(peers))
 }
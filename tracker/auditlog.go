@@ -0,0 +1,169 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/majestrate/chihaya/tracker/models"
+)
+
+// auditLog appends a JSON line for every announce handled to a file of its
+// own, apart from the operational logs and whatever their verbosity.
+// Passkeys are recorded as an HMAC, so that a user's announces can be told
+// apart without the log giving away their passkey. The file is rotated by
+// renaming it once it grows past maxSize or gets older than maxAge. A nil
+// *auditLog is valid and records nothing.
+type auditLog struct {
+	path    string
+	secret  []byte
+	maxSize int64
+	maxAge  time.Duration
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+	closed bool
+}
+
+// auditEntry is a line of the audit log.
+type auditEntry struct {
+	Time       time.Time `json:"time"`
+	Passkey    string    `json:"passkey,omitempty"`
+	Infohash   string    `json:"infohash"`
+	Event      string    `json:"event,omitempty"`
+	Uploaded   uint64    `json:"uploaded"`
+	Downloaded uint64    `json:"downloaded"`
+	Left       uint64    `json:"left"`
+}
+
+// newAuditLog opens the audit log at path for appending. It returns nil when
+// path is empty. Non-positive maxSize and maxAge never rotate the log.
+func newAuditLog(path string, secret []byte, maxSize int64, maxAge time.Duration) (*auditLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+	l := &auditLog{
+		path:    path,
+		secret:  secret,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *auditLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size, l.opened = f, info.Size(), time.Now()
+	return nil
+}
+
+// Record appends an announce to the log. Failing to write is logged rather
+// than failing the announce.
+func (l *auditLog) Record(ann *models.Announce) {
+	if l == nil {
+		return
+	}
+
+	entry := auditEntry{
+		Time:       time.Now().UTC(),
+		Infohash:   hex.EncodeToString([]byte(ann.Infohash)),
+		Event:      ann.Event,
+		Uploaded:   ann.Uploaded,
+		Downloaded: ann.Downloaded,
+		Left:       ann.Left,
+	}
+	if ann.Passkey != "" {
+		mac := hmac.New(sha256.New, l.secret)
+		mac.Write([]byte(ann.Passkey))
+		entry.Passkey = hex.EncodeToString(mac.Sum(nil))
+	}
+	line, err := json.Marshal(&entry)
+	if err != nil {
+		glog.Errorf("Failed to encode audit log entry: %s", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+
+	if l.file == nil || l.due(int64(len(line))) {
+		if err = l.rotate(); err != nil {
+			glog.Errorf("Failed to rotate audit log %s: %s", l.path, err)
+			if l.file == nil {
+				return
+			}
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		glog.Errorf("Failed to write to audit log %s: %s", l.path, err)
+	}
+}
+
+// due is true if the log has to be rotated before writing n more bytes.
+func (l *auditLog) due(n int64) bool {
+	if l.maxSize > 0 && l.size > 0 && l.size+n > l.maxSize {
+		return true
+	}
+	return l.maxAge > 0 && time.Since(l.opened) > l.maxAge
+}
+
+// rotate renames the current log after the time it was rotated at, and starts
+// a new one.
+func (l *auditLog) rotate() error {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+		rotated := l.path + "." + time.Now().UTC().Format("20060102T150405.000000000Z")
+		if err := os.Rename(l.path, rotated); err != nil {
+			return err
+		}
+	}
+	return l.open()
+}
+
+// Close closes the log file.
+func (l *auditLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.closed = true
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
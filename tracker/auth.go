@@ -0,0 +1,128 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/majestrate/chihaya/lru"
+	"github.com/majestrate/chihaya/tracker/models"
+)
+
+// An Authorizer decides whether an announce may be handled, before anything
+// is done with the swarm. It returns the user announcing on a private
+// tracker, and an error to refuse the announce.
+type Authorizer interface {
+	AuthorizeAnnounce(ann *models.Announce) (*models.User, error)
+}
+
+// passkeyAuthorizer allows announces by enabled users on private trackers,
+// and every announce on public ones.
+type passkeyAuthorizer struct {
+	tkr *Tracker
+}
+
+func (a passkeyAuthorizer) AuthorizeAnnounce(ann *models.Announce) (*models.User, error) {
+	if !a.tkr.Config.PrivateEnabled {
+		return nil, nil
+	}
+	return a.tkr.findEnabledUser(ann.Passkey)
+}
+
+// errAnnounceDenied is returned for announces an authorization service
+// refused without giving a reason.
+var errAnnounceDenied = models.ClientError("announce not authorized")
+
+// maxAuthReason is the longest reason for refusing an announce that is passed
+// on to clients.
+const maxAuthReason = 256
+
+// httpAuthorizer asks an external service whether an announce may be
+// handled, by POSTing its passkey and infohash as JSON to a URL. The service
+// allows the announce with a 2xx response and refuses it with a 403, whose
+// body is the reason given to the client. Decisions are cached per passkey
+// and infohash. Announces the service allows are then authorized by next.
+type httpAuthorizer struct {
+	url       string
+	client    *http.Client
+	decisions *lru.Cache
+	next      Authorizer
+	tkr       *Tracker
+}
+
+type authRequest struct {
+	Passkey  string `json:"passkey"`
+	Infohash string `json:"infohash"`
+}
+
+func newHTTPAuthorizer(tkr *Tracker, url string, timeout time.Duration, cacheSize int, cacheTTL time.Duration, next Authorizer) *httpAuthorizer {
+	return &httpAuthorizer{
+		url:       url,
+		client:    &http.Client{Timeout: timeout},
+		decisions: lru.New(cacheSize, cacheTTL),
+		next:      next,
+		tkr:       tkr,
+	}
+}
+
+func (a *httpAuthorizer) AuthorizeAnnounce(ann *models.Announce) (*models.User, error) {
+	key := ann.Passkey + "\x00" + ann.Infohash
+	var denied error
+	if decision, cached := a.decisions.Get(key); cached {
+		denied, _ = decision.(error)
+	} else {
+		var err error
+		if denied, err = a.ask(ann); err != nil {
+			// the service being down isn't a decision, so it isn't cached
+			return nil, a.tkr.backendError(err)
+		}
+		a.decisions.Put(key, denied)
+	}
+
+	if denied != nil {
+		return nil, denied
+	}
+	return a.next.AuthorizeAnnounce(ann)
+}
+
+// ask the service about an announce, returning the error to refuse it with,
+// or nil if it is allowed.
+func (a *httpAuthorizer) ask(ann *models.Announce) (denied, err error) {
+	body, err := json.Marshal(authRequest{
+		Passkey:  ann.Passkey,
+		Infohash: hex.EncodeToString([]byte(ann.Infohash)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, nil
+	case resp.StatusCode == http.StatusForbidden:
+		reason, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxAuthReason))
+		if msg := strings.TrimSpace(string(reason)); msg != "" {
+			return models.ClientError(msg), nil
+		}
+		return errAnnounceDenied, nil
+	default:
+		return nil, fmt.Errorf("authorization service responded %s", resp.Status)
+	}
+}
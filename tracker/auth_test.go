@@ -0,0 +1,98 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/majestrate/chihaya/config"
+	"github.com/majestrate/chihaya/tracker/models"
+)
+
+func TestHTTPAuthorizer(t *testing.T) {
+	var calls int32
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		var req authRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		switch req.Passkey {
+		case "allowed":
+		case "banned":
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, "session expired\n")
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer auth.Close()
+
+	cfg := config.DefaultConfig
+	cfg.AnnounceAuthURL = auth.URL
+	tkr := newTestTracker(t, &cfg)
+
+	ann := newTestAnnounce(&cfg, "peer1", 10, "started")
+	ann.Passkey = "allowed"
+	for i := 0; i < 2; i++ {
+		if err := tkr.HandleAnnounce(ann, &recordingWriter{}); err != nil {
+			t.Fatalf("expected an allowed announce to be handled, got %s", err)
+		}
+	}
+
+	ann.Passkey = "banned"
+	for i := 0; i < 2; i++ {
+		if err := tkr.HandleAnnounce(ann, &recordingWriter{}); err == nil || err.Error() != "session expired" {
+			t.Errorf("expected the service's reason for refusing, got %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("expected decisions to be cached, the service was asked %d times", n)
+	}
+
+	ann.Passkey = "unknown"
+	for i := 0; i < 2; i++ {
+		if _, retryable := tkr.HandleAnnounce(ann, &recordingWriter{}).(*models.RetryableError); !retryable {
+			t.Error("expected a failing service to make clients retry later")
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 4 {
+		t.Errorf("expected failures not to be cached, the service was asked %d times", n)
+	}
+}
+
+func TestHTTPAuthorizerBatch(t *testing.T) {
+	refused := newTestAnnounce(&config.DefaultConfig, "peer1", 10, "started").Infohash + "x"
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req authRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Infohash == hex.EncodeToString([]byte(refused)) {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer auth.Close()
+
+	cfg := config.DefaultConfig
+	cfg.AnnounceAuthURL = auth.URL
+	tkr := newTestTracker(t, &cfg)
+
+	allowed := newTestAnnounce(&cfg, "peer1", 10, "started")
+	other := newTestAnnounce(&cfg, "peer1", 10, "started")
+	other.Infohash = refused
+	writers := []Writer{&recordingWriter{}, &recordingWriter{}}
+	if err := tkr.HandleAnnounceBatch([]*models.Announce{allowed, other}, writers); err != nil {
+		t.Fatalf("expected the batch to be handled, got %s", err)
+	}
+	if w := writers[0].(*recordingWriter); w.err != nil || w.announce == nil {
+		t.Errorf("expected the allowed announce to be answered, got %v", w.err)
+	}
+	if w := writers[1].(*recordingWriter); w.err != errAnnounceDenied {
+		t.Errorf("expected the refused announce to be denied, got %v", w.err)
+	}
+}
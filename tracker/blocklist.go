@@ -0,0 +1,108 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// blocklist is the set of infohashes the tracker refuses to serve, such as
+// those of torrents taken down on request. Lookups are a map access, so the
+// list may hold millions of infohashes without slowing down announces.
+type blocklist struct {
+	mu         sync.RWMutex
+	infohashes map[string]struct{}
+}
+
+func newBlocklist() *blocklist {
+	return &blocklist{infohashes: make(map[string]struct{})}
+}
+
+// loadBlocklist reads a blocklist file, which has an infohash in hex on each
+// line. Blank lines and lines starting with # are skipped.
+func loadBlocklist(path string) (*blocklist, error) {
+	b := newBlocklist()
+	if path == "" {
+		return b, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		infohash, err := ParseHexInfohash(text)
+		if err != nil {
+			return nil, fmt.Errorf("tracker: invalid infohash on line %d of blocklist %s: %s", line, path, err)
+		}
+		b.infohashes[infohash] = struct{}{}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// ParseHexInfohash decodes a hex encoded v1 or v2 infohash.
+func ParseHexInfohash(s string) (string, error) {
+	if len(s) != 40 && len(s) != 64 {
+		return "", fmt.Errorf("infohash %q is not 40 or 64 hex digits", s)
+	}
+	infohash, err := hex.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	return string(infohash), nil
+}
+
+// Contains is true if infohash is blocked.
+func (b *blocklist) Contains(infohash string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	_, blocked := b.infohashes[infohash]
+	return blocked
+}
+
+func (b *blocklist) Add(infohash string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.infohashes[infohash] = struct{}{}
+}
+
+func (b *blocklist) Remove(infohash string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.infohashes, infohash)
+}
+
+// BlockInfohash keeps the tracker from serving a torrent, evicting its peers.
+// The torrent stays with the backend, so that unblocking it restores it.
+func (tkr *Tracker) BlockInfohash(infohash string) {
+	tkr.blocklist.Add(infohash)
+	tkr.Cache.DeleteTorrent(infohash)
+	tkr.torrentLookups.Remove(infohash)
+}
+
+// UnblockInfohash lets the tracker serve a blocked torrent again.
+func (tkr *Tracker) UnblockInfohash(infohash string) {
+	tkr.blocklist.Remove(infohash)
+}
+
+// InfohashBlocked is true if the tracker refuses to serve a torrent.
+func (tkr *Tracker) InfohashBlocked(infohash string) bool {
+	return tkr.blocklist.Contains(infohash)
+}
@@ -0,0 +1,80 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"sync"
+
+	"github.com/majestrate/chihaya/tracker/models"
+)
+
+// leechSlots limits how many torrents each user may leech at once. It records
+// the peer each user started leeching a torrent with, and checks that the peer
+// is still leeching whenever the user's slots are counted, so peers leaving
+// the swarm in any way, such as completing, stopping or being reaped, free
+// their slot without being tracked. A nil *leechSlots is valid and allows
+// everything.
+type leechSlots struct {
+	max int
+
+	users map[uint64]map[string]models.PeerKey
+	sync.Mutex
+}
+
+// newLeechSlots creates slots allowing max torrents leeched at once per user.
+// It returns nil when max is not positive.
+func newLeechSlots(max int) *leechSlots {
+	if max <= 0 {
+		return nil
+	}
+	return &leechSlots{
+		max:   max,
+		users: make(map[uint64]map[string]models.PeerKey),
+	}
+}
+
+// Acquire takes a slot for a user starting to leech a torrent as the peer with
+// key, and is false if the user has no slot left. leeching tells whether a
+// peer recorded earlier is still leeching.
+func (s *leechSlots) Acquire(userID uint64, infohash string, key models.PeerKey, leeching func(userID uint64, infohash string, key models.PeerKey) bool) bool {
+	if s == nil {
+		return true
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	torrents := s.users[userID]
+	if torrents == nil {
+		torrents = make(map[string]models.PeerKey)
+		s.users[userID] = torrents
+	}
+
+	active := 0
+	for ih, k := range torrents {
+		if ih == infohash {
+			continue
+		}
+		if !leeching(userID, ih, k) {
+			delete(torrents, ih)
+			continue
+		}
+		active++
+	}
+	if active >= s.max {
+		return false
+	}
+	torrents[infohash] = key
+	return true
+}
+
+// userLeeching is true if the peer with key is leeching a torrent for a user.
+func (tkr *Tracker) userLeeching(userID uint64, infohash string, key models.PeerKey) bool {
+	t, err := tkr.Cache.FindTorrent(infohash)
+	if err != nil {
+		return false
+	}
+	p, exists := t.Leechers.LookUp(key)
+	return exists && p.UserID == userID
+}
@@ -0,0 +1,134 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/majestrate/chihaya/stats"
+)
+
+// how often the load is sampled to adjust the announce interval
+var loadSampleInterval = 10 * time.Second
+
+// loadInterval raises the announce interval advertised to clients while the
+// tracker is under load, so that they announce less often. The interval is
+// scaled by how far the load is over its threshold, up to a ceiling. A nil
+// *loadInterval is valid and always advertises the configured interval.
+type loadInterval struct {
+	base, ceiling time.Duration
+	connections   int64   // open connections considered high load
+	requestRate   float64 // requests per second considered high load
+
+	load         uint64 // bits of the float64 load factor, accessed atomically
+	lastRequests uint64
+	lastSample   time.Time
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newLoadInterval creates a loadInterval scaling base up to ceiling, or nil if
+// neither threshold is set.
+func newLoadInterval(base, ceiling time.Duration, connections int64, requestRate float64) *loadInterval {
+	if connections <= 0 && requestRate <= 0 {
+		return nil
+	}
+	if ceiling < base {
+		ceiling = base
+	}
+	return &loadInterval{
+		base:        base,
+		ceiling:     ceiling,
+		connections: connections,
+		requestRate: requestRate,
+		load:        math.Float64bits(1),
+		done:        make(chan struct{}),
+	}
+}
+
+// Interval returns the announce interval to advertise in place of base.
+func (li *loadInterval) Interval(base time.Duration) time.Duration {
+	if li == nil {
+		return base
+	}
+	return li.scale(base, math.Float64frombits(atomic.LoadUint64(&li.load)))
+}
+
+// scale raises base by load, up to the ceiling or base, whichever is longer.
+func (li *loadInterval) scale(base time.Duration, load float64) time.Duration {
+	interval := time.Duration(float64(base) * load)
+	if ceiling := li.ceiling; interval > ceiling {
+		if ceiling < base {
+			ceiling = base
+		}
+		interval = ceiling
+	}
+	return interval
+}
+
+// clampInterval bounds an announce interval to at least min and at most max.
+// A bound of 0 leaves that side open.
+func clampInterval(interval, min, max time.Duration) time.Duration {
+	if min > 0 && interval < min {
+		interval = min
+	}
+	if max > 0 && interval > max {
+		interval = max
+	}
+	return interval
+}
+
+// run samples the load from the default stats until the loadInterval is
+// closed.
+func (li *loadInterval) run() {
+	ticker := time.NewTicker(loadSampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s := stats.DefaultStats
+			if s == nil {
+				continue
+			}
+			li.sample(atomic.LoadInt64(&s.OpenConnections), atomic.LoadUint64(&s.RequestsHandled), now)
+		case <-li.done:
+			return
+		}
+	}
+}
+
+// Close stops sampling the load. Closing more than once is harmless.
+func (li *loadInterval) Close() {
+	if li == nil {
+		return
+	}
+	li.closeOnce.Do(func() { close(li.done) })
+}
+
+// sample adjusts the interval to the number of open connections and the
+// total number of requests handled at now.
+func (li *loadInterval) sample(connections int64, requests uint64, now time.Time) {
+	load := 1.0
+	if li.connections > 0 {
+		if l := float64(connections) / float64(li.connections); l > load {
+			load = l
+		}
+	}
+	if li.requestRate > 0 && !li.lastSample.IsZero() && requests >= li.lastRequests {
+		rate := float64(requests-li.lastRequests) / now.Sub(li.lastSample).Seconds()
+		if l := rate / li.requestRate; l > load {
+			load = l
+		}
+	}
+	li.lastRequests, li.lastSample = requests, now
+
+	atomic.StoreUint64(&li.load, math.Float64bits(load))
+	stats.RecordAnnounceInterval(li.scale(li.base, load))
+}
@@ -0,0 +1,103 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoadInterval(t *testing.T) {
+	li := newLoadInterval(30*time.Minute, 2*time.Hour, 100, 50)
+	start := time.Now()
+
+	var tests = []struct {
+		connections int64
+		requests    uint64
+		after       time.Duration
+		expected    time.Duration
+	}{
+		// the first sample has no request rate to go by
+		{50, 0, 0, 30 * time.Minute},
+		{200, 0, 10 * time.Second, time.Hour},
+		// 1500 requests in 10 seconds is three times the threshold
+		{10, 1500, 20 * time.Second, 90 * time.Minute},
+		{1000, 1500, 30 * time.Second, 2 * time.Hour},
+		{10, 1600, 40 * time.Second, 30 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		li.sample(tt.connections, tt.requests, start.Add(tt.after))
+		if got := li.Interval(30 * time.Minute); got != tt.expected {
+			t.Errorf("%d connections, %d requests after %s: expected %s, got %s", tt.connections, tt.requests, tt.after, tt.expected, got)
+		}
+	}
+
+	var disabled *loadInterval
+	if got := disabled.Interval(time.Minute); got != time.Minute {
+		t.Errorf("expected no scaling when disabled, got %s", got)
+	}
+}
+
+func TestLoadIntervalScalesBase(t *testing.T) {
+	li := newLoadInterval(30*time.Minute, 2*time.Hour, 100, 0)
+	li.sample(200, 0, time.Now())
+
+	var tests = []struct {
+		base, expected time.Duration
+	}{
+		{10 * time.Minute, 20 * time.Minute},
+		{30 * time.Minute, time.Hour},
+		{90 * time.Minute, 2 * time.Hour},
+		// a base past the ceiling is never lowered
+		{3 * time.Hour, 3 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		if got := li.Interval(tt.base); got != tt.expected {
+			t.Errorf("twice the load on %s: expected %s, got %s", tt.base, tt.expected, got)
+		}
+	}
+}
+
+func TestLoadIntervalClose(t *testing.T) {
+	li := newLoadInterval(30*time.Minute, 2*time.Hour, 100, 0)
+
+	stopped := make(chan struct{})
+	go func() {
+		li.run()
+		close(stopped)
+	}()
+
+	li.Close()
+	li.Close()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("expected sampling to stop once closed")
+	}
+
+	var disabled *loadInterval
+	disabled.Close()
+}
+
+func TestClampInterval(t *testing.T) {
+	var tests = []struct {
+		interval, min, max time.Duration
+		expected           time.Duration
+	}{
+		{30 * time.Minute, 0, 0, 30 * time.Minute},
+		{30 * time.Minute, 45 * time.Minute, 0, 45 * time.Minute},
+		{30 * time.Minute, 0, 20 * time.Minute, 20 * time.Minute},
+		{30 * time.Minute, 10 * time.Minute, time.Hour, 30 * time.Minute},
+		{30 * time.Minute, time.Hour, time.Hour, time.Hour},
+	}
+
+	for _, tt := range tests {
+		if got := clampInterval(tt.interval, tt.min, tt.max); got != tt.expected {
+			t.Errorf("%s within [%s, %s]: expected %s, got %s", tt.interval, tt.min, tt.max, tt.expected, got)
+		}
+	}
+}
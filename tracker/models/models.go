@@ -7,7 +7,12 @@
 package models
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/majestrate/chihaya/config"
@@ -27,14 +32,69 @@ var (
 	// ErrUserDNE is returned when a user does not exist.
 	ErrUserDNE = NotFoundError("user does not exist")
 
+	// ErrUserExists is returned when adding a user whose external id is
+	// already taken.
+	ErrUserExists = ClientError("user already exists")
+
 	// ErrTorrentDNE is returned when a torrent does not exist.
 	ErrTorrentDNE = NotFoundError("torrent does not exist")
 
+	// ErrTorrentExists is returned when adding a torrent whose infohash is
+	// already taken.
+	ErrTorrentExists = ClientError("torrent already exists")
+
+	// ErrPeerDNE is returned when a peer is not in a torrent's swarm.
+	ErrPeerDNE = NotFoundError("peer does not exist")
+
 	// ErrClientUnapproved is returned when a clientID is not in the whitelist.
 	ErrClientUnapproved = ClientError("client is not approved")
 
 	// ErrInvalidPasskey is returned when a passkey is not properly formatted.
 	ErrInvalidPasskey = ClientError("passkey is invalid")
+
+	// ErrScrapeThrottled is returned when a client scrapes more often than
+	// the scrape rate limit allows.
+	ErrScrapeThrottled = ClientError("too many scrapes, slow down")
+
+	// ErrDryRunDisabled is returned for a dry run announce when the tracker
+	// isn't configured to allow them.
+	ErrDryRunDisabled = ClientError("dry run announces are disabled")
+
+	// ErrTorrentUnapproved is returned when a new leecher announces a
+	// torrent that staff haven't approved, or have marked dead.
+	ErrTorrentUnapproved = ClientError("torrent is not approved")
+
+	// ErrTorrentNotPrivate is returned when a torrent added to a private
+	// tracker doesn't have the private flag set.
+	ErrTorrentNotPrivate = ClientError("torrent does not have the private flag set")
+
+	// ErrTorrentBlocked is returned when announcing or scraping a torrent
+	// whose infohash is on the blocklist.
+	ErrTorrentBlocked = ClientError("torrent is blocked")
+
+	// ErrUnknownCategory is returned when filing a torrent under a category
+	// that does not exist.
+	ErrUnknownCategory = ClientError("category does not exist")
+
+	// ErrPeerIDReused is returned when a peer ID announces from an address
+	// far from the one it was just seen at, and such announces are refused.
+	ErrPeerIDReused = ClientError("peer id is in use from another address")
+
+	// ErrTooManyLeeches is returned when a user starts leeching a torrent
+	// while already leeching as many as they may at once.
+	ErrTooManyLeeches = ClientError("too many torrents leeching at once")
+
+	// ErrTooManyUserPeers is returned when a user is already in a torrent's
+	// swarm from as many addresses as allowed.
+	ErrTooManyUserPeers = ClientError("account is already in this swarm from too many addresses")
+
+	// ErrUserDisabled is returned when a disabled user announces or scrapes
+	// and no other message is configured.
+	ErrUserDisabled = ClientError("account disabled")
+
+	// ErrBackupUnsupported is returned when a backup is requested from a
+	// backend that has nothing to back up.
+	ErrBackupUnsupported = ClientError("backend does not support backups")
 )
 
 type ClientError string
@@ -45,25 +105,80 @@ func (e ClientError) Error() string   { return string(e) }
 func (e NotFoundError) Error() string { return string(e) }
 func (e ProtocolError) Error() string { return string(e) }
 
+// RetryableError is a failure on the tracker's side that clients should only
+// retry after RetryIn, as per BEP 31.
+type RetryableError struct {
+	Reason  string
+	RetryIn time.Duration
+}
+
+func (e *RetryableError) Error() string { return e.Reason }
+
 // IsPublicError determines whether an error should be propogated to the client.
 func IsPublicError(err error) bool {
 	_, cl := err.(ClientError)
 	_, nf := err.(NotFoundError)
 	_, pc := err.(ProtocolError)
-	return cl || nf || pc
+	_, rt := err.(*RetryableError)
+	return cl || nf || pc || rt
 }
 
 // PeerList represents a list of peers: either seeders or leechers.
 type PeerList []Peer
 
+// contains is true if the list holds a peer with the same ID and address.
+func (pl PeerList) contains(p *Peer) bool {
+	for i := range pl {
+		if pl[i].ID == p.ID && pl[i].IP == p.IP && pl[i].Port == p.Port {
+			return true
+		}
+	}
+	return false
+}
+
+// Without returns the list with the peers equivalent to p left out. The list
+// itself is returned, without copying, when it holds none of them.
+func (pl PeerList) Without(p *Peer) PeerList {
+	for i := range pl {
+		if !peersEquivalent(p, &pl[i]) {
+			continue
+		}
+		filtered := append(PeerList{}, pl[:i]...)
+		for j := i + 1; j < len(pl); j++ {
+			if !peersEquivalent(p, &pl[j]) {
+				filtered = append(filtered, pl[j])
+			}
+		}
+		return filtered
+	}
+	return pl
+}
+
 // PeerKey is the key used to uniquely identify a peer in a swarm.
 type PeerKey string
 
 // internal delimiter for peer key
 const peerKeyDelim = "//"
 
+// peerKeySecret is the server secret used to HMAC the address part of a
+// PeerKey. When nil, addresses are stored in plaintext.
+var peerKeySecret []byte
+
+// SetPeerKeySecret enables hashing the address part of every PeerKey with the
+// provided secret so stored or logged keys don't reveal the addresses of
+// peers. Passing nil disables hashing. This must be called before any peers
+// are stored, since keys made with different secrets never match.
+func SetPeerKeySecret(secret []byte) {
+	peerKeySecret = secret
+}
+
 // NewPeerKey creates a properly formatted PeerKey given public addresses
 func NewPeerKey(peerID, pub string) PeerKey {
+	if peerKeySecret != nil {
+		mac := hmac.New(sha256.New, peerKeySecret)
+		mac.Write([]byte(pub))
+		pub = hex.EncodeToString(mac.Sum(nil)[:16])
+	}
 	return PeerKey(pub + peerKeyDelim + peerID)
 }
 
@@ -74,7 +189,8 @@ func (pk PeerKey) PeerID() string {
 	return k[idx+len(peerKeyDelim):]
 }
 
-// Addr returns the address of a peer key
+// Addr returns the address of a peer key. If peer key hashing is enabled this
+// is the hashed address; use Peer.IP for the raw address.
 func (pk PeerKey) Addr() string {
 	return strings.Split(string(pk), peerKeyDelim)[0]
 }
@@ -90,6 +206,18 @@ type Peer struct {
 	Downloaded   uint64 `json:"downloaded"`
 	Left         uint64 `json:"left"`
 	LastAnnounce int64  `json:"lastAnnounce"`
+
+	// Corrupt is the number of bytes the peer has reported discarding
+	// because they failed a hash check.
+	Corrupt uint64 `json:"corrupt,omitempty"`
+
+	// Announces is the number of times the peer has announced since it
+	// joined the swarm.
+	Announces uint64 `json:"announces"`
+
+	// Unreachable is set for peers on a blocked port, which are kept in the
+	// swarm but never handed out.
+	Unreachable bool `json:"unreachable,omitempty"`
 }
 
 // MarshalBencode implements bencode writing format
@@ -115,6 +243,34 @@ type TorrentInfo struct {
 	Description string   `json:"desc"`
 	Files       []string `json:"files"`
 	Tags        []string `json:"tags"`
+	WebSeeds    []string `json:"webSeeds"`
+	// Private is set if the torrent file has the private flag set, which
+	// keeps clients from finding peers outside the tracker.
+	Private bool `json:"private"`
+	// FilePath is the name the torrent file was stored under, if it was
+	// uploaded.
+	FilePath string `json:"filepath,omitempty"`
+}
+
+// CheckLimits returns a ClientError if the info lists more files or tags, or
+// has a longer name or description, than the configuration allows.
+func (info *TorrentInfo) CheckLimits(cfg *config.Config) error {
+	switch {
+	case exceeds(len(info.Files), cfg.MaxTorrentFiles):
+		return ClientError(fmt.Sprintf("torrent has %d files, at most %d are allowed", len(info.Files), cfg.MaxTorrentFiles))
+	case exceeds(len(info.Tags), cfg.MaxTorrentTags):
+		return ClientError(fmt.Sprintf("torrent has %d tags, at most %d are allowed", len(info.Tags), cfg.MaxTorrentTags))
+	case exceeds(len(info.TorrentName), cfg.MaxTorrentNameLength):
+		return ClientError(fmt.Sprintf("torrent name is longer than %d bytes", cfg.MaxTorrentNameLength))
+	case exceeds(len(info.Description), cfg.MaxTorrentDescLength):
+		return ClientError(fmt.Sprintf("torrent description is longer than %d bytes", cfg.MaxTorrentDescLength))
+	}
+	return nil
+}
+
+// exceeds is true if n is over a limit, where a limit of 0 is no limit.
+func exceeds(n, limit int) bool {
+	return limit > 0 && n > limit
 }
 
 // Torrent represents a BitTorrent swarm and its metadata.
@@ -130,7 +286,55 @@ type Torrent struct {
 	DownMultiplier float64 `json:"downMultiplier"`
 	LastAction     int64   `json:"lastAction"`
 
-	Info *TorrentInfo `json:"info"`
+	Status TorrentStatus `json:"status"`
+	Info   *TorrentInfo  `json:"info"`
+
+	// Freeleech is set for torrents whose downloads aren't counted against
+	// users' ratios.
+	Freeleech bool `json:"freeleech"`
+}
+
+// TorrentUpdate holds changes to the metadata of a torrent. Fields left nil
+// are not changed.
+type TorrentUpdate struct {
+	Category    *string   `json:"category"`
+	Description *string   `json:"desc"`
+	Tags        *[]string `json:"tags"`
+	Freeleech   *bool     `json:"freeleech"`
+}
+
+// Apply makes the changes of an update to a torrent. The torrent's info is
+// replaced by an updated copy rather than changed in place.
+func (u *TorrentUpdate) Apply(t *Torrent) {
+	info := new(TorrentInfo)
+	if t.Info != nil {
+		*info = *t.Info
+	}
+	if u.Category != nil {
+		info.Category = *u.Category
+	}
+	if u.Description != nil {
+		info.Description = *u.Description
+	}
+	if u.Tags != nil {
+		info.Tags = *u.Tags
+	}
+	if u.Freeleech != nil {
+		t.Freeleech = *u.Freeleech
+	}
+	t.Info = info
+}
+
+// TorrentStatus holds the moderation flags staff set on a torrent.
+type TorrentStatus struct {
+	Approved bool `json:"approved"`
+	Dead     bool `json:"dead"`
+	Trumped  bool `json:"trumped"`
+}
+
+// Leechable is false for torrents that are dead or haven't been approved.
+func (s TorrentStatus) Leechable() bool {
+	return s.Approved && !s.Dead
 }
 
 // PeerCount returns the total number of peers connected on this Torrent.
@@ -143,7 +347,9 @@ type User struct {
 	ID             uint64  `json:"id"`
 	Passkey        string  `json:"passkey"`
 	Username       string  `json:"username"`
-	Cred           string  `json:"credential"`
+	Cred           string  `json:"credential,omitempty"`
+	ExternalID     string  `json:"externalId,omitempty"`
+	Disabled       bool    `json:"disabled,omitempty"`
 	UpMultiplier   float64 `json:"upMultiplier"`
 	DownMultiplier float64 `json:"downMultiplier"`
 }
@@ -162,12 +368,33 @@ type Announce struct {
 	PeerID     string `json:"peer_id"`
 	Uploaded   uint64 `json:"uploaded"`
 
+	// Corrupt is the number of downloaded bytes the client reported as
+	// failing a hash check. It is never more than Downloaded.
+	Corrupt uint64 `json:"corrupt,omitempty"`
+
 	IP   string `json:"ip"`
 	Port uint16 `json:"port"`
 
+	// AltIP is the address of a dual-stacked peer in the address family
+	// other than IP's, if it announced one.
+	AltIP string `json:"altIp,omitempty"`
+
+	// SameFamily is set for clients that can only be handed peers in IP's
+	// address family, such as UDP clients, whose responses hold addresses of
+	// one size.
+	SameFamily bool `json:"sameFamily,omitempty"`
+
+	// DryRun is true if the announce should only be validated and answered
+	// without changing any state, for testing clients.
+	DryRun bool `json:"dryrun,omitempty"`
+
 	Torrent *Torrent `json:"-"`
 	User    *User    `json:"-"`
 	Peer    *Peer    `json:"-"`
+
+	// AltPeer is the Peer for AltIP. It joins the swarm alongside Peer so
+	// that other peers can reach a dual-stacked peer over either family.
+	AltPeer *Peer `json:"-"`
 }
 
 // ClientID returns the part of a PeerID that identifies a Peer's client
@@ -196,6 +423,7 @@ func (a *Announce) BuildPeer(u *User, t *Torrent) (err error) {
 		Uploaded:     a.Uploaded,
 		Downloaded:   a.Downloaded,
 		Left:         a.Left,
+		Corrupt:      a.Corrupt,
 		LastAnnounce: time.Now().Unix(),
 		IP:           a.IP,
 		Port:         a.Port,
@@ -211,6 +439,12 @@ func (a *Announce) BuildPeer(u *User, t *Torrent) (err error) {
 		a.User = u
 	}
 
+	if a.AltIP != "" {
+		alt := *a.Peer
+		alt.IP = a.AltIP
+		a.AltPeer = &alt
+	}
+
 	return
 }
 
@@ -243,19 +477,59 @@ type AnnounceResponse struct {
 	Interval, MinInterval int64
 	Peers                 PeerList
 
+	// CachedPeers is set when Peers is shared with the responses to other
+	// announces, in which case Peers must not be modified.
+	CachedPeers *CachedPeerList
+
+	// Warning is a message shown to the user when set.
+	Warning string
+
+	// WebSeeds are HTTP sources of the torrent's content, handed out when
+	// there are no peers to download from.
+	WebSeeds []string
+
+	// DHTNodes are nodes clients may bootstrap the DHT from.
+	DHTNodes []DHTNode
+
 	Compact bool
 }
 
+// DHTNode is the address of a DHT node, as in the nodes key of BEP 5
+// metainfo.
+type DHTNode struct {
+	Host string
+	Port uint16
+}
+
+// CachedPeerList is a peer list shared between the responses to several
+// announces. Its peers must not be modified.
+type CachedPeerList struct {
+	Peers PeerList
+
+	once    sync.Once
+	encoded []byte
+}
+
+// Encoded returns the peers serialized by encode. The serialization is only
+// computed once and is then reused for every response sharing the list.
+func (c *CachedPeerList) Encoded(encode func(PeerList) []byte) []byte {
+	c.once.Do(func() { c.encoded = encode(c.Peers) })
+	return c.encoded
+}
+
 // Scrape is a Scrape by a Peer.
 type Scrape struct {
 	Config *config.Config `json:"config"`
 
+	IP         string
 	Passkey    string
 	Infohashes []string
 }
 
 // ScrapeResponse contains the information needed to fulfill a scrape.
 type ScrapeResponse struct {
+	// Files holds a torrent for each scraped infohash, in the order they
+	// were scraped, or nil for infohashes that are not served.
 	Files []*Torrent
 }
 
@@ -265,3 +539,15 @@ type TorrentCategory struct {
 	Name        string `json:"name"`
 	Description string `json:"desc"`
 }
+
+// CategoryCount is a category with the number of torrents in it.
+type CategoryCount struct {
+	TorrentCategory
+	Torrents uint64 `json:"torrents"`
+}
+
+// Backup describes a snapshot of the backend's database written to a file.
+type Backup struct {
+	Path string           `json:"path"`
+	Rows map[string]int64 `json:"rows"`
+}
@@ -4,7 +4,11 @@
 
 package models
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/majestrate/chihaya/config"
+)
 
 type PeerClientPair struct {
 	announce Announce
@@ -62,3 +66,38 @@ func TestClientID(t *testing.T) {
 		}
 	}
 }
+
+func TestHashedPeerKey(t *testing.T) {
+	peer := &Peer{ID: "-TR2820-peer1", IP: "10.0.0.1"}
+	plain := peer.Key()
+
+	SetPeerKeySecret([]byte("secret"))
+	defer SetPeerKeySecret(nil)
+
+	hashed := peer.Key()
+	if hashed == plain || hashed.Addr() == peer.IP {
+		t.Errorf("expected hashed key to hide the address, got %s", hashed)
+	}
+	if hashed.PeerID() != peer.ID {
+		t.Errorf("expected peer ID %s, got %s", peer.ID, hashed.PeerID())
+	}
+	if peer.Key() != hashed {
+		t.Error("expected hashed keys to be stable")
+	}
+
+	SetPeerKeySecret([]byte("other secret"))
+	if peer.Key() == hashed {
+		t.Error("expected keys made with different secrets to differ")
+	}
+}
+
+func TestAppendPeersKeepsGivenPeers(t *testing.T) {
+	pm := NewPeerMap(true, &config.DefaultConfig)
+	pm.Put(Peer{ID: "seeder", IP: "10.0.0.1", Port: 1234})
+	leecher := &Announce{Peer: &Peer{ID: "leecher", IP: "10.0.0.2", Port: 1234}}
+
+	peers := pm.AppendPeers(PeerList{{ID: "picked", IP: "10.0.0.3", Port: 1234}}, leecher, 10)
+	if len(peers) != 2 || peers[0].ID != "picked" || peers[1].ID != "seeder" {
+		t.Errorf("expected the seeder appended to the peers already picked, got %v", peers)
+	}
+}
@@ -5,16 +5,57 @@
 package models
 
 import (
+	"encoding/json"
+	"math/rand"
+	"net"
 	"sync"
 
 	"github.com/majestrate/chihaya/config"
 	"github.com/majestrate/chihaya/stats"
 )
 
-// PeerMap is a thread-safe map from PeerKeys to Peers. When PreferredSubnet is
-// enabled, it is a thread-safe map of maps from MaskedIPs to Peerkeys to Peers.
+// preferredSources are the networks of peers, such as official seedboxes,
+// that are handed out before any others.
+var preferredSources []*net.IPNet
+
+// SetPreferredSources sets the networks of peers that are handed out before
+// any others. This must be called before any peers are stored, since peers
+// are only checked against them as they join.
+func SetPreferredSources(nets []*net.IPNet) {
+	preferredSources = nets
+}
+
+// isPreferredSource is true if ip is within one of the preferred source
+// networks.
+func isPreferredSource(ip string) bool {
+	if len(preferredSources) == 0 {
+		return false
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipnet := range preferredSources {
+		if ipnet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// PeerMap is a thread-safe map from PeerKeys to Peers. Peers are stored in a
+// slice indexed by their key, so that adding and removing a peer is O(1) and
+// a uniformly random subset of n peers can be picked in O(n) regardless of
+// the size of the swarm.
 type PeerMap struct {
-	Peers   map[PeerKey]Peer
+	peers   []Peer
+	keys    []PeerKey // keys[i] is the key of peers[i]
+	index   map[PeerKey]int
+	changes uint64 // number of peers ever added or removed
+
+	// preferred holds the keys of peers that are preferred sources
+	preferred map[PeerKey]struct{}
+
 	Seeders bool `json:"seeders"`
 	sync.RWMutex
 }
@@ -22,17 +63,34 @@ type PeerMap struct {
 // NewPeerMap initializes the map for a new PeerMap.
 func NewPeerMap(seeders bool, cfg *config.Config) *PeerMap {
 	pm := &PeerMap{
-		Peers:   make(map[PeerKey]Peer),
-		Seeders: seeders,
+		index:     make(map[PeerKey]int),
+		preferred: make(map[PeerKey]struct{}),
+		Seeders:   seeders,
 	}
 	return pm
 }
 
+// MarshalJSON encodes a PeerMap as a JSON object of its peers by key.
+func (pm *PeerMap) MarshalJSON() ([]byte, error) {
+	pm.RLock()
+	defer pm.RUnlock()
+
+	peers := make(map[PeerKey]Peer, len(pm.peers))
+	for key, idx := range pm.index {
+		peers[key] = pm.peers[idx]
+	}
+
+	return json.Marshal(struct {
+		Peers   map[PeerKey]Peer
+		Seeders bool `json:"seeders"`
+	}{peers, pm.Seeders})
+}
+
 // Contains is true if a peer is contained with a PeerMap.
 func (pm *PeerMap) Contains(pk PeerKey) bool {
 	pm.RLock()
 	defer pm.RUnlock()
-	_, exists := pm.Peers[pk]
+	_, exists := pm.index[pk]
 	return exists
 }
 
@@ -40,7 +98,10 @@ func (pm *PeerMap) Contains(pk PeerKey) bool {
 func (pm *PeerMap) LookUp(pk PeerKey) (peer Peer, exists bool) {
 	pm.RLock()
 	defer pm.RUnlock()
-	peer, exists = pm.Peers[pk]
+	idx, exists := pm.index[pk]
+	if exists {
+		peer = pm.peers[idx]
+	}
 	return
 }
 
@@ -48,24 +109,67 @@ func (pm *PeerMap) LookUp(pk PeerKey) (peer Peer, exists bool) {
 func (pm *PeerMap) Put(p Peer) {
 	pm.Lock()
 	defer pm.Unlock()
-	pm.Peers[p.Key()] = p
+	key := p.Key()
+	if idx, exists := pm.index[key]; exists {
+		pm.peers[idx] = p
+		return
+	}
+	pm.index[key] = len(pm.peers)
+	pm.peers = append(pm.peers, p)
+	pm.keys = append(pm.keys, key)
+	pm.changes++
+	if isPreferredSource(p.IP) {
+		pm.preferred[key] = struct{}{}
+	}
 }
 
 // Delete is a thread-safe delete from a PeerMap.
 func (pm *PeerMap) Delete(pk PeerKey) {
 	pm.Lock()
 	defer pm.Unlock()
-	_, exists := pm.Peers[pk]
-	if exists {
-		delete(pm.Peers, pk)
+	if idx, exists := pm.index[pk]; exists {
+		pm.remove(idx)
+	}
+}
+
+// remove deletes the peer at idx by moving the last peer into its place. The
+// caller must hold the write lock.
+func (pm *PeerMap) remove(idx int) {
+	delete(pm.index, pm.keys[idx])
+	delete(pm.preferred, pm.keys[idx])
+	last := len(pm.peers) - 1
+	if idx != last {
+		pm.peers[idx] = pm.peers[last]
+		pm.keys[idx] = pm.keys[last]
+		pm.index[pm.keys[idx]] = idx
 	}
+	pm.peers[last] = Peer{}
+	pm.peers = pm.peers[:last]
+	pm.keys = pm.keys[:last]
+	pm.changes++
+}
+
+// swap exchanges the peers at i and j. The caller must hold the write lock.
+func (pm *PeerMap) swap(i, j int) {
+	pm.peers[i], pm.peers[j] = pm.peers[j], pm.peers[i]
+	pm.keys[i], pm.keys[j] = pm.keys[j], pm.keys[i]
+	pm.index[pm.keys[i]] = i
+	pm.index[pm.keys[j]] = j
 }
 
 // Len returns the number of peers within a PeerMap.
 func (pm *PeerMap) Len() int {
-	pm.Lock()
-	defer pm.Unlock()
-	return len(pm.Peers)
+	pm.RLock()
+	defer pm.RUnlock()
+	return len(pm.peers)
+}
+
+// Changes returns the number of times a peer has joined or left the PeerMap.
+// Updates to peers already in the map are not counted.
+func (pm *PeerMap) Changes() uint64 {
+	pm.RLock()
+	defer pm.RUnlock()
+	return pm.changes
 }
 
 // Purge iterates over all of the peers within a PeerMap and deletes them if
@@ -73,9 +177,11 @@ func (pm *PeerMap) Len() int {
 func (pm *PeerMap) Purge(unixtime int64) {
 	pm.Lock()
 	defer pm.Unlock()
-	for key, peer := range pm.Peers {
-		if peer.LastAnnounce <= unixtime {
-			delete(pm.Peers, key)
+	// Walk backwards so that peers moved into a removed peer's place have
+	// already been checked.
+	for idx := len(pm.peers) - 1; idx >= 0; idx-- {
+		if pm.peers[idx].LastAnnounce <= unixtime {
+			pm.remove(idx)
 			if pm.Seeders {
 				stats.RecordPeerEvent(stats.ReapedSeed)
 			} else {
@@ -85,22 +191,60 @@ func (pm *PeerMap) Purge(unixtime int64) {
 	}
 }
 
-func (pm *PeerMap) AppendPeers(peers PeerList, a *Announce, wanted int) (ls PeerList) {
+// AppendPeers appends up to wanted peers, picked uniformly at random, to
+// peers. Peers equivalent to the announcing peer are never included. This
+// performs a partial Fisher-Yates shuffle of the map's storage, so it costs
+// O(wanted) rather than O(swarm size).
+func (pm *PeerMap) AppendPeers(peers PeerList, a *Announce, wanted int) PeerList {
 	pm.Lock()
 	defer pm.Unlock()
-	for _, peer := range pm.Peers {
-		if wanted > 0 {
-			if peersEquivalent(a.Peer, &peer) {
-				continue
-			} else {
-				ls = append(ls, peer)
-				wanted--
-			}
-		} else {
+	v4 := isIPv4(a.IP)
+	for i := 0; wanted > 0 && i < len(pm.peers); i++ {
+		pm.swap(i, i+rand.Intn(len(pm.peers)-i))
+		if peersEquivalent(a.Peer, &pm.peers[i]) || pm.peers[i].Unreachable {
+			continue
+		}
+		if a.SameFamily && isIPv4(pm.peers[i].IP) != v4 {
+			continue
+		}
+		if _, preferred := pm.preferred[pm.keys[i]]; preferred && peers.contains(&pm.peers[i]) {
+			// already picked by AppendPreferredPeers
+			continue
+		}
+		peers = append(peers, pm.peers[i])
+		wanted--
+	}
+	return peers
+}
+
+// AppendPreferredPeers appends up to wanted peers from the preferred source
+// networks to peers. When there are more, a random few are picked.
+func (pm *PeerMap) AppendPreferredPeers(peers PeerList, a *Announce, wanted int) PeerList {
+	pm.RLock()
+	defer pm.RUnlock()
+	v4 := isIPv4(a.IP)
+	// map iteration order is random enough to take turns
+	for key := range pm.preferred {
+		if wanted <= 0 {
 			break
 		}
+		p := &pm.peers[pm.index[key]]
+		if peersEquivalent(a.Peer, p) || p.Unreachable {
+			continue
+		}
+		if a.SameFamily && isIPv4(p.IP) != v4 {
+			continue
+		}
+		peers = append(peers, *p)
+		wanted--
 	}
-	return
+	return peers
+}
+
+// isIPv4 is true for IPv4 addresses, including IPv4-mapped IPv6 ones.
+func isIPv4(addr string) bool {
+	ip := net.ParseIP(addr)
+	return ip != nil && ip.To4() != nil
 }
 
 // peersEquivalent checks if two peers represent the same entity.
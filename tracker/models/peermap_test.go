@@ -0,0 +1,119 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package models
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"github.com/majestrate/chihaya/config"
+)
+
+func newTestPeerMap(n int) *PeerMap {
+	pm := NewPeerMap(false, &config.DefaultConfig)
+	for i := 0; i < n; i++ {
+		pm.Put(Peer{ID: "peer" + strconv.Itoa(i), IP: "10.0.0.1", LastAnnounce: int64(i)})
+	}
+	return pm
+}
+
+func TestPeerMapPutDelete(t *testing.T) {
+	pm := newTestPeerMap(10)
+
+	pm.Put(Peer{ID: "peer3", IP: "10.0.0.1", Port: 1234})
+	if p, _ := pm.LookUp(NewPeerKey("peer3", "10.0.0.1")); p.Port != 1234 || pm.Len() != 10 {
+		t.Errorf("expected put of an existing peer to update it in place")
+	}
+
+	for _, i := range []int{0, 9, 4} {
+		pm.Delete(NewPeerKey("peer"+strconv.Itoa(i), "10.0.0.1"))
+	}
+	if pm.Len() != 7 {
+		t.Errorf("expected 7 peers, got %d", pm.Len())
+	}
+	for i := 0; i < 10; i++ {
+		key := NewPeerKey("peer"+strconv.Itoa(i), "10.0.0.1")
+		deleted := i == 0 || i == 9 || i == 4
+		if p, exists := pm.LookUp(key); exists == deleted || (exists && p.Key() != key) {
+			t.Errorf("unexpected lookup of %s: %v (%t)", key, p, exists)
+		}
+	}
+
+	pm.Purge(5)
+	if pm.Len() != 3 {
+		t.Errorf("expected 3 peers after purge, got %d", pm.Len())
+	}
+}
+
+func TestPeerMapAppendPeers(t *testing.T) {
+	pm := newTestPeerMap(100)
+	self := &Announce{Peer: &Peer{ID: "peer7"}}
+
+	seen := make(map[string]int)
+	for round := 0; round < 1000; round++ {
+		peers := pm.AppendPeers(PeerList{{ID: "existing"}}, self, 10)
+		if len(peers) != 11 || peers[0].ID != "existing" {
+			t.Fatalf("expected 10 peers appended to the existing list, got %d", len(peers))
+		}
+
+		unique := make(map[string]bool)
+		for _, p := range peers[1:] {
+			if p.ID == self.Peer.ID {
+				t.Fatal("expected the announcing peer to be excluded")
+			}
+			if unique[p.ID] {
+				t.Fatalf("peer %s returned twice", p.ID)
+			}
+			unique[p.ID] = true
+			seen[p.ID]++
+		}
+	}
+
+	// Each of the 99 other peers is expected 1000*10/99 ~ 101 times.
+	for id, n := range seen {
+		if n < 40 || n > 200 {
+			t.Errorf("peer %s picked %d times, sampling looks biased", id, n)
+		}
+	}
+	if len(seen) != 99 {
+		t.Errorf("expected every other peer to be picked eventually, got %d", len(seen))
+	}
+
+	if peers := pm.AppendPeers(nil, self, 1000); len(peers) != 99 {
+		t.Errorf("expected all 99 other peers, got %d", len(peers))
+	}
+}
+
+func TestPeerMapJSON(t *testing.T) {
+	pm := newTestPeerMap(2)
+
+	var decoded struct {
+		Peers   map[PeerKey]Peer
+		Seeders bool `json:"seeders"`
+	}
+	buf, err := json.Marshal(pm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(buf, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Peers) != 2 || decoded.Peers[NewPeerKey("peer1", "10.0.0.1")].ID != "peer1" {
+		t.Errorf("unexpected JSON encoding %s", buf)
+	}
+}
+
+func BenchmarkAppendPeersLargeSwarm(b *testing.B) {
+	pm := newTestPeerMap(100000)
+	self := &Announce{Peer: &Peer{ID: "self"}}
+	peers := make(PeerList, 0, 50)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		peers = pm.AppendPeers(peers[:0], self, 50)
+	}
+}
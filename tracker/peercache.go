@@ -0,0 +1,130 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/majestrate/chihaya/tracker/models"
+)
+
+// addressFamily classifies the address a peer announced from.
+type addressFamily uint8
+
+const (
+	familyOther addressFamily = iota // overlay network names
+	familyIPv4
+	familyIPv6
+)
+
+func familyOf(addr string) addressFamily {
+	ip := net.ParseIP(addr)
+	switch {
+	case ip == nil:
+		return familyOther
+	case ip.To4() != nil:
+		return familyIPv4
+	default:
+		return familyIPv6
+	}
+}
+
+// peerListCache holds the peer lists recently handed out for each torrent, so
+// that announces to a hot torrent arriving within a short window share one
+// random subset of the swarm instead of each picking and serializing their
+// own. A cached list is dropped once it expires or once more than maxChanges
+// peers have joined or left the swarm since it was picked. A nil
+// *peerListCache is valid and never holds anything.
+type peerListCache struct {
+	ttl        time.Duration
+	maxChanges uint64
+
+	entries   map[peerListKey]*peerListEntry
+	nextSweep time.Time
+	sync.Mutex
+}
+
+type peerListKey struct {
+	infohash string
+	numWant  int
+	seeding  bool
+	family   addressFamily
+
+	// lists picked for clients taking one family only hold fewer peers
+	sameFamily bool
+}
+
+type peerListEntry struct {
+	peers   *models.CachedPeerList
+	changes uint64
+	expires time.Time
+}
+
+// newPeerListCache creates a cache whose lists live for at most ttl. It
+// returns nil when ttl is not positive.
+func newPeerListCache(ttl time.Duration, maxChanges int) *peerListCache {
+	if ttl <= 0 {
+		return nil
+	}
+	if maxChanges < 0 {
+		maxChanges = 0
+	}
+	return &peerListCache{
+		ttl:        ttl,
+		maxChanges: uint64(maxChanges),
+		entries:    make(map[peerListKey]*peerListEntry),
+	}
+}
+
+// Get returns the list cached for key if it is still fresh for a swarm that
+// has seen changes membership changes in total.
+func (c *peerListCache) Get(key peerListKey, changes uint64) *models.CachedPeerList {
+	if c == nil {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	entry, exists := c.entries[key]
+	if !exists {
+		return nil
+	}
+
+	// A swarm whose counter went backwards was deleted and recreated.
+	if time.Now().After(entry.expires) || changes < entry.changes || changes-entry.changes > c.maxChanges {
+		delete(c.entries, key)
+		return nil
+	}
+	return entry.peers
+}
+
+// Put caches peers for key, picked when the swarm had seen changes membership
+// changes in total.
+func (c *peerListCache) Put(key peerListKey, changes uint64, peers *models.CachedPeerList) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	if now.After(c.nextSweep) {
+		// Drop the lists of torrents that are no longer being announced to.
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.nextSweep = now.Add(c.ttl)
+	}
+
+	c.entries[key] = &peerListEntry{
+		peers:   peers,
+		changes: changes,
+		expires: now.Add(c.ttl),
+	}
+}
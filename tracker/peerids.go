@@ -0,0 +1,103 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Addresses in the same network this size are taken to be the same client
+// moving around, such as a laptop changing access points.
+const (
+	peerIDNetworkBitsV4 = 16
+	peerIDNetworkBitsV6 = 48
+)
+
+// peerIDWatch remembers where each peer ID last announced from, to spot a peer
+// ID being used from two distant addresses at once. A client keeps its peer ID
+// across torrents, so that alone is normal. A nil *peerIDWatch is valid and
+// finds nothing suspicious.
+type peerIDWatch struct {
+	window time.Duration
+
+	sightings map[string]*peerIDSighting
+	nextSweep time.Time
+	sync.Mutex
+}
+
+type peerIDSighting struct {
+	ip   net.IP
+	last time.Time
+}
+
+// newPeerIDWatch creates a watch that compares announces at most window
+// apart. It returns nil when window is not positive.
+func newPeerIDWatch(window time.Duration) *peerIDWatch {
+	if window <= 0 {
+		return nil
+	}
+	return &peerIDWatch{
+		window:    window,
+		sightings: make(map[string]*peerIDSighting),
+	}
+}
+
+// Check records an announce by peerID from ip, and from altIP for
+// dual-stacked peers. It returns the address the peer ID was last seen at if
+// that is in another network, in which case the announce is not recorded, so
+// that the peer ID stays with the address that used it first. Addresses are
+// only compared with the last one of the same family, as a dual-stacked
+// client announces over IPv4 and IPv6 alike.
+func (w *peerIDWatch) Check(peerID, ip, altIP string) net.IP {
+	now := time.Now()
+	if seen := w.checkAt(peerID, net.ParseIP(ip), now); seen != nil {
+		return seen
+	}
+	if altIP == "" {
+		return nil
+	}
+	return w.checkAt(peerID, net.ParseIP(altIP), now)
+}
+
+func (w *peerIDWatch) checkAt(peerID string, ip net.IP, now time.Time) net.IP {
+	if w == nil || ip == nil {
+		return nil
+	}
+	w.Lock()
+	defer w.Unlock()
+
+	if now.After(w.nextSweep) {
+		for k, s := range w.sightings {
+			if now.Sub(s.last) > w.window {
+				delete(w.sightings, k)
+			}
+		}
+		w.nextSweep = now.Add(w.window)
+	}
+
+	key := peerID + "/6"
+	if ip.To4() != nil {
+		key = peerID + "/4"
+	}
+	s, exists := w.sightings[key]
+	if exists && now.Sub(s.last) <= w.window && !sameNetwork(s.ip, ip) {
+		return s.ip
+	}
+	w.sightings[key] = &peerIDSighting{ip: ip, last: now}
+	return nil
+}
+
+// sameNetwork is true if a and b, of the same family, are in the same network
+// of the size peer IDs may move around in.
+func sameNetwork(a, b net.IP) bool {
+	if a4, b4 := a.To4(), b.To4(); a4 != nil && b4 != nil {
+		mask := net.CIDRMask(peerIDNetworkBitsV4, 32)
+		return a4.Mask(mask).Equal(b4.Mask(mask))
+	}
+	mask := net.CIDRMask(peerIDNetworkBitsV6, 128)
+	return a.Mask(mask).Equal(b.Mask(mask))
+}
@@ -0,0 +1,55 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// portRange is an inclusive range of ports.
+type portRange struct {
+	low, high uint16
+}
+
+// portRanges is a set of ports that peers may not listen on, nil when no port
+// is blocked.
+type portRanges []portRange
+
+// parsePortRanges parses ports and ranges of ports such as "6881-6889".
+func parsePortRanges(ranges []string) (portRanges, error) {
+	var parsed portRanges
+	for _, r := range ranges {
+		low, high := r, r
+		if i := strings.Index(r, "-"); i >= 0 {
+			low, high = r[:i], r[i+1:]
+		}
+
+		l, err := strconv.ParseUint(strings.TrimSpace(low), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("tracker: invalid blocked port range %q: %s", r, err)
+		}
+		h, err := strconv.ParseUint(strings.TrimSpace(high), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("tracker: invalid blocked port range %q: %s", r, err)
+		}
+		if l > h {
+			return nil, fmt.Errorf("tracker: invalid blocked port range %q: ends before it starts", r)
+		}
+		parsed = append(parsed, portRange{uint16(l), uint16(h)})
+	}
+	return parsed, nil
+}
+
+// Contains is true if port is in any of the ranges.
+func (r portRanges) Contains(port uint16) bool {
+	for _, pr := range r {
+		if port >= pr.low && port <= pr.high {
+			return true
+		}
+	}
+	return false
+}
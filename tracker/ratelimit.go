@@ -0,0 +1,87 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket per client address. Each bucket holds up to
+// burst tokens and refills at rate tokens per second, and every request takes
+// one. A nil *rateLimiter is valid and allows everything.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	buckets   map[string]*tokenBucket
+	nextSweep time.Time
+	sync.Mutex
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter creates a limiter allowing rate requests per second with
+// bursts of up to burst requests. It returns nil when rate is not positive.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Allow takes a token from the bucket of addr, and is false if there was none
+// to take.
+func (l *rateLimiter) Allow(addr string) bool {
+	return l.allowAt(addr, time.Now())
+}
+
+func (l *rateLimiter) allowAt(addr string, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	l.Lock()
+	defer l.Unlock()
+
+	// A bucket that has been idle long enough to refill is the same as no
+	// bucket at all.
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	if now.After(l.nextSweep) {
+		for k, b := range l.buckets {
+			if now.Sub(b.last) >= full {
+				delete(l.buckets, k)
+			}
+		}
+		l.nextSweep = now.Add(full)
+	}
+
+	b, exists := l.buckets[addr]
+	if !exists {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[addr] = b
+	} else if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * l.rate
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -12,21 +12,47 @@ import (
 // HandleScrape encapsulates all the logic of handling a BitTorrent client's
 // scrape without being coupled to any transport protocol.
 func (tkr *Tracker) HandleScrape(scrape *models.Scrape, w Writer) (err error) {
+	if !tkr.scrapeLimiter.Allow(scrape.IP) {
+		stats.RecordEvent(stats.ThrottledScrape)
+		return models.ErrScrapeThrottled
+	}
+
 	if tkr.Config.PrivateEnabled {
-		if _, err = tkr.FindUser(scrape.Passkey); err != nil {
+		if _, err = tkr.findEnabledUser(scrape.Passkey); err != nil {
 			return err
 		}
 	}
 
 	var torrents []*models.Torrent
+	var blocked int
 	for _, infohash := range scrape.Infohashes {
+		if tkr.blocklist.Contains(infohash) {
+			blocked++
+			torrents = append(torrents, nil)
+			continue
+		}
+
 		torrent, err := tkr.FindTorrent(infohash)
-		if err != nil {
+		if err == models.ErrTorrentDNE {
+			// Unknown torrents don't fail the scrape of the others. They
+			// keep their place in the response, for UDP scrapes that match
+			// counts to infohashes by position, and are left out of HTTP
+			// ones as per BEP 48.
+			stats.RecordEvent(stats.UnknownScrapeTorrent)
+			torrents = append(torrents, nil)
+			continue
+		} else if err != nil {
 			return err
 		}
 		torrents = append(torrents, torrent)
 	}
 
+	// Blocked torrents are answered like unknown ones, but a scrape of
+	// nothing else is refused so the client learns why.
+	if blocked > 0 && blocked == len(scrape.Infohashes) {
+		return models.ErrTorrentBlocked
+	}
+
 	stats.RecordEvent(stats.Scrape)
 	return w.WriteScrape(&models.ScrapeResponse{
 		Files: torrents,
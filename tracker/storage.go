@@ -5,7 +5,6 @@
 package tracker
 
 import (
-	"hash/fnv"
 	"runtime"
 	"sync"
 	"sync/atomic"
@@ -16,11 +15,37 @@ import (
 	"github.com/majestrate/chihaya/tracker/models"
 )
 
+// Torrents is a single shard of the torrent map, guarded by its own lock.
 type Torrents struct {
 	torrents map[string]*models.Torrent
 	sync.RWMutex
 }
 
+// announceSlots is a semaphore limiting the announces for one torrent that
+// are processed at once. refs counts the announces holding or waiting for a
+// slot, so the semaphore can be dropped once nobody needs it. Once refs has
+// been set to -1 the semaphore is being dropped and can't be used again.
+type announceSlots struct {
+	slots chan struct{}
+	refs  int32
+}
+
+// ref takes a reference to the slots, unless they are being dropped.
+func (sem *announceSlots) ref() bool {
+	for {
+		refs := atomic.LoadInt32(&sem.refs)
+		if refs < 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&sem.refs, refs, refs+1) {
+			return true
+		}
+	}
+}
+
+// Storage holds the tracker's fast-moving data in memory. Torrents are spread
+// over TorrentMapShards independently locked shards by infohash so announces
+// for different torrents don't contend on a single lock.
 type Storage struct {
 	users  map[string]*models.User
 	usersM sync.RWMutex
@@ -28,15 +53,39 @@ type Storage struct {
 	shards []Torrents
 	size   int32
 
+	// reapBatchSize is how many torrents are reaped per lock of a shard.
+	reapBatchSize int
+
+	// maxAnnounces is how many announces for one torrent are processed at
+	// once, or 0 for no limit.
+	maxAnnounces int
+
+	// announcing holds the *announceSlots of torrents being announced to,
+	// apart from the shards so that taking a slot doesn't lock one
+	announcing sync.Map
+
 	clients  map[string]bool
 	clientsM sync.RWMutex
 }
 
 func NewStorage(cfg *config.Config) *Storage {
+	numShards := cfg.TorrentMapShards
+	if numShards < 1 {
+		numShards = 1
+	}
+
+	reapBatchSize := cfg.ReapBatchSize
+	if reapBatchSize < 1 {
+		reapBatchSize = 1
+	}
+
 	s := &Storage{
 		users:   make(map[string]*models.User),
-		shards:  make([]Torrents, cfg.TorrentMapShards),
+		shards:  make([]Torrents, numShards),
 		clients: make(map[string]bool),
+
+		reapBatchSize: reapBatchSize,
+		maxAnnounces:  cfg.MaxTorrentAnnounces,
 	}
 	for i := range s.shards {
 		s.shards[i].torrents = make(map[string]*models.Torrent)
@@ -48,7 +97,7 @@ func (s *Storage) TopTorrents(n int) (t []*models.Torrent) {
 	if n > 0 {
 		t = make([]*models.Torrent, n)
 		for i := range s.shards {
-			shard := s.shards[i]
+			shard := &s.shards[i]
 			shard.RLock()
 			for _, torrent := range shard.torrents {
 				for idx := range t {
@@ -67,7 +116,7 @@ func (s *Storage) TopTorrents(n int) (t []*models.Torrent) {
 func (s *Storage) DumpTorrents() (t []*models.Torrent) {
 	t = []*models.Torrent{}
 	for i := range s.shards {
-		shard := s.shards[i]
+		shard := &s.shards[i]
 		shard.RLock()
 		for _, torrent := range shard.torrents {
 			t = append(t, torrent)
@@ -81,10 +130,20 @@ func (s *Storage) Len() int {
 	return int(atomic.LoadInt32(&s.size))
 }
 
+// getShardIndex hashes an infohash with 32-bit FNV-1 into a shard index. The
+// hash is inlined so that finding a shard doesn't allocate.
 func (s *Storage) getShardIndex(infohash string) uint32 {
-	idx := fnv.New32()
-	idx.Write([]byte(infohash))
-	return idx.Sum32() % uint32(len(s.shards))
+	const (
+		offset32 = 2166136261
+		prime32  = 16777619
+	)
+
+	hash := uint32(offset32)
+	for i := 0; i < len(infohash); i++ {
+		hash *= prime32
+		hash ^= uint32(infohash[i])
+	}
+	return hash % uint32(len(s.shards))
 }
 
 func (s *Storage) getTorrentShard(infohash string, readonly bool) *Torrents {
@@ -97,6 +156,75 @@ func (s *Storage) getTorrentShard(infohash string, readonly bool) *Torrents {
 	return &s.shards[shardindex]
 }
 
+// AcquireAnnounce takes one of the slots for processing an announce for a
+// torrent, waiting up to wait for one to free up. It is false if no slot
+// could be taken, and otherwise the slot must be given back with
+// ReleaseAnnounce. Without a limit on announces per torrent it is always true.
+func (s *Storage) AcquireAnnounce(infohash string, wait time.Duration) bool {
+	if s.maxAnnounces <= 0 {
+		return true
+	}
+
+	sem := s.refAnnounce(infohash)
+	select {
+	case sem.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case sem.slots <- struct{}{}:
+			return true
+		case <-timer.C:
+		}
+	}
+
+	s.unrefAnnounce(infohash, sem)
+	return false
+}
+
+// ReleaseAnnounce gives back a slot taken by AcquireAnnounce.
+func (s *Storage) ReleaseAnnounce(infohash string) {
+	if s.maxAnnounces <= 0 {
+		return
+	}
+
+	// The slot taken holds a reference, so the slots are still there.
+	v, _ := s.announcing.Load(infohash)
+	sem := v.(*announceSlots)
+	<-sem.slots
+	s.unrefAnnounce(infohash, sem)
+}
+
+// refAnnounce takes a reference to the slots of a torrent, creating them if
+// nobody is announcing to it.
+func (s *Storage) refAnnounce(infohash string) *announceSlots {
+	for {
+		v, exists := s.announcing.Load(infohash)
+		if !exists {
+			v, _ = s.announcing.LoadOrStore(infohash, &announceSlots{slots: make(chan struct{}, s.maxAnnounces)})
+		}
+		if sem := v.(*announceSlots); sem.ref() {
+			return sem
+		}
+		// The slots are being dropped, and will be gone in a moment.
+		runtime.Gosched()
+	}
+}
+
+// unrefAnnounce drops an announce's reference to the slots of a torrent,
+// dropping the slots once nobody holds a reference.
+func (s *Storage) unrefAnnounce(infohash string, sem *announceSlots) {
+	if atomic.AddInt32(&sem.refs, -1) == 0 && atomic.CompareAndSwapInt32(&sem.refs, 0, -1) {
+		// Nobody can take a reference any more, so no other slots can be
+		// stored for the torrent until these are deleted.
+		s.announcing.Delete(infohash)
+	}
+}
+
 func (s *Storage) TouchTorrent(infohash string) error {
 	shard := s.getTorrentShard(infohash, false)
 	defer shard.Unlock()
@@ -158,6 +286,37 @@ func (s *Storage) IncrementTorrentSnatches(infohash string) error {
 	return nil
 }
 
+func (s *Storage) SetTorrentStatus(infohash string, status models.TorrentStatus) error {
+	shard := s.getTorrentShard(infohash, false)
+	defer shard.Unlock()
+
+	torrent, exists := shard.torrents[infohash]
+	if !exists {
+		return models.ErrTorrentDNE
+	}
+
+	torrent.Status = status
+
+	return nil
+}
+
+// UpdateTorrent replaces the info and freeleech flag of a torrent, keeping its
+// swarm.
+func (s *Storage) UpdateTorrent(infohash string, info *models.TorrentInfo, freeleech bool) error {
+	shard := s.getTorrentShard(infohash, false)
+	defer shard.Unlock()
+
+	torrent, exists := shard.torrents[infohash]
+	if !exists {
+		return models.ErrTorrentDNE
+	}
+
+	torrent.Info = info
+	torrent.Freeleech = freeleech
+
+	return nil
+}
+
 func (s *Storage) PutLeecher(infohash string, p *models.Peer) error {
 	shard := s.getTorrentShard(infohash, false)
 	defer shard.Unlock()
@@ -231,54 +390,67 @@ func (s *Storage) PurgeInactiveTorrent(infohash string) error {
 	return nil
 }
 
+// PurgeInactivePeers removes the peers that last announced before the given
+// time. The shards are reaped one at a time, and each shard's torrents in
+// batches of reapBatchSize, yielding between batches so that announces are
+// only ever held up by a single batch rather than by the whole sweep.
 func (s *Storage) PurgeInactivePeers(purgeEmptyTorrents bool, before time.Time) error {
 	unixtime := before.Unix()
 
-	// Build a list of keys to process.
-	index := 0
-	maxkeys := s.Len()
-	keys := make([]string, maxkeys)
+	var keys []string
 	for i := range s.shards {
 		shard := &s.shards[i]
+
+		// Build a list of keys to process.
+		keys = keys[:0]
 		shard.RLock()
 		for infohash := range shard.torrents {
-			keys[index] = infohash
-			index++
-			if index >= maxkeys {
-				break
-			}
+			keys = append(keys, infohash)
 		}
 		shard.RUnlock()
-		if index >= maxkeys {
-			break
+
+		// Process the keys while allowing other goroutines to run.
+		for len(keys) > 0 {
+			n := s.reapBatchSize
+			if n > len(keys) {
+				n = len(keys)
+			}
+			reaped := s.purgeBatch(shard, keys[:n], purgeEmptyTorrents, unixtime)
+			keys = keys[n:]
+
+			for ; reaped > 0; reaped-- {
+				stats.RecordEvent(stats.ReapedTorrent)
+			}
+			runtime.Gosched()
 		}
 	}
 
-	// Process the keys while allowing other goroutines to run.
-	for _, infohash := range keys {
-		runtime.Gosched()
-		shard := s.getTorrentShard(infohash, false)
-		torrent := shard.torrents[infohash]
+	return nil
+}
+
+// purgeBatch purges the inactive peers of a batch of torrents in a shard under
+// a single lock, returning how many empty torrents it removed.
+func (s *Storage) purgeBatch(shard *Torrents, infohashes []string, purgeEmptyTorrents bool, unixtime int64) (reaped int) {
+	shard.Lock()
+	defer shard.Unlock()
 
+	for _, infohash := range infohashes {
+		torrent := shard.torrents[infohash]
 		if torrent == nil {
 			// The torrent has already been deleted since keys were computed.
-			shard.Unlock()
 			continue
 		}
 
 		torrent.Seeders.Purge(unixtime)
 		torrent.Leechers.Purge(unixtime)
 
-		peers := torrent.PeerCount()
-		shard.Unlock()
-
-		if purgeEmptyTorrents && peers == 0 {
-			s.PurgeInactiveTorrent(infohash)
-			stats.RecordEvent(stats.ReapedTorrent)
+		if purgeEmptyTorrents && torrent.PeerCount() == 0 {
+			atomic.AddInt32(&s.size, -1)
+			delete(shard.torrents, infohash)
+			reaped++
 		}
 	}
-
-	return nil
+	return
 }
 
 func (s *Storage) FindUser(passkey string) (*models.User, error) {
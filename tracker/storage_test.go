@@ -0,0 +1,254 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"hash/fnv"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/majestrate/chihaya/config"
+	"github.com/majestrate/chihaya/tracker/models"
+)
+
+func newTestStorage(shards, torrents int) (*Storage, []string) {
+	return newTestStorageWithBatches(shards, torrents, config.DefaultConfig.ReapBatchSize)
+}
+
+func newTestStorageWithBatches(shards, torrents, reapBatchSize int) (*Storage, []string) {
+	cfg := config.DefaultConfig
+	cfg.TorrentMapShards = shards
+	cfg.ReapBatchSize = reapBatchSize
+	s := NewStorage(&cfg)
+
+	infohashes := make([]string, torrents)
+	for i := range infohashes {
+		infohashes[i] = "infohash" + strconv.Itoa(i)
+		s.PutTorrent(&models.Torrent{
+			Infohash: infohashes[i],
+			Seeders:  models.NewPeerMap(true, &cfg),
+			Leechers: models.NewPeerMap(false, &cfg),
+		})
+	}
+	return s, infohashes
+}
+
+func TestShardIndex(t *testing.T) {
+	s, infohashes := newTestStorage(7, 100)
+	for _, infohash := range infohashes {
+		h := fnv.New32()
+		h.Write([]byte(infohash))
+		if expected := h.Sum32() % 7; s.getShardIndex(infohash) != expected {
+			t.Errorf("expected %s in shard %d, got %d", infohash, expected, s.getShardIndex(infohash))
+		}
+	}
+
+	if len(s.DumpTorrents()) != len(infohashes) || s.Len() != len(infohashes) {
+		t.Errorf("expected %d torrents, got %d", len(infohashes), len(s.DumpTorrents()))
+	}
+}
+
+func TestZeroShards(t *testing.T) {
+	s, infohashes := newTestStorage(0, 10)
+	for _, infohash := range infohashes {
+		if _, err := s.FindTorrent(infohash); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestPurgeInactivePeersInBatches(t *testing.T) {
+	s, infohashes := newTestStorageWithBatches(3, 50, 4)
+	now := time.Now().Unix()
+	for i, infohash := range infohashes {
+		if i%2 == 0 {
+			s.PutSeeder(infohash, &models.Peer{ID: "active", LastAnnounce: now})
+		}
+		s.PutLeecher(infohash, &models.Peer{ID: "stale", LastAnnounce: now - 3600})
+	}
+
+	s.PurgeInactivePeers(true, time.Unix(now-60, 0))
+
+	if s.Len() != 25 {
+		t.Errorf("expected the 25 torrents without active peers to be reaped, %d torrents are left", s.Len())
+	}
+	for i, infohash := range infohashes {
+		torrent, err := s.FindTorrent(infohash)
+		if i%2 != 0 {
+			if err != models.ErrTorrentDNE {
+				t.Errorf("expected %s to be reaped", infohash)
+			}
+			continue
+		}
+		if err != nil || torrent.Seeders.Len() != 1 || torrent.Leechers.Len() != 0 {
+			t.Errorf("expected %s to keep only its active seeder", infohash)
+		}
+	}
+}
+
+// benchmarkAnnounceDuringReap measures announces to a large single shard
+// while the reaper sweeps it over and over, reporting the slowest announce
+// alongside the average.
+func benchmarkAnnounceDuringReap(b *testing.B, reapBatchSize int) {
+	s, infohashes := newTestStorageWithBatches(1, 100000, reapBatchSize)
+	now := time.Now().Unix()
+	for _, infohash := range infohashes {
+		s.PutSeeder(infohash, &models.Peer{ID: "seeder", LastAnnounce: now})
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				s.PurgeInactivePeers(true, time.Unix(now-60, 0))
+			}
+		}
+	}()
+
+	peer := &models.Peer{ID: "leecher", LastAnnounce: now}
+	var slowest time.Duration
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := time.Now()
+		s.PutLeecher(infohashes[i%len(infohashes)], peer)
+		if elapsed := time.Since(start); elapsed > slowest {
+			slowest = elapsed
+		}
+	}
+	b.StopTimer()
+	close(stop)
+	<-done
+
+	b.ReportMetric(float64(slowest.Nanoseconds()), "max-ns/op")
+}
+
+func BenchmarkAnnounceDuringReap1(b *testing.B)   { benchmarkAnnounceDuringReap(b, 1) }
+func BenchmarkAnnounceDuringReap100(b *testing.B) { benchmarkAnnounceDuringReap(b, 100) }
+
+// BenchmarkAnnounceDuringReapUnbatched reaps the whole shard under one lock.
+func BenchmarkAnnounceDuringReapUnbatched(b *testing.B) { benchmarkAnnounceDuringReap(b, 1<<30) }
+
+func benchmarkParallelAnnounces(b *testing.B, shards int) {
+	s, infohashes := newTestStorage(shards, 1024)
+	var next uint32
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		peer := &models.Peer{ID: "peer" + strconv.Itoa(int(atomic.AddUint32(&next, 1)))}
+		i := 0
+		for pb.Next() {
+			infohash := infohashes[i%len(infohashes)]
+			s.TouchTorrent(infohash)
+			s.PutLeecher(infohash, peer)
+			i += 7
+		}
+	})
+}
+
+func BenchmarkParallelAnnounces1Shard(b *testing.B)   { benchmarkParallelAnnounces(b, 1) }
+func BenchmarkParallelAnnounces64Shards(b *testing.B) { benchmarkParallelAnnounces(b, 64) }
+
+func TestAcquireAnnounce(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.MaxTorrentAnnounces = 2
+	s := NewStorage(&cfg)
+
+	if !s.AcquireAnnounce("hot", 0) || !s.AcquireAnnounce("hot", 0) {
+		t.Fatal("expected two announces to get a slot")
+	}
+	if s.AcquireAnnounce("hot", 10*time.Millisecond) {
+		t.Error("expected a third announce to be shed")
+	}
+	if !s.AcquireAnnounce("cold", 0) {
+		t.Error("expected other torrents to be unaffected")
+	}
+	s.ReleaseAnnounce("cold")
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.ReleaseAnnounce("hot")
+	}()
+	if !s.AcquireAnnounce("hot", time.Second) {
+		t.Error("expected a waiting announce to get a released slot")
+	}
+	s.ReleaseAnnounce("hot")
+	s.ReleaseAnnounce("hot")
+
+	n := 0
+	s.announcing.Range(func(k, v interface{}) bool {
+		n++
+		return true
+	})
+	if n != 0 {
+		t.Errorf("expected the slots to be dropped once unused, %d are left", n)
+	}
+}
+
+// benchmarkFlashCrowd announces to one hot torrent from most goroutines while
+// the rest announce to other torrents, and reports how long the slowest of
+// those took.
+func benchmarkFlashCrowd(b *testing.B, maxAnnounces int) {
+	cfg := config.DefaultConfig
+	cfg.TorrentMapShards = 64
+	cfg.MaxTorrentAnnounces = maxAnnounces
+	s := NewStorage(&cfg)
+	infohashes := make([]string, 64)
+	for i := range infohashes {
+		infohashes[i] = "infohash" + strconv.Itoa(i)
+		s.PutTorrent(&models.Torrent{
+			Infohash: infohashes[i],
+			Seeders:  models.NewPeerMap(true, &cfg),
+			Leechers: models.NewPeerMap(false, &cfg),
+		})
+	}
+	var next uint32
+	var slowest int64
+
+	// enough goroutines for a crowd, whatever GOMAXPROCS is
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		n := atomic.AddUint32(&next, 1)
+		peer := &models.Peer{ID: "peer" + strconv.Itoa(int(n))}
+		cold := n%8 == 0
+		i := int(n)
+		for pb.Next() {
+			infohash := infohashes[0]
+			if cold {
+				i++
+				infohash = infohashes[1+i%(len(infohashes)-1)]
+			}
+			start := time.Now()
+			if !s.AcquireAnnounce(infohash, 0) {
+				continue
+			}
+			s.PutLeecher(infohash, peer)
+			s.DeleteLeecher(infohash, peer)
+			s.ReleaseAnnounce(infohash)
+			if cold {
+				elapsed := int64(time.Since(start))
+				for {
+					prev := atomic.LoadInt64(&slowest)
+					if elapsed <= prev || atomic.CompareAndSwapInt64(&slowest, prev, elapsed) {
+						break
+					}
+				}
+			}
+		}
+	})
+	b.StopTimer()
+
+	b.ReportMetric(float64(atomic.LoadInt64(&slowest)), "cold-max-ns")
+}
+
+func BenchmarkFlashCrowdUnlimited(b *testing.B) { benchmarkFlashCrowd(b, 0) }
+func BenchmarkFlashCrowdLimit4(b *testing.B)    { benchmarkFlashCrowd(b, 4) }
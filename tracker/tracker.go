@@ -7,12 +7,21 @@
 package tracker
 
 import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/golang/glog"
 
 	"github.com/majestrate/chihaya/backend"
 	"github.com/majestrate/chihaya/config"
+	"github.com/majestrate/chihaya/lru"
+	"github.com/majestrate/chihaya/stats"
 	"github.com/majestrate/chihaya/tracker/models"
 )
 
@@ -22,35 +31,274 @@ type Tracker struct {
 	Config  *config.Config
 	Backend backend.Conn
 	Cache   *Storage
+
+	// short lived caches of backend lookups, nil when disabled
+	torrentLookups *lru.Cache
+	userLookups    *lru.Cache
+
+	// recently handed out peer lists, nil when disabled
+	peerLists *peerListCache
+
+	// scrapes allowed per client address, nil when disabled
+	scrapeLimiter *rateLimiter
+
+	// the announce interval raised under load, nil when disabled
+	loadInterval *loadInterval
+
+	// ports peers may not announce, nil when none are blocked
+	blockedPorts portRanges
+
+	// infohashes the tracker refuses to serve
+	blocklist *blocklist
+
+	// where peer IDs were last seen, nil when disabled
+	peerIDs *peerIDWatch
+
+	// DHT nodes handed out with peers
+	dhtNodes []models.DHTNode
+
+	// torrents each user is leeching, nil when unlimited
+	leechSlots *leechSlots
+
+	// the peers each user has in each swarm, nil when unlimited
+	userPeers *userPeers
+
+	// record of the announces handled, nil when disabled
+	audit *auditLog
+
+	// Authorizer decides whether announces may be handled. It checks
+	// passkeys by default, and may be replaced to authorize announces
+	// some other way.
+	Authorizer Authorizer
+}
+
+// lookupResult is a backend lookup as held by the lookup caches.
+type lookupResult struct {
+	value interface{}
+	err   error
 }
 
 // New creates a new Tracker, and opens any necessary connections.
 // Maintenance routines are automatically spawned in the background.
 func New(cfg *config.Config) (*Tracker, error) {
-	bc, err := backend.Open(&cfg.DriverConfig)
+	// The configuration is checked before connecting to the backend, so
+	// that a mistake in it doesn't leave a connection open.
+	var secret []byte
+	var err error
+	if cfg.HashPeerKeys {
+		if secret, err = newPeerKeySecret(cfg.PeerKeySecret); err != nil {
+			return nil, err
+		}
+	}
+	models.SetPeerKeySecret(secret)
+
+	sources, err := parsePreferredSources(cfg.PreferredSources)
+	if err != nil {
+		return nil, err
+	}
+	models.SetPreferredSources(sources)
+
+	blockedPorts, err := parsePortRanges(cfg.BlockedPorts)
+	if err != nil {
+		return nil, err
+	}
+
+	dhtNodes, err := parseDHTNodes(cfg.DHTNodes)
+	if err != nil {
+		return nil, err
+	}
+
+	blocked, err := loadBlocklist(cfg.InfohashBlocklist)
+	if err != nil {
+		return nil, err
+	}
+
+	bc, err := openBackend(cfg)
 	if err != nil {
 		return nil, err
 	}
 
+	if cfg.AnonymousUserID != 0 {
+		if err = checkUserExists(bc, cfg.AnonymousUserID); err != nil {
+			bc.Close()
+			return nil, err
+		}
+	}
+
+	var clients []string
+	if cfg.ClientWhitelistEnabled && cfg.PrivateEnabled {
+		if clients, err = bc.GetClients(); err != nil {
+			bc.Close()
+			return nil, err
+		}
+	}
+
+	// The audit log is opened last, as nothing closes it if New fails.
+	var audit *auditLog
+	if cfg.AuditLog != "" {
+		// passkeys are hashed like peer keys, with a random secret unless
+		// one is configured
+		if secret, err = newPeerKeySecret(cfg.PeerKeySecret); err == nil {
+			audit, err = newAuditLog(cfg.AuditLog, secret, cfg.AuditLogMaxSize, cfg.AuditLogMaxAge.Duration)
+		}
+		if err != nil {
+			bc.Close()
+			return nil, err
+		}
+	}
+
+	// the interval raised under load stays within the configured bounds too
+	interval := clampInterval(cfg.Announce.Duration, cfg.MinInterval.Duration, cfg.MaxInterval.Duration)
+	maxInterval := clampInterval(cfg.MaxAnnounce.Duration, cfg.MinInterval.Duration, cfg.MaxInterval.Duration)
+
 	tkr := &Tracker{
 		Config:  cfg,
 		Backend: bc,
 		Cache:   NewStorage(cfg),
+
+		torrentLookups: lru.New(cfg.LookupCacheSize, cfg.LookupCacheTTL.Duration),
+		userLookups:    lru.New(cfg.LookupCacheSize, cfg.LookupCacheTTL.Duration),
+		peerLists:      newPeerListCache(cfg.PeerListCacheTTL.Duration, cfg.PeerListCacheChanges),
+		scrapeLimiter:  newRateLimiter(cfg.ScrapeRateLimit, cfg.ScrapeRateBurst),
+		loadInterval:   newLoadInterval(interval, maxInterval, cfg.LoadConnections, cfg.LoadRequestRate),
+		blockedPorts:   blockedPorts,
+		blocklist:      blocked,
+		peerIDs:        newPeerIDWatch(cfg.PeerIDReuseWindow.Duration),
+		dhtNodes:       dhtNodes,
+		leechSlots:     newLeechSlots(cfg.MaxActiveLeech),
+		userPeers:      newUserPeers(cfg.MaxPeersPerUserPerTorrent),
+		audit:          audit,
+	}
+
+	tkr.Authorizer = passkeyAuthorizer{tkr}
+	if cfg.AnnounceAuthURL != "" {
+		tkr.Authorizer = newHTTPAuthorizer(tkr, cfg.AnnounceAuthURL, cfg.AnnounceAuthTimeout.Duration,
+			cfg.AnnounceAuthCacheSize, cfg.AnnounceAuthCacheTTL.Duration, tkr.Authorizer)
 	}
 
-	go tkr.purgeInactivePeers(
-		cfg.PurgeInactiveTorrents,
-		time.Duration(float64(cfg.MinAnnounce.Duration)*cfg.ReapRatio),
-		cfg.ReapInterval.Duration,
-	)
+	stats.RecordAnnounceInterval(interval)
+	if tkr.loadInterval != nil {
+		go tkr.loadInterval.run()
+	}
+
+	if cfg.PrivateEnabled && cfg.PurgeInactiveTorrents && cfg.InactiveTorrentAge.Duration > 0 {
+		go tkr.purgeInactiveTorrents(cfg.InactiveTorrentAge.Duration, cfg.ReapInterval.Duration)
+	}
+
+	ttl := peerTTL(cfg)
+	if cfg.PeerTTL.Duration > 0 && ttl < cfg.Announce.Duration {
+		glog.Warningf("Peers are dropped %s after their last announce, before they are asked to announce again every %s",
+			ttl, cfg.Announce.Duration)
+	}
+	go tkr.purgeInactivePeers(cfg.PurgeInactiveTorrents, ttl, cfg.ReapInterval.Duration)
 
 	if cfg.ClientWhitelistEnabled {
 		tkr.LoadApprovedClients(cfg.ClientWhitelist)
+		tkr.LoadApprovedClients(clients)
 	}
 
 	return tkr, nil
 }
 
+// maxBackendConnectWait caps the wait between attempts to connect to the
+// backend, unless the configured wait is already longer.
+const maxBackendConnectWait = time.Minute
+
+// openBackend connects to the backend, retrying up to backendConnectRetries
+// times if it can't be reached, or forever if that is negative. The wait
+// between attempts starts at backendConnectWait and doubles each time, up to
+// a minute, so a tracker started alongside its database waits for it to come
+// up instead of exiting.
+func openBackend(cfg *config.Config) (bc backend.Conn, err error) {
+	wait := cfg.BackendConnectWait.Duration
+	maxWait := maxBackendConnectWait
+	if wait > maxWait {
+		maxWait = wait
+	}
+
+	for attempt := 1; ; attempt++ {
+		bc, err = backend.Open(&cfg.DriverConfig)
+		if err == nil || !connectionError(err) ||
+			(cfg.BackendConnectRetries >= 0 && attempt > cfg.BackendConnectRetries) {
+			return
+		}
+		glog.Warningf("Failed to connect to the backend on attempt %d, retrying in %s: %s", attempt, wait, err)
+		time.Sleep(wait)
+		if wait *= 2; wait > maxWait {
+			wait = maxWait
+		}
+	}
+}
+
+// connectionError is true for errors reaching the backend over the network.
+// Anything else, like an unknown driver or bad credentials, would only fail
+// the same way again.
+func connectionError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// newPeerKeySecret returns the configured peer key secret, or a random one
+// that lasts for the lifetime of the process if none is configured.
+func newPeerKeySecret(configured string) ([]byte, error) {
+	if configured != "" {
+		return []byte(configured), nil
+	}
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	return secret, err
+}
+
+// findEnabledUser finds the user with a passkey, failing for users that are
+// disabled.
+func (tkr *Tracker) findEnabledUser(passkey string) (*models.User, error) {
+	u, err := tkr.FindUser(passkey)
+	if err == nil && u.Disabled {
+		if tkr.Config.DisabledUserMessage != "" {
+			return nil, models.ClientError(tkr.Config.DisabledUserMessage)
+		}
+		return nil, models.ErrUserDisabled
+	}
+	return u, err
+}
+
+// parsePreferredSources parses a list of CIDRs or single IPs.
+func parsePreferredSources(sources []string) (nets []*net.IPNet, err error) {
+	for _, source := range sources {
+		if ip := net.ParseIP(source); ip != nil {
+			bits := 128
+			if v4 := ip.To4(); v4 != nil {
+				ip, bits = v4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(source)
+		if err != nil {
+			return nil, fmt.Errorf("tracker: invalid preferred source %q: %s", source, err)
+		}
+		nets = append(nets, ipnet)
+	}
+	return
+}
+
+// parseDHTNodes parses a list of host:port addresses.
+func parseDHTNodes(addrs []string) (nodes []models.DHTNode, err error) {
+	for _, addr := range addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("tracker: invalid DHT node %q: %s", addr, err)
+		}
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || host == "" || p == 0 {
+			return nil, fmt.Errorf("tracker: invalid DHT node %q: needs a host and a port", addr)
+		}
+		nodes = append(nodes, models.DHTNode{Host: host, Port: uint16(p)})
+	}
+	return
+}
+
 // check if a peerID is approved
 func (tkr *Tracker) ClientApproved(peerID string) (err error) {
 	err = tkr.Cache.ClientApproved(peerID)
@@ -63,7 +311,7 @@ func (tkr *Tracker) FindUser(passkey string) (u *models.User, err error) {
 	u, err = tkr.Cache.FindUser(passkey)
 	if err == models.ErrUserDNE {
 		if tkr.Config.PrivateEnabled {
-			u, err = tkr.Backend.GetUserByPassKey(passkey)
+			u, err = tkr.lookupUser(passkey)
 		}
 		if err == nil {
 			// yey we got it
@@ -81,7 +329,7 @@ func (tkr *Tracker) FindTorrent(infohash string) (t *models.Torrent, err error)
 		// not in cache
 		// let's check if it's registered
 		if tkr.Config.PrivateEnabled {
-			t, err = tkr.Backend.GetTorrentByInfoHash(infohash)
+			t, err = tkr.lookupTorrent(infohash)
 			if err == nil {
 				t.Seeders = models.NewPeerMap(true, tkr.Config)
 				t.Leechers = models.NewPeerMap(false, tkr.Config)
@@ -93,11 +341,107 @@ func (tkr *Tracker) FindTorrent(infohash string) (t *models.Torrent, err error)
 	return
 }
 
+// lookupUser fetches a user from the backend, consulting the lookup cache
+// first if it is enabled.
+func (tkr *Tracker) lookupUser(passkey string) (*models.User, error) {
+	if cached, ok := tkr.userLookups.Get(passkey); ok {
+		res := cached.(lookupResult)
+		if res.err != nil {
+			return nil, res.err
+		}
+		return res.value.(*models.User), nil
+	}
+
+	u, err := tkr.Backend.GetUserByPassKey(passkey)
+	if cacheableLookup(err) {
+		tkr.userLookups.Put(passkey, lookupResult{u, err})
+	}
+	return u, tkr.backendError(err)
+}
+
+// lookupTorrent fetches a torrent from the backend, consulting the lookup
+// cache first if it is enabled. Every call returns a distinct copy so the
+// caller is free to attach peer maps to it.
+func (tkr *Tracker) lookupTorrent(infohash string) (*models.Torrent, error) {
+	if cached, ok := tkr.torrentLookups.Get(infohash); ok {
+		res := cached.(lookupResult)
+		if res.err != nil {
+			return nil, res.err
+		}
+		t := res.value.(models.Torrent)
+		return &t, nil
+	}
+
+	t, err := tkr.Backend.GetTorrentByInfoHash(infohash)
+	if cacheableLookup(err) {
+		var res lookupResult
+		if err == nil {
+			res.value = *t
+		} else {
+			res.err = err
+		}
+		tkr.torrentLookups.Put(infohash, res)
+	}
+	return t, tkr.backendError(err)
+}
+
+// backendError turns an error from the backend that isn't about the request
+// itself into a RetryableError, so that clients back off while the backend is
+// unavailable instead of retrying at their usual interval.
+func (tkr *Tracker) backendError(err error) error {
+	if err == nil || models.IsPublicError(err) || tkr.Config.BackendRetryIn.Duration <= 0 {
+		return err
+	}
+	glog.Errorf("Backend unavailable: %s", err)
+	stats.RecordEvent(stats.BackendUnavailable)
+	return &models.RetryableError{
+		Reason:  "tracker backend unavailable",
+		RetryIn: tkr.Config.BackendRetryIn.Duration,
+	}
+}
+
+// checkUserExists returns an error unless the backend has a user with the
+// given id.
+func checkUserExists(bc backend.Conn, id uint64) error {
+	users, err := bc.LoadUsers([]uint64{id})
+	if err != nil {
+		return fmt.Errorf("tracker: cannot load anonymous user %d: %s", id, err)
+	}
+	if len(users) == 0 {
+		return fmt.Errorf("tracker: anonymous user %d does not exist", id)
+	}
+	return nil
+}
+
+// cacheableLookup is true for backend lookup results that are safe to cache:
+// successes and definitive misses.
+func cacheableLookup(err error) bool {
+	_, notFound := err.(models.NotFoundError)
+	return err == nil || notFound
+}
+
 // put a torrent into the database
 func (tkr *Tracker) PutTorrent(torrent *models.Torrent) (err error) {
+	if torrent.Info != nil {
+		if err = torrent.Info.CheckLimits(tkr.Config); err != nil {
+			return
+		}
+		if tkr.Config.PrivateEnabled && tkr.Config.RequirePrivateFlag && !torrent.Info.Private {
+			return models.ErrTorrentNotPrivate
+		}
+	}
+	if torrent.Info != nil && torrent.Info.UserID == 0 {
+		// attribute anonymous uploads to the configured anonymous user
+		torrent.Info.UserID = tkr.Config.AnonymousUserID
+	}
 	if tkr.Config.PrivateEnabled {
-		err = tkr.Backend.AddTorrent(torrent)
+		if err = tkr.Backend.AddTorrent(torrent); err != nil {
+			// don't shadow the stored torrent, or a torrent that was never
+			// stored, with this one
+			return
+		}
 	}
+	tkr.torrentLookups.Remove(torrent.Infohash)
 	tkr.Cache.PutTorrent(torrent)
 	return
 }
@@ -143,6 +487,79 @@ func (tkr *Tracker) DeleteLeecher(infohash string, p *models.Peer) (err error) {
 	return
 }
 
+// EvictPeer immediately removes a peer from a torrent's swarm so it is no
+// longer handed out to other peers. The peer rejoins the swarm if it announces
+// again.
+func (tkr *Tracker) EvictPeer(infohash string, pk models.PeerKey) error {
+	torrent, err := tkr.Cache.FindTorrent(infohash)
+	if err != nil {
+		return err
+	}
+
+	if peer, exists := torrent.Seeders.LookUp(pk); exists {
+		if err = tkr.DeleteSeeder(infohash, &peer); err == nil {
+			stats.RecordPeerEvent(stats.DeletedSeed)
+		}
+		return err
+	}
+
+	if peer, exists := torrent.Leechers.LookUp(pk); exists {
+		if err = tkr.DeleteLeecher(infohash, &peer); err == nil {
+			stats.RecordPeerEvent(stats.DeletedLeech)
+		}
+		return err
+	}
+
+	return models.ErrPeerDNE
+}
+
+// SetTorrentStatus sets the moderation flags of a torrent.
+func (tkr *Tracker) SetTorrentStatus(infohash string, status models.TorrentStatus) error {
+	t, err := tkr.FindTorrent(infohash)
+	if err != nil {
+		return err
+	}
+	if tkr.Config.PrivateEnabled {
+		stored := *t
+		stored.Status = status
+		if err = tkr.Backend.SetTorrentStatus(&stored); err != nil {
+			return err
+		}
+	}
+	tkr.torrentLookups.Remove(infohash)
+	return tkr.Cache.SetTorrentStatus(infohash, status)
+}
+
+// UpdateTorrent changes the metadata of a torrent without touching its swarm,
+// and returns the updated torrent.
+func (tkr *Tracker) UpdateTorrent(infohash string, update *models.TorrentUpdate) (*models.Torrent, error) {
+	t, err := tkr.FindTorrent(infohash)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := *t
+	update.Apply(&stored)
+	if err = stored.Info.CheckLimits(tkr.Config); err != nil {
+		return nil, err
+	}
+	if tkr.Config.PrivateEnabled {
+		if err = tkr.Backend.UpdateTorrent(infohash, update); err != nil {
+			return nil, err
+		}
+		if t.Info == nil {
+			// The info wasn't loaded from the backend, so the copy made by
+			// Apply only holds the changed fields.
+			stored.Info = nil
+		}
+	}
+	tkr.torrentLookups.Remove(infohash)
+	if err = tkr.Cache.UpdateTorrent(infohash, stored.Info, stored.Freeleech); err != nil {
+		return nil, err
+	}
+	return tkr.Cache.FindTorrent(infohash)
+}
+
 // delete torrent from database
 func (tkr *Tracker) DeleteTorrent(infohash string) error {
 	t, err := tkr.FindTorrent(infohash)
@@ -153,13 +570,33 @@ func (tkr *Tracker) DeleteTorrent(infohash string) error {
 
 	// remove from cache
 	tkr.Cache.DeleteTorrent(infohash)
+	tkr.torrentLookups.Remove(infohash)
 	return err
 }
 
+// DeleteTorrentByID deletes the torrent with the given backend ID, evicting
+// its peers just like DeleteTorrent.
+func (tkr *Tracker) DeleteTorrentByID(id uint64) error {
+	torrents, err := tkr.Backend.LoadTorrents([]uint64{id})
+	if err != nil {
+		return err
+	}
+	if len(torrents) == 0 {
+		return models.ErrTorrentDNE
+	}
+	return tkr.DeleteTorrent(torrents[0].Infohash)
+}
+
 // put new user into database
 // populate the user model with info
+// a user with an external id is only added once, registering the same
+// external id again gets the user that was added first
 func (tkr *Tracker) RegisterUser(u *models.User) (user *models.User, err error) {
-	err = tkr.Backend.AddUser(u)
+	if u.ExternalID != "" {
+		err = tkr.Backend.AddOrGetUser(u)
+	} else {
+		err = tkr.Backend.AddUser(u)
+	}
 	if err == nil {
 		// user added gud
 		var added []*models.User
@@ -169,12 +606,18 @@ func (tkr *Tracker) RegisterUser(u *models.User) (user *models.User, err error)
 			// user info retrieved from backend
 			user = added[0]
 			// put the user in the cache
+			tkr.userLookups.Remove(user.Passkey)
 			tkr.Cache.PutUser(user)
 		}
 	}
 	return
 }
 
+// VerifyCredential checks the credential of the user with a passkey.
+func (tkr *Tracker) VerifyCredential(passkey, cred string) (bool, error) {
+	return tkr.Backend.VerifyCredential(passkey, cred)
+}
+
 func (tkr *Tracker) DeleteUser(passkey string) (err error) {
 	var u *models.User
 	u, err = tkr.Backend.GetUserByPassKey(passkey)
@@ -183,12 +626,30 @@ func (tkr *Tracker) DeleteUser(passkey string) (err error) {
 		err = tkr.Backend.DeleteUser(u)
 		// remove from cache too
 		tkr.Cache.DeleteUser(u.Passkey)
+		tkr.userLookups.Remove(u.Passkey)
 	}
 	return
 }
 
+// SetUserEnabled enables or disables the user with a passkey. Disabled users
+// can't announce or scrape, but are kept with their history.
+func (tkr *Tracker) SetUserEnabled(passkey string, enabled bool) error {
+	u, err := tkr.Backend.GetUserByPassKey(passkey)
+	if err == nil {
+		err = tkr.Backend.SetUserEnabled(u, enabled)
+	}
+	if err == nil {
+		// drop the user from the caches so the change is seen right away
+		tkr.Cache.DeleteUser(u.Passkey)
+		tkr.userLookups.Remove(u.Passkey)
+	}
+	return err
+}
+
 // Close gracefully shutdowns a Tracker by closing any database connections.
 func (tkr *Tracker) Close() error {
+	tkr.loadInterval.Close()
+	tkr.audit.Close()
 	return tkr.Backend.Close()
 }
 
@@ -199,6 +660,29 @@ func (tkr *Tracker) LoadApprovedClients(clients []string) {
 	}
 }
 
+// PutClient approves a client, storing the approval with the backend so that
+// it lasts across restarts.
+func (tkr *Tracker) PutClient(clientID string) error {
+	if tkr.Config.PrivateEnabled {
+		if err := tkr.Backend.AddClient(clientID); err != nil {
+			return err
+		}
+	}
+	tkr.Cache.PutClient(clientID)
+	return nil
+}
+
+// DeleteClient revokes the approval of a client, with the backend too.
+func (tkr *Tracker) DeleteClient(clientID string) error {
+	if tkr.Config.PrivateEnabled {
+		if err := tkr.Backend.DeleteClient(clientID); err != nil {
+			return err
+		}
+	}
+	tkr.Cache.DeleteClient(clientID)
+	return nil
+}
+
 // Writer serializes a tracker's responses, and is implemented for each
 // response transport used by the tracker. Only one of these may be called
 // per request, and only once.
@@ -211,6 +695,15 @@ type Writer interface {
 	WriteScrape(*models.ScrapeResponse) error
 }
 
+// peerTTL is how long peers are kept after their last announce: peerTTL if
+// it is set, or reapRatio times the minimum announce interval.
+func peerTTL(cfg *config.Config) time.Duration {
+	if cfg.PeerTTL.Duration > 0 {
+		return cfg.PeerTTL.Duration
+	}
+	return time.Duration(float64(cfg.MinAnnounce.Duration) * cfg.ReapRatio)
+}
+
 // purgeInactivePeers periodically walks the torrent database and removes
 // peers that haven't announced recently.
 func (tkr *Tracker) purgeInactivePeers(purgeEmptyTorrents bool, threshold, interval time.Duration) {
@@ -222,5 +715,46 @@ func (tkr *Tracker) purgeInactivePeers(purgeEmptyTorrents bool, threshold, inter
 		if err != nil {
 			glog.Errorf("Error purging torrents: %s", err)
 		}
+		tkr.userPeers.Sweep(tkr.userPeer)
+	}
+}
+
+// purgeInactiveTorrents periodically deletes the torrents that haven't been
+// announced for longer than maxAge from the backend.
+func (tkr *Tracker) purgeInactiveTorrents(maxAge, interval time.Duration) {
+	for range time.NewTicker(interval).C {
+		before := time.Now().Add(-maxAge)
+		glog.V(0).Infof("Purging torrents with no announces since %s", before)
+		if err := tkr.purgeBackendTorrents(before); err != nil {
+			glog.Errorf("Error purging torrents from the backend: %s", err)
+		}
+	}
+}
+
+// purgeBackendTorrents deletes the torrents that haven't been announced since
+// before from the backend, and forgets about them. The files of torrents
+// uploaded through the API are removed too.
+func (tkr *Tracker) purgeBackendTorrents(before time.Time) error {
+	torrents, err := tkr.Backend.PurgeInactiveTorrents(before)
+	for _, t := range torrents {
+		tkr.torrentLookups.Remove(t.Infohash)
+		tkr.Cache.DeleteTorrent(t.Infohash)
+		tkr.removeTorrentFile(t)
+		stats.RecordEvent(stats.ReapedTorrent)
+	}
+	return err
+}
+
+// removeTorrentFile removes the file a torrent was stored under in
+// apiTorrentFileDir, if it has one.
+func (tkr *Tracker) removeTorrentFile(t *models.Torrent) {
+	dir := tkr.Config.APIConfig.TorrentFileDir
+	if dir == "" || t.Info == nil || t.Info.FilePath == "" {
+		return
+	}
+	// the backend only records the name of the file
+	path := filepath.Join(dir, filepath.Base(t.Info.FilePath))
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		glog.Errorf("Failed to remove the file of purged torrent %s: %s", t.Infohash, err)
 	}
 }
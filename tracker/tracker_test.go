@@ -0,0 +1,1569 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/majestrate/chihaya/config"
+	"github.com/majestrate/chihaya/stats"
+	"github.com/majestrate/chihaya/tracker/models"
+
+	"github.com/majestrate/chihaya/backend"
+	"github.com/majestrate/chihaya/backend/noop"
+)
+
+const testInfohash = "01234567890123456789"
+
+// The drivers of the test backends are registered once, as registering a
+// name twice panics. Tests point them at their own backend before use.
+var (
+	testClientDriver   = &clientDriver{}
+	testCategoryDriver = &categoryDriver{}
+	testFlakyDriver    = &flakyDriver{}
+)
+
+func init() {
+	backend.Register("clients", testClientDriver)
+	backend.Register("categories", testCategoryDriver)
+	backend.Register("flaky", testFlakyDriver)
+}
+
+// recordingWriter is a Writer that keeps the last response written to it.
+type recordingWriter struct {
+	err      error
+	announce *models.AnnounceResponse
+	scrape   *models.ScrapeResponse
+}
+
+func (w *recordingWriter) WriteError(err error) error {
+	w.err = err
+	return nil
+}
+
+func (w *recordingWriter) WriteAnnounce(res *models.AnnounceResponse) error {
+	w.announce = res
+	return nil
+}
+
+func (w *recordingWriter) WriteScrape(res *models.ScrapeResponse) error {
+	w.scrape = res
+	return nil
+}
+
+func newTestTracker(t *testing.T, cfg *config.Config) *Tracker {
+	if cfg == nil {
+		cfg = &config.DefaultConfig
+	}
+	tkr, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tkr
+}
+
+func newTestAnnounce(cfg *config.Config, peerID string, left uint64, event string) *models.Announce {
+	return &models.Announce{
+		Config:   cfg,
+		Event:    event,
+		Infohash: testInfohash,
+		Left:     left,
+		NumWant:  50,
+		PeerID:   peerID,
+		IP:       "10.0.0.1",
+		Port:     1234,
+	}
+}
+
+// announce runs an announce through the tracker and returns its response.
+func announce(t *testing.T, tkr *Tracker, ann *models.Announce) *models.AnnounceResponse {
+	w := &recordingWriter{}
+	if err := tkr.HandleAnnounce(ann, w); err != nil {
+		t.Fatalf("announce of %s failed: %s", ann.PeerID, err)
+	}
+	return w.announce
+}
+
+func TestSnatchCounting(t *testing.T) {
+	cfg := config.DefaultConfig
+	tkr := newTestTracker(t, &cfg)
+
+	announce(t, tkr, newTestAnnounce(&cfg, "peer1", 10, "started"))
+	announce(t, tkr, newTestAnnounce(&cfg, "peer1", 5, ""))
+	announce(t, tkr, newTestAnnounce(&cfg, "peer2", 0, "started"))
+
+	if torrent, _ := tkr.FindTorrent(testInfohash); torrent.Snatches != 0 {
+		t.Fatalf("expected no snatches before completion, got %d", torrent.Snatches)
+	}
+
+	announce(t, tkr, newTestAnnounce(&cfg, "peer1", 0, "completed"))
+	announce(t, tkr, newTestAnnounce(&cfg, "peer1", 0, ""))
+	announce(t, tkr, newTestAnnounce(&cfg, "peer2", 0, ""))
+
+	if torrent, _ := tkr.FindTorrent(testInfohash); torrent.Snatches != 1 {
+		t.Errorf("expected 1 snatch, got %d", torrent.Snatches)
+	}
+}
+
+func TestEvictPeer(t *testing.T) {
+	cfg := config.DefaultConfig
+	tkr := newTestTracker(t, &cfg)
+
+	announce(t, tkr, newTestAnnounce(&cfg, "peer1", 10, "started"))
+	announce(t, tkr, newTestAnnounce(&cfg, "peer2", 0, "started"))
+
+	leech := models.NewPeerKey("peer1", "10.0.0.1")
+	if err := tkr.EvictPeer(testInfohash, leech); err != nil {
+		t.Fatal(err)
+	}
+	if err := tkr.EvictPeer(testInfohash, leech); err != models.ErrPeerDNE {
+		t.Errorf("expected ErrPeerDNE evicting an absent peer, got %v", err)
+	}
+	if err := tkr.EvictPeer("unknown", leech); err != models.ErrTorrentDNE {
+		t.Errorf("expected ErrTorrentDNE evicting from an unknown torrent, got %v", err)
+	}
+
+	torrent, _ := tkr.FindTorrent(testInfohash)
+	if torrent.Leechers.Len() != 0 || torrent.Seeders.Len() != 1 {
+		t.Errorf("expected only the seeder to remain, got %d leechers and %d seeders",
+			torrent.Leechers.Len(), torrent.Seeders.Len())
+	}
+}
+
+func TestCompletedWithoutLeeching(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		cfg := config.DefaultConfig
+		cfg.StrictEvents = strict
+		tkr := newTestTracker(t, &cfg)
+
+		w := &recordingWriter{}
+		err := tkr.HandleAnnounce(newTestAnnounce(&cfg, "crossseed", 0, "completed"), w)
+
+		torrent, _ := tkr.FindTorrent(testInfohash)
+		if strict {
+			if err != models.ErrBadRequest {
+				t.Errorf("expected ErrBadRequest in strict mode, got %v", err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("expected completed from a non-leecher to be tolerated, got %s", err)
+		}
+		if torrent.Snatches != 0 || torrent.Seeders.Len() != 1 {
+			t.Errorf("expected a seeder and no snatch, got %d snatches and %d seeders",
+				torrent.Snatches, torrent.Seeders.Len())
+		}
+	}
+}
+
+func TestAnonymousUserID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chihaya-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := config.DefaultConfig
+	cfg.AnonymousUserID = 42
+	cfg.AuditLog = filepath.Join(dir, "announces.log")
+	if _, err := New(&cfg); err == nil {
+		t.Error("expected a missing anonymous user to fail startup")
+	}
+	if _, err := os.Stat(cfg.AuditLog); !os.IsNotExist(err) {
+		t.Errorf("expected the audit log not to be opened by a failed startup, got %v", err)
+	}
+	cfg.AuditLog = ""
+
+	cfg.AnonymousUserID = 0
+	tkr := newTestTracker(t, &cfg)
+	cfg.AnonymousUserID = 42
+
+	info := &models.TorrentInfo{}
+	tkr.PutTorrent(&models.Torrent{Infohash: testInfohash, Info: info})
+	if info.UserID != 42 {
+		t.Errorf("expected anonymous torrent to be attributed to user 42, got %d", info.UserID)
+	}
+}
+
+func TestPeerListCache(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.PeerListCacheTTL = config.Duration{Duration: time.Minute}
+	tkr := newTestTracker(t, &cfg)
+
+	for i := 0; i < 20; i++ {
+		announce(t, tkr, newTestAnnounce(&cfg, "leecher"+strconv.Itoa(i), 10, "started"))
+	}
+	announce(t, tkr, newTestAnnounce(&cfg, "seeder", 0, "started"))
+
+	first := announce(t, tkr, newTestAnnounce(&cfg, "seeder", 0, ""))
+	second := announce(t, tkr, newTestAnnounce(&cfg, "seeder", 0, ""))
+	if first.CachedPeers == nil || first.CachedPeers != second.CachedPeers {
+		t.Fatal("expected announces to an unchanged swarm to share a peer list")
+	}
+
+	announce(t, tkr, newTestAnnounce(&cfg, "newcomer", 10, "started"))
+	if third := announce(t, tkr, newTestAnnounce(&cfg, "seeder", 0, "")); third.CachedPeers == first.CachedPeers {
+		t.Error("expected a peer joining the swarm to invalidate the cached list")
+	}
+
+	if res := announce(t, tkr, newTestAnnounce(&cfg, "newcomer", 10, "")); res.CachedPeers == first.CachedPeers {
+		t.Error("expected leechers and seeders not to share a peer list")
+	}
+}
+
+func TestStartedSkipsPeerListCache(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.PeerListCacheTTL = config.Duration{Duration: time.Minute}
+	cfg.PeerListCacheChanges = 100
+	tkr := newTestTracker(t, &cfg)
+
+	announce(t, tkr, newTestAnnounce(&cfg, "leecher1", 10, "started"))
+	announce(t, tkr, newTestAnnounce(&cfg, "seeder", 0, "started"))
+	cached := announce(t, tkr, newTestAnnounce(&cfg, "seeder", 0, ""))
+	announce(t, tkr, newTestAnnounce(&cfg, "leecher2", 10, "started"))
+
+	if res := announce(t, tkr, newTestAnnounce(&cfg, "seeder", 0, "")); res.CachedPeers != cached.CachedPeers {
+		t.Fatal("expected a regular announce to get the cached list")
+	}
+
+	// A client restarting right after announcing still gets every peer.
+	res := announce(t, tkr, newTestAnnounce(&cfg, "seeder", 0, "started"))
+	if len(res.Peers) != 2 || res.CachedPeers == cached.CachedPeers {
+		t.Errorf("expected a started announce to get a fresh list of both leechers, got %v", res.Peers)
+	}
+}
+
+func TestPeerListCacheSkipsRequester(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.PeerListCacheTTL = config.Duration{Duration: time.Minute}
+	tkr := newTestTracker(t, &cfg)
+
+	for _, id := range []string{"leecher1", "leecher2", "leecher3"} {
+		announce(t, tkr, newTestAnnounce(&cfg, id, 10, "started"))
+	}
+	// The list picked for leecher3 holds the two others.
+	first := announce(t, tkr, newTestAnnounce(&cfg, "leecher3", 10, ""))
+	if len(first.Peers) != 2 || first.CachedPeers == nil {
+		t.Fatalf("expected a cached list of the other two leechers, got %v", first.Peers)
+	}
+
+	res := announce(t, tkr, newTestAnnounce(&cfg, "leecher1", 10, ""))
+	for _, p := range res.Peers {
+		if p.ID == "leecher1" {
+			t.Fatal("expected the cached list to be handed out without the announcing peer")
+		}
+	}
+	if len(res.Peers) != 1 || res.CachedPeers != nil {
+		t.Errorf("expected a filtered, unshared list of one peer, got %v", res.Peers)
+	}
+}
+
+func TestMinSeedersToLeech(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.MinSeedersToLeech = 1
+	tkr := newTestTracker(t, &cfg)
+
+	announce(t, tkr, newTestAnnounce(&cfg, "leecher1", 10, "started"))
+	res := announce(t, tkr, newTestAnnounce(&cfg, "leecher2", 10, "started"))
+	if len(res.Peers) != 0 || res.Warning == "" || res.Incomplete != 2 {
+		t.Fatalf("expected no peers and a warning for a torrent without seeders, got %v %q", res.Peers, res.Warning)
+	}
+
+	res = announce(t, tkr, newTestAnnounce(&cfg, "seeder", 0, "started"))
+	if len(res.Peers) != 2 || res.Warning != "" {
+		t.Errorf("expected seeders to get the leechers, got %v %q", res.Peers, res.Warning)
+	}
+
+	res = announce(t, tkr, newTestAnnounce(&cfg, "leecher1", 10, ""))
+	if len(res.Peers) != 2 || res.Peers[0].ID != "seeder" || res.Warning != "" {
+		t.Errorf("expected leechers to get peers once seeded, got %v %q", res.Peers, res.Warning)
+	}
+}
+
+func TestRequireApproval(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.RequireApproval = true
+	tkr := newTestTracker(t, &cfg)
+
+	announce(t, tkr, newTestAnnounce(&cfg, "seeder", 0, "started"))
+	if err := tkr.HandleAnnounce(newTestAnnounce(&cfg, "leecher1", 10, "started"), &recordingWriter{}); err != models.ErrTorrentUnapproved {
+		t.Fatalf("expected a leecher on an unapproved torrent to be refused, got %v", err)
+	}
+
+	if err := tkr.SetTorrentStatus(testInfohash, models.TorrentStatus{Approved: true}); err != nil {
+		t.Fatal(err)
+	}
+	announce(t, tkr, newTestAnnounce(&cfg, "leecher1", 10, "started"))
+
+	if err := tkr.SetTorrentStatus(testInfohash, models.TorrentStatus{Approved: true, Dead: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tkr.HandleAnnounce(newTestAnnounce(&cfg, "leecher2", 10, "started"), &recordingWriter{}); err != models.ErrTorrentUnapproved {
+		t.Errorf("expected a new leecher on a dead torrent to be refused, got %v", err)
+	}
+	announce(t, tkr, newTestAnnounce(&cfg, "leecher1", 10, ""))
+
+	if torrent, _ := tkr.FindTorrent(testInfohash); !torrent.Status.Dead {
+		t.Errorf("expected the torrent to be marked dead, got %+v", torrent.Status)
+	}
+	if err := tkr.SetTorrentStatus("unknown", models.TorrentStatus{}); err != models.ErrTorrentDNE {
+		t.Errorf("expected setting the status of an unknown torrent to fail, got %v", err)
+	}
+}
+
+func TestPreferredSources(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.PreferredSources = []string{"192.168.1.0/24", "10.1.0.1"}
+	cfg.MaxPreferredSources = 2
+	tkr := newTestTracker(t, &cfg)
+	defer models.SetPreferredSources(nil)
+
+	for i := 0; i < 20; i++ {
+		ann := newTestAnnounce(&cfg, "seeder"+strconv.Itoa(i), 0, "started")
+		announce(t, tkr, ann)
+	}
+	for _, ip := range []string{"192.168.1.1", "192.168.1.2", "10.1.0.1"} {
+		ann := newTestAnnounce(&cfg, "seedbox-"+ip, 0, "started")
+		ann.IP = ip
+		announce(t, tkr, ann)
+	}
+
+	for round := 0; round < 20; round++ {
+		ann := newTestAnnounce(&cfg, "leecher", 10, "")
+		ann.NumWant = 5
+		res := announce(t, tkr, ann)
+		if len(res.Peers) != 5 {
+			t.Fatalf("expected 5 peers, got %d", len(res.Peers))
+		}
+		seen := make(map[string]bool)
+		for i, p := range res.Peers {
+			if seen[p.ID] {
+				t.Fatalf("peer %s returned twice", p.ID)
+			}
+			seen[p.ID] = true
+			if preferred := strings.HasPrefix(p.ID, "seedbox-"); i < 2 && !preferred {
+				t.Fatalf("expected the first 2 peers to be preferred sources, got %v", res.Peers)
+			}
+		}
+	}
+
+	cfg.PreferredSources = []string{"not an address"}
+	if _, err := New(&cfg); err == nil {
+		t.Error("expected an invalid preferred source to be refused")
+	}
+}
+
+func TestStoppedPeersAreDeletedNotReaped(t *testing.T) {
+	stats.DefaultStats = stats.New(config.StatsConfig{})
+	defer func() { stats.DefaultStats = nil }()
+
+	cfg := config.DefaultConfig
+	cfg.PurgeInactiveTorrents = false
+	tkr := newTestTracker(t, &cfg)
+
+	announce(t, tkr, newTestAnnounce(&cfg, "stopper", 10, "started"))
+	announce(t, tkr, newTestAnnounce(&cfg, "seeder", 0, "started"))
+	announce(t, tkr, newTestAnnounce(&cfg, "leecher", 10, "started"))
+	announce(t, tkr, newTestAnnounce(&cfg, "stopper", 10, "stopped"))
+	announce(t, tkr, newTestAnnounce(&cfg, "stranger", 10, "stopped"))
+
+	if torrent, _ := tkr.FindTorrent(testInfohash); torrent.PeerCount() != 2 {
+		t.Fatalf("expected stopped peers to be removed immediately, got %d peers", torrent.PeerCount())
+	}
+
+	tkr.Cache.PurgeInactivePeers(false, time.Now().Add(time.Hour))
+
+	// Stats are handled in order by a single goroutine, so once this event is
+	// received every peer event has been counted.
+	stats.RecordEvent(stats.Announce)
+
+	peers := stats.DefaultStats.Peers
+	if peers.Joined != 3 || peers.Left != 1 || peers.Reaped != 2 || peers.Seeds.Reaped != 1 {
+		t.Errorf("expected 3 joined, 1 left and 2 reaped (1 seed), got %d, %d and %d (%d)",
+			peers.Joined, peers.Left, peers.Reaped, peers.Seeds.Reaped)
+	}
+}
+
+func TestStoppedAnnounceResponse(t *testing.T) {
+	stats.DefaultStats = stats.New(config.StatsConfig{})
+	defer func() { stats.DefaultStats = nil }()
+
+	cfg := config.DefaultConfig
+	cfg.PurgeInactiveTorrents = false
+	tkr := newTestTracker(t, &cfg)
+
+	announce(t, tkr, newTestAnnounce(&cfg, "seeder", 0, "started"))
+	announce(t, tkr, newTestAnnounce(&cfg, "leecher1", 10, "started"))
+	announce(t, tkr, newTestAnnounce(&cfg, "leecher2", 10, "started"))
+
+	for _, ann := range []*models.Announce{
+		newTestAnnounce(&cfg, "seeder", 0, "stopped"),
+		newTestAnnounce(&cfg, "leecher1", 10, "stopped"),
+	} {
+		res := announce(t, tkr, ann)
+		if len(res.Peers) != 0 || res.Interval != int64(cfg.Announce.Seconds()) {
+			t.Errorf("%s: expected no peers and the announce interval, got %v and %d", ann.PeerID, res.Peers, res.Interval)
+		}
+	}
+
+	stats.RecordEvent(stats.Announce)
+
+	peers := stats.DefaultStats.Peers
+	if peers.Left != 2 || peers.Seeds.Left != 1 || peers.Current != 1 {
+		t.Errorf("expected a seed and a leech to have left, got %d left (%d seeds) and %d current",
+			peers.Left, peers.Seeds.Left, peers.Current)
+	}
+}
+
+func TestDualStackedPeers(t *testing.T) {
+	cfg := config.DefaultConfig
+	tkr := newTestTracker(t, &cfg)
+
+	dual := newTestAnnounce(&cfg, "dual", 10, "started")
+	dual.AltIP = "2001:db8::1"
+	announce(t, tkr, dual)
+
+	res := announce(t, tkr, newTestAnnounce(&cfg, "seeder", 0, "started"))
+	addrs := make(map[string]bool)
+	for _, peer := range res.Peers {
+		if peer.ID == "dual" {
+			addrs[peer.IP] = true
+		}
+	}
+	if len(res.Peers) != 2 || !addrs["10.0.0.1"] || !addrs["2001:db8::1"] {
+		t.Fatalf("expected an entry for each of the dual-stacked peer's addresses, got %v", res.Peers)
+	}
+
+	completed := newTestAnnounce(&cfg, "dual", 0, "completed")
+	completed.AltIP = "2001:db8::1"
+	announce(t, tkr, completed)
+	if torrent, _ := tkr.FindTorrent(testInfohash); torrent.Snatches != 1 || torrent.Seeders.Len() != 3 {
+		t.Errorf("expected both addresses to seed for a single snatch, got %d seeders and %d snatches",
+			torrent.Seeders.Len(), torrent.Snatches)
+	}
+
+	stopped := newTestAnnounce(&cfg, "dual", 0, "stopped")
+	stopped.AltIP = "2001:db8::1"
+	announce(t, tkr, stopped)
+	if torrent, _ := tkr.FindTorrent(testInfohash); torrent.PeerCount() != 1 {
+		t.Errorf("expected both addresses to stop, got %d peers", torrent.PeerCount())
+	}
+}
+
+func TestSameFamilyPeers(t *testing.T) {
+	cfg := config.DefaultConfig
+	tkr := newTestTracker(t, &cfg)
+
+	for i := 0; i < 10; i++ {
+		seeder := newTestAnnounce(&cfg, "seeder"+strconv.Itoa(i), 0, "started")
+		seeder.IP = "2001:db8::" + strconv.Itoa(i+1)
+		announce(t, tkr, seeder)
+	}
+	seeder := newTestAnnounce(&cfg, "seeder", 0, "started")
+	seeder.IP = "10.0.0.2"
+	announce(t, tkr, seeder)
+
+	// The IPv4 seeder has to be picked before the list is cut to numwant.
+	leecher := newTestAnnounce(&cfg, "leecher", 10, "")
+	leecher.NumWant = 1
+	leecher.SameFamily = true
+	for i := 0; i < 5; i++ {
+		res := announce(t, tkr, leecher)
+		if len(res.Peers) != 1 || res.Peers[0].IP != "10.0.0.2" {
+			t.Fatalf("expected only the IPv4 seeder, got %v", res.Peers)
+		}
+	}
+}
+
+func TestDHTNodes(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.DHTNodes = []string{"router.example:6881", "[2001:db8::1]:6882"}
+	tkr := newTestTracker(t, &cfg)
+
+	res := announce(t, tkr, newTestAnnounce(&cfg, "leecher1", 10, "started"))
+	if len(res.DHTNodes) != 2 || res.DHTNodes[1] != (models.DHTNode{Host: "2001:db8::1", Port: 6882}) {
+		t.Errorf("expected the DHT nodes to be handed out, got %v", res.DHTNodes)
+	}
+	if res = announce(t, tkr, newTestAnnounce(&cfg, "leecher1", 10, "stopped")); res.DHTNodes != nil {
+		t.Errorf("expected no DHT nodes for a stopping peer, got %v", res.DHTNodes)
+	}
+
+	for _, node := range []string{"router.example", "router.example:0", ":6881"} {
+		cfg.DHTNodes = []string{node}
+		if _, err := New(&cfg); err == nil {
+			t.Errorf("expected DHT node %q to be refused", node)
+		}
+	}
+}
+
+func TestWebSeeds(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.WebSeeds = []string{"http://mirror.example/global"}
+	tkr := newTestTracker(t, &cfg)
+
+	res := announce(t, tkr, newTestAnnounce(&cfg, "leecher1", 10, "started"))
+	if len(res.WebSeeds) != 1 || res.WebSeeds[0] != cfg.WebSeeds[0] {
+		t.Errorf("expected the global web seeds for an empty swarm, got %v", res.WebSeeds)
+	}
+
+	if res = announce(t, tkr, newTestAnnounce(&cfg, "leecher2", 10, "started")); res.WebSeeds != nil {
+		t.Errorf("expected no web seeds once the swarm has peers, got %v", res.WebSeeds)
+	}
+
+	tkr.PutTorrent(&models.Torrent{
+		Infohash: "othertorrent00000000",
+		Seeders:  models.NewPeerMap(true, &cfg),
+		Leechers: models.NewPeerMap(false, &cfg),
+		Info:     &models.TorrentInfo{WebSeeds: []string{"http://mirror.example/torrent"}},
+	})
+	ann := newTestAnnounce(&cfg, "leecher1", 10, "started")
+	ann.Infohash = "othertorrent00000000"
+	if res = announce(t, tkr, ann); len(res.WebSeeds) != 1 || res.WebSeeds[0] != "http://mirror.example/torrent" {
+		t.Errorf("expected the torrent's own web seeds, got %v", res.WebSeeds)
+	}
+}
+
+func TestDryRunAnnounce(t *testing.T) {
+	cfg := config.DefaultConfig
+	tkr := newTestTracker(t, &cfg)
+
+	dryRun := newTestAnnounce(&cfg, "tester", 10, "started")
+	dryRun.DryRun = true
+	if err := tkr.HandleAnnounce(dryRun, &recordingWriter{}); err != models.ErrDryRunDisabled {
+		t.Fatalf("expected dry runs to be refused when disabled, got %v", err)
+	}
+
+	cfg.DryRunEnabled = true
+	dryRun = newTestAnnounce(&cfg, "tester", 10, "started")
+	dryRun.DryRun = true
+	announce(t, tkr, dryRun)
+	if _, err := tkr.FindTorrent(testInfohash); err != models.ErrTorrentDNE {
+		t.Fatalf("expected a dry run not to create the torrent, got %v", err)
+	}
+
+	announce(t, tkr, newTestAnnounce(&cfg, "seeder", 0, "started"))
+	dryRun = newTestAnnounce(&cfg, "tester", 10, "started")
+	dryRun.DryRun = true
+	res := announce(t, tkr, dryRun)
+	if len(res.Peers) != 1 || res.Peers[0].ID != "seeder" || res.Complete != 1 {
+		t.Errorf("expected the dry run to be handed the seeder, got %+v", res)
+	}
+
+	if torrent, _ := tkr.FindTorrent(testInfohash); torrent.Leechers.Len() != 0 {
+		t.Errorf("expected a dry run not to join the swarm, got %d leechers", torrent.Leechers.Len())
+	}
+}
+
+func TestDeleteTorrentByIDNotFound(t *testing.T) {
+	tkr := newTestTracker(t, nil)
+	if err := tkr.DeleteTorrentByID(7); err != models.ErrTorrentDNE {
+		t.Errorf("expected ErrTorrentDNE for an unknown id, got %v", err)
+	}
+}
+
+func TestPutTorrentLimits(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.MaxTorrentFiles = 100
+	cfg.MaxTorrentTags = 10
+	tkr := newTestTracker(t, &cfg)
+
+	var tests = []struct {
+		files, tags int
+		valid       bool
+	}{
+		{100, 10, true},
+		{100000, 0, false},
+		{0, 11, false},
+	}
+
+	for _, tt := range tests {
+		info := &models.TorrentInfo{
+			Files: make([]string, tt.files),
+			Tags:  make([]string, tt.tags),
+		}
+		err := tkr.PutTorrent(&models.Torrent{Infohash: testInfohash, Info: info})
+		if _, rejected := err.(models.ClientError); rejected == tt.valid {
+			t.Errorf("%d files and %d tags: expected valid=%t, got %v", tt.files, tt.tags, tt.valid, err)
+		}
+	}
+
+	tkr.DeleteTorrent(testInfohash)
+	tkr.PutTorrent(&models.Torrent{Infohash: testInfohash, Info: &models.TorrentInfo{Tags: make([]string, 11)}})
+	if _, err := tkr.FindTorrent(testInfohash); err != models.ErrTorrentDNE {
+		t.Errorf("expected a rejected torrent not to be stored, got %v", err)
+	}
+}
+
+// userBackend is a backend that keeps users in memory.
+type userBackend struct {
+	noop.NoOp
+	users []*models.User
+}
+
+func (b *userBackend) AddUser(u *models.User) error {
+	u.ID = uint64(len(b.users) + 1)
+	u.Passkey = "passkey" + strconv.FormatUint(u.ID, 10)
+	b.users = append(b.users, &models.User{ID: u.ID, Passkey: u.Passkey, Username: u.Username, ExternalID: u.ExternalID})
+	return nil
+}
+
+func (b *userBackend) LoadUsers(ids []uint64) (users []*models.User, err error) {
+	for _, id := range ids {
+		users = append(users, b.users[id-1])
+	}
+	return
+}
+
+func (b *userBackend) GetUserByPassKey(passkey string) (*models.User, error) {
+	for _, u := range b.users {
+		if u.Passkey == passkey {
+			copied := *u
+			return &copied, nil
+		}
+	}
+	return nil, models.ErrUserDNE
+}
+
+func (b *userBackend) SetUserEnabled(u *models.User, enabled bool) error {
+	b.users[u.ID-1].Disabled = !enabled
+	return nil
+}
+
+func TestDisabledUser(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.PrivateEnabled = true
+	tkr := newTestTracker(t, &cfg)
+	tkr.Backend = &userBackend{}
+
+	user, err := tkr.RegisterUser(&models.User{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scrape := &models.Scrape{Config: &cfg, Passkey: user.Passkey}
+	if err = tkr.HandleScrape(scrape, &recordingWriter{}); err != nil {
+		t.Fatalf("expected an enabled user to scrape, got %s", err)
+	}
+
+	if err = tkr.SetUserEnabled(user.Passkey, false); err != nil {
+		t.Fatal(err)
+	}
+	if err = tkr.HandleScrape(scrape, &recordingWriter{}); err != models.ErrUserDisabled {
+		t.Errorf("expected a disabled user to be refused, got %v", err)
+	}
+	ann := newTestAnnounce(&cfg, "peer1", 10, "started")
+	ann.Passkey = user.Passkey
+	if err = tkr.HandleAnnounce(ann, &recordingWriter{}); err != models.ErrUserDisabled {
+		t.Errorf("expected a disabled user's announce to be refused, got %v", err)
+	}
+
+	cfg.DisabledUserMessage = "banned, see the forums"
+	if err = tkr.HandleScrape(scrape, &recordingWriter{}); err == nil || err.Error() != cfg.DisabledUserMessage {
+		t.Errorf("expected the configured message, got %v", err)
+	}
+
+	if err = tkr.SetUserEnabled(user.Passkey, true); err != nil {
+		t.Fatal(err)
+	}
+	if err = tkr.HandleScrape(scrape, &recordingWriter{}); err != nil {
+		t.Errorf("expected a re-enabled user to scrape, got %s", err)
+	}
+}
+
+func TestScrapeRateLimit(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.ScrapeRateLimit = 1
+	cfg.ScrapeRateBurst = 2
+	tkr := newTestTracker(t, &cfg)
+	tkr.PutTorrent(&models.Torrent{Infohash: testInfohash})
+
+	scrape := func(ip string) error {
+		return tkr.HandleScrape(&models.Scrape{Config: &cfg, IP: ip, Infohashes: []string{testInfohash}}, &recordingWriter{})
+	}
+	for i := 0; i < 2; i++ {
+		if err := scrape("10.0.0.1"); err != nil {
+			t.Fatalf("expected scrape %d to be allowed, got %s", i+1, err)
+		}
+	}
+	if err := scrape("10.0.0.1"); err != models.ErrScrapeThrottled {
+		t.Errorf("expected a scrape over the burst to be throttled, got %v", err)
+	}
+	if err := scrape("10.0.0.2"); err != nil {
+		t.Errorf("expected another address to have its own limit, got %s", err)
+	}
+
+	now := time.Now().Add(time.Second)
+	if !tkr.scrapeLimiter.allowAt("10.0.0.1", now) || tkr.scrapeLimiter.allowAt("10.0.0.1", now) {
+		t.Error("expected one scrape to be allowed again after a second")
+	}
+}
+
+func TestRequirePrivateFlag(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.PrivateEnabled = true
+	cfg.RequirePrivateFlag = true
+	tkr := newTestTracker(t, &cfg)
+
+	torrent := &models.Torrent{Infohash: testInfohash, Info: &models.TorrentInfo{TorrentName: "public"}}
+	if err := tkr.PutTorrent(torrent); err != models.ErrTorrentNotPrivate {
+		t.Errorf("expected a torrent without the private flag to be refused, got %v", err)
+	}
+
+	torrent.Info.Private = true
+	if err := tkr.PutTorrent(torrent); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := tkr.FindTorrent(testInfohash); err != nil || !stored.Info.Private {
+		t.Errorf("expected the private torrent to be stored, got %v", err)
+	}
+}
+
+func TestScrapeUnknownTorrents(t *testing.T) {
+	cfg := config.DefaultConfig
+	tkr := newTestTracker(t, &cfg)
+	tkr.PutTorrent(&models.Torrent{Infohash: testInfohash})
+
+	w := &recordingWriter{}
+	scrape := &models.Scrape{Config: &cfg, Infohashes: []string{"unknown1", testInfohash, "unknown2"}}
+	if err := tkr.HandleScrape(scrape, w); err != nil {
+		t.Fatalf("expected unknown torrents not to fail the scrape, got %s", err)
+	}
+	files := w.scrape.Files
+	if len(files) != 3 || files[0] != nil || files[1] == nil || files[1].Infohash != testInfohash || files[2] != nil {
+		t.Errorf("expected the known torrent in its place between two unknown ones, got %v", files)
+	}
+}
+
+// downBackend is a backend that can't be reached.
+type downBackend struct {
+	noop.NoOp
+}
+
+func (*downBackend) GetUserByPassKey(passkey string) (*models.User, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestBackendUnavailable(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.PrivateEnabled = true
+	cfg.BackendRetryIn = config.Duration{Duration: 5 * time.Minute}
+	tkr := newTestTracker(t, &cfg)
+	tkr.Backend = &downBackend{}
+
+	ann := newTestAnnounce(&cfg, "peer1", 10, "started")
+	err := tkr.HandleAnnounce(ann, &recordingWriter{})
+	if retryable, ok := err.(*models.RetryableError); !ok || retryable.RetryIn != 5*time.Minute {
+		t.Errorf("expected clients to be told to retry in 5 minutes, got %v", err)
+	}
+
+	cfg.BackendRetryIn = config.Duration{Duration: 0}
+	if err = tkr.HandleAnnounce(ann, &recordingWriter{}); models.IsPublicError(err) {
+		t.Errorf("expected the backend error to be internal when backoff is disabled, got %v", err)
+	}
+}
+
+func TestCorruptNotCredited(t *testing.T) {
+	cfg := config.DefaultConfig
+	torrent := &models.Torrent{
+		Infohash:       testInfohash,
+		Seeders:        models.NewPeerMap(true, &cfg),
+		Leechers:       models.NewPeerMap(false, &cfg),
+		UpMultiplier:   1,
+		DownMultiplier: 1,
+	}
+	user := &models.User{UpMultiplier: 1, DownMultiplier: 1}
+
+	ann := newTestAnnounce(&cfg, "peer1", 10, "")
+	ann.Uploaded, ann.Downloaded, ann.Corrupt = 100, 100, 30
+	ann.BuildPeer(user, torrent)
+	torrent.Leechers.Put(*ann.Peer)
+
+	// Only the corrupt bytes since the last announce are subtracted.
+	ann = newTestAnnounce(&cfg, "peer1", 10, "")
+	ann.Uploaded, ann.Downloaded, ann.Corrupt = 150, 300, 80
+	ann.BuildPeer(user, torrent)
+	delta := newAnnounceDelta(ann, torrent)
+	if delta.Uploaded != 0 || delta.Downloaded != 150 {
+		t.Errorf("expected 0 up and 150 down credited, got %d and %d", delta.Uploaded, delta.Downloaded)
+	}
+	if delta.RawUploaded != 50 || delta.RawDownloaded != 200 {
+		t.Errorf("expected raw deltas of 50 and 200, got %d and %d", delta.RawUploaded, delta.RawDownloaded)
+	}
+
+	// Corrupt bytes are taken off before the multipliers are applied.
+	ann.User = &models.User{UpMultiplier: 1, DownMultiplier: 2}
+	delta = newAnnounceDelta(ann, torrent)
+	if delta.Downloaded != 300 {
+		t.Errorf("expected 300 down credited with a multiplier of 2, got %d", delta.Downloaded)
+	}
+}
+
+// purgingBackend is a backend holding a single torrent that was last
+// announced at lastActive, stored under filePath.
+type purgingBackend struct {
+	noop.NoOp
+	lastActive time.Time
+	filePath   string
+}
+
+func (b *purgingBackend) PurgeInactiveTorrents(before time.Time) ([]*models.Torrent, error) {
+	if b.lastActive.Before(before) {
+		info := &models.TorrentInfo{FilePath: b.filePath}
+		return []*models.Torrent{{Infohash: testInfohash, Info: info}}, nil
+	}
+	return nil, nil
+}
+
+func TestPurgeBackendTorrents(t *testing.T) {
+	stats.DefaultStats = stats.New(config.StatsConfig{})
+	defer func() { stats.DefaultStats = nil }()
+
+	dir, err := ioutil.TempDir("", "chihaya-torrents")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "1.torrent")
+	if err = ioutil.WriteFile(file, []byte("d4:infode"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.DefaultConfig
+	cfg.PrivateEnabled = true
+	cfg.APIConfig.TorrentFileDir = dir
+	tkr := newTestTracker(t, &cfg)
+	tkr.Backend = &purgingBackend{lastActive: time.Now().Add(-time.Hour), filePath: "1.torrent"}
+	tkr.Cache.PutTorrent(&models.Torrent{Infohash: testInfohash})
+
+	if err := tkr.purgeBackendTorrents(time.Now().Add(-2 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tkr.Cache.FindTorrent(testInfohash); err != nil {
+		t.Fatalf("expected an active torrent to be kept, got %v", err)
+	}
+
+	if err := tkr.purgeBackendTorrents(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tkr.Cache.FindTorrent(testInfohash); err != models.ErrTorrentDNE {
+		t.Errorf("expected an inactive torrent to be forgotten, got %v", err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("expected the file of a purged torrent to be removed, got %v", err)
+	}
+
+	stats.RecordEvent(stats.Announce)
+	if reaped := stats.DefaultStats.TorrentsReaped; reaped != 1 {
+		t.Errorf("expected 1 reaped torrent, got %d", reaped)
+	}
+}
+
+// clientBackend is a backend that keeps approved clients in memory.
+type clientBackend struct {
+	noop.NoOp
+	clients map[string]bool
+}
+
+func (b *clientBackend) GetClients() (clients []string, err error) {
+	for client := range b.clients {
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
+
+func (b *clientBackend) AddClient(clientID string) error {
+	b.clients[clientID] = true
+	return nil
+}
+
+func (b *clientBackend) DeleteClient(clientID string) error {
+	delete(b.clients, clientID)
+	return nil
+}
+
+type clientDriver struct {
+	conn *clientBackend
+}
+
+func (d *clientDriver) New(*config.DriverConfig) (backend.Conn, error) {
+	return d.conn, nil
+}
+
+func TestClientsPersisted(t *testing.T) {
+	bc := &clientBackend{clients: make(map[string]bool)}
+	testClientDriver.conn = bc
+
+	cfg := config.DefaultConfig
+	cfg.PrivateEnabled = true
+	cfg.ClientWhitelistEnabled = true
+	cfg.ClientWhitelist = []string{"TR2820"}
+	cfg.DriverConfig.Name = "clients"
+	tkr := newTestTracker(t, &cfg)
+
+	if err := tkr.PutClient("qB4250"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tkr.PutClient("UT3500"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tkr.DeleteClient("UT3500"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restarted tracker approves the clients approved before along with
+	// the configured ones.
+	tkr = newTestTracker(t, &cfg)
+	for client, approved := range map[string]bool{"TR2820": true, "qB4250": true, "UT3500": false} {
+		if err := tkr.ClientApproved(client); (err == nil) != approved {
+			t.Errorf("expected approval of %s to be %t, got %v", client, approved, err)
+		}
+	}
+}
+
+func TestPeerAnnounceCount(t *testing.T) {
+	cfg := config.DefaultConfig
+	tkr := newTestTracker(t, &cfg)
+
+	announce(t, tkr, newTestAnnounce(&cfg, "peer1", 10, "started"))
+	announce(t, tkr, newTestAnnounce(&cfg, "peer1", 5, ""))
+	announce(t, tkr, newTestAnnounce(&cfg, "peer2", 0, "started"))
+
+	key := models.NewPeerKey("peer1", "10.0.0.1")
+	torrent, _ := tkr.FindTorrent(testInfohash)
+	if peer, _ := torrent.Leechers.LookUp(key); peer.Announces != 2 {
+		t.Errorf("expected 2 announces by the leecher, got %d", peer.Announces)
+	}
+
+	// The count carries over when the leecher completes.
+	announce(t, tkr, newTestAnnounce(&cfg, "peer1", 0, "completed"))
+	if peer, _ := torrent.Seeders.LookUp(key); peer.Announces != 3 {
+		t.Errorf("expected 3 announces by the new seeder, got %d", peer.Announces)
+	}
+	if peer, _ := torrent.Seeders.LookUp(models.NewPeerKey("peer2", "10.0.0.1")); peer.Announces != 1 {
+		t.Errorf("expected 1 announce by the other seeder, got %d", peer.Announces)
+	}
+
+	// A peer that leaves and comes back starts counting again.
+	announce(t, tkr, newTestAnnounce(&cfg, "peer1", 0, "stopped"))
+	announce(t, tkr, newTestAnnounce(&cfg, "peer1", 0, "started"))
+	if peer, _ := torrent.Seeders.LookUp(key); peer.Announces != 1 {
+		t.Errorf("expected 1 announce by the returning seeder, got %d", peer.Announces)
+	}
+}
+
+func TestBlockedPorts(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.BlockedPorts = []string{"0", "6881-6889"}
+	tkr := newTestTracker(t, &cfg)
+
+	var tests = []struct {
+		port    uint16
+		event   string
+		allowed bool
+	}{
+		{0, "started", false},
+		{0, "", false},
+		{6881, "", false},
+		{6889, "", false},
+		{6890, "", true},
+		{1, "", true},
+		{0, "stopped", true},
+	}
+	for _, tt := range tests {
+		ann := newTestAnnounce(&cfg, "peer1", 10, tt.event)
+		ann.Port = tt.port
+		err := tkr.HandleAnnounce(ann, &recordingWriter{})
+		if (err == nil) != tt.allowed || (err != nil && err != models.ErrMalformedRequest) {
+			t.Errorf("port %d (%q): expected allowed to be %t, got %v", tt.port, tt.event, tt.allowed, err)
+		}
+	}
+
+	if _, err := parsePortRanges([]string{"6889-6881"}); err == nil {
+		t.Error("expected a backwards port range to be refused")
+	}
+	if _, err := parsePortRanges([]string{"65536"}); err == nil {
+		t.Error("expected an invalid port to be refused")
+	}
+}
+
+func TestHideBlockedPorts(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.BlockedPorts = []string{"0"}
+	cfg.HideBlockedPorts = true
+	tkr := newTestTracker(t, &cfg)
+
+	hidden := newTestAnnounce(&cfg, "hidden", 0, "started")
+	hidden.Port = 0
+	announce(t, tkr, hidden)
+	announce(t, tkr, newTestAnnounce(&cfg, "seeder", 0, "started"))
+
+	res := announce(t, tkr, newTestAnnounce(&cfg, "leecher", 10, "started"))
+	if len(res.Peers) != 1 || res.Peers[0].ID != "seeder" || res.Complete != 2 {
+		t.Errorf("expected the peer on port 0 to be counted but not handed out, got %v with %d seeders", res.Peers, res.Complete)
+	}
+
+	// The hidden peer still gets peers itself.
+	hidden.Event = ""
+	if res = announce(t, tkr, hidden); len(res.Peers) != 1 || res.Peers[0].ID != "leecher" {
+		t.Errorf("expected the peer on port 0 to get the leecher, got %v", res.Peers)
+	}
+}
+
+func TestInfohashBlocklist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chihaya")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const listed = "99999999999999999999"
+	path := filepath.Join(dir, "blocklist")
+	list := "# taken down\n\n" + hex.EncodeToString([]byte(listed)) + "\n"
+	if err = ioutil.WriteFile(path, []byte(list), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.DefaultConfig
+	cfg.InfohashBlocklist = path
+	tkr := newTestTracker(t, &cfg)
+
+	ann := newTestAnnounce(&cfg, "peer1", 10, "started")
+	ann.Infohash = listed
+	if err = tkr.HandleAnnounce(ann, &recordingWriter{}); err != models.ErrTorrentBlocked {
+		t.Errorf("expected an announce of a listed torrent to be refused, got %v", err)
+	}
+
+	// Blocking a torrent at runtime evicts its peers.
+	announce(t, tkr, newTestAnnounce(&cfg, "seeder", 0, "started"))
+	tkr.BlockInfohash(testInfohash)
+	if _, err = tkr.Cache.FindTorrent(testInfohash); err != models.ErrTorrentDNE {
+		t.Errorf("expected a blocked torrent to be evicted, got %v", err)
+	}
+	scrape := &models.Scrape{Config: &cfg, Infohashes: []string{testInfohash}}
+	if err = tkr.HandleScrape(scrape, &recordingWriter{}); err != models.ErrTorrentBlocked {
+		t.Errorf("expected a scrape of a blocked torrent to be refused, got %v", err)
+	}
+
+	// Mixed with others, a blocked torrent keeps its place empty.
+	tkr.PutTorrent(&models.Torrent{Infohash: "other"})
+	w := &recordingWriter{}
+	scrape.Infohashes = []string{testInfohash, "other"}
+	if err = tkr.HandleScrape(scrape, w); err != nil {
+		t.Fatalf("expected a scrape mixing blocked and allowed torrents to succeed, got %s", err)
+	}
+	if files := w.scrape.Files; len(files) != 2 || files[0] != nil || files[1] == nil || files[1].Infohash != "other" {
+		t.Errorf("expected an empty place for the blocked torrent before the allowed one, got %v", files)
+	}
+
+	tkr.UnblockInfohash(testInfohash)
+	if res := announce(t, tkr, newTestAnnounce(&cfg, "leecher", 10, "started")); res.Complete != 0 {
+		t.Errorf("expected no seeders to be left after blocking, got %d", res.Complete)
+	}
+}
+
+func TestConfigCheckedBeforeBackend(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.DriverConfig.Name = "unreachable"
+	cfg.PreferredSources = []string{"not an address"}
+	if _, err := New(&cfg); err == nil || !strings.Contains(err.Error(), "preferred source") {
+		t.Errorf("expected the configuration to be refused before the backend is opened, got %v", err)
+	}
+}
+
+func TestInvalidInfohashBlocklist(t *testing.T) {
+	f, err := ioutil.TempFile("", "chihaya")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("not an infohash\n")
+	f.Close()
+
+	cfg := config.DefaultConfig
+	cfg.InfohashBlocklist = f.Name()
+	if _, err = New(&cfg); err == nil {
+		t.Error("expected an invalid blocklist to be refused")
+	}
+}
+
+// categoryBackend is a backend that only knows the "linux" category.
+type categoryBackend struct {
+	noop.NoOp
+	updated *models.TorrentUpdate
+}
+
+func (b *categoryBackend) UpdateTorrent(infohash string, update *models.TorrentUpdate) error {
+	if update.Category != nil && *update.Category != "linux" {
+		return models.ErrUnknownCategory
+	}
+	b.updated = update
+	return nil
+}
+
+type categoryDriver struct {
+	conn *categoryBackend
+}
+
+func (d *categoryDriver) New(*config.DriverConfig) (backend.Conn, error) {
+	return d.conn, nil
+}
+
+func TestUpdateTorrent(t *testing.T) {
+	cfg := config.DefaultConfig
+	tkr := newTestTracker(t, &cfg)
+
+	info := &models.TorrentInfo{TorrentName: "distro", Category: "misc", Description: "old", Tags: []string{"iso"}}
+	torrent := &models.Torrent{
+		Infohash: testInfohash,
+		Info:     info,
+		Snatches: 3,
+		Seeders:  models.NewPeerMap(true, &cfg),
+		Leechers: models.NewPeerMap(false, &cfg),
+	}
+	if err := tkr.PutTorrent(torrent); err != nil {
+		t.Fatal(err)
+	}
+	announce(t, tkr, newTestAnnounce(&cfg, "seeder", 0, "started"))
+
+	desc, freeleech := "new", true
+	torrent, err := tkr.UpdateTorrent(testInfohash, &models.TorrentUpdate{Description: &desc, Freeleech: &freeleech})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torrent.Info.Description != "new" || torrent.Info.Category != "misc" || len(torrent.Info.Tags) != 1 || !torrent.Freeleech {
+		t.Errorf("expected only the description and freeleech flag to change, got %+v", torrent.Info)
+	}
+	if torrent.Seeders.Len() != 1 || torrent.Snatches != 3 {
+		t.Errorf("expected the swarm and snatches to be kept, got %d seeders and %d snatches", torrent.Seeders.Len(), torrent.Snatches)
+	}
+	if info.Description != "old" {
+		t.Error("expected the info of the torrent to be replaced rather than changed in place")
+	}
+
+	if _, err = tkr.UpdateTorrent("unknown", &models.TorrentUpdate{}); err != models.ErrTorrentDNE {
+		t.Errorf("expected ErrTorrentDNE for an unknown torrent, got %v", err)
+	}
+}
+
+func TestUpdateTorrentCategory(t *testing.T) {
+	bc := &categoryBackend{}
+	testCategoryDriver.conn = bc
+
+	cfg := config.DefaultConfig
+	cfg.PrivateEnabled = true
+	cfg.DriverConfig.Name = "categories"
+	tkr := newTestTracker(t, &cfg)
+
+	info := &models.TorrentInfo{TorrentName: "distro", Category: "linux", Private: true}
+	if err := tkr.PutTorrent(&models.Torrent{Infohash: testInfohash, Info: info}); err != nil {
+		t.Fatal(err)
+	}
+
+	unknown := "nope"
+	if _, err := tkr.UpdateTorrent(testInfohash, &models.TorrentUpdate{Category: &unknown}); err != models.ErrUnknownCategory {
+		t.Errorf("expected an unknown category to be refused, got %v", err)
+	}
+	if torrent, _ := tkr.FindTorrent(testInfohash); torrent.Info.Category != "linux" {
+		t.Errorf("expected a refused update to leave the torrent alone, got category %q", torrent.Info.Category)
+	}
+
+	tags := []string{"iso", "amd64"}
+	if _, err := tkr.UpdateTorrent(testInfohash, &models.TorrentUpdate{Tags: &tags}); err != nil {
+		t.Fatal(err)
+	}
+	if bc.updated == nil || bc.updated.Tags == nil || len(*bc.updated.Tags) != 2 {
+		t.Errorf("expected the backend to store the new tags, got %+v", bc.updated)
+	}
+
+	// Torrents loaded from a private tracker's backend have no info, which
+	// mustn't be taken for a blank category, description and tags.
+	other := "88888888888888888888"
+	if err := tkr.PutTorrent(&models.Torrent{Infohash: other}); err != nil {
+		t.Fatal(err)
+	}
+	freeleech := true
+	torrent, err := tkr.UpdateTorrent(other, &models.TorrentUpdate{Freeleech: &freeleech})
+	if err != nil {
+		t.Fatalf("expected a torrent without info to be updated, got %s", err)
+	}
+	if bc.updated.Category != nil || bc.updated.Description != nil || bc.updated.Tags != nil {
+		t.Errorf("expected only the freeleech flag to be sent to the backend, got %+v", bc.updated)
+	}
+	if !torrent.Freeleech || torrent.Info != nil {
+		t.Errorf("expected only the freeleech flag to change, got %t and %+v", torrent.Freeleech, torrent.Info)
+	}
+}
+
+func TestPeerIDReuse(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.PeerIDReuseWindow = config.Duration{Duration: time.Minute}
+	cfg.RejectPeerIDReuse = true
+	tkr := newTestTracker(t, &cfg)
+
+	// A client announcing every torrent it has with the same peer ID.
+	announce(t, tkr, newTestAnnounce(&cfg, "peer1", 10, "started"))
+	other := newTestAnnounce(&cfg, "peer1", 10, "started")
+	other.Infohash = "99999999999999999999"
+	announce(t, tkr, other)
+
+	// The same client moving to a nearby address.
+	moved := newTestAnnounce(&cfg, "peer1", 10, "")
+	moved.IP = "10.0.200.1"
+	announce(t, tkr, moved)
+
+	// Someone else across the world using its peer ID.
+	impostor := newTestAnnounce(&cfg, "peer1", 10, "started")
+	impostor.IP = "192.0.2.1"
+	if err := tkr.HandleAnnounce(impostor, &recordingWriter{}); err != models.ErrPeerIDReused {
+		t.Errorf("expected an announce from a distant address to be refused, got %v", err)
+	}
+	impostor.Infohash = "99999999999999999999"
+	if err := tkr.HandleAnnounce(impostor, &recordingWriter{}); err != models.ErrPeerIDReused {
+		t.Errorf("expected the peer ID to stay with its first address across torrents, got %v", err)
+	}
+}
+
+func TestPeerIDReuseWindow(t *testing.T) {
+	w := newPeerIDWatch(time.Minute)
+	now := time.Now()
+	home, away := net.ParseIP("10.0.0.1"), net.ParseIP("10.1.0.1")
+
+	if seen := w.checkAt("peer1", home, now); seen != nil {
+		t.Fatalf("expected a new peer ID not to be suspicious, got %s", seen)
+	}
+	if seen := w.checkAt("peer1", away, now.Add(time.Second)); !seen.Equal(home) {
+		t.Errorf("expected a distant address to be flagged, got %v", seen)
+	}
+	if seen := w.checkAt("peer1", away, now.Add(2*time.Minute)); seen != nil {
+		t.Errorf("expected the peer ID to be free once the window passed, got %s", seen)
+	}
+
+	// A dual-stacked client announces over both families with one peer ID.
+	if seen := w.checkAt("peer1", net.ParseIP("2001:db8::1"), now.Add(2*time.Minute)); seen != nil {
+		t.Errorf("expected an address of the other family not to be flagged, got %s", seen)
+	}
+	if seen := w.Check("peer2", "10.0.0.1", "2001:db8::1"); seen != nil {
+		t.Errorf("expected a dual-stacked announce not to be flagged, got %s", seen)
+	}
+	if seen := w.Check("peer2", "10.0.0.1", "2001:db9::1"); !seen.Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("expected a distant alternate address to be flagged, got %v", seen)
+	}
+
+	if seen := (*peerIDWatch)(nil).Check("peer1", "10.0.0.1", ""); seen != nil {
+		t.Errorf("expected a disabled watch to flag nothing, got %s", seen)
+	}
+}
+
+func TestMaxActiveLeech(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.PrivateEnabled = true
+	cfg.MaxActiveLeech = 2
+	tkr := newTestTracker(t, &cfg)
+	tkr.Backend = &userBackend{}
+
+	user, err := tkr.RegisterUser(&models.User{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	infohashes := []string{"11111111111111111111", "22222222222222222222", "33333333333333333333", "44444444444444444444"}
+	for _, infohash := range infohashes {
+		tkr.PutTorrent(&models.Torrent{
+			Infohash: infohash,
+			Seeders:  models.NewPeerMap(true, &cfg),
+			Leechers: models.NewPeerMap(false, &cfg),
+		})
+	}
+	userAnnounce := func(infohash string, left uint64, event string) error {
+		ann := newTestAnnounce(&cfg, "peer1", left, event)
+		ann.Infohash, ann.Passkey = infohash, user.Passkey
+		return tkr.HandleAnnounce(ann, &recordingWriter{})
+	}
+
+	for _, infohash := range infohashes[:2] {
+		if err = userAnnounce(infohash, 10, "started"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = userAnnounce(infohashes[2], 10, "started"); err != models.ErrTooManyLeeches {
+		t.Errorf("expected a third leech to be refused, got %v", err)
+	}
+	if err = userAnnounce(infohashes[2], 0, "started"); err != nil {
+		t.Errorf("expected seeding not to be limited, got %v", err)
+	}
+	if err = userAnnounce(infohashes[0], 5, ""); err != nil {
+		t.Errorf("expected a leecher already in the swarm to keep its slot, got %v", err)
+	}
+
+	// Finishing or stopping a download frees its slot.
+	if err = userAnnounce(infohashes[0], 0, "completed"); err != nil {
+		t.Fatal(err)
+	}
+	if err = userAnnounce(infohashes[3], 10, "started"); err != nil {
+		t.Errorf("expected the slot of a completed download to be usable, got %v", err)
+	}
+	if err = userAnnounce(infohashes[1], 10, "stopped"); err != nil {
+		t.Fatal(err)
+	}
+	if err = userAnnounce(infohashes[0], 10, "started"); err != nil {
+		t.Errorf("expected the slot of a stopped download to be usable, got %v", err)
+	}
+}
+
+func TestMaxPeersPerUserPerTorrent(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.PrivateEnabled = true
+	cfg.MaxPeersPerUserPerTorrent = 2
+	tkr := newTestTracker(t, &cfg)
+	tkr.Backend = &userBackend{}
+
+	alice, err := tkr.RegisterUser(&models.User{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := tkr.RegisterUser(&models.User{Username: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tkr.PutTorrent(&models.Torrent{
+		Infohash: testInfohash,
+		Seeders:  models.NewPeerMap(true, &cfg),
+		Leechers: models.NewPeerMap(false, &cfg),
+	})
+	userAnnounce := func(user *models.User, peerID, ip, event string) error {
+		ann := newTestAnnounce(&cfg, peerID, 10, event)
+		ann.IP, ann.Passkey = ip, user.Passkey
+		return tkr.HandleAnnounce(ann, &recordingWriter{})
+	}
+
+	if err = userAnnounce(alice, "peer1", "10.0.0.1", "started"); err != nil {
+		t.Fatal(err)
+	}
+	if err = userAnnounce(alice, "peer2", "10.0.0.2", "started"); err != nil {
+		t.Fatal(err)
+	}
+	if err = userAnnounce(alice, "peer3", "10.0.0.3", "started"); err != models.ErrTooManyUserPeers {
+		t.Errorf("expected a third address to be refused, got %v", err)
+	}
+	if err = userAnnounce(alice, "peer4", "10.0.0.1", "started"); err != nil {
+		t.Errorf("expected another peer from an address in use to be allowed, got %v", err)
+	}
+	if err = userAnnounce(alice, "peer2", "10.0.0.2", ""); err != nil {
+		t.Errorf("expected a peer already in the swarm to keep announcing, got %v", err)
+	}
+	if err = userAnnounce(bob, "peer5", "10.0.0.5", "started"); err != nil {
+		t.Errorf("expected other users to have their own limit, got %v", err)
+	}
+
+	// Leaving the swarm frees the address.
+	if err = userAnnounce(alice, "peer2", "10.0.0.2", "stopped"); err != nil {
+		t.Fatal(err)
+	}
+	if err = userAnnounce(alice, "peer3", "10.0.0.3", "started"); err != nil {
+		t.Errorf("expected the address of a stopped peer to be freed, got %v", err)
+	}
+
+	// Sweeping forgets the peers that left without being counted again.
+	tkr.Cache.DeleteTorrent(testInfohash)
+	tkr.userPeers.Sweep(tkr.userPeer)
+	if len(tkr.userPeers.peers) != 0 {
+		t.Errorf("expected the peers of a deleted swarm to be swept, got %v", tkr.userPeers.peers)
+	}
+}
+
+func TestPeerTTL(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.MinAnnounce = config.Duration{Duration: 20 * time.Minute}
+	cfg.ReapRatio = 1.5
+	if ttl := peerTTL(&cfg); ttl != 30*time.Minute {
+		t.Errorf("expected the TTL to fall back to reapRatio times minAnnounce, got %s", ttl)
+	}
+
+	cfg.PeerTTL = config.Duration{Duration: 45 * time.Minute}
+	if ttl := peerTTL(&cfg); ttl != 45*time.Minute {
+		t.Errorf("expected peerTTL to be used when set, got %s", ttl)
+	}
+}
+
+func TestAnnounceCountsWithoutPeers(t *testing.T) {
+	cfg := config.DefaultConfig
+	tkr := newTestTracker(t, &cfg)
+
+	announce(t, tkr, newTestAnnounce(&cfg, "seeder", 0, "started"))
+	announce(t, tkr, newTestAnnounce(&cfg, "leecher1", 10, "started"))
+	announce(t, tkr, newTestAnnounce(&cfg, "leecher2", 10, "started"))
+
+	ann := newTestAnnounce(&cfg, "leecher1", 10, "")
+	ann.NumWant = 0
+	if res := announce(t, tkr, ann); res.Complete != 1 || res.Incomplete != 2 || len(res.Peers) != 0 {
+		t.Errorf("expected counts of 1 seeder and 2 leechers with no peers for numwant=0, got %d, %d and %d peers",
+			res.Complete, res.Incomplete, len(res.Peers))
+	}
+
+	if res := announce(t, tkr, newTestAnnounce(&cfg, "leecher2", 10, "stopped")); res.Complete != 1 || res.Incomplete != 1 {
+		t.Errorf("expected a stopping peer to get the counts of the swarm it left, got %d and %d", res.Complete, res.Incomplete)
+	}
+
+	cfg.MinSeedersToLeech = 2
+	if res := announce(t, tkr, newTestAnnounce(&cfg, "leecher1", 10, "")); res.Complete != 1 || res.Incomplete != 1 {
+		t.Errorf("expected counts when peers are held back, got %d and %d", res.Complete, res.Incomplete)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chihaya-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := config.DefaultConfig
+	cfg.AuditLog = filepath.Join(dir, "announces.log")
+	cfg.PeerKeySecret = "secret"
+	tkr := newTestTracker(t, &cfg)
+	defer tkr.Close()
+
+	ann := newTestAnnounce(&cfg, "peer1", 10, "started")
+	ann.Passkey = "hunter2"
+	ann.Uploaded = 5
+	announce(t, tkr, ann)
+	dryRun := newTestAnnounce(&cfg, "peer2", 10, "started")
+	dryRun.DryRun = true
+	cfg.DryRunEnabled = true
+	announce(t, tkr, dryRun)
+
+	raw, err := ioutil.ReadFile(cfg.AuditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), "hunter2") {
+		t.Error("expected the passkey to be left out of the audit log")
+	}
+	lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected a line for the announce only, got %q", raw)
+	}
+
+	var entry auditEntry
+	if err = json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("hunter2"))
+	if entry.Passkey != hex.EncodeToString(mac.Sum(nil)) || entry.Infohash != hex.EncodeToString([]byte(testInfohash)) ||
+		entry.Event != "started" || entry.Uploaded != 5 || entry.Left != 10 {
+		t.Errorf("expected the announce to be recorded, got %+v", entry)
+	}
+
+	// The next line doesn't fit, so the log is rotated first.
+	tkr.audit.maxSize = int64(len(raw)) + 1
+	announce(t, tkr, newTestAnnounce(&cfg, "peer1", 0, "completed"))
+	files, err := filepath.Glob(cfg.AuditLog + "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected the log to be rotated, got %v", files)
+	}
+	for _, file := range files {
+		if b, _ := ioutil.ReadFile(file); strings.Count(string(b), "\n") != 1 {
+			t.Errorf("expected a line in each of the logs, got %q in %s", b, file)
+		}
+	}
+}
+
+// flakyDriver fails to connect a number of times before succeeding, then
+// fails with err if it is set.
+type flakyDriver struct {
+	failures int
+	err      error
+}
+
+func (d *flakyDriver) New(*config.DriverConfig) (backend.Conn, error) {
+	if d.failures > 0 {
+		d.failures--
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return &noop.NoOp{}, nil
+}
+
+func TestBackendConnectRetries(t *testing.T) {
+	defer func() { *testFlakyDriver = flakyDriver{} }()
+
+	cfg := config.DefaultConfig
+	cfg.DriverConfig.Name = "flaky"
+	cfg.BackendConnectWait = config.Duration{Duration: time.Millisecond}
+
+	testFlakyDriver.failures = 1
+	if _, err := New(&cfg); err == nil {
+		t.Fatal("expected the tracker to fail without retries")
+	}
+
+	testFlakyDriver.failures = 3
+	cfg.BackendConnectRetries = 3
+	tkr, err := New(&cfg)
+	if err != nil {
+		t.Fatalf("expected the tracker to connect within 3 retries: %s", err)
+	}
+	tkr.Close()
+
+	testFlakyDriver.failures = 4
+	if _, err := New(&cfg); err == nil {
+		t.Fatal("expected the tracker to give up after 3 retries")
+	}
+
+	testFlakyDriver.failures = 10
+	cfg.BackendConnectRetries = -1
+	tkr, err = New(&cfg)
+	if err != nil {
+		t.Fatalf("expected the tracker to retry until connected: %s", err)
+	}
+	tkr.Close()
+
+	testFlakyDriver.err = errors.New("password authentication failed")
+	if _, err := New(&cfg); err != testFlakyDriver.err {
+		t.Errorf("expected an error other than failing to connect not to be retried, got %v", err)
+	}
+}
+
+func TestIntervalBounds(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.MinInterval = config.Duration{Duration: 45 * time.Minute}
+	tkr := newTestTracker(t, &cfg)
+
+	res := announce(t, tkr, newTestAnnounce(&cfg, "-TR2820-000000000001", 100, "started"))
+	if res.Interval != int64((45 * time.Minute).Seconds()) {
+		t.Errorf("expected the interval to be raised to minInterval, got %d", res.Interval)
+	}
+	if res.MinInterval != int64(cfg.MinAnnounce.Seconds()) {
+		t.Errorf("expected min interval to be left alone, got %d", res.MinInterval)
+	}
+
+	cfg = config.DefaultConfig
+	cfg.LoadConnections = 100
+	cfg.MaxInterval = config.Duration{Duration: time.Hour}
+	tkr = newTestTracker(t, &cfg)
+
+	// ten times the load would scale the interval up to maxAnnounce
+	tkr.loadInterval.sample(1000, 0, time.Now())
+	res = announce(t, tkr, newTestAnnounce(&cfg, "-TR2820-000000000001", 100, "started"))
+	if res.Interval != int64(time.Hour.Seconds()) {
+		t.Errorf("expected the interval raised under load to be capped at maxInterval, got %d", res.Interval)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"sync"
+
+	"github.com/majestrate/chihaya/tracker/models"
+)
+
+// userPeers limits how many addresses each user may have in the swarm of a
+// torrent, to curb sharing accounts. It records the peers each user joined a
+// swarm with, and checks that they are still in it whenever the user's
+// addresses are counted, like leechSlots. Since users come and go from many
+// more swarms than they leech at once, the reaper also sweeps out the peers
+// that have left. A nil *userPeers is valid and allows everything.
+type userPeers struct {
+	max int
+
+	peers map[userTorrent]map[models.PeerKey]string
+	sync.Mutex
+}
+
+type userTorrent struct {
+	userID   uint64
+	infohash string
+}
+
+// newUserPeers creates a limit of max addresses per user in a swarm. It
+// returns nil when max is not positive.
+func newUserPeers(max int) *userPeers {
+	if max <= 0 {
+		return nil
+	}
+	return &userPeers{
+		max:   max,
+		peers: make(map[userTorrent]map[models.PeerKey]string),
+	}
+}
+
+// Acquire records a user joining the swarm of a torrent as the peer with key
+// at ip, and is false if the user is already in the swarm from as many other
+// addresses as allowed. present tells whether a peer recorded earlier is
+// still in the swarm.
+func (u *userPeers) Acquire(userID uint64, infohash string, key models.PeerKey, ip string, present func(userID uint64, infohash string, key models.PeerKey) bool) bool {
+	if u == nil {
+		return true
+	}
+	u.Lock()
+	defer u.Unlock()
+
+	ut := userTorrent{userID, infohash}
+	peers := u.peers[ut]
+
+	ips := make(map[string]struct{}, len(peers))
+	for k, addr := range peers {
+		if k == key {
+			continue
+		}
+		if !present(userID, infohash, k) {
+			delete(peers, k)
+			continue
+		}
+		ips[addr] = struct{}{}
+	}
+
+	if _, known := ips[ip]; !known && len(ips) >= u.max {
+		if len(peers) == 0 {
+			delete(u.peers, ut)
+		}
+		return false
+	}
+	if peers == nil {
+		peers = make(map[models.PeerKey]string)
+		u.peers[ut] = peers
+	}
+	peers[key] = ip
+	return true
+}
+
+// Sweep forgets the peers that are no longer in their swarm.
+func (u *userPeers) Sweep(present func(userID uint64, infohash string, key models.PeerKey) bool) {
+	if u == nil {
+		return
+	}
+	u.Lock()
+	defer u.Unlock()
+
+	for ut, peers := range u.peers {
+		for k := range peers {
+			if !present(ut.userID, ut.infohash, k) {
+				delete(peers, k)
+			}
+		}
+		if len(peers) == 0 {
+			delete(u.peers, ut)
+		}
+	}
+}
+
+// userPeer is true if the peer with key is in the swarm of a torrent for a
+// user.
+func (tkr *Tracker) userPeer(userID uint64, infohash string, key models.PeerKey) bool {
+	t, err := tkr.Cache.FindTorrent(infohash)
+	if err != nil {
+		return false
+	}
+	p, exists := t.Leechers.LookUp(key)
+	if !exists {
+		p, exists = t.Seeders.LookUp(key)
+	}
+	return exists && p.UserID == userID
+}
@@ -0,0 +1,126 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package udp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"net"
+	"time"
+
+	"github.com/majestrate/chihaya/tracker/models"
+)
+
+var (
+	errBadConnectionID = models.ProtocolError("bad connection ID")
+	errUnknownAction   = models.ProtocolError("unknown action")
+	errInternal        = models.ProtocolError("internal error")
+)
+
+// maxScrapeInfohashes is the most infohashes a scrape request can hold.
+const maxScrapeInfohashes = 74
+
+// Request sizes, as per BEP 15.
+const (
+	announceLength = 98
+	maxScrapeSize  = 16 + maxScrapeInfohashes*20
+)
+
+// udpEvents maps the event numbers of a UDP announce to their HTTP names.
+var udpEvents = []string{"", "completed", "started", "stopped"}
+
+// connectionID returns the connection ID handed out to ip at now. IDs are
+// derived from the address rather than stored, so that spoofed connect
+// requests can't fill up memory. An ID is a 64-bit MAC of the address and the
+// window of time it was issued in.
+func (s *Server) connectionID(ip net.IP, now time.Time) []byte {
+	return s.connectionMAC(ip, s.connectionIDWindow(now))
+}
+
+func (s *Server) connectionMAC(ip net.IP, window int64) []byte {
+	var issued [8]byte
+	be.PutUint64(issued[:], uint64(window))
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(ip.To16())
+	mac.Write(issued[:])
+	return mac.Sum(nil)[:8]
+}
+
+// connectionIDWindow returns the window of time now falls in. Windows last
+// half of udpConnectionMaxAge, and IDs from the current and the previous
+// window are accepted, so an ID lasts for at least half of
+// udpConnectionMaxAge and at most all of it.
+func (s *Server) connectionIDWindow(now time.Time) int64 {
+	length := s.config.UDPConfig.ConnectionMaxAge.Duration / 2
+	if length < time.Second {
+		length = time.Second
+	}
+	return now.UnixNano() / int64(length)
+}
+
+// validConnectionID is true if connID was handed out to ip in the current or
+// the previous window. Older IDs are refused, so that captured packets can't
+// be replayed for long.
+func (s *Server) validConnectionID(connID []byte, ip net.IP, now time.Time) bool {
+	window := s.connectionIDWindow(now)
+	return hmac.Equal(connID, s.connectionMAC(ip, window)) ||
+		hmac.Equal(connID, s.connectionMAC(ip, window-1))
+}
+
+// newAnnounce parses an announce request from the client at ip. The address
+// and key fields the client sends are ignored: peers are always listed under
+// the address the packet came from.
+func (s *Server) newAnnounce(packet []byte, ip net.IP) (*models.Announce, error) {
+	if len(packet) < announceLength {
+		return nil, models.ErrMalformedRequest
+	}
+
+	event := be.Uint32(packet[80:84])
+	if event >= uint32(len(udpEvents)) {
+		return nil, models.ErrMalformedRequest
+	}
+
+	numWant := int(int32(be.Uint32(packet[92:96])))
+	if numWant < 0 {
+		numWant = s.config.NumWantFallback
+	}
+
+	return &models.Announce{
+		Config:     s.config,
+		Compact:    true,
+		SameFamily: true,
+		Infohash:   string(packet[16:36]),
+		PeerID:     string(packet[36:56]),
+		Downloaded: be.Uint64(packet[56:64]),
+		Left:       be.Uint64(packet[64:72]),
+		Uploaded:   be.Uint64(packet[72:80]),
+		Event:      udpEvents[event],
+		NumWant:    numWant,
+		IP:         ip.String(),
+		Port:       be.Uint16(packet[96:98]),
+	}, nil
+}
+
+// newScrape parses a scrape request.
+func (s *Server) newScrape(packet []byte, ip net.IP) (*models.Scrape, error) {
+	if len(packet) > maxScrapeSize {
+		packet = packet[:maxScrapeSize]
+	}
+	hashes := packet[16:]
+	if len(hashes) < 20 {
+		return nil, models.ErrMalformedRequest
+	}
+
+	infohashes := make([]string, 0, len(hashes)/20)
+	for ; len(hashes) >= 20; hashes = hashes[20:] {
+		infohashes = append(infohashes, string(hashes[:20]))
+	}
+
+	return &models.Scrape{
+		Config:     s.config,
+		IP:         ip.String(),
+		Infohashes: infohashes,
+	}, nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package udp
+
+import (
+	"sync"
+	"time"
+)
+
+// replayFilter remembers the connection and transaction IDs of recent
+// requests, so that duplicates of a request can be dropped. IDs are kept in
+// two generations that are rotated every window, or sooner once the current
+// one holds size IDs, so an ID is remembered for between one and two windows
+// and at most twice size IDs are held. A nil *replayFilter is valid and
+// remembers nothing.
+type replayFilter struct {
+	window time.Duration
+	size   int
+
+	current, previous map[[12]byte]struct{}
+	rotated           time.Time
+	sync.Mutex
+}
+
+// newReplayFilter creates a replayFilter, or nil if window is not positive.
+func newReplayFilter(window time.Duration, size int) *replayFilter {
+	if window <= 0 {
+		return nil
+	}
+	if size < 1 {
+		size = 1
+	}
+	return &replayFilter{
+		window:   window,
+		size:     size,
+		current:  make(map[[12]byte]struct{}),
+		previous: make(map[[12]byte]struct{}),
+	}
+}
+
+// Seen records a request at now, and is true if the same connection and
+// transaction IDs were recorded recently.
+func (f *replayFilter) Seen(connID, transactionID []byte, now time.Time) bool {
+	if f == nil {
+		return false
+	}
+
+	var key [12]byte
+	copy(key[0:8], connID)
+	copy(key[8:12], transactionID)
+
+	f.Lock()
+	defer f.Unlock()
+	if now.Sub(f.rotated) >= f.window || len(f.current) >= f.size {
+		f.previous, f.current = f.current, make(map[[12]byte]struct{}, len(f.current))
+		f.rotated = now
+	}
+
+	if _, seen := f.current[key]; seen {
+		return true
+	}
+	if _, seen := f.previous[key]; seen {
+		return true
+	}
+	f.current[key] = struct{}{}
+	return false
+}
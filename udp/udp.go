@@ -0,0 +1,274 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package udp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/majestrate/chihaya/config"
+	"github.com/majestrate/chihaya/stats"
+	"github.com/majestrate/chihaya/tracker"
+	"github.com/majestrate/chihaya/tracker/models"
+)
+
+// maxPacketSize is larger than any request a client sends.
+const maxPacketSize = 2048
+
+// Server represents a UDP torrent tracker.
+type Server struct {
+	config  *config.Config
+	tracker *tracker.Tracker
+
+	// secret keys the connection IDs handed out to clients.
+	secret []byte
+
+	// recently seen requests, nil when duplicates aren't dropped
+	replays *replayFilter
+
+	conns    []*net.UDPConn
+	stopping bool
+	sync.Mutex
+}
+
+// NewServer returns a new UDP server for a given configuration and tracker.
+func NewServer(cfg *config.Config, tkr *tracker.Tracker) *Server {
+	return &Server{
+		config:  cfg,
+		tracker: tkr,
+
+		replays: newReplayFilter(cfg.UDPConfig.ReplayWindow.Duration, cfg.UDPConfig.ReplayCacheSize),
+	}
+}
+
+// Setup generates the secret used for connection IDs.
+func (s *Server) Setup() error {
+	if s.secret == nil {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		s.secret = secret
+	}
+	return nil
+}
+
+// Serve runs a UDP server, blocking until the server has shut down. It
+// returns an error if the server failed rather than being stopped.
+func (s *Server) Serve() error {
+	if err := s.listen(); err != nil {
+		glog.Errorf("Failed to run UDP server: %s", err)
+		return err
+	}
+	return s.serve()
+}
+
+// Stop cleanly shuts down the server.
+func (s *Server) Stop() {
+	s.Lock()
+	s.stopping = true
+	s.Unlock()
+	s.closeConns()
+}
+
+// closeConns closes every socket, which ends all the listeners.
+func (s *Server) closeConns() {
+	s.Lock()
+	defer s.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// listen binds the configured sockets. udpListenAddr may be an IPv4 address,
+// or [::] to accept both families on one socket, while udpListenAddr6 binds
+// a separate IPv6 only socket.
+func (s *Server) listen() error {
+	var addrs []struct{ network, addr string }
+	if s.config.UDPConfig.ListenAddr != "" {
+		addrs = append(addrs, struct{ network, addr string }{"udp", s.config.UDPConfig.ListenAddr})
+	}
+	if s.config.UDPConfig.ListenAddr6 != "" {
+		addrs = append(addrs, struct{ network, addr string }{"udp6", s.config.UDPConfig.ListenAddr6})
+	}
+	if len(addrs) == 0 {
+		return errors.New("udp: no listen address configured")
+	}
+
+	var conns []*net.UDPConn
+	for _, a := range addrs {
+		laddr, err := net.ResolveUDPAddr(a.network, a.addr)
+		if err == nil {
+			var conn *net.UDPConn
+			if conn, err = net.ListenUDP(a.network, laddr); err == nil {
+				conns = append(conns, conn)
+				if size := s.config.UDPConfig.ReadBufferSize; size > 0 {
+					err = conn.SetReadBuffer(size)
+				}
+			}
+		}
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return err
+		}
+	}
+
+	s.Lock()
+	s.conns = conns
+	s.stopping = false
+	s.Unlock()
+	return nil
+}
+
+// serve reads packets from every socket with a pool of listeners each, until
+// the sockets are closed.
+func (s *Server) serve() error {
+	listeners := s.config.NumListeners
+	if listeners < 1 {
+		listeners = 1
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(s.conns)*listeners)
+	for _, conn := range s.conns {
+		glog.Infof("Serving UDP on %s", conn.LocalAddr())
+		for i := 0; i < listeners; i++ {
+			wg.Add(1)
+			go func(conn *net.UDPConn) {
+				defer wg.Done()
+				errs <- s.serveConn(conn)
+			}(conn)
+		}
+	}
+	wg.Wait()
+	close(errs)
+
+	s.Lock()
+	stopping := s.stopping
+	s.Unlock()
+
+	if err := <-errs; err != nil && !stopping {
+		glog.Errorf("Failed to run UDP server: %s", err)
+		return err
+	}
+	glog.Info("UDP server shut down cleanly")
+	return nil
+}
+
+// serveConn handles packets from a socket until reading from it fails.
+func (s *Server) serveConn(conn *net.UDPConn) error {
+	packet := make([]byte, maxPacketSize)
+	buf := new(bytes.Buffer)
+
+	for {
+		n, addr, err := conn.ReadFromUDP(packet)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			// Any other error ends serving on this socket, so the others
+			// are closed too and Serve can report the failure.
+			s.closeConns()
+			return err
+		}
+
+		start := time.Now()
+		buf.Reset()
+		if s.handlePacket(packet[:n], addr.IP, buf) {
+			if _, err := conn.WriteToUDP(buf.Bytes(), addr); err != nil {
+				glog.V(2).Infof("Failed to write UDP response to %s: %s", addr, err)
+			}
+		}
+
+		duration := time.Since(start)
+		// Packets too short to hold an action were ignored straight away.
+		if threshold := s.config.SlowRequestThreshold.Duration; threshold > 0 && duration > threshold && n >= 12 {
+			glog.Warningf("[UDP - %9s] slow request from %s, action %d", duration, addr, be.Uint32(packet[8:12]))
+			stats.RecordEvent(stats.SlowRequest)
+		}
+
+		stats.RecordEvent(stats.HandledRequest)
+		stats.RecordTiming(stats.ResponseTime, duration)
+	}
+}
+
+// handlePacket handles a request from the client at ip, writing the response
+// into buf. It returns false if the packet should be ignored.
+func (s *Server) handlePacket(packet []byte, ip net.IP, buf *bytes.Buffer) bool {
+	if len(packet) < 16 {
+		return false
+	}
+
+	connID := packet[0:8]
+	action := be.Uint32(packet[8:12])
+	w := &Writer{
+		buf:           buf,
+		transactionID: packet[12:16],
+		ipv6:          ip.To4() == nil,
+		maxSize:       s.config.MaxResponseSize,
+	}
+
+	if action == connectActionID {
+		if be.Uint64(connID) != connectProtocolID {
+			return false
+		}
+		w.writeConnect(s.connectionID(ip, time.Now()))
+		return true
+	}
+
+	now := time.Now()
+	if !s.validConnectionID(connID, ip, now) {
+		w.WriteError(errBadConnectionID)
+		return true
+	}
+	if s.replays.Seen(connID, w.transactionID, now) {
+		glog.V(2).Infof("[UDP] %s: dropped a duplicate request", ip)
+		return false
+	}
+
+	var err error
+	switch action {
+	case announceActionID:
+		var ann *models.Announce
+		if ann, err = s.newAnnounce(packet, ip); err == nil {
+			err = s.tracker.HandleAnnounce(ann, w)
+		}
+
+	case scrapeActionID:
+		var scrape *models.Scrape
+		if scrape, err = s.newScrape(packet, ip); err == nil {
+			err = s.tracker.HandleScrape(scrape, w)
+		}
+
+	default:
+		err = errUnknownAction
+	}
+
+	if err != nil {
+		// Drop anything written before the failure.
+		buf.Reset()
+		if _, retryable := err.(*models.RetryableError); retryable {
+			// There is no way to tell UDP clients when to retry, so they
+			// only get the reason.
+			w.WriteError(err)
+		} else if models.IsPublicError(err) {
+			stats.RecordEvent(stats.ClientError)
+			w.WriteError(err)
+		} else {
+			glog.Errorf("[UDP] %s: %s", ip, err)
+			stats.RecordEvent(stats.ErroredRequest)
+			w.WriteError(errInternal)
+		}
+	}
+	return true
+}
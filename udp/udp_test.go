@@ -0,0 +1,273 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package udp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/majestrate/chihaya/config"
+	"github.com/majestrate/chihaya/tracker"
+	"github.com/majestrate/chihaya/tracker/models"
+
+	_ "github.com/majestrate/chihaya/backend/noop"
+)
+
+const testInfohash = "01234567890123456789"
+
+func startServer(t *testing.T, listenAddr, listenAddr6 string) *Server {
+	cfg := config.DefaultConfig
+	cfg.UDPConfig.ListenAddr = listenAddr
+	cfg.UDPConfig.ListenAddr6 = listenAddr6
+	cfg.NumListeners = 1
+
+	tkr, err := tracker.New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(&cfg, tkr)
+	if err = srv.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	if err = srv.listen(); err != nil {
+		t.Skipf("cannot listen on %q and %q: %s", listenAddr, listenAddr6, err)
+	}
+	go srv.serve()
+	return srv
+}
+
+func dial(t *testing.T, conn *net.UDPConn) *net.UDPConn {
+	client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func roundTrip(t *testing.T, client *net.UDPConn, packet []byte) (uint32, []byte) {
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Write(packet); err != nil {
+		t.Fatal(err)
+	}
+	res := make([]byte, maxPacketSize)
+	n, err := client.Read(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < 8 || !bytes.Equal(res[4:8], packet[12:16]) {
+		t.Fatalf("unexpected response header %x", res[:n])
+	}
+	return be.Uint32(res[0:4]), res[8:n]
+}
+
+func connect(t *testing.T, client *net.UDPConn) []byte {
+	packet := make([]byte, 16)
+	be.PutUint64(packet[0:8], connectProtocolID)
+	be.PutUint32(packet[8:12], connectActionID)
+	be.PutUint32(packet[12:16], 0xcafe)
+
+	action, body := roundTrip(t, client, packet)
+	if action != connectActionID || len(body) != 8 {
+		t.Fatalf("unexpected connect response %d %x", action, body)
+	}
+	return body
+}
+
+// announce returns the compact peer list of an announce response.
+func announce(t *testing.T, client *net.UDPConn, peerID string, left uint64, port uint16) []byte {
+	packet := make([]byte, announceLength)
+	copy(packet[0:8], connect(t, client))
+	be.PutUint32(packet[8:12], announceActionID)
+	be.PutUint32(packet[12:16], 0xbeef)
+	copy(packet[16:36], testInfohash)
+	copy(packet[36:56], peerID)
+	be.PutUint64(packet[64:72], left)
+	be.PutUint32(packet[80:84], 2)
+	be.PutUint32(packet[92:96], 0xffffffff)
+	be.PutUint16(packet[96:98], port)
+
+	action, body := roundTrip(t, client, packet)
+	if action != announceActionID || len(body) < 12 {
+		t.Fatalf("unexpected announce response %d %q", action, body)
+	}
+	return body[12:]
+}
+
+func compactPeer(ip string, port uint16) []byte {
+	addr := net.ParseIP(ip)
+	if addr4 := addr.To4(); addr4 != nil {
+		addr = addr4
+	}
+	var p [2]byte
+	be.PutUint16(p[:], port)
+	return append(append([]byte{}, addr...), p[:]...)
+}
+
+func TestAnnounceMatchesClientFamily(t *testing.T) {
+	srv := startServer(t, "127.0.0.1:0", "[::1]:0")
+	defer srv.Stop()
+
+	client4 := dial(t, srv.conns[0])
+	defer client4.Close()
+	client6 := dial(t, srv.conns[1])
+	defer client6.Close()
+
+	announce(t, client4, "-TR2820-seeder4aaaaa", 0, 1111)
+	announce(t, client6, "-TR2820-seeder6aaaaa", 0, 2222)
+
+	peers := announce(t, client4, "-TR2820-leecher4aaaa", 100, 3333)
+	if expected := compactPeer("127.0.0.1", 1111); !bytes.Equal(peers, expected) {
+		t.Errorf("IPv4 client got peers %x, expected %x", peers, expected)
+	}
+
+	peers = announce(t, client6, "-TR2820-leecher6aaaa", 100, 4444)
+	if expected := compactPeer("::1", 2222); !bytes.Equal(peers, expected) {
+		t.Errorf("IPv6 client got peers %x, expected %x", peers, expected)
+	}
+}
+
+func TestAnnounceMaxSize(t *testing.T) {
+	res := &models.AnnounceResponse{Interval: 1800}
+	for i := 0; i < 100000; i++ {
+		res.Peers = append(res.Peers, models.Peer{IP: "10.0.0.1", Port: uint16(i)})
+	}
+
+	buf := &bytes.Buffer{}
+	w := &Writer{buf: buf, transactionID: make([]byte, 4), maxSize: 1000}
+	if err := w.WriteAnnounce(res); err != nil {
+		t.Fatal(err)
+	}
+	// 20 bytes of header and as many 6 byte peers as fit.
+	if buf.Len() != 20+(1000-20)/6*6 {
+		t.Errorf("expected the peers to be cut short at 1000 bytes, got %d bytes", buf.Len())
+	}
+}
+
+func TestBadConnectionID(t *testing.T) {
+	srv := startServer(t, "127.0.0.1:0", "")
+	defer srv.Stop()
+
+	client := dial(t, srv.conns[0])
+	defer client.Close()
+
+	packet := make([]byte, announceLength)
+	be.PutUint64(packet[0:8], 12345)
+	be.PutUint32(packet[8:12], announceActionID)
+	action, body := roundTrip(t, client, packet)
+	if action != errorActionID || string(body) != errBadConnectionID.Error()+"\x00" {
+		t.Errorf("unexpected response %d %q to a bad connection ID", action, body)
+	}
+}
+
+func TestConnectionIDMaxAge(t *testing.T) {
+	cfg := config.DefaultConfig
+	srv := &Server{config: &cfg, secret: []byte("secret")}
+	ip := net.ParseIP("192.0.2.1")
+	// issued at the start of a window, so it lasts all of udpConnectionMaxAge
+	maxAge := cfg.UDPConfig.ConnectionMaxAge.Duration
+	issued := time.Unix(0, srv.connectionIDWindow(time.Now())*int64(maxAge/2))
+	connID := srv.connectionID(ip, issued)
+	if len(connID) != 8 {
+		t.Fatalf("expected an 8 byte connection ID, got %d bytes", len(connID))
+	}
+
+	var tests = []struct {
+		ip       string
+		after    time.Duration
+		expected bool
+	}{
+		{"192.0.2.1", 0, true},
+		{"192.0.2.1", maxAge - time.Second, true},
+		{"192.0.2.1", maxAge, false},
+		{"192.0.2.1", -time.Second, false},
+		{"192.0.2.2", 0, false},
+	}
+
+	for _, tt := range tests {
+		if valid := srv.validConnectionID(connID, net.ParseIP(tt.ip), issued.Add(tt.after)); valid != tt.expected {
+			t.Errorf("%s after %s: expected valid to be %t", tt.ip, tt.after, tt.expected)
+		}
+	}
+}
+
+func TestReplayFilter(t *testing.T) {
+	f := newReplayFilter(time.Second, 2)
+	connID, start := []byte("connidid"), time.Now()
+
+	if f.Seen(connID, []byte("tx01"), start) {
+		t.Error("expected a new request not to be seen")
+	}
+	if !f.Seen(connID, []byte("tx01"), start.Add(time.Second)) {
+		t.Error("expected a duplicate within the window to be seen")
+	}
+	if f.Seen(connID, []byte("tx01"), start.Add(3*time.Second)) {
+		t.Error("expected a request to be forgotten after two windows")
+	}
+
+	// a full generation is rotated early, so at most twice size are held
+	f.Seen(connID, []byte("tx02"), start.Add(3*time.Second))
+	f.Seen(connID, []byte("tx03"), start.Add(3*time.Second))
+	if len(f.current)+len(f.previous) > 4 {
+		t.Errorf("expected at most 4 remembered requests, got %d", len(f.current)+len(f.previous))
+	}
+
+	var disabled *replayFilter
+	if disabled.Seen(connID, []byte("tx01"), start) || disabled.Seen(connID, []byte("tx01"), start) {
+		t.Error("expected nothing to be seen when disabled")
+	}
+}
+
+func TestDuplicateRequestDropped(t *testing.T) {
+	srv := startServer(t, "127.0.0.1:0", "")
+	defer srv.Stop()
+	srv.replays = newReplayFilter(10*time.Second, 16)
+
+	client := dial(t, srv.conns[0])
+	defer client.Close()
+
+	packet := make([]byte, 16+20)
+	copy(packet[0:8], connect(t, client))
+	be.PutUint32(packet[8:12], scrapeActionID)
+	be.PutUint32(packet[12:16], 0xf00d)
+	copy(packet[16:36], testInfohash)
+
+	// the torrent is unknown, but any response will do
+	roundTrip(t, client, packet)
+
+	client.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	client.Write(packet)
+	if n, err := client.Read(make([]byte, maxPacketSize)); err == nil {
+		t.Errorf("expected a duplicate scrape to be dropped, got a %d byte response", n)
+	}
+}
+
+func TestScrapeKeepsUnknownTorrentsInPlace(t *testing.T) {
+	srv := startServer(t, "127.0.0.1:0", "")
+	defer srv.Stop()
+
+	client := dial(t, srv.conns[0])
+	defer client.Close()
+	announce(t, client, "seeder", 0, 6881)
+
+	packet := make([]byte, 16+2*20)
+	copy(packet[0:8], connect(t, client))
+	be.PutUint32(packet[8:12], scrapeActionID)
+	be.PutUint32(packet[12:16], 0xf00d)
+	copy(packet[16:36], "unknown-infohash-000")
+	copy(packet[36:56], testInfohash)
+
+	action, body := roundTrip(t, client, packet)
+	if action != scrapeActionID || len(body) != 24 {
+		t.Fatalf("expected two scrape triples, got %d %x", action, body)
+	}
+	if be.Uint32(body[0:4]) != 0 || be.Uint32(body[4:8]) != 0 || be.Uint32(body[8:12]) != 0 {
+		t.Errorf("expected zeroes for the unknown torrent, got %x", body[0:12])
+	}
+	if seeders, leechers := be.Uint32(body[12:16]), be.Uint32(body[20:24]); seeders != 1 || leechers != 0 {
+		t.Errorf("expected the known torrent's counts second, got %d seeders and %d leechers", seeders, leechers)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package udp implements a BitTorrent tracker over the UDP protocol as per
+// BEP 15.
+package udp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+
+	"github.com/majestrate/chihaya/tracker/models"
+)
+
+// connectProtocolID is the magic number a connect request carries in place of
+// a connection ID.
+const connectProtocolID uint64 = 0x41727101980
+
+// Action IDs used in the headers of UDP tracker packets.
+const (
+	connectActionID uint32 = iota
+	announceActionID
+	scrapeActionID
+	errorActionID
+)
+
+var be = binary.BigEndian
+
+// Writer implements the tracker.Writer interface for the UDP protocol,
+// serializing a response packet into buf.
+type Writer struct {
+	buf *bytes.Buffer
+
+	transactionID []byte
+
+	// ipv6 is true when the client asked over IPv6, in which case the
+	// response lists IPv6 peers rather than IPv4 ones.
+	ipv6 bool
+
+	// maxSize is the largest announce response written, in bytes, or 0 for
+	// no limit.
+	maxSize int
+}
+
+// WriteError writes the failure reason as a null-terminated string.
+func (w *Writer) WriteError(err error) error {
+	w.writeHeader(errorActionID)
+	w.buf.WriteString(err.Error())
+	w.buf.WriteByte(0)
+	return nil
+}
+
+// WriteAnnounce encodes an announce response with the peer list in compact
+// form. The packet has no way to tell clients which address family it lists,
+// so it only holds peers in the client's own family: 6 byte IPv4 entries for
+// IPv4 clients and 18 byte IPv6 entries for IPv6 clients. Peers that would
+// take the packet over maxSize are silently left out, as the protocol has no
+// way to warn about it.
+func (w *Writer) WriteAnnounce(res *models.AnnounceResponse) error {
+	w.writeHeader(announceActionID)
+	binary.Write(w.buf, binary.BigEndian, uint32(res.Interval))
+	binary.Write(w.buf, binary.BigEndian, uint32(res.Incomplete))
+	binary.Write(w.buf, binary.BigEndian, uint32(res.Complete))
+
+	for _, peer := range res.Peers {
+		ip := net.ParseIP(peer.IP)
+		if ip == nil {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			if w.ipv6 {
+				continue
+			}
+			ip = ip4
+		} else if !w.ipv6 {
+			continue
+		}
+		if w.maxSize > 0 && w.buf.Len()+len(ip)+2 > w.maxSize {
+			break
+		}
+		w.buf.Write(ip)
+		binary.Write(w.buf, binary.BigEndian, peer.Port)
+	}
+
+	return nil
+}
+
+// WriteScrape encodes the seeders, completed and leechers counts of each
+// torrent, in the same order as the scraped infohashes. These are the same
+// three numbers as the HTTP scrape's complete, downloaded and incomplete.
+// Infohashes that aren't served get zeroes, as clients match the counts to
+// infohashes by position.
+func (w *Writer) WriteScrape(res *models.ScrapeResponse) error {
+	w.writeHeader(scrapeActionID)
+
+	for _, torrent := range res.Files {
+		var seeders, completed, leechers uint32
+		if torrent != nil {
+			seeders = uint32(torrent.Seeders.Len())
+			completed = uint32(torrent.Snatches)
+			leechers = uint32(torrent.Leechers.Len())
+		}
+		binary.Write(w.buf, binary.BigEndian, seeders)
+		binary.Write(w.buf, binary.BigEndian, completed)
+		binary.Write(w.buf, binary.BigEndian, leechers)
+	}
+
+	return nil
+}
+
+// writeConnect writes the connection ID the client must use in later
+// requests.
+func (w *Writer) writeConnect(connID []byte) {
+	w.writeHeader(connectActionID)
+	w.buf.Write(connID)
+}
+
+// writeHeader writes the action and transaction ID to the response.
+func (w *Writer) writeHeader(action uint32) {
+	binary.Write(w.buf, binary.BigEndian, action)
+	w.buf.Write(w.transactionID)
+}
@@ -0,0 +1,73 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package udp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/zeebo/bencode"
+
+	"github.com/majestrate/chihaya/config"
+	chttp "github.com/majestrate/chihaya/http"
+	"github.com/majestrate/chihaya/tracker/models"
+)
+
+type scrapeCounts struct {
+	Complete   uint32 `bencode:"complete"`
+	Downloaded uint32 `bencode:"downloaded"`
+	Incomplete uint32 `bencode:"incomplete"`
+}
+
+func TestScrapeMatchesHTTP(t *testing.T) {
+	torrent := &models.Torrent{
+		Infohash: "01234567890123456789",
+		Snatches: 7,
+		Seeders:  models.NewPeerMap(true, &config.DefaultConfig),
+		Leechers: models.NewPeerMap(false, &config.DefaultConfig),
+	}
+	torrent.Seeders.Put(models.Peer{ID: "seed1", IP: "10.0.0.1"})
+	torrent.Seeders.Put(models.Peer{ID: "seed2", IP: "10.0.0.2"})
+	torrent.Leechers.Put(models.Peer{ID: "leech1", IP: "10.0.0.3"})
+	res := &models.ScrapeResponse{Files: []*models.Torrent{torrent}}
+
+	rec := httptest.NewRecorder()
+	if err := (&chttp.Writer{ResponseWriter: rec}).WriteScrape(res); err != nil {
+		t.Fatal(err)
+	}
+	var httpScrape struct {
+		Files map[string]scrapeCounts `bencode:"files"`
+	}
+	if err := bencode.DecodeBytes(rec.Body.Bytes(), &httpScrape); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &Writer{buf: new(bytes.Buffer), transactionID: []byte{1, 2, 3, 4}}
+	if err := w.WriteScrape(res); err != nil {
+		t.Fatal(err)
+	}
+	var header struct {
+		Action        uint32
+		TransactionID uint32
+	}
+	var udpScrape struct {
+		Seeders, Completed, Leechers uint32
+	}
+	binary.Read(w.buf, binary.BigEndian, &header)
+	if err := binary.Read(w.buf, binary.BigEndian, &udpScrape); err != nil {
+		t.Fatal(err)
+	}
+	if header.Action != scrapeActionID || header.TransactionID != 0x01020304 || w.buf.Len() != 0 {
+		t.Errorf("unexpected scrape packet header %+v with %d trailing bytes", header, w.buf.Len())
+	}
+
+	expected := httpScrape.Files[torrent.Infohash]
+	got := scrapeCounts{udpScrape.Seeders, udpScrape.Completed, udpScrape.Leechers}
+	if got != expected || expected != (scrapeCounts{2, 7, 1}) {
+		t.Errorf("UDP scrape %+v does not match HTTP scrape %+v", got, expected)
+	}
+}